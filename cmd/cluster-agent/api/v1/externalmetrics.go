@@ -0,0 +1,72 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	as "github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver"
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/hpa"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// installExternalMetricsEndpoints registers v1 external metrics endpoints
+func installExternalMetricsEndpoints(r *mux.Router) {
+	r.HandleFunc("/externalmetrics/refresh", refreshExternalMetric).Methods("POST")
+}
+
+// refreshExternalMetric is used by the refresh-metric command to force-refresh a stored external metric.
+func refreshExternalMetric(w http.ResponseWriter, r *http.Request) {
+	/*
+		Input
+			localhost:5001/api/v1/externalmetrics/refresh?key=default/web/nginx.net.request_per_s
+		Outputs
+			Status: 200
+			Returns: custommetrics.ExternalMetricValue
+
+			Status: 400
+			Returns: string
+			Example: "missing the key of the external metric to refresh"
+
+			Status: 404
+			Returns: string
+			Example: "key \"default/web/nginx\": no stored external metric matches the key"
+
+			Status: 500
+			Returns: string
+			Example: "could not refresh the external metric: too many failed queries to Datadog, the queries are suspended"
+	*/
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "missing the key of the external metric to refresh", http.StatusBadRequest)
+		return
+	}
+	em, err := as.RefreshExternalMetric(r.Context(), key)
+	if err != nil {
+		log.Errorf("Could not refresh the external metric %q: %v", key, err)
+		status := http.StatusInternalServerError
+		if errors.Cause(err) == hpa.ErrMetricNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	emBytes, err := json.Marshal(em)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(emBytes)
+}
@@ -0,0 +1,15 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build !kubeapiserver
+
+package v1
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// installExternalMetricsEndpoints not implemented
+func installExternalMetricsEndpoints(_ *mux.Router) {}
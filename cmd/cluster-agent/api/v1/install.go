@@ -40,6 +40,7 @@ func Install(r *mux.Router, sc clusteragent.ServerContext) {
 	r.HandleFunc("/metadata/{nodeName}", getNodeMetadata).Methods("GET")
 	r.HandleFunc("/metadata", getAllMetadata).Methods("GET")
 	installClusterCheckEndpoints(r, sc)
+	installExternalMetricsEndpoints(r)
 }
 
 // getPodMetadata is only used when the node agent hits the DCA for the tags list.
@@ -0,0 +1,83 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/DataDog/datadog-agent/cmd/agent/common"
+	"github.com/DataDog/datadog-agent/pkg/api/util"
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/config"
+)
+
+func init() {
+	ClusterAgentCmd.AddCommand(refreshMetricCmd)
+}
+
+var refreshMetricCmd = &cobra.Command{
+	Use:   "refresh-metric <namespace>/<hpa>/<metric>",
+	Short: "Refresh an external metric from Datadog immediately",
+	Long: `The refresh-metric command is mostly designed for troubleshooting purposes.
+It queries an external metric of an HPA again without waiting for the next refresh,
+bypassing the caches, and stores the result. It must be run on the leader.`,
+	Example: "datadog-cluster-agent refresh-metric default/web/nginx.net.request_per_s",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := common.SetupConfig(confPath)
+		if err != nil {
+			return fmt.Errorf("unable to set up global cluster agent configuration: %v", err)
+		}
+		if len(args) != 1 {
+			return fmt.Errorf("please specify the key of the external metric to refresh")
+		}
+		return refreshMetric(args[0])
+	},
+}
+
+func refreshMetric(key string) error {
+	var e error
+	c := util.GetClient(false) // FIX: get certificates right then make this true
+	urlstr := fmt.Sprintf("https://localhost:%v/api/v1/externalmetrics/refresh?%s", config.Datadog.GetInt("cluster_agent.cmd_port"), url.Values{"key": {key}}.Encode())
+
+	// Set session token
+	e = util.SetAuthToken()
+	if e != nil {
+		return e
+	}
+
+	r, e := util.DoPost(c, urlstr, "application/json", bytes.NewBuffer(nil))
+	if e != nil {
+		fmt.Printf(`
+		Could not refresh the external metric: %v
+		Make sure the agent is properly running and is the leader before refreshing a metric.
+		Contact support if you continue having issues.`, e)
+		return e
+	}
+
+	var em custommetrics.ExternalMetricValue
+	e = json.Unmarshal(r, &em)
+	if e != nil {
+		return e
+	}
+
+	fmt.Printf("Refreshed the external metric %s of the HPA %s/%s:\n", em.MetricName, em.HPA.Namespace, em.HPA.Name)
+	fmt.Printf("  Query: %s\n", em.Query)
+	fmt.Printf("  Valid: %t\n", em.Valid)
+	fmt.Printf("  Value: %v\n", em.ValueFloat)
+	fmt.Printf("  Timestamp: %s\n", time.Unix(em.Timestamp, 0).UTC().Format(time.RFC3339))
+	if em.LastError != "" {
+		fmt.Printf("  Error: %s\n", em.LastError)
+	}
+	return nil
+}
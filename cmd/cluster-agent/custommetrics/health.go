@@ -0,0 +1,60 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/hpa"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const healthCheckTimeout = 10 * time.Second
+
+// healthChecker periodically verifies that the external metrics can be fetched from Datadog.
+type healthChecker struct {
+	processor *hpa.Processor
+
+	mutex sync.RWMutex
+	err   error
+}
+
+func (h *healthChecker) run(period time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		h.checkDatadog()
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *healthChecker) checkDatadog() {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	err := h.processor.HealthCheck(ctx)
+	if err != nil {
+		log.Warnf("The external metrics cannot be fetched from Datadog: %s", err)
+	}
+	h.mutex.Lock()
+	h.err = err
+	h.mutex.Unlock()
+}
+
+// check is the healthz check of the External Metrics Provider.
+func (h *healthChecker) check(_ *http.Request) error {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.err
+}
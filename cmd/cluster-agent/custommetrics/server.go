@@ -16,11 +16,13 @@ import (
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/dynamicmapper"
 	"github.com/spf13/pflag"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apiserver/pkg/server/healthz"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
 
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	ddconfig "github.com/DataDog/datadog-agent/pkg/config"
 	as "github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver"
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/common"
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/leaderelection"
@@ -80,7 +82,7 @@ func StartServer() error {
 		return err
 	}
 	datadogHPAConfigMap := custommetrics.GetConfigmapName()
-	store, err := custommetrics.NewConfigMapStore(client.Cl, common.GetResourcesNamespace(), datadogHPAConfigMap)
+	store, err := custommetrics.NewStore(client.Cl, common.GetResourcesNamespace(), datadogHPAConfigMap)
 	if err != nil {
 		return err
 	}
@@ -97,13 +99,26 @@ func StartServer() error {
 	if errHPAController != nil {
 		return errHPAController
 	}
+	// The health checks and the canary use the Processor of the controller, so that a single Processor queries
+	// Datadog and its state is the one published.
+	healthProc := as.AutoscalersProcessor()
+	if healthProc == nil {
+		return fmt.Errorf("the Autoscaler controller is not running")
+	}
 	emProvider := custommetrics.NewDatadogProvider(clientPool, dynamicMapper, store)
 	// As the Custom Metrics Provider is introduced, change the first emProvider to a cmProvider.
 	server, err := config.Complete().New("datadog-custom-metrics-adapter", emProvider, emProvider)
 	if err != nil {
 		return err
 	}
+	// The connectivity to Datadog is reported by /healthz/datadog-external-metrics, in addition to /healthz.
+	health := &healthChecker{processor: healthProc}
+	if err := server.GenericAPIServer.AddHealthzChecks(healthz.NamedCheck("datadog-external-metrics", health.check)); err != nil {
+		return err
+	}
 	stopCh = make(chan struct{})
+	go health.run(time.Duration(ddconfig.Datadog.GetInt("external_metrics_provider.refresh_period"))*time.Second, stopCh)
+	go healthProc.RunCanary(stopCh)
 	return server.GenericAPIServer.PrepareRun().Run(stopCh)
 }
 
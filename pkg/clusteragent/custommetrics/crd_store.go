@@ -0,0 +1,246 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// externalMetricsAPIPath is the path of the API group of the ExternalMetric custom resource.
+	externalMetricsAPIPath = "/apis/datadoghq.com/v1alpha1"
+	// externalMetricsResource is the plural name of the ExternalMetric custom resource.
+	externalMetricsResource = "externalmetrics"
+)
+
+// externalMetricResource is an ExternalMetric custom resource, holding a single external metric.
+type externalMetricResource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ExternalMetricValue `json:"spec"`
+}
+
+// externalMetricResourceList is a list of ExternalMetric custom resources.
+type externalMetricResourceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []externalMetricResource `json:"items"`
+}
+
+// crdStore provides persistent storage of external metrics using an ExternalMetric custom resource per metric.
+type crdStore struct {
+	namespace string
+	client    rest.Interface
+	// deleteBatchSize is the number of custom resources deleted per batch, see DeleteExternalMetricValues.
+	deleteBatchSize int
+}
+
+// NewCRDStore returns a new store backed by ExternalMetric custom resources in the specified namespace.
+func NewCRDStore(client kubernetes.Interface, ns string) (Store, error) {
+	store := &crdStore{
+		namespace:       ns,
+		client:          client.CoreV1().RESTClient(),
+		deleteBatchSize: GetDeleteBatchSize(),
+	}
+	if err := store.client.Get().AbsPath(store.path("")).Do().Error(); err != nil {
+		log.Infof("Could not list the %s custom resources, is their CustomResourceDefinition installed? %v", externalMetricsResource, err)
+		return nil, err
+	}
+	return store, nil
+}
+
+// SetExternalMetricValues creates or updates the custom resources of the external metrics.
+func (c *crdStore) SetExternalMetricValues(added []ExternalMetricValue) error {
+	if len(added) == 0 {
+		return nil
+	}
+
+	var failed int
+	var lastErr error
+	for _, m := range added {
+		if err := c.setExternalMetricValue(m); err != nil {
+			log.Debugf("Could not store the external metric %s for HPA %s/%s: %v", m.MetricName, m.HPA.Namespace, m.HPA.Name, err)
+			failed++
+			lastErr = err
+		}
+	}
+
+	externalTotal.Set(int64(len(added)))
+	valid := int64(0)
+	for _, metric := range added {
+		if metric.Valid {
+			valid += 1
+		}
+	}
+	externalValid.Set(valid)
+
+	if lastErr != nil {
+		return fmt.Errorf("could not store %d of %d external metrics: %v", failed, len(added), lastErr)
+	}
+	return nil
+}
+
+func (c *crdStore) setExternalMetricValue(m ExternalMetricValue) error {
+	obj := externalMetricResource{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "datadoghq.com/v1alpha1",
+			Kind:       "ExternalMetric",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      externalMetricName(m),
+			Namespace: c.namespace,
+		},
+		Spec: m,
+	}
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	err = c.client.Post().AbsPath(c.path("")).Body(body).Do().Error()
+	if !errors.IsAlreadyExists(err) {
+		return err
+	}
+
+	// The update needs the resource version of the stored metric.
+	raw, err := c.client.Get().AbsPath(c.path(obj.Name)).Do().Raw()
+	if err != nil {
+		return err
+	}
+	var current externalMetricResource
+	if err := json.Unmarshal(raw, &current); err != nil {
+		return err
+	}
+	obj.ResourceVersion = current.ResourceVersion
+	if body, err = json.Marshal(obj); err != nil {
+		return err
+	}
+	return c.client.Put().AbsPath(c.path(obj.Name)).Body(body).Do().Error()
+}
+
+// DeleteExternalMetricValues deletes the custom resources of the external metrics, in batches.
+func (c *crdStore) DeleteExternalMetricValues(deleted []ExternalMetricValue) error {
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	var lastErr error
+	batches := deleteBatches(deleted, c.deleteBatchSize)
+	for i, batch := range batches {
+		for _, m := range batch {
+			if err := c.deleteExternalMetricValue(m); err != nil {
+				log.Debugf("Could not delete the external metric %s for HPA %s/%s: %v", m.MetricName, m.HPA.Namespace, m.HPA.Name, err)
+				lastErr = err
+			}
+		}
+		log.Debugf("Deleted batch %d of %d of the external metrics from the %s: metrics=%d", i+1, len(batches), externalMetricsResource, len(batch))
+	}
+	return lastErr
+}
+
+func (c *crdStore) deleteExternalMetricValue(m ExternalMetricValue) error {
+	// The metric could have been stored by an older version.
+	names := append([]string{externalMetricName(m)}, legacyExternalMetricNames(m)...)
+	var lastErr error
+	for _, name := range names {
+		err := c.deleteResource(name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		log.Debugf("Deleted metric %s for HPA %s/%s from the %s", m.MetricName, m.HPA.Namespace, m.HPA.Name, externalMetricsResource)
+	}
+	return lastErr
+}
+
+// deleteResource deletes a custom resource, retrying with a backoff on conflicts and throttling.
+func (c *crdStore) deleteResource(name string) error {
+	for attempt := 0; ; attempt++ {
+		err := c.client.Delete().AbsPath(c.path(name)).Do().Error()
+		if !errors.IsConflict(err) && !errors.IsTooManyRequests(err) {
+			return err
+		}
+		if attempt >= conflictRetries {
+			return fmt.Errorf("could not delete the %s %s after %d attempts: %v", externalMetricsResource, name, attempt+1, err)
+		}
+		delay := conflictDelay(attempt)
+		log.Debugf("The deletion of the %s %s was rejected, retrying it in %s: %v", externalMetricsResource, name, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// ListAllExternalMetricValues returns the most up-to-date list of external metrics from the custom resources.
+// Any replica can safely call this function.
+func (c *crdStore) ListAllExternalMetricValues() ([]ExternalMetricValue, error) {
+	raw, err := c.client.Get().AbsPath(c.path("")).Do().Raw()
+	if err != nil {
+		log.Infof("Could not list the %s: %v", externalMetricsResource, err)
+		return nil, err
+	}
+	var list externalMetricResourceList
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{}, len(list.Items))
+	for _, item := range list.Items {
+		names[item.Name] = struct{}{}
+	}
+	var metrics []ExternalMetricValue
+	for _, item := range list.Items {
+		if name := externalMetricName(item.Spec); name != item.Name {
+			// A metric stored by an older version is outdated if it was stored again with its current name.
+			if _, ok := names[name]; ok {
+				continue
+			}
+		}
+		metrics = append(metrics, item.Spec)
+	}
+	return metrics, nil
+}
+
+// path returns the path of the custom resource with the given name, or of the collection if it is empty.
+func (c *crdStore) path(name string) string {
+	path := fmt.Sprintf("%s/namespaces/%s/%s", externalMetricsAPIPath, c.namespace, externalMetricsResource)
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// externalMetricName returns the name of the custom resource of an external metric.
+func externalMetricName(m ExternalMetricValue) string {
+	return hashedExternalMetricName(externalMetricValueKeyFunc(m))
+}
+
+// legacyExternalMetricNames returns the names of the custom resources of an external metric stored by the older versions.
+func legacyExternalMetricNames(m ExternalMetricValue) []string {
+	var names []string
+	for _, key := range legacyExternalMetricValueKeys(m) {
+		names = append(names, hashedExternalMetricName(key))
+	}
+	return names
+}
+
+func hashedExternalMetricName(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("external-metric-%016x", h.Sum64())
+}
@@ -0,0 +1,213 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeExternalMetricsAPI serves the ExternalMetric custom resources of a namespace from memory.
+type fakeExternalMetricsAPI struct {
+	m       sync.Mutex
+	objects map[string]externalMetricResource
+	version int
+	// throttled is the number of the next deletions rejected with a 429 status.
+	throttled int
+	deletes   int
+}
+
+func (f *fakeExternalMetricsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	collection := externalMetricsAPIPath + "/namespaces/default/" + externalMetricsResource
+	if !strings.HasPrefix(r.URL.Path, collection) {
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, collection), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		list := externalMetricResourceList{}
+		for _, obj := range f.objects {
+			list.Items = append(list.Items, obj)
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodGet:
+		obj, ok := f.objects[name]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(obj)
+	case r.Method == http.MethodPost || r.Method == http.MethodPut:
+		var obj externalMetricResource
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &obj); err != nil {
+			writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest)
+			return
+		}
+		current, exists := f.objects[obj.Name]
+		if r.Method == http.MethodPost && exists {
+			writeStatus(w, http.StatusConflict, metav1.StatusReasonAlreadyExists)
+			return
+		}
+		if r.Method == http.MethodPut && (!exists || current.ResourceVersion != obj.ResourceVersion) {
+			writeStatus(w, http.StatusConflict, metav1.StatusReasonConflict)
+			return
+		}
+		f.version++
+		obj.ResourceVersion = string(rune('0' + f.version))
+		f.objects[obj.Name] = obj
+		json.NewEncoder(w).Encode(obj)
+	case r.Method == http.MethodDelete:
+		f.deletes++
+		if f.throttled > 0 {
+			f.throttled--
+			writeStatus(w, http.StatusTooManyRequests, metav1.StatusReasonTooManyRequests)
+			return
+		}
+		if _, ok := f.objects[name]; !ok {
+			writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		}
+		delete(f.objects, name)
+		writeStatus(w, http.StatusOK, "")
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed)
+	}
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason metav1.StatusReason) {
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusSuccess,
+		Code:     int32(code),
+		Reason:   reason,
+	}
+	if code >= 300 {
+		status.Status = metav1.StatusFailure
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+func TestCRDStoreExternalMetrics(t *testing.T) {
+	api := &fakeExternalMetricsAPI{objects: make(map[string]externalMetricResource)}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+
+	store, err := NewCRDStore(client, "default")
+	require.NoError(t, err)
+
+	metrics := []ExternalMetricValue{
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        ObjectReference{Name: "foo", Namespace: "default"},
+		},
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "backend"},
+			HPA:        ObjectReference{Name: "bar", Namespace: "default"},
+		},
+	}
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+	list, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+
+	// The metrics already stored are updated.
+	metrics[0].Value, metrics[0].ValueFloat, metrics[0].Valid = 12, 12, true
+	err = store.SetExternalMetricValues(metrics[:1])
+	require.NoError(t, err)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+
+	// The metrics not stored are ignored.
+	err = store.DeleteExternalMetricValues([]ExternalMetricValue{
+		metrics[1],
+		{MetricName: "requests_per_s", HPA: ObjectReference{Name: "baz", Namespace: "default"}},
+	})
+	require.NoError(t, err)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics[:1], list)
+}
+
+func TestNewCRDStoreNotInstalled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+	}))
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+
+	_, err = NewCRDStore(client, "default")
+	assert.Error(t, err)
+}
+
+func TestCRDStoreDeleteThrottled(t *testing.T) {
+	defer func(backoff time.Duration) { conflictBackoff = backoff }(conflictBackoff)
+	conflictBackoff = time.Millisecond
+
+	api := &fakeExternalMetricsAPI{objects: make(map[string]externalMetricResource)}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+
+	store, err := NewCRDStore(client, "default")
+	require.NoError(t, err)
+	store.(*crdStore).deleteBatchSize = 2
+
+	var metrics []ExternalMetricValue
+	for i := 0; i < 5; i++ {
+		metrics = append(metrics, ExternalMetricValue{
+			MetricName: "requests_per_s",
+			HPA:        ObjectReference{Name: fmt.Sprintf("hpa-%d", i), Namespace: "default"},
+		})
+	}
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+
+	// The deletions throttled by the API server are retried.
+	api.throttled = 2
+	err = store.DeleteExternalMetricValues(metrics[:4])
+	require.NoError(t, err)
+	list, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics[4:], list)
+
+	// The retries are bounded.
+	api.throttled = conflictRetries + 1
+	api.deletes = 0
+	err = store.DeleteExternalMetricValues(metrics[4:])
+	require.Error(t, err)
+	assert.Equal(t, conflictRetries+1, api.deletes)
+}
@@ -9,23 +9,41 @@ package custommetrics
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 
+	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
+var podsGroupResource = schema.GroupResource{Resource: "pods"}
+
+// staleLabel is the label added to the external metrics whose value is stale, see ExternalMetricValue.Stale.
+const staleLabel = "datadoghq.com/stale"
+
+const (
+	// ValueEncodingMilli encodes the values served as milli-quantities, preserving their fractional part, the default.
+	ValueEncodingMilli = "milli"
+	// ValueEncodingInteger rounds the values served to integer quantities, for the HPA controllers mishandling the
+	// milli-quantities.
+	ValueEncodingInteger = "integer"
+)
+
 type externalMetric struct {
 	info  provider.ExternalMetricInfo
 	value external_metrics.ExternalMetricValue
+	// selector is set for the metrics whose selector has MatchExpressions, these cannot be matched on their labels only.
+	selector labels.Selector
 }
 
 type datadogProvider struct {
@@ -36,18 +54,41 @@ type datadogProvider struct {
 	externalMetrics []externalMetric
 	resVersion      string
 	store           Store
+	// valueEncoding is the encoding of the values served into quantities, ValueEncodingMilli or ValueEncodingInteger.
+	valueEncoding string
 }
 
 // NewDatadogProvider creates a Custom Metrics and External Metrics Provider.
 func NewDatadogProvider(client dynamic.ClientPool, mapper apimeta.RESTMapper, store Store) provider.MetricsProvider {
 	return &datadogProvider{
-		client: client,
-		mapper: mapper,
-		values: make(map[provider.CustomMetricInfo]int64),
-		store:  store,
+		client:        client,
+		mapper:        mapper,
+		values:        make(map[provider.CustomMetricInfo]int64),
+		store:         store,
+		valueEncoding: getValueEncoding(),
 	}
 }
 
+// getValueEncoding returns the encoding of the values served set in the configuration.
+func getValueEncoding() string {
+	encoding := config.Datadog.GetString("external_metrics_provider.value_encoding")
+	switch encoding {
+	case ValueEncodingMilli, ValueEncodingInteger:
+		return encoding
+	}
+	log.Warnf("Invalid value encoding %q for the metrics served, using %q", encoding, ValueEncodingMilli)
+	return ValueEncodingMilli
+}
+
+// quantity returns the quantity of a value served, with the value encoding of the provider.
+func (p *datadogProvider) quantity(value float64) resource.Quantity {
+	if p.valueEncoding == ValueEncodingInteger {
+		return *resource.NewQuantity(int64(math.Round(value)), resource.DecimalSI)
+	}
+	// Milli-units preserve the fractional part of the values.
+	return *resource.NewMilliQuantity(int64(math.Round(value*1000)), resource.DecimalSI)
+}
+
 // GetRootScopedMetricByName - Not implemented
 func (p *datadogProvider) GetRootScopedMetricByName(groupResource schema.GroupResource, name string, metricName string) (*custom_metrics.MetricValue, error) {
 	return nil, fmt.Errorf("not Implemented - GetRootScopedMetricByName")
@@ -58,20 +99,157 @@ func (p *datadogProvider) GetRootScopedMetricBySelector(groupResource schema.Gro
 	return nil, fmt.Errorf("not Implemented - GetRootScopedMetricBySelector")
 }
 
-// GetNamespacedMetricByName - Not implemented
+// GetNamespacedMetricByName returns the value of the Object metric of the HPAs describing the object.
 func (p *datadogProvider) GetNamespacedMetricByName(groupResource schema.GroupResource, namespace string, name string, metricName string) (*custom_metrics.MetricValue, error) {
-	return nil, fmt.Errorf("not Implemented - GetNamespacedMetricByName")
+	rawMetrics, err := p.store.ListAllExternalMetricValues()
+	if err != nil {
+		return nil, err
+	}
+	// The metric is matched on the kind and the name of the object it describes.
+	var matching []ExternalMetricValue
+	for _, m := range rawMetrics {
+		if m.Type != ObjectMetricType || !m.Valid || m.MetricName != metricName || m.HPA.Namespace != namespace {
+			continue
+		}
+		if m.Object == nil || m.Object.Name != name || objectGroupResource(m.Object).Resource != groupResource.Resource {
+			continue
+		}
+		matching = append(matching, m)
+	}
+	if len(matching) == 0 {
+		return nil, provider.NewMetricNotFoundForError(groupResource, metricName, name)
+	}
+	if len(matching) > 1 {
+		return nil, fmt.Errorf("the metric %s of the %s %s/%s is referenced by %d HPAs", metricName, groupResource.Resource, namespace, name, len(matching))
+	}
+	metric := matching[0]
+
+	return &custom_metrics.MetricValue{
+		DescribedObject: custom_metrics.ObjectReference{
+			APIVersion: metric.Object.APIVersion,
+			Kind:       metric.Object.Kind,
+			Name:       name,
+			Namespace:  namespace,
+		},
+		MetricName: metricName,
+		Timestamp:  metric.GetTimestamp(),
+		Value:      p.quantity(metric.GetValue()),
+	}, nil
 }
 
-// GetNamespacedMetricBySelector - Not implemented
+// objectGroupResource returns the resource of the object described by a metric, without its group.
+func objectGroupResource(object *DescribedObject) schema.GroupResource {
+	plural, _ := apimeta.UnsafeGuessKindToResource(schema.GroupVersionKind{Kind: object.Kind})
+	return plural.GroupResource()
+}
+
+// GetNamespacedMetricBySelector returns the value of the Pods metrics of the HPAs for each of the selected pods.
 func (p *datadogProvider) GetNamespacedMetricBySelector(groupResource schema.GroupResource, namespace string, selector labels.Selector, metricName string) (*custom_metrics.MetricValueList, error) {
-	return nil, fmt.Errorf("not Implemented - GetNamespacedMetricBySelector")
+	if groupResource != podsGroupResource {
+		return nil, fmt.Errorf("not Implemented - GetNamespacedMetricBySelector for %s", groupResource.String())
+	}
+
+	rawMetrics, err := p.store.ListAllExternalMetricValues()
+	if err != nil {
+		return nil, err
+	}
+	// The HPA controller requests the metric with the selector of the pods of the scale target of the HPA.
+	var matching []ExternalMetricValue
+	for _, m := range rawMetrics {
+		if m.Type != PodsMetricType || !m.Valid || m.MetricName != metricName || m.HPA.Namespace != namespace {
+			continue
+		}
+		podSelector, err := labels.Parse(m.PodSelector)
+		if m.PodSelector == "" || err != nil || podSelector.String() != selector.String() {
+			continue
+		}
+		matching = append(matching, m)
+	}
+	if len(matching) == 0 {
+		return nil, provider.NewMetricNotFoundError(groupResource, metricName)
+	}
+	if len(matching) > 1 {
+		return nil, fmt.Errorf("the metric %s of the pods %q in %s is referenced by %d HPAs targeting the same pods", metricName, selector.String(), namespace, len(matching))
+	}
+	metric := matching[0]
+
+	pods, err := p.listPodNames(namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	value := p.quantity(metric.GetValue())
+	values := make([]custom_metrics.MetricValue, 0, len(pods))
+	for _, pod := range pods {
+		values = append(values, custom_metrics.MetricValue{
+			DescribedObject: custom_metrics.ObjectReference{
+				APIVersion: "/v1",
+				Kind:       "Pod",
+				Name:       pod,
+				Namespace:  namespace,
+			},
+			MetricName: metricName,
+			Timestamp:  metric.GetTimestamp(),
+			Value:      value,
+		})
+	}
+	return &custom_metrics.MetricValueList{
+		Items: values,
+	}, nil
 }
 
-// ListAllMetrics reads from a ConfigMap, similarly to ListExternalMetrics
-// TODO implement the in cluster Custom Metrics Provider to use the ListAllMetrics
+// listPodNames returns the names of the pods of the namespace matching the selector.
+func (p *datadogProvider) listPodNames(namespace string, selector labels.Selector) ([]string, error) {
+	client, err := p.client.ClientForGroupVersionResource(podsGroupResource.WithVersion("v1"))
+	if err != nil {
+		return nil, err
+	}
+	apiResource := &metav1.APIResource{Name: podsGroupResource.Resource, Namespaced: true, Kind: "Pod"}
+	obj, err := client.Resource(apiResource, namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.(*unstructured.UnstructuredList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected list of pods %T", obj)
+	}
+	names := make([]string, 0, len(list.Items))
+	for _, item := range list.Items {
+		names = append(names, item.GetName())
+	}
+	return names, nil
+}
+
+// ListAllMetrics reads from a ConfigMap, similarly to ListExternalMetrics. Only the Pods and Object metrics are served.
 func (p *datadogProvider) ListAllMetrics() []provider.CustomMetricInfo {
-	return nil
+	var customMetricsInfoList []provider.CustomMetricInfo
+
+	rawMetrics, err := p.store.ListAllExternalMetricValues()
+	if err != nil {
+		log.Errorf("Could not list the metrics in the store: %s", err.Error())
+		return customMetricsInfoList
+	}
+
+	seen := make(map[provider.CustomMetricInfo]struct{})
+	for _, metric := range rawMetrics {
+		if metric.Type == "" || !metric.Valid || (metric.Type == ObjectMetricType && metric.Object == nil) {
+			continue
+		}
+		info := provider.CustomMetricInfo{
+			GroupResource: podsGroupResource,
+			Namespaced:    true,
+			Metric:        metric.MetricName,
+		}
+		if metric.Type == ObjectMetricType {
+			info.GroupResource = objectGroupResource(metric.Object)
+		}
+		if _, ok := seen[info]; ok {
+			continue
+		}
+		seen[info] = struct{}{}
+		customMetricsInfoList = append(customMetricsInfoList, info)
+	}
+	log.Debugf("ListAllMetrics returns %d metrics", len(customMetricsInfoList))
+	return customMetricsInfoList
 }
 
 // ListAllExternalMetrics is called every 30 seconds, although this is configurable on the API Server's end.
@@ -87,7 +265,8 @@ func (p *datadogProvider) ListAllExternalMetrics() []provider.ExternalMetricInfo
 
 	for _, metric := range rawMetrics {
 		// Only metrics that exist in Datadog and available are eligible to be evaluated in the HPA process.
-		if !metric.Valid {
+		// The Pods and Object metrics are served as custom metrics.
+		if !metric.Valid || metric.Type != "" {
 			continue
 		}
 		var extMetric externalMetric
@@ -95,10 +274,31 @@ func (p *datadogProvider) ListAllExternalMetrics() []provider.ExternalMetricInfo
 			Metric: metric.MetricName,
 			Labels: metric.Labels,
 		}
+		metricLabels := metric.Labels
+		if metric.Stale {
+			// The label tells the operators the value is served past its max age, the HPA controller ignores it.
+			metricLabels = make(map[string]string, len(metric.Labels)+1)
+			for k, v := range metric.Labels {
+				metricLabels[k] = v
+			}
+			metricLabels[staleLabel] = "true"
+		}
 		extMetric.value = external_metrics.ExternalMetricValue{
 			MetricName:   metric.MetricName,
-			MetricLabels: metric.Labels,
-			Value:        *resource.NewQuantity(metric.Value, resource.DecimalSI),
+			MetricLabels: metricLabels,
+			Value:        p.quantity(metric.GetValue()),
+			Timestamp:    metric.GetTimestamp(),
+		}
+		if len(metric.MatchExpressions) > 0 {
+			selector, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
+				MatchLabels:      metric.Labels,
+				MatchExpressions: metric.MatchExpressions,
+			})
+			if err != nil {
+				log.Errorf("Could not parse the selector of the external metric %s: %s", metric.MetricName, err.Error())
+				continue
+			}
+			extMetric.selector = selector
 		}
 		externalMetricsList = append(externalMetricsList, extMetric)
 
@@ -124,14 +324,13 @@ func (p *datadogProvider) GetExternalMetric(namespace string, metricName string,
 	for _, metric := range p.externalMetrics {
 		metricFromDatadog := external_metrics.ExternalMetricValue{
 			MetricName:   metricName,
-			MetricLabels: metric.info.Labels,
+			MetricLabels: metric.value.MetricLabels,
 			Value:        metric.value.Value,
+			// The HPA controller sees when the value was observed in Datadog rather than when it is served.
+			Timestamp: metric.value.Timestamp,
 		}
-		if metric.info.Metric == metricName &&
-			metricSelector.Matches(labels.Set(metric.info.Labels)) {
-			metricValue := metricFromDatadog
-			metricValue.Timestamp = metav1.Now()
-			matchingMetrics = append(matchingMetrics, metricValue)
+		if metric.info.Metric == metricName && metric.matches(metricSelector) {
+			matchingMetrics = append(matchingMetrics, metricFromDatadog)
 		}
 	}
 	log.Tracef("External metrics returned: %#v", matchingMetrics)
@@ -139,3 +338,11 @@ func (p *datadogProvider) GetExternalMetric(namespace string, metricName string,
 		Items: matchingMetrics,
 	}, nil
 }
+
+// matches returns whether the metric was queried for the selector of an HPA.
+func (m externalMetric) matches(metricSelector labels.Selector) bool {
+	if m.selector != nil {
+		return m.selector.String() == metricSelector.String()
+	}
+	return metricSelector.Matches(labels.Set(m.info.Labels))
+}
@@ -0,0 +1,451 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+)
+
+func TestListAllExternalMetrics(t *testing.T) {
+	tests := []struct {
+		desc          string
+		metric        ExternalMetricValue
+		expectedMilli int64
+	}{
+		{
+			"fractional value",
+			ExternalMetricValue{
+				MetricName: "queue_depth_per_pod",
+				Labels:     map[string]string{"role": "worker"},
+				HPA:        ObjectReference{Name: "foo", Namespace: "default"},
+				Value:      0,
+				ValueFloat: 0.8,
+				Valid:      true,
+			},
+			800,
+		},
+		{
+			"value stored by an older version",
+			ExternalMetricValue{
+				MetricName: "requests_per_s",
+				Labels:     map[string]string{"role": "frontend"},
+				HPA:        ObjectReference{Name: "foo", Namespace: "default"},
+				Value:      14,
+				Valid:      true,
+			},
+			14000,
+		},
+		{
+			"genuine zero",
+			ExternalMetricValue{
+				MetricName: "queue_depth",
+				Labels:     map[string]string{"queue": "jobs"},
+				HPA:        ObjectReference{Name: "foo", Namespace: "default"},
+				Value:      0,
+				ValueFloat: 0,
+				Valid:      true,
+			},
+			0,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			store, err := NewConfigMapStore(client, "default", fmt.Sprintf("test-%d", i))
+			require.NoError(t, err)
+			err = store.SetExternalMetricValues([]ExternalMetricValue{tt.metric})
+			require.NoError(t, err)
+
+			p := NewDatadogProvider(nil, nil, store).(*datadogProvider)
+			info := p.ListAllExternalMetrics()
+			require.Len(t, info, 1)
+			require.Len(t, p.externalMetrics, 1)
+			assert.Equal(t, tt.expectedMilli, p.externalMetrics[0].value.Value.MilliValue())
+		})
+	}
+}
+
+func TestListAllExternalMetricsValueEncoding(t *testing.T) {
+	defer config.Datadog.Set("external_metrics_provider.value_encoding", config.Datadog.Get("external_metrics_provider.value_encoding"))
+	tests := []struct {
+		desc     string
+		encoding string
+		value    float64
+		expected string
+	}{
+		{"milli-units preserve the fraction", ValueEncodingMilli, 0.8, "800m"},
+		{"integers are rounded", ValueEncodingInteger, 0.8, "1"},
+		{"integers round half away from zero", ValueEncodingInteger, 2.5, "3"},
+		{"whole values are integers in both encodings", ValueEncodingMilli, 14, "14"},
+		{"an invalid encoding uses milli-units", "float", 0.8, "800m"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			config.Datadog.Set("external_metrics_provider.value_encoding", tt.encoding)
+			client := fake.NewSimpleClientset()
+			store, err := NewConfigMapStore(client, "default", fmt.Sprintf("test-encoding-%d", i))
+			require.NoError(t, err)
+			err = store.SetExternalMetricValues([]ExternalMetricValue{
+				{
+					MetricName: "queue_depth_per_pod",
+					Labels:     map[string]string{"role": "worker"},
+					HPA:        ObjectReference{Name: "foo", Namespace: "default"},
+					ValueFloat: tt.value,
+					Valid:      true,
+				},
+			})
+			require.NoError(t, err)
+
+			p := NewDatadogProvider(nil, nil, store).(*datadogProvider)
+			p.ListAllExternalMetrics()
+			require.Len(t, p.externalMetrics, 1)
+			value := p.externalMetrics[0].value.Value
+			assert.Equal(t, tt.expected, value.String())
+		})
+	}
+}
+
+func TestGetExternalMetric(t *testing.T) {
+	metrics := []ExternalMetricValue{
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        ObjectReference{Name: "foo", Namespace: "default"},
+			ValueFloat: 12,
+			Valid:      true,
+		},
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "worker"},
+			MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "env", Operator: metav1.LabelSelectorOpIn, Values: []string{"prod", "dev"}},
+			},
+			HPA:        ObjectReference{Name: "bar", Namespace: "default"},
+			ValueFloat: 14,
+			Valid:      true,
+		},
+	}
+	tests := []struct {
+		desc     string
+		selector string
+		expected []int64
+	}{
+		{"labels only", "role=frontend", []int64{12}},
+		{"same selector with expressions", "env in (dev,prod),role=worker", []int64{14}},
+		{"different expressions", "env in (prod),role=worker", nil},
+		{"labels of a metric with expressions", "role=worker", nil},
+	}
+
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "test-get")
+	require.NoError(t, err)
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+	p := NewDatadogProvider(nil, nil, store).(*datadogProvider)
+	p.ListAllExternalMetrics()
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			selector, err := labels.Parse(tt.selector)
+			require.NoError(t, err)
+
+			list, err := p.GetExternalMetric("default", "requests_per_s", selector)
+			require.NoError(t, err)
+			var values []int64
+			for _, item := range list.Items {
+				values = append(values, item.Value.Value())
+			}
+			assert.Equal(t, tt.expected, values)
+		})
+	}
+}
+
+func TestGetExternalMetricTimestamp(t *testing.T) {
+	metrics := []ExternalMetricValue{
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        ObjectReference{Name: "foo", Namespace: "default"},
+			ValueFloat: 12,
+			Valid:      true,
+			Timestamp:  1531492452,
+		},
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "worker"},
+			HPA:        ObjectReference{Name: "bar", Namespace: "default"},
+			ValueFloat: 14,
+			Valid:      true,
+		},
+	}
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "test-timestamp")
+	require.NoError(t, err)
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+	p := NewDatadogProvider(nil, nil, store).(*datadogProvider)
+	p.ListAllExternalMetrics()
+
+	// The timestamp served is the one of the Datadog point of the value.
+	list, err := p.GetExternalMetric("default", "requests_per_s", labels.SelectorFromSet(labels.Set{"role": "frontend"}))
+	require.NoError(t, err)
+	require.Len(t, list.Items, 1)
+	assert.Equal(t, int64(1531492452), list.Items[0].Timestamp.Unix())
+
+	// The values never refreshed are served with the current time.
+	start := time.Now().Add(-time.Second)
+	list, err = p.GetExternalMetric("default", "requests_per_s", labels.SelectorFromSet(labels.Set{"role": "worker"}))
+	require.NoError(t, err)
+	require.Len(t, list.Items, 1)
+	assert.True(t, list.Items[0].Timestamp.After(start))
+}
+
+func TestGetExternalMetricStale(t *testing.T) {
+	metrics := []ExternalMetricValue{
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        ObjectReference{Name: "foo", Namespace: "default"},
+			ValueFloat: 12,
+			Valid:      true,
+			Stale:      true,
+		},
+	}
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "test-stale")
+	require.NoError(t, err)
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+	p := NewDatadogProvider(nil, nil, store).(*datadogProvider)
+	p.ListAllExternalMetrics()
+
+	// The stale value is still served, labeled as stale, and still matches the selector of its HPA.
+	list, err := p.GetExternalMetric("default", "requests_per_s", labels.SelectorFromSet(labels.Set{"role": "frontend"}))
+	require.NoError(t, err)
+	require.Len(t, list.Items, 1)
+	assert.Equal(t, int64(12), list.Items[0].Value.Value())
+	assert.Equal(t, map[string]string{"role": "frontend", staleLabel: "true"}, list.Items[0].MetricLabels)
+	assert.Equal(t, map[string]string{"role": "frontend"}, metrics[0].Labels)
+}
+
+func TestGetExternalMetricAggregatorPrefix(t *testing.T) {
+	metrics := []ExternalMetricValue{
+		{
+			MetricName: "avg:requests_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        ObjectReference{Name: "foo", Namespace: "default", UID: "1111"},
+			ValueFloat: 12,
+			Valid:      true,
+		},
+		{
+			MetricName: "max:requests_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        ObjectReference{Name: "bar", Namespace: "default", UID: "2222"},
+			ValueFloat: 30,
+			Valid:      true,
+		},
+	}
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "test-aggregator")
+	require.NoError(t, err)
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+	p := NewDatadogProvider(nil, nil, store).(*datadogProvider)
+	require.Len(t, p.ListAllExternalMetrics(), 2)
+
+	// Each aggregation of the metric is served under its own name.
+	selector := labels.SelectorFromSet(labels.Set{"role": "frontend"})
+	for name, expected := range map[string]int64{"avg:requests_per_s": 12, "max:requests_per_s": 30} {
+		list, err := p.GetExternalMetric("default", name, selector)
+		require.NoError(t, err)
+		require.Len(t, list.Items, 1, name)
+		assert.Equal(t, expected, list.Items[0].Value.Value(), name)
+		assert.Equal(t, name, list.Items[0].MetricName)
+	}
+	list, err := p.GetExternalMetric("default", "requests_per_s", selector)
+	require.NoError(t, err)
+	assert.Empty(t, list.Items)
+}
+
+func newPod(name string, podLabels map[string]string) unstructured.Unstructured {
+	pod := unstructured.Unstructured{}
+	pod.SetName(name)
+	pod.SetNamespace("default")
+	pod.SetLabels(podLabels)
+	return pod
+}
+
+func TestGetNamespacedMetricBySelector(t *testing.T) {
+	metrics := []ExternalMetricValue{
+		{
+			MetricName:  "queue_depth",
+			Labels:      map[string]string{"kube_namespace": "default", "kube_deployment": "worker"},
+			HPA:         ObjectReference{Name: "worker", Namespace: "default"},
+			ValueFloat:  2.5,
+			Valid:       true,
+			Type:        PodsMetricType,
+			PodSelector: "app=worker",
+		},
+		{
+			MetricName:  "queue_depth",
+			Labels:      map[string]string{"kube_namespace": "default", "kube_deployment": "batch"},
+			HPA:         ObjectReference{Name: "batch", Namespace: "default"},
+			ValueFloat:  7,
+			Valid:       true,
+			Type:        PodsMetricType,
+			PodSelector: "app=batch",
+		},
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        ObjectReference{Name: "frontend", Namespace: "default"},
+			ValueFloat: 12,
+			Valid:      true,
+		},
+	}
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "test-pods")
+	require.NoError(t, err)
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+
+	clientPool := &dynamicfake.FakeClientPool{}
+	clientPool.AddReactor("list", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, &unstructured.UnstructuredList{
+			Items: []unstructured.Unstructured{
+				newPod("worker-1", map[string]string{"app": "worker"}),
+				newPod("worker-2", map[string]string{"app": "worker"}),
+				newPod("batch-1", map[string]string{"app": "batch"}),
+			},
+		}, nil
+	})
+	p := NewDatadogProvider(clientPool, nil, store).(*datadogProvider)
+
+	// The Pods metrics are only served as custom metrics of the pods.
+	assert.Len(t, p.ListAllExternalMetrics(), 1)
+	assert.Equal(t, []provider.CustomMetricInfo{{GroupResource: podsGroupResource, Namespaced: true, Metric: "queue_depth"}}, p.ListAllMetrics())
+
+	selector, err := labels.Parse("app=worker")
+	require.NoError(t, err)
+	list, err := p.GetNamespacedMetricBySelector(podsGroupResource, "default", selector, "queue_depth")
+	require.NoError(t, err)
+	require.Len(t, list.Items, 2)
+	for i, item := range list.Items {
+		assert.Equal(t, fmt.Sprintf("worker-%d", i+1), item.DescribedObject.Name)
+		assert.Equal(t, "Pod", item.DescribedObject.Kind)
+		assert.Equal(t, int64(2500), item.Value.MilliValue())
+	}
+
+	_, err = p.GetNamespacedMetricBySelector(podsGroupResource, "default", selector, "requests_per_s")
+	assert.Error(t, err)
+	_, err = p.GetNamespacedMetricBySelector(podsGroupResource, "other", selector, "queue_depth")
+	assert.Error(t, err)
+
+	// The metric of the other HPA of the namespace is served for its own pods only.
+	batchSelector, err := labels.Parse("app=batch")
+	require.NoError(t, err)
+	list, err = p.GetNamespacedMetricBySelector(podsGroupResource, "default", batchSelector, "queue_depth")
+	require.NoError(t, err)
+	require.NotEmpty(t, list.Items)
+	assert.Equal(t, int64(7000), list.Items[0].Value.MilliValue())
+	otherSelector, err := labels.Parse("app=frontend")
+	require.NoError(t, err)
+	_, err = p.GetNamespacedMetricBySelector(podsGroupResource, "default", otherSelector, "queue_depth")
+	assert.Error(t, err)
+
+	// The metrics of the HPAs targeting the same pods are ambiguous.
+	metrics = append(metrics, metrics[0])
+	metrics[len(metrics)-1].HPA.Name = "worker-bis"
+	err = store.SetExternalMetricValues(metrics[len(metrics)-1:])
+	require.NoError(t, err)
+	_, err = p.GetNamespacedMetricBySelector(podsGroupResource, "default", selector, "queue_depth")
+	assert.Error(t, err)
+}
+
+func TestGetNamespacedMetricByName(t *testing.T) {
+	ingresses := schema.GroupResource{Group: "extensions", Resource: "ingresses"}
+	metrics := []ExternalMetricValue{
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"kube_namespace": "default", "kube_ingress": "frontend"},
+			HPA:        ObjectReference{Name: "frontend", Namespace: "default"},
+			ValueFloat: 120.5,
+			Valid:      true,
+			Type:       ObjectMetricType,
+			Object:     &DescribedObject{Kind: "Ingress", Name: "frontend", APIVersion: "extensions/v1beta1"},
+		},
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"kube_namespace": "default", "kube_service": "frontend"},
+			HPA:        ObjectReference{Name: "frontend-svc", Namespace: "default"},
+			ValueFloat: 80,
+			Valid:      true,
+			Type:       ObjectMetricType,
+			Object:     &DescribedObject{Kind: "Service", Name: "frontend", APIVersion: "v1"},
+		},
+	}
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "test-objects")
+	require.NoError(t, err)
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+	p := NewDatadogProvider(nil, nil, store).(*datadogProvider)
+
+	// The Object metrics are only served as custom metrics of the described objects.
+	assert.Len(t, p.ListAllExternalMetrics(), 0)
+	assert.ElementsMatch(t, []provider.CustomMetricInfo{
+		{GroupResource: schema.GroupResource{Resource: "ingresses"}, Namespaced: true, Metric: "requests_per_s"},
+		{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "requests_per_s"},
+	}, p.ListAllMetrics())
+
+	value, err := p.GetNamespacedMetricByName(ingresses, "default", "frontend", "requests_per_s")
+	require.NoError(t, err)
+	assert.Equal(t, "Ingress", value.DescribedObject.Kind)
+	assert.Equal(t, "frontend", value.DescribedObject.Name)
+	assert.Equal(t, int64(120500), value.Value.MilliValue())
+
+	value, err = p.GetNamespacedMetricByName(schema.GroupResource{Resource: "services"}, "default", "frontend", "requests_per_s")
+	require.NoError(t, err)
+	assert.Equal(t, int64(80000), value.Value.MilliValue())
+
+	_, err = p.GetNamespacedMetricByName(ingresses, "default", "backend", "requests_per_s")
+	assert.Error(t, err)
+	_, err = p.GetNamespacedMetricByName(ingresses, "other", "frontend", "requests_per_s")
+	assert.Error(t, err)
+
+	// The metrics of the HPAs describing the same object are ambiguous.
+	other := metrics[0]
+	other.HPA.Name = "frontend-bis"
+	other.ValueFloat = 30
+	err = store.SetExternalMetricValues([]ExternalMetricValue{other})
+	require.NoError(t, err)
+	_, err = p.GetNamespacedMetricByName(ingresses, "default", "frontend", "requests_per_s")
+	assert.Error(t, err)
+	value, err = p.GetNamespacedMetricByName(schema.GroupResource{Resource: "services"}, "default", "frontend", "requests_per_s")
+	require.NoError(t, err)
+	assert.Equal(t, int64(80000), value.Value.MilliValue())
+}
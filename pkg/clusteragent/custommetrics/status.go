@@ -8,6 +8,8 @@
 package custommetrics
 
 import (
+	"encoding/json"
+	"expvar"
 	"fmt"
 
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/common"
@@ -19,9 +21,15 @@ func GetStatus(apiCl kubernetes.Interface) map[string]interface{} {
 	status := make(map[string]interface{})
 	configMapName := GetConfigmapName()
 	configMapNamespace := common.GetResourcesNamespace()
-	status["Cmname"] = fmt.Sprintf("%s/%s", configMapNamespace, configMapName)
+	if GetStoreBackend() == StoreBackendCRD {
+		status["Crd"] = fmt.Sprintf("%s/%s", configMapNamespace, externalMetricsResource)
+	} else if shards := GetConfigmapShards(); shards > 1 {
+		status["Cmname"] = fmt.Sprintf("%s/%s-0 to %s-%d", configMapNamespace, configMapName, configMapName, shards-1)
+	} else {
+		status["Cmname"] = fmt.Sprintf("%s/%s", configMapNamespace, configMapName)
+	}
 
-	store, err := NewConfigMapStore(apiCl, configMapNamespace, configMapName)
+	store, err := NewStore(apiCl, configMapNamespace, configMapName)
 	if err != nil {
 		status["StoreError"] = err.Error()
 		return status
@@ -44,6 +52,39 @@ func GetStatus(apiCl kubernetes.Interface) map[string]interface{} {
 		}
 	}
 	externalStatus["Valid"] = valid
+	externalStatus["Degraded"] = isDegraded()
+	externalStatus["Health"] = getHealth()
+	externalStatus["Failing"] = getFailing()
 
 	return status
 }
+
+// isDegraded returns whether the queries to Datadog are suspended by the circuit breaker of the HPA processor.
+func isDegraded() bool {
+	return getDatadogStats()["CircuitBreaker"] == "open"
+}
+
+// getHealth returns the result of the last health check of the connectivity to Datadog.
+func getHealth() string {
+	health, _ := getDatadogStats()["Health"].(string)
+	return health
+}
+
+// getFailing returns the metrics left invalid by the last refresh of the HPA processor.
+func getFailing() []interface{} {
+	state := make(map[string]interface{})
+	if stateVar := expvar.Get("external-metrics-processor"); stateVar != nil {
+		json.Unmarshal([]byte(stateVar.String()), &state)
+	}
+	failing, _ := state["failing"].([]interface{})
+	return failing
+}
+
+// getDatadogStats returns the datadog-api expvar, empty if it is not published.
+func getDatadogStats() map[string]interface{} {
+	datadogStats := make(map[string]interface{})
+	if datadogStatsVar := expvar.Get("datadog-api"); datadogStatsVar != nil {
+		json.Unmarshal([]byte(datadogStatsVar.String()), &datadogStats)
+	}
+	return datadogStats
+}
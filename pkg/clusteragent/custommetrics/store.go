@@ -11,8 +11,10 @@ import (
 	"encoding/json"
 	"expvar"
 	"fmt"
+	"hash/fnv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
@@ -51,13 +53,55 @@ type Store interface {
 	ListAllExternalMetricValues() ([]ExternalMetricValue, error)
 }
 
-// configMapStore provides persistent storage of custom and external metrics using a configmap.
+// ShardMigrator is implemented by the stores whose metrics are moved when their number of shards changes.
+type ShardMigrator interface {
+	MigrateShards() error
+}
+
+// configMapStore provides persistent storage of custom and external metrics using configmaps, sharded by key.
 type configMapStore struct {
 	namespace string
 	name      string
 	client    corev1.CoreV1Interface
 	mu        sync.RWMutex
-	cm        *v1.ConfigMap
+	shards    []*v1.ConfigMap
+	// deleteBatchSize is the number of metrics deleted per update of a configmap, see DeleteExternalMetricValues.
+	deleteBatchSize int
+}
+
+const (
+	// StoreBackendConfigMap stores the metrics in a configmap, the default.
+	StoreBackendConfigMap = "configmap"
+	// StoreBackendCRD stores the metrics in ExternalMetric custom resources.
+	StoreBackendCRD = "crd"
+
+	// configMapSizeLimit is the size limit of the objects stored in etcd.
+	configMapSizeLimit = 1 << 20
+	// configMapSizeWarning is the size of a configmap above which a warning is logged, to leave room for its metadata.
+	configMapSizeWarning = configMapSizeLimit * 9 / 10
+	// conflictRetries is the number of times the update of a configmap modified concurrently is retried.
+	conflictRetries = 5
+	// defaultDeleteBatchSize is the number of metrics deleted per write to the store if the configured one is invalid.
+	defaultDeleteBatchSize = 100
+)
+
+// conflictBackoff is the delay before the first retry of a write rejected by a conflict, doubled at each retry.
+var conflictBackoff = 50 * time.Millisecond
+
+// GetStoreBackend returns the backend of the store of the metrics, StoreBackendConfigMap or StoreBackendCRD.
+func GetStoreBackend() string {
+	if config.Datadog.GetString("external_metrics_provider.store_backend") == StoreBackendCRD {
+		return StoreBackendCRD
+	}
+	return StoreBackendConfigMap
+}
+
+// NewStore returns a new store of the backend set in the configuration, in the specified namespace.
+func NewStore(client kubernetes.Interface, ns, name string) (Store, error) {
+	if GetStoreBackend() == StoreBackendCRD {
+		return NewCRDStore(client, ns)
+	}
+	return NewShardedConfigMapStore(client, ns, name, GetConfigmapShards())
 }
 
 // GetConfigmapName returns the name of the ConfigMap used to store the state of the Custom Metrics Provider
@@ -65,41 +109,196 @@ func GetConfigmapName() string {
 	return config.Datadog.GetString("hpa_configmap_name")
 }
 
+// GetConfigmapShards returns the number of ConfigMaps the state of the Custom Metrics Provider is sharded across
+func GetConfigmapShards() int {
+	shards := config.Datadog.GetInt("hpa_configmap_shards")
+	if shards < 1 {
+		log.Warnf("Invalid number of configmap shards %d, using a single configmap", shards)
+		return 1
+	}
+	return shards
+}
+
+// GetDeleteBatchSize returns the number of metrics deleted per write to the store.
+func GetDeleteBatchSize() int {
+	size := config.Datadog.GetInt("external_metrics_provider.delete_batch_size")
+	if size < 1 {
+		log.Warnf("Invalid delete batch size %d for the external metrics, deleting them in batches of %d", size, defaultDeleteBatchSize)
+		return defaultDeleteBatchSize
+	}
+	return size
+}
+
+// deleteBatches splits the metrics to delete into batches of at most size metrics.
+func deleteBatches(deleted []ExternalMetricValue, size int) [][]ExternalMetricValue {
+	if size < 1 {
+		size = len(deleted)
+	}
+	batches := make([][]ExternalMetricValue, 0, (len(deleted)+size-1)/size)
+	for len(deleted) > size {
+		batches = append(batches, deleted[:size])
+		deleted = deleted[size:]
+	}
+	return append(batches, deleted)
+}
+
+// conflictDelay returns the backoff before a retry of a write rejected by a conflict, see conflictBackoff.
+func conflictDelay(attempt int) time.Duration {
+	return conflictBackoff << uint(attempt)
+}
+
 // NewConfigMapStore returns a new store backed by a configmap. The configmap will be created
 // in the specified namespace if it does not exist.
 func NewConfigMapStore(client kubernetes.Interface, ns, name string) (Store, error) {
+	return NewShardedConfigMapStore(client, ns, name, 1)
+}
+
+// NewShardedConfigMapStore returns a new store backed by the given number of configmaps, see MigrateShards.
+func NewShardedConfigMapStore(client kubernetes.Interface, ns, name string, shards int) (Store, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("invalid number of configmap shards: %d", shards)
+	}
 	store := &configMapStore{
-		namespace: ns,
-		name:      name,
-		client:    client.CoreV1(),
+		namespace:       ns,
+		name:            name,
+		client:          client.CoreV1(),
+		shards:          make([]*v1.ConfigMap, shards),
+		deleteBatchSize: GetDeleteBatchSize(),
+	}
+	for i := range store.shards {
+		if err := store.initConfigMap(i); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// leftoverShards returns the configmaps left over by another number of shards.
+func (c *configMapStore) leftoverShards() ([]*v1.ConfigMap, error) {
+	var leftovers []*v1.ConfigMap
+	if len(c.shards) > 1 {
+		cm, err := c.client.ConfigMaps(c.namespace).Get(c.name, metav1.GetOptions{})
+		if err == nil {
+			leftovers = append(leftovers, cm)
+		} else if !errors.IsNotFound(err) {
+			return nil, err
+		}
 	}
-	err := store.getConfigMap()
+	first := len(c.shards)
+	if first == 1 {
+		first = 0
+	}
+	for i := first; ; i++ {
+		cm, err := c.client.ConfigMaps(c.namespace).Get(fmt.Sprintf("%s-%d", c.name, i), metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return leftovers, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		leftovers = append(leftovers, cm)
+	}
+}
+
+// MigrateShards moves the metrics stored outside of their shard to their shard, and deletes the leftover configmaps.
+func (c *configMapStore) MigrateShards() error {
+	leftovers, err := c.leftoverShards()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// moved are the metrics stored outside of their shard, by key.
+	moved := make(map[string]string)
+	for _, cm := range leftovers {
+		for key, value := range cm.Data {
+			if isExternalMetricValueKey(key) {
+				moved[key] = value
+			}
+		}
+	}
+	for i, cm := range c.shards {
+		for key, value := range cm.Data {
+			if _, ok := moved[key]; !ok && isExternalMetricValueKey(key) && c.shardOf(key) != i {
+				moved[key] = value
+			}
+		}
+	}
+	for i := range c.shards {
+		err := c.updateLatestConfigMap(i, func(cm *v1.ConfigMap) bool {
+			changed := false
+			for key, value := range moved {
+				if _, ok := cm.Data[key]; ok || c.shardOf(key) != i {
+					continue
+				}
+				if cm.Data == nil {
+					cm.Data = make(map[string]string)
+				}
+				cm.Data[key] = value
+				changed = true
+			}
+			return changed
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i := range c.shards {
+		err := c.updateLatestConfigMap(i, func(cm *v1.ConfigMap) bool {
+			changed := false
+			for key := range moved {
+				if _, ok := cm.Data[key]; ok && c.shardOf(key) != i {
+					delete(cm.Data, key)
+					changed = true
+				}
+			}
+			return changed
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, cm := range leftovers {
+		err := c.client.ConfigMaps(c.namespace).Delete(cm.Name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		log.Infof("Deleted the configmap %s left over by another number of shards", cm.Name)
+	}
+	if len(moved) > 0 {
+		log.Infof("Moved %d metrics stored with another number of shards to their shard", len(moved))
+	}
+	return nil
+}
+
+func (c *configMapStore) initConfigMap(shard int) error {
+	name := c.shardName(shard)
+	err := c.getConfigMap(shard)
 	if err == nil {
 		log.Infof("Retrieved the configmap %s", name)
-		return store, nil
+		return nil
 	}
 
 	if !errors.IsNotFound(err) {
 		log.Infof("Error while attempting to fetch the configmap %s: %v", name, err)
-		return nil, err
+		return err
 	}
 
 	log.Infof("The configmap %s does not exist, trying to create it", name)
 	cm := &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
-			Namespace: ns,
+			Namespace: c.namespace,
 		},
 	}
 	// FIXME: distinguish RBAC error
-	store.cm, err = client.CoreV1().ConfigMaps(ns).Create(cm)
-	if err != nil {
-		return nil, err
-	}
-	return store, nil
+	c.shards[shard], err = c.client.ConfigMaps(c.namespace).Create(cm)
+	return err
 }
 
-// SetExternalMetricValues updates the external metrics in the configmap.
+// SetExternalMetricValues updates the external metrics in the configmaps.
 func (c *configMapStore) SetExternalMetricValues(added []ExternalMetricValue) error {
 	if len(added) == 0 {
 		return nil
@@ -108,24 +307,65 @@ func (c *configMapStore) SetExternalMetricValues(added []ExternalMetricValue) er
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.cm == nil {
+	if !c.initialized() {
 		return errNotInitialized
 	}
-	if c.cm.Data == nil {
-		// Don't panic "assignment to entry in nil map" at init
-		c.cm.Data = make(map[string]string)
-	}
+	values := make(map[string]string, len(added))
+	// legacyKeys are the keys the metrics were stored with by the older versions, by key.
+	legacyKeys := make(map[string][]string)
 	for _, m := range added {
-		key := externalMetricValueKeyFunc(m)
 		toStore, err := json.Marshal(m)
 		if err != nil {
 			log.Debugf("Could not marshal the external metric %v: %v", m, err)
 			continue
 		}
-		c.cm.Data[key] = string(toStore)
+		key := externalMetricValueKeyFunc(m)
+		if previous, ok := values[key]; ok && previous != string(toStore) {
+			log.Debugf("The external metric %s for the HPA %s/%s is set twice, only the last value is stored", m.MetricName, m.HPA.Namespace, m.HPA.Name)
+		}
+		values[key] = string(toStore)
+		if legacy := legacyExternalMetricValueKeys(m); len(legacy) > 0 {
+			legacyKeys[key] = legacy
+		}
 	}
-	if err := c.updateConfigMap(); err != nil {
-		return err
+	var lastErr error
+	for i := range c.shards {
+		err := c.applyToConfigMap(i, func(cm *v1.ConfigMap) bool {
+			changed := false
+			for key, value := range values {
+				for _, legacy := range legacyKeys[key] {
+					if _, ok := cm.Data[legacy]; ok {
+						delete(cm.Data, legacy)
+						changed = true
+					}
+				}
+				if c.shardOf(key) != i {
+					// The metric could have been stored with another number of shards.
+					if _, ok := cm.Data[key]; ok {
+						delete(cm.Data, key)
+						changed = true
+					}
+					continue
+				}
+				if current, ok := cm.Data[key]; ok && current == value {
+					// The metric is already stored as is, setting it again does not update the configmap.
+					continue
+				}
+				if cm.Data == nil {
+					// Don't panic "assignment to entry in nil map" at init
+					cm.Data = make(map[string]string)
+				}
+				cm.Data[key] = value
+				changed = true
+			}
+			return changed
+		})
+		if err != nil {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return lastErr
 	}
 
 	total := int64(len(added))
@@ -143,7 +383,7 @@ func (c *configMapStore) SetExternalMetricValues(added []ExternalMetricValue) er
 	return nil
 }
 
-// Delete deletes all metrics in the configmap that refer to any of the given object references.
+// Delete deletes all metrics in the configmaps that refer to any of the given object references.
 func (c *configMapStore) DeleteExternalMetricValues(deleted []ExternalMetricValue) error {
 	if len(deleted) == 0 {
 		return nil
@@ -152,71 +392,238 @@ func (c *configMapStore) DeleteExternalMetricValues(deleted []ExternalMetricValu
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.cm == nil {
+	if !c.initialized() {
 		return errNotInitialized
 	}
-	for _, m := range deleted {
-		key := externalMetricValueKeyFunc(m)
-		delete(c.cm.Data, key)
-		log.Debugf("Deleted metric %s for HPA %s/%s from the configmap %s", m.MetricName, m.HPA.Namespace, m.HPA.Name, c.name)
+	var lastErr error
+	for _, batch := range deleteBatches(deleted, c.deleteBatchSize) {
+		if err := c.deleteBatch(batch); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// deleteBatch deletes a batch of metrics from the configmaps, with a single update per configmap.
+func (c *configMapStore) deleteBatch(deleted []ExternalMetricValue) error {
+	var lastErr error
+	for i := range c.shards {
+		err := c.updateLatestConfigMap(i, func(cm *v1.ConfigMap) bool {
+			changed := false
+			for _, m := range deleted {
+				for _, key := range append([]string{externalMetricValueKeyFunc(m)}, legacyExternalMetricValueKeys(m)...) {
+					if _, ok := cm.Data[key]; !ok {
+						continue
+					}
+					delete(cm.Data, key)
+					changed = true
+					log.Debugf("Deleted metric %s for HPA %s/%s from the configmap %s", m.MetricName, m.HPA.Namespace, m.HPA.Name, c.shardName(i))
+				}
+			}
+			return changed
+		})
+		if err != nil {
+			lastErr = err
+		}
 	}
-	return c.updateConfigMap()
+	return lastErr
 }
 
-// ListAllExternalMetricValues returns the most up-to-date list of external metrics from the configmap.
+// ListAllExternalMetricValues returns the most up-to-date list of external metrics from all the configmaps.
 // Any replica can safely call this function.
 func (c *configMapStore) ListAllExternalMetricValues() ([]ExternalMetricValue, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.getConfigMap(); err != nil {
-		return nil, err
+	for i := range c.shards {
+		if err := c.getConfigMap(i); err != nil {
+			return nil, err
+		}
 	}
-	var metrics []ExternalMetricValue
-	for k, v := range c.cm.Data {
-		if !isExternalMetricValueKey(k) {
-			continue
+	// A metric left in another shard by a previous number of shards is outdated if it is also in its own shard.
+	values := make(map[string]string)
+	for i, cm := range c.shards {
+		for k, v := range cm.Data {
+			if !isExternalMetricValueKey(k) {
+				continue
+			}
+			if _, ok := values[k]; ok && c.shardOf(k) != i {
+				continue
+			}
+			values[k] = v
 		}
+	}
+	var metrics []ExternalMetricValue
+	for k, v := range values {
 		m := ExternalMetricValue{}
 		if err := json.Unmarshal([]byte(v), &m); err != nil {
 			log.Debugf("Could not unmarshal the external metric for key %s: %v", k, err)
 			continue
 		}
+		if key := externalMetricValueKeyFunc(m); key != k {
+			// A metric stored by an older version is outdated if it was stored again with its current key.
+			if _, ok := values[key]; ok {
+				continue
+			}
+		}
 		metrics = append(metrics, m)
 	}
 	return metrics, nil
 }
 
-func (c *configMapStore) getConfigMap() error {
+func (c *configMapStore) initialized() bool {
+	for _, cm := range c.shards {
+		if cm == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// shardName returns the name of the configmap of a shard.
+func (c *configMapStore) shardName(shard int) string {
+	if len(c.shards) == 1 {
+		return c.name
+	}
+	return fmt.Sprintf("%s-%d", c.name, shard)
+}
+
+// shardOf returns the shard of the metric of the given key, so that a metric is always updated in the same configmap.
+func (c *configMapStore) shardOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(c.shards)))
+}
+
+func (c *configMapStore) getConfigMap(shard int) error {
 	var err error
-	c.cm, err = c.client.ConfigMaps(c.namespace).Get(c.name, metav1.GetOptions{})
+	c.shards[shard], err = c.client.ConfigMaps(c.namespace).Get(c.shardName(shard), metav1.GetOptions{})
 	if err != nil {
-		log.Infof("Could not get the configmap %s: %v", c.name, err)
+		log.Infof("Could not get the configmap %s: %v", c.shardName(shard), err)
 		return err
 	}
 	return nil
 }
 
-func (c *configMapStore) updateConfigMap() error {
-	var err error
-	c.cm, err = c.client.ConfigMaps(c.namespace).Update(c.cm)
+// updateLatestConfigMap applies a change to the latest version of the configmap of a shard.
+func (c *configMapStore) updateLatestConfigMap(shard int, change func(cm *v1.ConfigMap) bool) error {
+	if err := c.getConfigMap(shard); err != nil {
+		return err
+	}
+	return c.applyToConfigMap(shard, change)
+}
+
+// applyToConfigMap applies a change to the configmap of a shard, retried on conflicts. It is called with c.mu locked.
+func (c *configMapStore) applyToConfigMap(shard int, change func(cm *v1.ConfigMap) bool) error {
+	for attempt := 0; ; attempt++ {
+		if !change(c.shards[shard]) {
+			return nil
+		}
+		err := c.updateConfigMap(shard)
+		if err == nil || !errors.IsConflict(err) {
+			return err
+		}
+		if attempt >= conflictRetries {
+			return fmt.Errorf("could not update the configmap %s, it was modified concurrently %d times: %v", c.shardName(shard), attempt+1, err)
+		}
+		delay := conflictDelay(attempt)
+		log.Debugf("The configmap %s was modified concurrently, retrying its update in %s", c.shardName(shard), delay)
+		c.mu.Unlock()
+		time.Sleep(delay)
+		c.mu.Lock()
+		if err := c.getConfigMap(shard); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *configMapStore) updateConfigMap(shard int) error {
+	name := c.shardName(shard)
+	if size := configMapSize(c.shards[shard]); size > configMapSizeWarning {
+		log.Warnf("The configmap %s is %d bytes, close to the limit of %d bytes, consider increasing hpa_configmap_shards", name, size, configMapSizeLimit)
+	}
+	cm, err := c.client.ConfigMaps(c.namespace).Update(c.shards[shard])
 	if err != nil {
-		log.Infof("Could not update the configmap %s: %v", c.name, err)
+		log.Infof("Could not update the configmap %s: %v", name, err)
 		return err
 	}
+	c.shards[shard] = cm
 	return nil
 }
 
+// configMapSize returns the size of the data of a configmap.
+func configMapSize(cm *v1.ConfigMap) int {
+	size := 0
+	for k, v := range cm.Data {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
 // externalMetricValueKeyFunc knows how to make keys for storing external metrics. The key
 // is unique for each metric of an HPA. This means that the keys for the same metric from two
 // different HPAs will be different (important for external metrics that may use different labels
 // for the same metric).
 func externalMetricValueKeyFunc(val ExternalMetricValue) string {
+	if val.HPA.UID == "" {
+		return legacyExternalMetricValueKey(val)
+	}
+	parts := []string{
+		"external_metric",
+		val.HPA.Namespace,
+		val.HPA.Name,
+		val.HPA.UID,
+	}
+	if val.Type != "" {
+		parts = append(parts, strings.ToLower(val.Type))
+	}
+	parts = append(parts, metricNameKey(val.MetricName), selectorHash(val))
+	return strings.Join(parts, keyDelimeter)
+}
+
+// selectorHash returns a short hash of the selector and of the described object of a metric, telling apart the
+// metrics of an HPA with the same name.
+func selectorHash(val ExternalMetricValue) string {
+	selector, _ := json.Marshal(struct {
+		Labels           map[string]string                 `json:"labels,omitempty"`
+		MatchExpressions []metav1.LabelSelectorRequirement `json:"matchExpressions,omitempty"`
+		Object           *DescribedObject                  `json:"object,omitempty"`
+	}{val.Labels, val.MatchExpressions, val.Object})
+	h := fnv.New32a()
+	h.Write(selector)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// metricNameKey returns the name of a metric as a part of its key, e.g. `max-requests_per_s`.
+func metricNameKey(metricName string) string {
+	return strings.Replace(metricName, ":", keyDelimeter, -1)
+}
+
+// legacyExternalMetricValueKeys returns the keys the external metrics were stored with by the older versions, by
+// the UID of their HPA and without it, other than their key.
+func legacyExternalMetricValueKeys(val ExternalMetricValue) []string {
+	var keys []string
+	if val.HPA.UID != "" {
+		parts := []string{
+			"external_metric",
+			val.HPA.Namespace,
+			val.HPA.Name,
+			val.HPA.UID,
+			metricNameKey(val.MetricName),
+		}
+		keys = append(keys, strings.Join(parts, keyDelimeter), legacyExternalMetricValueKey(val))
+	}
+	return keys
+}
+
+// legacyExternalMetricValueKey is the key the external metrics were stored with by the versions ignoring the UIDs
+// of their HPAs.
+func legacyExternalMetricValueKey(val ExternalMetricValue) string {
 	parts := []string{
 		"external_metric",
 		val.HPA.Namespace,
 		val.HPA.Name,
-		val.MetricName,
+		metricNameKey(val.MetricName),
 	}
 	return strings.Join(parts, keyDelimeter)
 }
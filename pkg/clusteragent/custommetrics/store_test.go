@@ -10,13 +10,18 @@ package custommetrics
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
 )
 
 func TestNewConfigMapStore(t *testing.T) {
@@ -34,12 +39,12 @@ func TestNewConfigMapStore(t *testing.T) {
 	// configmap already exists
 	store, err := NewConfigMapStore(client, "default", "foo")
 	require.NoError(t, err)
-	require.NotNil(t, store.(*configMapStore).cm)
+	require.NotNil(t, store.(*configMapStore).shards[0])
 
 	// configmap doesn't exist
 	store, err = NewConfigMapStore(client, "default", "bar")
 	require.NoError(t, err)
-	require.NotNil(t, store.(*configMapStore).cm)
+	require.NotNil(t, store.(*configMapStore).shards[0])
 }
 
 func TestConfigMapStoreExternalMetrics(t *testing.T) {
@@ -132,7 +137,7 @@ func TestConfigMapStoreExternalMetrics(t *testing.T) {
 		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
 			store, err := NewConfigMapStore(client, "default", fmt.Sprintf("test-%d", i))
 			require.NoError(t, err)
-			require.NotNil(t, store.(*configMapStore).cm)
+			require.NotNil(t, store.(*configMapStore).shards[0])
 
 			err = store.SetExternalMetricValues(tt.metrics)
 			require.NoError(t, err)
@@ -150,3 +155,495 @@ func TestConfigMapStoreExternalMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestShardedConfigMapStoreExternalMetrics(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	store, err := NewShardedConfigMapStore(client, "default", "foo", 3)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := client.CoreV1().ConfigMaps("default").Get(fmt.Sprintf("foo-%d", i), metav1.GetOptions{})
+		require.NoError(t, err)
+	}
+
+	var metrics []ExternalMetricValue
+	for i := 0; i < 20; i++ {
+		metrics = append(metrics, ExternalMetricValue{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        ObjectReference{Name: fmt.Sprintf("hpa-%d", i), Namespace: "default"},
+		})
+	}
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+
+	// The metrics are spread across the shards, and listed from all of them.
+	for i := 0; i < 3; i++ {
+		cm, err := client.CoreV1().ConfigMaps("default").Get(fmt.Sprintf("foo-%d", i), metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.NotEmpty(t, cm.Data)
+		assert.True(t, len(cm.Data) < len(metrics))
+	}
+	list, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+
+	// A metric stored in another shard, e.g. by a previous number of shards, is moved to its shard.
+	key := externalMetricValueKeyFunc(metrics[0])
+	shards := store.(*configMapStore).shards
+	other := shards[(store.(*configMapStore).shardOf(key)+1)%3]
+	other.Data[key] = `{"metricName":"requests_per_s","hpa":{"name":"hpa-0","namespace":"default"},"value":1}`
+	_, err = client.CoreV1().ConfigMaps("default").Update(other)
+	require.NoError(t, err)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+
+	metrics[0].Value = 2
+	err = store.SetExternalMetricValues(metrics[:1])
+	require.NoError(t, err)
+	cm, err := client.CoreV1().ConfigMaps("default").Get(other.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, cm.Data, key)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+
+	err = store.DeleteExternalMetricValues(list)
+	require.NoError(t, err)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	_, err = NewShardedConfigMapStore(client, "default", "foo", 0)
+	assert.Error(t, err)
+}
+
+func TestShardedConfigMapStoreMigration(t *testing.T) {
+	var metrics []ExternalMetricValue
+	for i := 0; i < 20; i++ {
+		metrics = append(metrics, ExternalMetricValue{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        ObjectReference{Name: fmt.Sprintf("hpa-%d", i), Namespace: "default", UID: fmt.Sprintf("%d", i)},
+			Value:      int64(i),
+		})
+	}
+	tests := []struct {
+		caseName string
+		from, to int
+		deleted  []string
+	}{
+		{"1 to 3 shards", 1, 3, []string{"foo"}},
+		{"3 to 2 shards", 3, 2, []string{"foo-2"}},
+		{"2 to 1 shard", 2, 1, []string{"foo-0", "foo-1"}},
+		{"2 to 4 shards", 2, 4, nil},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.caseName), func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			previous, err := NewShardedConfigMapStore(client, "default", "foo", tt.from)
+			require.NoError(t, err)
+			err = previous.SetExternalMetricValues(metrics)
+			require.NoError(t, err)
+
+			// The metrics stored with the previous number of shards are moved to their shard by the migration only.
+			store, err := NewShardedConfigMapStore(client, "default", "foo", tt.to)
+			require.NoError(t, err)
+			for _, name := range tt.deleted {
+				_, err := client.CoreV1().ConfigMaps("default").Get(name, metav1.GetOptions{})
+				assert.NoError(t, err, name)
+			}
+			err = store.(ShardMigrator).MigrateShards()
+			require.NoError(t, err)
+			list, err := store.ListAllExternalMetricValues()
+			require.NoError(t, err)
+			assert.ElementsMatch(t, metrics, list)
+			for _, name := range tt.deleted {
+				_, err := client.CoreV1().ConfigMaps("default").Get(name, metav1.GetOptions{})
+				assert.True(t, errors.IsNotFound(err), name)
+			}
+			for shard := 0; shard < tt.to; shard++ {
+				cm, err := client.CoreV1().ConfigMaps("default").Get(store.(*configMapStore).shardName(shard), metav1.GetOptions{})
+				require.NoError(t, err)
+				for key := range cm.Data {
+					assert.Equal(t, shard, store.(*configMapStore).shardOf(key))
+				}
+			}
+
+			// The metrics are no longer served from the configmaps deleted.
+			err = store.DeleteExternalMetricValues(list)
+			require.NoError(t, err)
+			store, err = NewShardedConfigMapStore(client, "default", "foo", tt.to)
+			require.NoError(t, err)
+			list, err = store.ListAllExternalMetricValues()
+			require.NoError(t, err)
+			assert.Empty(t, list)
+		})
+	}
+}
+
+func TestShardedConfigMapStoreMigrationKeepsShard(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	metric := ExternalMetricValue{MetricName: "requests_per_s", HPA: ObjectReference{Name: "foo", Namespace: "default", UID: "1111"}, Value: 1}
+	legacy, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+	err = legacy.SetExternalMetricValues([]ExternalMetricValue{metric})
+	require.NoError(t, err)
+
+	// A metric already stored in its shard is more recent than the one of the configmap left over.
+	shard := (&configMapStore{shards: make([]*v1.ConfigMap, 2)}).shardOf(externalMetricValueKeyFunc(metric))
+	cm, err := client.CoreV1().ConfigMaps("default").Create(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("foo-%d", shard), Namespace: "default"}})
+	require.NoError(t, err)
+	cm.Data = map[string]string{externalMetricValueKeyFunc(metric): `{"metricName":"requests_per_s","hpa":{"name":"foo","namespace":"default","uid":"1111"},"value":2}`}
+	_, err = client.CoreV1().ConfigMaps("default").Update(cm)
+	require.NoError(t, err)
+
+	store, err := NewShardedConfigMapStore(client, "default", "foo", 2)
+	require.NoError(t, err)
+	err = store.(ShardMigrator).MigrateShards()
+	require.NoError(t, err)
+	list, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, int64(2), list[0].Value)
+}
+
+func TestConfigMapStoreDeleteConflict(t *testing.T) {
+	defer func(backoff time.Duration) { conflictBackoff = backoff }(conflictBackoff)
+	conflictBackoff = time.Millisecond
+
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+
+	metrics := []ExternalMetricValue{
+		{MetricName: "requests_per_s", HPA: ObjectReference{Name: "foo", Namespace: "default"}},
+		{MetricName: "requests_per_s", HPA: ObjectReference{Name: "bar", Namespace: "default"}},
+		{MetricName: "requests_per_s", HPA: ObjectReference{Name: "baz", Namespace: "default"}},
+	}
+	err = store.SetExternalMetricValues(metrics[:2])
+	require.NoError(t, err)
+
+	// Another writer stores a metric, the configmap cached by the store is outdated.
+	other, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+	err = other.SetExternalMetricValues(metrics[2:])
+	require.NoError(t, err)
+
+	// The first update conflicts with yet another writer, it is retried on the latest version of the configmap.
+	var updates int
+	client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates == 1 {
+			return true, nil, errors.NewConflict(v1.Resource("configmaps"), "foo", fmt.Errorf("the object has been modified"))
+		}
+		return false, nil, nil
+	})
+	err = store.DeleteExternalMetricValues(metrics[:2])
+	require.NoError(t, err)
+	// The deletions are coalesced into a single update of the configmap.
+	assert.Equal(t, 2, updates)
+
+	list, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics[2:], list)
+}
+
+func TestConfigMapStoreConflictBackoffUnlocked(t *testing.T) {
+	defer func(backoff time.Duration) { conflictBackoff = backoff }(conflictBackoff)
+	conflictBackoff = 500 * time.Millisecond
+
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+	metrics := []ExternalMetricValue{
+		{MetricName: "requests_per_s", HPA: ObjectReference{Name: "foo", Namespace: "default"}},
+	}
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+
+	conflicted := make(chan struct{})
+	var updates int
+	client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates == 1 {
+			close(conflicted)
+			return true, nil, errors.NewConflict(v1.Resource("configmaps"), "foo", fmt.Errorf("the object has been modified"))
+		}
+		return false, nil, nil
+	})
+	deleted := make(chan error)
+	go func() { deleted <- store.DeleteExternalMetricValues(metrics) }()
+
+	// The metrics are listed while the deletion waits for its retry.
+	<-conflicted
+	list, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	select {
+	case <-deleted:
+		t.Fatal("the metrics were only listed after the retry of the deletion")
+	default:
+	}
+	assert.ElementsMatch(t, metrics, list)
+
+	require.NoError(t, <-deleted)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+func TestConfigMapStoreDeleteBatches(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+	store.(*configMapStore).deleteBatchSize = 2
+
+	var metrics []ExternalMetricValue
+	for i := 0; i < 6; i++ {
+		metrics = append(metrics, ExternalMetricValue{
+			MetricName: "requests_per_s",
+			HPA:        ObjectReference{Name: fmt.Sprintf("hpa-%d", i), Namespace: "default"},
+		})
+	}
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+
+	var updates int
+	client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updates++
+		return false, nil, nil
+	})
+	// The deletions are coalesced into a single update of the configmap per batch.
+	err = store.DeleteExternalMetricValues(metrics[:5])
+	require.NoError(t, err)
+	assert.Equal(t, 3, updates)
+
+	list, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics[5:], list)
+}
+
+func TestDeleteBatches(t *testing.T) {
+	metrics := make([]ExternalMetricValue, 5)
+	for i, tt := range []struct {
+		caseName string
+		deleted  []ExternalMetricValue
+		size     int
+		expected []int
+	}{
+		{"smaller than a batch", metrics[:1], 2, []int{1}},
+		{"exact batches", metrics[:4], 2, []int{2, 2}},
+		{"last batch partial", metrics, 2, []int{2, 2, 1}},
+		{"no size", metrics, 0, []int{5}},
+	} {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.caseName), func(t *testing.T) {
+			var sizes []int
+			for _, batch := range deleteBatches(tt.deleted, tt.size) {
+				sizes = append(sizes, len(batch))
+			}
+			assert.Equal(t, tt.expected, sizes)
+		})
+	}
+}
+
+func TestConfigMapStoreSetConflict(t *testing.T) {
+	defer func(backoff time.Duration) { conflictBackoff = backoff }(conflictBackoff)
+	conflictBackoff = time.Millisecond
+
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+
+	metrics := []ExternalMetricValue{
+		{MetricName: "requests_per_s", HPA: ObjectReference{Name: "foo", Namespace: "default"}},
+		{MetricName: "requests_per_s", HPA: ObjectReference{Name: "bar", Namespace: "default"}},
+		{MetricName: "requests_per_s", HPA: ObjectReference{Name: "baz", Namespace: "default"}},
+	}
+	err = store.SetExternalMetricValues(metrics[:1])
+	require.NoError(t, err)
+
+	// Another writer stores a metric, the configmap cached by the store is outdated.
+	other, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+	err = other.SetExternalMetricValues(metrics[1:2])
+	require.NoError(t, err)
+
+	// The update of the outdated configmap conflicts, the metrics are stored again in its latest version.
+	var updates int
+	conflicts := 1
+	client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates <= conflicts {
+			return true, nil, errors.NewConflict(v1.Resource("configmaps"), "foo", fmt.Errorf("the object has been modified"))
+		}
+		return false, nil, nil
+	})
+	err = store.SetExternalMetricValues(metrics[2:])
+	require.NoError(t, err)
+	assert.Equal(t, 2, updates)
+
+	list, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+
+	// The metrics already stored as is do not update the configmap.
+	updates = 0
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+	assert.Equal(t, 0, updates)
+
+	// The retries are bounded.
+	updates = 0
+	conflicts = conflictRetries + 1
+	metrics[0].Value = 1
+	err = store.SetExternalMetricValues(metrics[:1])
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "modified concurrently")
+	assert.Equal(t, conflictRetries+1, updates)
+}
+
+func TestConfigMapStoreHPAUID(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+
+	// The namespaces and names of the HPAs join into the same key without their UIDs.
+	metrics := []ExternalMetricValue{
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        ObjectReference{Name: "web", Namespace: "team-a", UID: "1111"},
+		},
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        ObjectReference{Name: "a-web", Namespace: "team", UID: "2222"},
+		},
+	}
+	require.Equal(t, legacyExternalMetricValueKey(metrics[0]), legacyExternalMetricValueKey(metrics[1]))
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+	list, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+
+	err = store.DeleteExternalMetricValues(metrics[:1])
+	require.NoError(t, err)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics[1:], list)
+
+	// A metric stored by an older version is listed until it is stored again with the UID of its HPA.
+	cm := store.(*configMapStore).shards[0]
+	legacy := legacyExternalMetricValueKey(metrics[0])
+	cm.Data[legacy] = `{"metricName":"requests_per_s","labels":{"role":"frontend"},"hpa":{"name":"web","namespace":"team-a","uid":"1111"},"value":0,"valueFloat":0,"valid":false,"ts":0}`
+	_, err = client.CoreV1().ConfigMaps("default").Update(cm)
+	require.NoError(t, err)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+
+	metrics[0].Value, metrics[0].ValueFloat, metrics[0].Valid = 12, 12, true
+	err = store.SetExternalMetricValues(metrics[:1])
+	require.NoError(t, err)
+	cm, err = client.CoreV1().ConfigMaps("default").Get("foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, cm.Data, legacy)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+}
+
+func TestConfigMapStoreMetricsOfSameName(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+
+	// The metrics of an HPA with the same name are told apart by their type, selector and described object.
+	hpa := ObjectReference{Name: "web", Namespace: "default", UID: "1111"}
+	metrics := []ExternalMetricValue{
+		{MetricName: "requests_per_s", Labels: map[string]string{"role": "frontend"}, HPA: hpa, ValueFloat: 12},
+		{MetricName: "requests_per_s", Labels: map[string]string{"role": "backend"}, HPA: hpa, ValueFloat: 30},
+		{
+			MetricName:       "requests_per_s",
+			Labels:           map[string]string{"role": "frontend"},
+			MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "region", Operator: metav1.LabelSelectorOpIn, Values: []string{"eu"}}},
+			HPA:              hpa,
+			ValueFloat:       5,
+		},
+		{MetricName: "requests_per_s", Labels: map[string]string{"role": "frontend"}, HPA: hpa, Type: PodsMetricType, ValueFloat: 3},
+		{MetricName: "requests_per_s", HPA: hpa, Type: ObjectMetricType, Object: &DescribedObject{Kind: "Ingress", Name: "web"}, ValueFloat: 40},
+		{MetricName: "requests_per_s", HPA: hpa, Type: ObjectMetricType, Object: &DescribedObject{Kind: "Ingress", Name: "api"}, ValueFloat: 50},
+	}
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+	cm, err := client.CoreV1().ConfigMaps("default").Get("foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, cm.Data, len(metrics))
+	for key := range cm.Data {
+		assert.Empty(t, validation.IsConfigMapKey(key), key)
+	}
+	list, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+
+	err = store.DeleteExternalMetricValues(metrics[1:2])
+	require.NoError(t, err)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, append([]ExternalMetricValue{metrics[0]}, metrics[2:]...), list)
+
+	// A metric stored by an older version under the UID of its HPA only is listed until it is stored again.
+	legacy := "external_metric-default-web-1111-requests_per_s"
+	require.Equal(t, legacy, legacyExternalMetricValueKeys(metrics[1])[0])
+	cm, err = client.CoreV1().ConfigMaps("default").Get("foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	cm.Data[legacy] = `{"metricName":"requests_per_s","labels":{"role":"backend"},"hpa":{"name":"web","namespace":"default","uid":"1111"},"value":0,"valueFloat":1,"valid":false,"ts":0}`
+	_, err = client.CoreV1().ConfigMaps("default").Update(cm)
+	require.NoError(t, err)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	require.Len(t, list, len(metrics))
+
+	err = store.SetExternalMetricValues(metrics[1:2])
+	require.NoError(t, err)
+	cm, err = client.CoreV1().ConfigMaps("default").Get("foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, cm.Data, legacy)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+}
+
+func TestConfigMapStoreAggregatorPrefix(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+
+	// The aggregations of a metric are distinct metrics, stored under valid keys.
+	hpa := ObjectReference{Name: "web", Namespace: "default", UID: "1111"}
+	metrics := []ExternalMetricValue{
+		{MetricName: "avg:requests_per_s", Labels: map[string]string{"role": "frontend"}, HPA: hpa, ValueFloat: 12, Valid: true},
+		{MetricName: "max:requests_per_s", Labels: map[string]string{"role": "frontend"}, HPA: hpa, ValueFloat: 30, Valid: true},
+		{MetricName: "requests_per_s", Labels: map[string]string{"role": "frontend"}, HPA: hpa, ValueFloat: 12, Valid: true},
+	}
+	err = store.SetExternalMetricValues(metrics)
+	require.NoError(t, err)
+	cm, err := client.CoreV1().ConfigMaps("default").Get("foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, cm.Data, 3)
+	for key := range cm.Data {
+		assert.Empty(t, validation.IsConfigMapKey(key), key)
+	}
+	list, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics, list)
+
+	err = store.DeleteExternalMetricValues(metrics[1:2])
+	require.NoError(t, err)
+	list, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []ExternalMetricValue{metrics[0], metrics[2]}, list)
+}
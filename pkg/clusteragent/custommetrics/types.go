@@ -7,13 +7,105 @@
 
 package custommetrics
 
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ExternalMetricValue is the value of an external metric referenced by an HPA, as stored by the Datadog Cluster Agent.
 type ExternalMetricValue struct {
 	MetricName string            `json:"metricName"`
 	Labels     map[string]string `json:"labels"`
-	Timestamp  int64             `json:"ts"`
-	HPA        ObjectReference   `json:"hpa"`
-	Value      int64             `json:"value"`
-	Valid      bool              `json:"valid"`
+	// MatchExpressions are the expressions of the metric selector, in addition to its labels.
+	MatchExpressions []metav1.LabelSelectorRequirement `json:"matchExpressions,omitempty"`
+	// TargetTags are the tags of the pods of the scale target of the HPA scoping the query of the metric, in addition
+	// to its labels, empty unless the HPA opts its metrics in the scope of its scale target.
+	TargetTags map[string]string `json:"targetTags,omitempty"`
+	// Timestamp is the time in seconds of the Datadog point of the value, the time of its refresh for the values
+	// stored by older versions.
+	Timestamp int64           `json:"ts"`
+	HPA       ObjectReference `json:"hpa"`
+	// Value is the truncated value of the metric.
+	// Deprecated: only kept for compatibility with the values stored by older versions, use ValueFloat.
+	Value      int64   `json:"value"`
+	ValueFloat float64 `json:"valueFloat"`
+	Valid      bool    `json:"valid"`
+	// Type is PodsMetricType or ObjectMetricType for the metrics served as custom metrics, empty for external metrics.
+	Type string `json:"type,omitempty"`
+	// Object is the object described by the metrics of ObjectMetricType.
+	Object *DescribedObject `json:"object,omitempty"`
+	// PodSelector is the selector of the pods of the scale target of the HPA of the metrics of PodsMetricType,
+	// matched against the selector of the requests of the HPA controller.
+	PodSelector string `json:"podSelector,omitempty"`
+	// Query is the last query sent to Datadog for the metric, empty if the metric cannot be queried.
+	Query string `json:"query,omitempty"`
+	// MaxAge is the max age in seconds of the value of the metric set by its HPA, 0 for the default max age.
+	MaxAge int64 `json:"maxAge,omitempty"`
+	// Multiplier is the factor applied to the value of the metric set by its HPA, 0 if the value is not scaled.
+	Multiplier float64 `json:"multiplier,omitempty"`
+	// Aggregator, Rollup and QueryWindow are the query options of the metric set by its HPA, empty or 0 for the
+	// defaults of the processor. Rollup and QueryWindow are in seconds.
+	Aggregator  string `json:"aggregator,omitempty"`
+	Rollup      int64  `json:"rollup,omitempty"`
+	QueryWindow int64  `json:"window,omitempty"`
+	// Min and Max are the bounds of the value of the metric set by its HPA, nil if it is not bounded. RangeMode is
+	// whether the values out of the bounds are clamped or rejected, empty for the default.
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+	RangeMode string   `json:"rangeMode,omitempty"`
+	// Stat is the percentile of the distribution of the metric queried instead of its aggregation, set by its HPA,
+	// e.g. `p95`, empty for the aggregator.
+	Stat string `json:"stat,omitempty"`
+	// RollupMethod is the method rolling up the points of the metric set by its HPA, e.g. `sum` for a count, empty to
+	// roll them up with the aggregator.
+	RollupMethod string `json:"rollupMethod,omitempty"`
+	// SmoothingAlpha is the weight of the latest value in the moving average of the values of the metric set by its
+	// HPA, 0 if the values are not smoothed.
+	SmoothingAlpha float64 `json:"smoothingAlpha,omitempty"`
+	// Transform is the transform of the values of the metric set by its HPA, e.g. `per_second` for the rate of a
+	// counter, empty if the value is not transformed.
+	Transform string `json:"transform,omitempty"`
+	// Formula is the arithmetic formula of the queries of FormulaQueries queried instead of the metric, set by its
+	// HPA, e.g. `a/b`, empty to query the metric.
+	Formula        string            `json:"formula,omitempty"`
+	FormulaQueries map[string]string `json:"formulaQueries,omitempty"`
+	// QueryTemplate is the query of the metric set by its HPA, with the placeholders of the name of the metric and
+	// of its scope, e.g. `sum:{metric}{{scope}}.rollup(max, 60)`, empty for the query built from the metric.
+	QueryTemplate string `json:"queryTemplate,omitempty"`
+	// AllClusters is whether the metric is queried across all the clusters, opted out of the scope of the cluster
+	// by its HPA.
+	AllClusters bool `json:"allClusters,omitempty"`
+	// Frozen is whether the metric is frozen at its last value by its HPA, it is not refreshed while it is valid.
+	Frozen bool `json:"frozen,omitempty"`
+	// Stale is whether the value of the metric is older than its max age, served within the stale grace period as
+	// its queries fail transiently.
+	Stale bool `json:"stale,omitempty"`
+	// LastError is the error of the last refresh of the metric, empty if it succeeded.
+	LastError string `json:"lastError,omitempty"`
+	// LastSuccessTimestamp is the time of the last successful refresh of the metric.
+	LastSuccessTimestamp int64 `json:"lastSuccessTs,omitempty"`
+}
+
+const (
+	// PodsMetricType is the Type of the metrics that are the average value across the pods targeted by an HPA.
+	PodsMetricType = "Pods"
+	// ObjectMetricType is the Type of the metrics that describe a single Kubernetes object, e.g. an Ingress.
+	ObjectMetricType = "Object"
+)
+
+// GetValue returns the value of the metric, falling back on the truncated value for metrics stored by older versions.
+func (em ExternalMetricValue) GetValue() float64 {
+	if em.ValueFloat == 0 && em.Value != 0 {
+		return float64(em.Value)
+	}
+	return em.ValueFloat
+}
+
+// GetTimestamp returns the time of the Datadog point of the value of the metric, now if it was never refreshed.
+func (em ExternalMetricValue) GetTimestamp() metav1.Time {
+	if em.Timestamp == 0 {
+		return metav1.Now()
+	}
+	return metav1.Unix(em.Timestamp, 0)
 }
 
 // ObjectReference contains enough information to let you identify the referred resource.
@@ -22,3 +114,10 @@ type ObjectReference struct {
 	Namespace string `json:"namespace"`
 	UID       string `json:"uid"`
 }
+
+// DescribedObject identifies the Kubernetes object described by a metric, in the namespace of the HPA.
+type DescribedObject struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	APIVersion string `json:"apiVersion,omitempty"`
+}
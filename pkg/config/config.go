@@ -80,6 +80,7 @@ func init() {
 	// Configuration defaults
 	// Agent
 	BindEnvAndSetDefault("dd_url", "https://app.datadoghq.com")
+	BindEnvAndSetDefault("site", "") // Datadog site, e.g. datadoghq.eu, only used by the external metrics provider for now
 	BindEnvAndSetDefault("app_key", "")
 	Datadog.SetDefault("proxy", nil)
 	BindEnvAndSetDefault("skip_ssl_validation", false)
@@ -231,6 +232,7 @@ func init() {
 	BindEnvAndSetDefault("cluster_agent.auth_token", "")
 	BindEnvAndSetDefault("cluster_agent.url", "")
 	BindEnvAndSetDefault("cluster_agent.kubernetes_service_name", "datadog-cluster-agent")
+	BindEnvAndSetDefault("cluster_name", "") // Name of the cluster, the value of the kube_cluster_name tag of its series
 
 	// ECS
 	BindEnvAndSetDefault("ecs_agent_url", "") // Will be autodetected
@@ -293,10 +295,79 @@ func init() {
 	BindEnvAndSetDefault("hpa_watcher_gc_period", 60*5) // 5 minutes
 	BindEnvAndSetDefault("external_metrics_provider.enabled", false)
 	BindEnvAndSetDefault("hpa_configmap_name", "datadog-custom-metrics")
+	BindEnvAndSetDefault("hpa_configmap_shards", 1) // Number of configmaps the metrics are sharded across
 	BindEnvAndSetDefault("external_metrics_provider.refresh_period", 30)
 	BindEnvAndSetDefault("external_metrics_provider.batch_window", 5) // 5 seconds to batch calls to the configmap persistent store (GlobalStore)
 	BindEnvAndSetDefault("external_metrics_provider.max_age", 60)
-	BindEnvAndSetDefault("external_metrics_provider.bucket_size", 60*5) // Window of the metric from Datadog
+	BindEnvAndSetDefault("external_metrics_provider.bucket_size", 60*5)       // Window of the metric from Datadog
+	BindEnvAndSetDefault("external_metrics_provider.query_window", 0)         // Window of the queries to Datadog in seconds, 0 uses the bucket size
+	BindEnvAndSetDefault("external_metrics_provider.query_offset", 60)        // Seconds the window of the queries ends before now, to skip the points Datadog is still aggregating
+	BindEnvAndSetDefault("external_metrics_provider.rollup", 0)               // Rollup interval of the queries to Datadog in seconds, 0 lets Datadog pick it
+	BindEnvAndSetDefault("external_metrics_provider.rollup_points", 150)      // Points per serie targeted by the rollup of the long windows without an explicit rollup, 0 lets Datadog pick it
+	BindEnvAndSetDefault("external_metrics_provider.interpolation", "none")   // Fill of the gaps of the series up to the max age: none, last or linear
+	BindEnvAndSetDefault("external_metrics_provider.aggregator", "avg")       // Reduction of the points of a serie: avg, max, min, sum or last
+	BindEnvAndSetDefault("external_metrics_provider.query_cache_ttl", 0)      // TTL of the Datadog query results, 0 uses the refresh period and a negative value disables the cache
+	BindEnvAndSetDefault("external_metrics_provider.negative_cache_ttl", 120) // TTL of the permanent failures of the Datadog queries, before they are checked again, 0 disables the negative cache
+	BindEnvAndSetDefault("external_metrics_provider.query_retries", 2)        // Retries of the transient errors of the Datadog queries
+	BindEnvAndSetDefault("external_metrics_provider.query_backoff", 500)      // Backoff in milliseconds before the first retry, doubled for each retry
+	BindEnvAndSetDefault("external_metrics_provider.query_timeout", 10)       // Timeout in seconds of each attempt of a query to Datadog, 0 disables it
+	BindEnvAndSetDefault("external_metrics_provider.max_retry_after", 10)     // Longest delay in seconds requested by a rate limited response that is waited before retrying
+	// Series matched by the query of a metric above which it is invalid, 0 disables the limit
+	BindEnvAndSetDefault("external_metrics_provider.max_series_per_query", 100)
+	// Average of the series of a key, e.g. of the pods of a query grouped by pod: none, mean or weighted by their points
+	BindEnvAndSetDefault("external_metrics_provider.series_average", "none")
+	// Series with only null points in the window when the series are averaged: skip or zero to count them as 0
+	BindEnvAndSetDefault("external_metrics_provider.null_series", "skip")
+	// Query of a known metric checked periodically against [canary_min, canary_max], empty disables the canary
+	BindEnvAndSetDefault("external_metrics_provider.canary_query", "")
+	BindEnvAndSetDefault("external_metrics_provider.canary_interval", 60)     // Seconds between the checks of the canary
+	BindEnvAndSetDefault("external_metrics_provider.canary_min", "")          // Lowest expected value of the canary, empty if it is not bounded
+	BindEnvAndSetDefault("external_metrics_provider.canary_max", "")          // Highest expected value of the canary, empty if it is not bounded
+	BindEnvAndSetDefault("external_metrics_provider.query_concurrency", 4)    // Metrics queried in parallel when a batch is rejected and they are queried individually
+	BindEnvAndSetDefault("external_metrics_provider.breaker_max_failures", 5) // Consecutive failed queries to suspend the queries to Datadog, 0 disables the circuit breaker
+	BindEnvAndSetDefault("external_metrics_provider.breaker_window", 60*5)    // Window in which the failures are consecutive
+	BindEnvAndSetDefault("external_metrics_provider.breaker_cooldown", 60)    // Duration of the suspension of the queries
+	BindEnvAndSetDefault("external_metrics_provider.gc_grace_period", 0)      // Duration in seconds the metrics of an HPA missing from the list are kept, 0 deletes them on the next gc
+	BindEnvAndSetDefault("external_metrics_provider.per_namespace_qps", 0)    // Rate of the metrics queried per second for the HPAs of a namespace, 0 disables the limit
+	BindEnvAndSetDefault("external_metrics_provider.stale_grace_period", 0)   // Duration in seconds the metrics keep their last value when the queries fail transiently, 0 disables it
+	BindEnvAndSetDefault("external_metrics_provider.endpoint", "")            // Base URL of the Datadog API to query, e.g. https://api.datadoghq.eu, defaults to the API of the site
+	BindEnvAndSetDefault("external_metrics_provider.ca_file", "")             // PEM encoded certificates trusted to query Datadog in addition to the ones of the system
+	BindEnvAndSetDefault("external_metrics_provider.change_threshold", 0.0)   // Change of the value of a metric relative to the stored one, below which the refreshed metric is not stored again
+	BindEnvAndSetDefault("external_metrics_provider.refresh_jitter", 0.1)     // Fraction of the max age of a metric by which its refresh is advanced, spread by metric to stagger the refreshes
+	BindEnvAndSetDefault("external_metrics_provider.warmup_timeout", 30)      // Longest duration in seconds of the warmup of the metrics, the first time the replica is the leader
+	BindEnvAndSetDefault("external_metrics_provider.bootstrap_max_age", 0)    // Age in seconds of the stored metrics above which they are not served while they are refreshed, 0 disables the bootstrap
+	BindEnvAndSetDefault("external_metrics_provider.event_interval", 300)     // Shortest interval in seconds between the identical events of a metric emitted on its HPA
+	// Soft budget of calls to the Datadog query API per minute, the metrics nearest their max age are refreshed first, 0 disables the budget
+	BindEnvAndSetDefault("external_metrics_provider.max_queries_per_minute", 0)
+	// Delimiter of the alternative values of a label, e.g. `env: prod,staging` queried as `(env:prod OR env:staging)`, empty disables the split
+	BindEnvAndSetDefault("external_metrics_provider.label_value_delimiter", "")
+	// Keys of a fallback Datadog organization, queried when Datadog cannot be reached or rejects the keys of the primary one
+	BindEnvAndSetDefault("external_metrics_provider.fallback_api_key", "")
+	BindEnvAndSetDefault("external_metrics_provider.fallback_app_key", "")
+	// Endpoint of the fallback Datadog organization, the endpoint of the primary one if empty
+	BindEnvAndSetDefault("external_metrics_provider.fallback_endpoint", "")
+	// Keys of the namespaces querying their external metrics in a Datadog organization of their own, by namespace: api_key, app_key and endpoint
+	BindEnvAndSetDefault("external_metrics_provider.namespace_keys", map[string]interface{}{})
+	// Scope the queries to the cluster of the cluster_name with the kube_cluster_name tag, unless the HPAs opt their metrics out of it
+	BindEnvAndSetDefault("external_metrics_provider.scope_to_cluster", true)
+	// Capture the last raw points of the series returned by Datadog, served for debugging with the state of the processor
+	BindEnvAndSetDefault("external_metrics_provider.capture_raw", false)
+	BindEnvAndSetDefault("external_metrics_provider.capture_raw_points", 10)
+	// Allow the external metrics with an empty selector, queried over all the sources of the metric, e.g. the whole cluster
+	BindEnvAndSetDefault("external_metrics_provider.allow_unscoped_queries", false)
+	// List the WatermarkPodAutoscalers of the datadoghq.com API group and serve their external metrics along with the ones of the HPAs
+	BindEnvAndSetDefault("external_metrics_provider.wpa_controller", false)
+	// Backend of the store of the external metrics: configmap, or crd for the ExternalMetric custom resources
+	BindEnvAndSetDefault("external_metrics_provider.store_backend", "configmap")
+	// Encoding of the values served into quantities: milli preserves their fractional part, integer rounds them for the controllers mishandling milli-quantities
+	BindEnvAndSetDefault("external_metrics_provider.value_encoding", "milli")
+	// Glob patterns of the names of the metrics the queries are restricted to, e.g. nginx.*, empty to allow all the metrics
+	BindEnvAndSetDefault("external_metrics_provider.allowed_metrics", []string{})
+	// Glob patterns of the names of the metrics never queried, they take precedence over the allowed ones
+	BindEnvAndSetDefault("external_metrics_provider.denied_metrics", []string{})
+	// Number of external metrics deleted per write to the store, e.g. per configmap update, when many HPAs are deleted at once
+	BindEnvAndSetDefault("external_metrics_provider.delete_batch_size", 100)
+
 	BindEnvAndSetDefault("kubernetes_informers_resync_period", 60*5)    // 5 minutes
 	BindEnvAndSetDefault("kubernetes_informers_restclient_timeout", 60) // 1 minute
 
@@ -8,6 +8,7 @@
 package apiserver
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
@@ -17,11 +18,13 @@ import (
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/util/cache"
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/common"
@@ -37,6 +40,10 @@ var (
 	ErrOutdated      = errors.New("entity is outdated")
 	ErrNotLeader     = errors.New("not Leader")
 	isConnectVerbose = false
+
+	// autoscalersController is the Autoscaler controller started, see RefreshExternalMetric.
+	autoscalersControllerMutex sync.RWMutex
+	autoscalersController      *AutoscalersController
 )
 
 const (
@@ -79,6 +86,25 @@ func GetAPIClient() (*APIClient, error) {
 }
 
 func getKubeClient(timeout time.Duration) (kubernetes.Interface, error) {
+	clientConfig, err := getClientConfig(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(clientConfig)
+}
+
+// getWPAClient returns a dynamic client of the API group of the WatermarkPodAutoscalers.
+func getWPAClient(timeout time.Duration) (dynamic.Interface, error) {
+	clientConfig, err := getClientConfig(timeout)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig.GroupVersion = &wpaGroupVersion
+	clientConfig.APIPath = "/apis"
+	return dynamic.NewClient(clientConfig)
+}
+
+func getClientConfig(timeout time.Duration) (*rest.Config, error) {
 	var clientConfig *rest.Config
 	var err error
 	cfgPath := config.Datadog.GetString("kubernetes_kubeconfig_path")
@@ -97,7 +123,7 @@ func getKubeClient(timeout time.Duration) (kubernetes.Interface, error) {
 		}
 	}
 	clientConfig.Timeout = timeout
-	return kubernetes.NewForConfig(clientConfig)
+	return clientConfig, nil
 }
 
 func (c *APIClient) connect() error {
@@ -444,8 +470,45 @@ func StartAutoscalersController(le LeaderElectorInterface, dogCl hpa.DatadogClie
 	if err != nil {
 		return err
 	}
+	autoscalerController.setScaleTargetInformers(
+		informerFactory.Apps().V1().Deployments(),
+		informerFactory.Apps().V1().StatefulSets(),
+		informerFactory.Apps().V1().ReplicaSets(),
+	)
+	if config.Datadog.GetBool("external_metrics_provider.wpa_controller") {
+		wpaClient, err := getWPAClient(timeoutSeconds * time.Second)
+		if err != nil {
+			log.Infof("Could not get the client of the WatermarkPodAutoscalers: %v", err)
+			return err
+		}
+		autoscalerController.setWPAClient(wpaClient)
+	}
 
 	informerFactory.Start(stopCh)
 	go autoscalerController.Run(stopCh)
+	autoscalersControllerMutex.Lock()
+	autoscalersController = autoscalerController
+	autoscalersControllerMutex.Unlock()
 	return nil
 }
+
+// AutoscalersProcessor returns the Processor of the Autoscaler controller started, nil if it is not running.
+func AutoscalersProcessor() *hpa.Processor {
+	autoscalersControllerMutex.RLock()
+	defer autoscalersControllerMutex.RUnlock()
+	if autoscalersController == nil {
+		return nil
+	}
+	return autoscalersController.hpaProc
+}
+
+// RefreshExternalMetric force-refreshes a metric of the store with the Autoscaler controller.
+func RefreshExternalMetric(ctx context.Context, key string) (custommetrics.ExternalMetricValue, error) {
+	autoscalersControllerMutex.RLock()
+	h := autoscalersController
+	autoscalersControllerMutex.RUnlock()
+	if h == nil {
+		return custommetrics.ExternalMetricValue{}, errors.New("the Autoscaler controller is not running, the external metrics provider is disabled")
+	}
+	return h.refreshExternalMetric(ctx, key)
+}
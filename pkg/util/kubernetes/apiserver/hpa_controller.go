@@ -8,18 +8,27 @@
 package apiserver
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
 
 	autoscalingv2 "k8s.io/api/autoscaling/v2beta1"
+	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	appsinformer "k8s.io/client-go/informers/apps/v1"
 	autoscalersinformer "k8s.io/client-go/informers/autoscaling/v2beta1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	autoscalerslister "k8s.io/client-go/listers/autoscaling/v2beta1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
@@ -30,6 +39,13 @@ import (
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
+var (
+	// wpaGroupVersion is the API group and version of the WatermarkPodAutoscalers.
+	wpaGroupVersion = schema.GroupVersion{Group: "datadoghq.com", Version: "v1alpha1"}
+	// wpaResource is the resource of the WatermarkPodAutoscalers, listed as unstructured objects.
+	wpaResource = metav1.APIResource{Name: "watermarkpodautoscalers", Namespaced: true, Kind: "WatermarkPodAutoscaler"}
+)
+
 type PollerConfig struct {
 	gcPeriodSeconds int
 	refreshPeriod   int
@@ -38,9 +54,29 @@ type PollerConfig struct {
 
 type metricsBatch struct {
 	data []custommetrics.ExternalMetricValue
+	// hpas are the UIDs of the HPAs synced in the batch, data only holds the metrics of their last sync.
+	hpas map[string]struct{}
 	m    sync.Mutex
 }
 
+// add replaces the metrics of an HPA in the batch with the ones of its last sync.
+func (b *metricsBatch) add(uid string, metrics []custommetrics.ExternalMetricValue) {
+	if b.hpas == nil {
+		b.hpas = make(map[string]struct{})
+	}
+	if _, ok := b.hpas[uid]; ok {
+		data := b.data[:0]
+		for _, em := range b.data {
+			if em.HPA.UID != uid {
+				data = append(data, em)
+			}
+		}
+		b.data = data
+	}
+	b.hpas[uid] = struct{}{}
+	b.data = append(b.data, metrics...)
+}
+
 // AutoscalersController is responsible for synchronizing horizontal pod autoscalers from the Kubernetes
 // apiserver to determine the metrics that need to be provided by the custom metrics server.
 // This controller also queries Datadog for the values of detected external metrics.
@@ -51,6 +87,10 @@ type metricsBatch struct {
 type AutoscalersController struct {
 	autoscalersLister       autoscalerslister.HorizontalPodAutoscalerLister
 	autoscalersListerSynced cache.InformerSynced
+	// The scale targets of the HPAs resolve the selectors of their pods, see setScaleTargetInformers.
+	scaleTargetsSynced []cache.InformerSynced
+	// wpaClient lists the WatermarkPodAutoscalers, nil unless their metrics are served, see setWPAClient.
+	wpaClient dynamic.ResourceInterface
 	// Autoscalers that need to be added to the cache.
 	queue workqueue.RateLimitingInterface
 
@@ -63,13 +103,19 @@ type AutoscalersController struct {
 	clientSet kubernetes.Interface
 	poller    PollerConfig
 	le        LeaderElectorInterface
+
+	// The metrics of the HPAs missing from the list are only deleted by the gc after a grace period.
+	gcGracePeriod time.Duration
+	missingSince  map[string]time.Time
 }
 
 // NewAutoscalersController returns a new AutoscalersController
 func NewAutoscalersController(client kubernetes.Interface, le LeaderElectorInterface, dogCl hpa.DatadogClient, autoscalingInformer autoscalersinformer.HorizontalPodAutoscalerInformer) (*AutoscalersController, error) {
 	var err error
 	h := &AutoscalersController{
-		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "autoscalers"),
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "autoscalers"),
+		gcGracePeriod: time.Duration(config.Datadog.GetInt("external_metrics_provider.gc_grace_period")) * time.Second,
+		missingSince:  make(map[string]time.Time),
 	}
 
 	gcPeriodSeconds := config.Datadog.GetInt("hpa_watcher_gc_period")
@@ -93,15 +139,24 @@ func NewAutoscalersController(client kubernetes.Interface, le LeaderElectorInter
 		log.Errorf("Could not instantiate the HPA Processor: %v", err.Error())
 		return nil, err
 	}
+	h.hpaProc.Publish()
 	h.clientSet = client
 	h.le = le // only trigger GC and updateExternalMetrics by the Leader.
 
+	// The transitions of the metrics between valid and invalid are reported as events of their HPA.
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "datadog-cluster-agent"})
+	eventInterval := time.Duration(config.Datadog.GetInt("external_metrics_provider.event_interval")) * time.Second
+	h.hpaProc.SetEventRecorder(recorder, eventInterval)
+
 	datadogHPAConfigMap := custommetrics.GetConfigmapName()
-	h.store, err = custommetrics.NewConfigMapStore(client, common.GetResourcesNamespace(), datadogHPAConfigMap)
+	h.store, err = custommetrics.NewStore(client, common.GetResourcesNamespace(), datadogHPAConfigMap)
 	if err != nil {
 		log.Errorf("Could not instantiate the local store for the External Metrics %v", err)
 		return nil, err
 	}
+	h.hpaProc.SetStore(h.store)
 
 	autoscalingInformer.Informer().AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
@@ -115,17 +170,67 @@ func NewAutoscalersController(client kubernetes.Interface, le LeaderElectorInter
 	return h, nil
 }
 
+// setScaleTargetInformers sets the informers of the scale targets of the HPAs.
+func (h *AutoscalersController) setScaleTargetInformers(deployments appsinformer.DeploymentInformer, statefulSets appsinformer.StatefulSetInformer, replicaSets appsinformer.ReplicaSetInformer) {
+	h.hpaProc.SetScaleTargetListers(deployments.Lister(), statefulSets.Lister(), replicaSets.Lister())
+	h.scaleTargetsSynced = []cache.InformerSynced{
+		deployments.Informer().HasSynced,
+		statefulSets.Informer().HasSynced,
+		replicaSets.Informer().HasSynced,
+	}
+}
+
+// setWPAClient sets the client listing the WatermarkPodAutoscalers, whose metrics are then synced at each gc.
+func (h *AutoscalersController) setWPAClient(client dynamic.Interface) {
+	h.wpaClient = client.Resource(&wpaResource, metav1.NamespaceAll)
+}
+
+// listWPAs returns the WatermarkPodAutoscalers, none if they are not listed.
+func (h *AutoscalersController) listWPAs() ([]*unstructured.Unstructured, error) {
+	if h.wpaClient == nil {
+		return nil, nil
+	}
+	obj, err := h.wpaClient.List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.(*unstructured.UnstructuredList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected list of WatermarkPodAutoscalers %T", obj)
+	}
+	wpas := make([]*unstructured.Unstructured, 0, len(list.Items))
+	for i := range list.Items {
+		wpas = append(wpas, &list.Items[i])
+	}
+	return wpas, nil
+}
+
+// syncWPAs adds the metrics of the WatermarkPodAutoscalers to the batch, like the HPAs synced by the worker.
+func (h *AutoscalersController) syncWPAs(wpas []*unstructured.Unstructured) {
+	for _, wpa := range wpas {
+		new := h.hpaProc.ProcessWPAs(wpa)
+		h.toStore.m.Lock()
+		h.toStore.add(string(wpa.GetUID()), new)
+		h.toStore.m.Unlock()
+	}
+}
+
 func (h *AutoscalersController) Run(stopCh <-chan struct{}) {
 	defer h.queue.ShutDown()
 
 	log.Infof("Starting HPA Controller ... ")
 	defer log.Infof("Stopping HPA Controller")
 
-	if !cache.WaitForCacheSync(stopCh, h.autoscalersListerSynced) {
+	if !cache.WaitForCacheSync(stopCh, append([]cache.InformerSynced{h.autoscalersListerSynced}, h.scaleTargetsSynced...)...) {
 		return
 	}
+	defer h.hpaProc.Stop()
+
+	// Cancel the in-flight queries to Datadog when the controller stops.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	h.processingLoop()
+	h.processingLoop(ctx)
 
 	go wait.Until(h.worker, time.Second, stopCh)
 	<-stopCh
@@ -133,21 +238,52 @@ func (h *AutoscalersController) Run(stopCh <-chan struct{}) {
 
 // processingLoop is a go routine that schedules the garbage collection and the refreshing of external metrics
 // in the GlobalStore.
-func (c *AutoscalersController) processingLoop() {
+func (c *AutoscalersController) processingLoop(ctx context.Context) {
 	tickerHPARefreshProcess := time.NewTicker(time.Duration(c.poller.refreshPeriod) * time.Second)
 	gcPeriodSeconds := time.NewTicker(time.Duration(c.poller.gcPeriodSeconds) * time.Second)
 	batchFreq := time.NewTicker(time.Duration(c.poller.batchWindow) * time.Second)
+	// The metrics stored by the previous leader are bootstrapped by the new one before its first refresh, and the
+	// moving averages of the values of the metrics are only kept within a leader term.
+	leader := false
+	// The first time the replica is the leader, the store is migrated and its metrics are warmed up in place of
+	// the first refresh.
+	elected := false
 
 	go func() {
 		for {
 			select {
+			case <-ctx.Done():
+				tickerHPARefreshProcess.Stop()
+				gcPeriodSeconds.Stop()
+				batchFreq.Stop()
+				return
 			case <-tickerHPARefreshProcess.C:
 				if !c.le.IsLeader() {
+					if leader {
+						c.hpaProc.ResetSmoothing()
+					}
+					leader = false
+					continue
+				}
+				if !leader {
+					if !elected {
+						c.migrate()
+					}
+					c.hpaProc.ResetSmoothing()
+					if c.hpaProc.Bootstraps() {
+						log.Infof("Elected leader, bootstrapping the external metrics of the store before refreshing them")
+						c.bootstrap()
+					}
+				}
+				leader = true
+				if !elected {
+					elected = true
+					c.warmup(ctx)
 					continue
 				}
 				// Updating the metrics against Datadog should not affect the HPA pipeline.
 				// If metrics are temporarily unavailable for too long, they will become `Valid=false` and won't be evaluated.
-				c.updateExternalMetrics()
+				c.updateExternalMetrics(ctx)
 			case <-gcPeriodSeconds.C:
 				if !c.le.IsLeader() {
 					continue
@@ -167,18 +303,39 @@ func (h *AutoscalersController) pushToGlobalStore() error {
 	// reset the batch before submitting to avoid a discrepancy between the global store and the local one
 	h.toStore.m.Lock()
 	localStore := h.toStore.data
+	uids := h.toStore.hpas
 	h.toStore.data = nil
+	h.toStore.hpas = nil
 	h.toStore.m.Unlock()
 
 	if !h.le.IsLeader() {
 		return nil
 	}
+	if len(uids) == 0 {
+		return nil
+	}
 	log.Tracef("Batch call pushing %d metrics", len(localStore))
-	err := h.store.SetExternalMetricValues(localStore)
-	return err
+	emList, err := h.store.ListAllExternalMetricValues()
+	if err != nil {
+		log.Debugf("Could not list the external metrics to reconcile the batch, storing it as is: %v", err)
+		return h.store.SetExternalMetricValues(localStore)
+	}
+	// Only the stored metrics of the HPAs synced in the batch are reconciled with it.
+	var current []custommetrics.ExternalMetricValue
+	for _, em := range emList {
+		if _, ok := uids[em.HPA.UID]; ok {
+			current = append(current, em)
+		}
+	}
+	toUpsert, toDelete := hpa.ReconcileExternalMetrics(current, localStore)
+	log.Debugf("Reconciled the batch of external metrics with the store: metrics=%d upserted=%d deleted=%d", len(localStore), len(toUpsert), len(toDelete))
+	if err := h.store.DeleteExternalMetricValues(toDelete); err != nil {
+		return err
+	}
+	return h.store.SetExternalMetricValues(toUpsert)
 }
 
-func (h *AutoscalersController) updateExternalMetrics() {
+func (h *AutoscalersController) updateExternalMetrics(ctx context.Context) {
 	emList, err := h.store.ListAllExternalMetricValues()
 	if err != nil {
 		log.Infof("Error while retrieving external metrics from the store: %s", err)
@@ -190,12 +347,78 @@ func (h *AutoscalersController) updateExternalMetrics() {
 		return
 	}
 
-	updated := h.hpaProc.UpdateExternalMetrics(emList)
+	// A refresh should not overlap with the next one.
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(h.poller.refreshPeriod)*time.Second)
+	defer cancel()
+
+	// The settings of the queries can be tuned without a restart.
+	h.hpaProc.ReloadConfig()
+	updated, unchanged, err := h.hpaProc.RefreshChangedWithContext(ctx, emList)
+	if err != nil {
+		log.Infof("Partial refresh of the external metrics, %d metrics updated: %v", len(updated), err)
+	}
+	log.Debugf("Refreshed the external metrics: changed=%d unchanged=%d", len(updated), unchanged)
 	if err = h.store.SetExternalMetricValues(updated); err != nil {
 		log.Errorf("Could not update the external metrics in the store: %s", err.Error())
 	}
 }
 
+// migrate moves the metrics left over by another number of shards of the store, see custommetrics.ShardMigrator.
+func (h *AutoscalersController) migrate() {
+	migrator, ok := h.store.(custommetrics.ShardMigrator)
+	if !ok {
+		return
+	}
+	if err := migrator.MigrateShards(); err != nil {
+		log.Warnf("Could not migrate the configmaps left over by another number of shards, their metrics are refreshed as the HPAs are processed again: %v", err)
+	}
+}
+
+// warmup refreshes the metrics of the store before they are served.
+func (h *AutoscalersController) warmup(ctx context.Context) {
+	emList, err := h.store.ListAllExternalMetricValues()
+	if err != nil {
+		log.Infof("Could not list the external metrics to warm up: %v", err)
+		return
+	}
+
+	warmed, err := h.hpaProc.Warmup(ctx, emList)
+	if err != nil {
+		log.Infof("Partial warmup of the external metrics, %d of %d metrics warmed up: %v", len(warmed), len(emList), err)
+	}
+	if !h.le.IsLeader() {
+		return
+	}
+	if err = h.store.SetExternalMetricValues(warmed); err != nil {
+		log.Errorf("Could not store the warmed up external metrics: %v", err)
+	}
+}
+
+// bootstrap bounds the staleness of the metrics of the store, see Processor.Bootstrap.
+func (h *AutoscalersController) bootstrap() {
+	emList, err := h.store.ListAllExternalMetricValues()
+	if err != nil {
+		log.Infof("Could not list the external metrics to bootstrap: %v", err)
+		return
+	}
+
+	bootstrapped := h.hpaProc.Bootstrap(emList)
+	if !h.le.IsLeader() || len(bootstrapped) == 0 {
+		return
+	}
+	if err = h.store.SetExternalMetricValues(bootstrapped); err != nil {
+		log.Errorf("Could not store the bootstrapped external metrics: %v", err)
+	}
+}
+
+// refreshExternalMetric force-refreshes a metric of the store, only on the leader.
+func (h *AutoscalersController) refreshExternalMetric(ctx context.Context, key string) (custommetrics.ExternalMetricValue, error) {
+	if !h.le.IsLeader() {
+		return custommetrics.ExternalMetricValue{}, ErrNotLeader
+	}
+	return h.hpaProc.RefreshMetric(ctx, key)
+}
+
 // gc checks if any hpas have been deleted (possibly while the Datadog Cluster Agent was
 // not running) to clean the store.
 func (h *AutoscalersController) gc() {
@@ -206,6 +429,17 @@ func (h *AutoscalersController) gc() {
 		log.Errorf("Could not list hpas: %v", err)
 		return
 	}
+	// The WPAs are not watched, they are synced as they are listed.
+	wpas, err := h.listWPAs()
+	if err != nil {
+		log.Errorf("Could not list the WatermarkPodAutoscalers: %v", err)
+		return
+	}
+	h.syncWPAs(wpas)
+	wpaList := make([]metav1.ObjectMeta, 0, len(wpas))
+	for _, wpa := range wpas {
+		wpaList = append(wpaList, hpa.WPAObjectMeta(wpa))
+	}
 
 	emList, err := h.store.ListAllExternalMetricValues()
 	if err != nil {
@@ -213,11 +447,18 @@ func (h *AutoscalersController) gc() {
 		return
 	}
 
-	deleted := hpa.ComputeDeleteExternalMetrics(list, emList)
-	if h.store.DeleteExternalMetricValues(deleted); err != nil {
-		log.Errorf("Could not delete the external metrics in the store: %v")
+	gcDeletions := hpa.ComputeGCExternalMetrics(list, wpaList, emList, h.gcGracePeriod, h.missingSince, time.Now())
+	deleted := make([]custommetrics.ExternalMetricValue, 0, len(gcDeletions))
+	for _, d := range gcDeletions {
+		deleted = append(deleted, d.Metric)
+	}
+	if err = h.store.DeleteExternalMetricValues(deleted); err != nil {
+		log.Errorf("Could not delete the external metrics in the store: %v", err)
 		return
 	}
+	if len(gcDeletions) > 0 {
+		log.Infof("GC: %s", hpa.SummarizeGC(gcDeletions))
+	}
 	log.Debugf("Done GC run. Deleted %d metrics", len(deleted))
 }
 
@@ -267,7 +508,7 @@ func (h *AutoscalersController) syncAutoscalers(key interface{}) error {
 		}
 		new := h.hpaProc.ProcessHPAs(hpa)
 		h.toStore.m.Lock()
-		h.toStore.data = append(h.toStore.data, new...)
+		h.toStore.add(string(hpa.UID), new)
 		log.Tracef("Local batch cache of HPA is %v", h.toStore.data)
 		h.toStore.m.Unlock()
 	}
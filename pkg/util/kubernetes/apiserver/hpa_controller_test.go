@@ -8,6 +8,7 @@
 package apiserver
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -18,9 +19,14 @@ import (
 	"gopkg.in/zorkian/go-datadog-api.v2"
 	"k8s.io/api/autoscaling/v2beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
 
+	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/errors"
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/hpa"
 	"k8s.io/apimachinery/pkg/types"
@@ -86,7 +92,7 @@ type fakeDatadogClient struct {
 	queryMetricsFunc func(from, to int64, query string) ([]datadog.Series, error)
 }
 
-func (d *fakeDatadogClient) QueryMetrics(from, to int64, query string) ([]datadog.Series, error) {
+func (d *fakeDatadogClient) QueryMetrics(_ context.Context, from, to int64, query string) ([]datadog.Series, error) {
 	if d.queryMetricsFunc != nil {
 		return d.queryMetricsFunc(from, to, query)
 	}
@@ -98,9 +104,20 @@ func TestAutoscalerController(t *testing.T) {
 	name := custommetrics.GetConfigmapName()
 	store, client := newFakeConfigMapStore(t, "default", name, nil)
 	metricName := "foo"
+	scopeOne := "foo:bar"
+	scopeTwo := "dcos_version:2.1.9"
 	ddSeries := []datadog.Series{
 		{
 			Metric: &metricName,
+			Scope:  &scopeOne,
+			Points: []datadog.DataPoint{
+				{1531492452, 12},
+				{1531492486, 14},
+			},
+		},
+		{
+			Metric: &metricName,
+			Scope:  &scopeTwo,
 			Points: []datadog.DataPoint{
 				{1531492452, 12},
 				{1531492486, 14},
@@ -167,7 +184,7 @@ func TestAutoscalerController(t *testing.T) {
 		storedExternal, err := store.ListAllExternalMetricValues()
 		require.NoError(t, err)
 		require.NotZero(t, len(storedExternal))
-		require.Equal(t, storedExternal[0].Value, int64(14))
+		require.Equal(t, storedExternal[0].Value, int64(13))
 		require.Equal(t, storedExternal[0].Labels, map[string]string{"foo": "bar"})
 	case <-timeout.C:
 		require.FailNow(t, "Timeout waiting for HPAs to update")
@@ -216,8 +233,9 @@ func TestAutoscalerController(t *testing.T) {
 	case <-ticker.C:
 		storedExternal, err := store.ListAllExternalMetricValues()
 		require.NoError(t, err)
-		require.NotZero(t, len(storedExternal))
-		require.Equal(t, storedExternal[0].Value, int64(14))
+		// The metric whose selector changed replaced the previous one.
+		require.Len(t, storedExternal, 1)
+		require.Equal(t, storedExternal[0].Value, int64(13))
 		require.Equal(t, storedExternal[0].Labels, map[string]string{"dcos_version": "2.1.9"})
 	case <-timeout.C:
 		require.FailNow(t, "Timeout waiting for HPAs to update")
@@ -341,3 +359,161 @@ func TestAutoscalerControllerGC(t *testing.T) {
 		})
 	}
 }
+
+func TestAutoscalerControllerGCWPAs(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "bar:baz"
+	d := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(time.Now().Unix() * 1000), 14}},
+				},
+			}, nil
+		},
+	}
+	metrics := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"bar": "baz"}, HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1111"}},
+		{MetricName: metricName, Labels: map[string]string{"bar": "baz"}, HPA: custommetrics.ObjectReference{Name: "bar", Namespace: "default", UID: "2222"}},
+	}
+	store, client := newFakeConfigMapStore(t, "default", "test-wpa", metrics)
+	hctrl, _ := newFakeAutoscalerController(client, alwaysLeader, d)
+	hctrl.store = store
+
+	wpaClient := &dynamicfake.FakeClient{GroupVersion: wpaGroupVersion, Fake: &clienttesting.Fake{}}
+	wpaClient.AddReactor("list", wpaResource.Name, func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, &unstructured.UnstructuredList{
+			Items: []unstructured.Unstructured{
+				{
+					Object: map[string]interface{}{
+						"apiVersion": "datadoghq.com/v1alpha1",
+						"kind":       "WatermarkPodAutoscaler",
+						"metadata":   map[string]interface{}{"name": "foo", "namespace": "default", "uid": "1111"},
+						"spec": map[string]interface{}{
+							"metrics": []interface{}{
+								map[string]interface{}{
+									"type": "External",
+									"external": map[string]interface{}{
+										"metricName":     metricName,
+										"metricSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"bar": "baz"}},
+										"highWatermark":  "20",
+										"lowWatermark":   "10",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}, nil
+	})
+	hctrl.setWPAClient(wpaClient)
+
+	// The metrics of the WPAs listed are kept and synced, the ones of the autoscalers missing are deleted.
+	hctrl.gc()
+	allMetrics, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics[:1], allMetrics)
+
+	err = hctrl.pushToGlobalStore()
+	require.NoError(t, err)
+	allMetrics, err = store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	require.Len(t, allMetrics, 1)
+	assert.Equal(t, "1111", allMetrics[0].HPA.UID)
+	assert.True(t, allMetrics[0].Valid)
+	assert.Equal(t, 14.0, allMetrics[0].ValueFloat)
+}
+
+func TestAutoscalerControllerWarmup(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "bar:baz"
+	metric := custommetrics.ExternalMetricValue{
+		MetricName: metricName,
+		Labels:     map[string]string{"bar": "baz"},
+		HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1111"},
+		Timestamp:  12,
+		ValueFloat: 1,
+		Valid:      false,
+	}
+	d := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(time.Now().Unix() * 1000), 14}},
+				},
+			}, nil
+		},
+	}
+
+	for i, isLeader := range []bool{false, true} {
+		t.Run(fmt.Sprintf("#%d leader=%t", i, isLeader), func(t *testing.T) {
+			store, client := newFakeConfigMapStore(t, "default", fmt.Sprintf("test-warmup-%d", i), []custommetrics.ExternalMetricValue{metric})
+			hctrl, _ := newFakeAutoscalerController(client, &fakeLeaderElector{isLeader}, d)
+			hctrl.store = store
+
+			hctrl.warmup(context.Background())
+			allMetrics, err := store.ListAllExternalMetricValues()
+			require.NoError(t, err)
+			require.Len(t, allMetrics, 1)
+			// Only the leader stores the warmed up metrics.
+			assert.Equal(t, isLeader, allMetrics[0].Valid)
+			if isLeader {
+				assert.Equal(t, 14.0, allMetrics[0].ValueFloat)
+			}
+		})
+	}
+}
+
+func TestAutoscalerControllerBootstrap(t *testing.T) {
+	now := time.Now()
+	metric := func(name string, age time.Duration) custommetrics.ExternalMetricValue {
+		return custommetrics.ExternalMetricValue{
+			MetricName: name,
+			Labels:     map[string]string{"bar": "baz"},
+			HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1111"},
+			Timestamp:  now.Add(-age).Unix(),
+			ValueFloat: 1,
+			Valid:      true,
+		}
+	}
+	d := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			t.Fatalf("the bootstrap queried Datadog: %s", query)
+			return nil, nil
+		},
+	}
+
+	for i, isLeader := range []bool{false, true} {
+		t.Run(fmt.Sprintf("#%d leader=%t", i, isLeader), func(t *testing.T) {
+			metrics := []custommetrics.ExternalMetricValue{metric("recent", time.Minute), metric("old", time.Hour)}
+			store, client := newFakeConfigMapStore(t, "default", fmt.Sprintf("test-bootstrap-%d", i), metrics)
+			hctrl, _ := newFakeAutoscalerController(client, &fakeLeaderElector{isLeader}, d)
+			hctrl.store = store
+			hctrl.hpaProc = newBootstrapProcessor(t, 10*time.Minute)
+
+			hctrl.bootstrap()
+			allMetrics, err := store.ListAllExternalMetricValues()
+			require.NoError(t, err)
+			require.Len(t, allMetrics, 2)
+			// Only the leader stores the bootstrapped metrics, the old one is no longer served.
+			for _, em := range allMetrics {
+				assert.Equal(t, !isLeader || em.MetricName == "recent", em.Valid, em.MetricName)
+			}
+		})
+	}
+}
+
+// newBootstrapProcessor returns a Processor bootstrapping the metrics stored less than maxAge ago.
+func newBootstrapProcessor(t *testing.T, maxAge time.Duration) *hpa.Processor {
+	defer config.Datadog.Set("external_metrics_provider.bootstrap_max_age", config.Datadog.Get("external_metrics_provider.bootstrap_max_age"))
+	config.Datadog.Set("external_metrics_provider.bootstrap_max_age", int(maxAge.Seconds()))
+	p, err := hpa.NewProcessor(&fakeDatadogClient{})
+	require.NoError(t, err)
+	require.True(t, p.Bootstraps())
+	return p
+}
@@ -0,0 +1,61 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// errBootstrapExpired invalidates the stored metrics refreshed longer than the bootstrap max age ago.
+var errBootstrapExpired = errors.New("the stored value of the metric is older than the bootstrap max age")
+
+// Bootstraps returns whether the metrics persisted in the store are served while they are refreshed.
+func (p *Processor) Bootstraps() bool {
+	return p.bootstrapMaxAge > 0
+}
+
+// Bootstrap returns the stored metrics whose validity changed with the bootstrap max age.
+func (p *Processor) Bootstrap(emList []custommetrics.ExternalMetricValue) []custommetrics.ExternalMetricValue {
+	if !p.Bootstraps() {
+		return nil
+	}
+	now := p.now().Unix()
+	var bootstrapped []custommetrics.ExternalMetricValue
+	var served, stale, expired int
+	for _, em := range emList {
+		if !em.Valid {
+			continue
+		}
+		age := now - p.lastRefresh(em)
+		if age > int64(p.bootstrapMaxAge.Seconds()) {
+			expired++
+			previous := em
+			em.Valid = false
+			em.Stale = false
+			em.LastError = errBootstrapExpired.Error()
+			log.Warnf("The stored value of the external metric is too old to be served until it is refreshed, the metric is invalid: %s result=invalid age=%d", metricFields(em), age)
+			p.recordTransition(previous, em, errBootstrapExpired)
+			bootstrapped = append(bootstrapped, em)
+			continue
+		}
+		served++
+		if age <= p.maxAge(em) {
+			continue
+		}
+		stale++
+		if !em.Stale {
+			em.Stale = true
+			bootstrapped = append(bootstrapped, em)
+		}
+	}
+	log.Infof("Bootstrapped the external metrics from the store: metrics=%d served=%d stale=%d expired=%d", len(emList), served, stale, expired)
+	return bootstrapped
+}
@@ -0,0 +1,81 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// budgetWindow is the window over which the calls to the Datadog query API are counted against the budget.
+const budgetWindow = time.Minute
+
+// errBudgetExceeded is returned instead of querying Datadog while the budget of queries per minute is spent.
+var errBudgetExceeded = errors.New("the budget of queries to Datadog per minute is spent, the queries are deferred")
+
+// queryBudget counts the calls to the Datadog query API over the last minute, against a soft budget per minute.
+type queryBudget struct {
+	max int
+
+	m     sync.Mutex
+	calls []time.Time
+	now   func() time.Time
+}
+
+func newQueryBudget(max int) *queryBudget {
+	if max < 0 {
+		max = 0
+	}
+	return &queryBudget{
+		max: max,
+		now: time.Now,
+	}
+}
+
+// allow returns errBudgetExceeded if the budget of calls over the last minute is spent.
+func (b *queryBudget) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	spent := b.prune()
+	if b.max > 0 && spent >= b.max {
+		return errBudgetExceeded
+	}
+	return nil
+}
+
+// record counts a call to the Datadog query API.
+func (b *queryBudget) record() {
+	if b == nil {
+		return
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.calls = append(b.calls, b.now())
+	b.prune()
+}
+
+// limited returns whether the calls are limited by a budget.
+func (b *queryBudget) limited() bool {
+	return b != nil && b.max > 0
+}
+
+// prune forgets the calls older than the window and returns the number of calls left, reported as the spend.
+func (b *queryBudget) prune() int {
+	since := b.now().Add(-budgetWindow)
+	i := 0
+	for i < len(b.calls) && !b.calls[i].After(since) {
+		i++
+	}
+	b.calls = b.calls[i:]
+	querySpendTelemetry.Set(float64(len(b.calls)))
+	return len(b.calls)
+}
@@ -0,0 +1,143 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+var datadogCanary = &expvar.String{}
+
+func init() {
+	datadogStats.Set("Canary", datadogCanary)
+}
+
+// canary is a query of a known metric checked periodically against its expected range.
+type canary struct {
+	query    string
+	interval time.Duration
+	min      *float64
+	max      *float64
+}
+
+// loadCanary reads the canary from the configuration, nil if it is disabled.
+func loadCanary() *canary {
+	query := strings.TrimSpace(config.Datadog.GetString("external_metrics_provider.canary_query"))
+	interval := time.Duration(config.Datadog.GetInt("external_metrics_provider.canary_interval")) * time.Second
+	if query == "" || interval <= 0 {
+		return nil
+	}
+	c := &canary{
+		query:    query,
+		interval: interval,
+		min:      parseCanaryBound("external_metrics_provider.canary_min"),
+		max:      parseCanaryBound("external_metrics_provider.canary_max"),
+	}
+	if c.min != nil && c.max != nil && *c.min > *c.max {
+		log.Warnf("The canary_min of the external metrics is greater than their canary_max, the value of the canary is not bounded")
+		c.min, c.max = nil, nil
+	}
+	return c
+}
+
+// parseCanaryBound returns the bound of the value of the canary set by a setting, nil if it is unset or invalid.
+func parseCanaryBound(setting string) *float64 {
+	value := strings.TrimSpace(config.Datadog.GetString(setting))
+	if value == "" {
+		return nil
+	}
+	bound, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Warnf("Invalid %s %q for the canary of the external metrics, it is ignored: %v", setting, value, err)
+		return nil
+	}
+	return &bound
+}
+
+// RunCanary checks the canary every canary interval until stopCh is closed or the Processor is stopped.
+func (p *Processor) RunCanary(stopCh <-chan struct{}) {
+	if p.canary == nil {
+		return
+	}
+	log.Infof("Checking the canary of the external metrics: query=%q interval=%s", p.canary.query, p.canary.interval)
+	ticker := time.NewTicker(p.canary.interval)
+	defer ticker.Stop()
+	ctx := p.getContext()
+	for {
+		p.CheckCanary(ctx)
+		select {
+		case <-stopCh:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckCanary queries the canary and returns an error if it fails or if its value is out of range.
+func (p *Processor) CheckCanary(ctx context.Context) error {
+	if p.canary == nil {
+		return nil
+	}
+	value, err := p.checkCanary(ctx)
+	if err != nil {
+		log.Warnf("The canary of the external metrics failed, the queries to Datadog may be broken: query=%q error=%q", p.canary.query, err)
+		canaryHealthyTelemetry.Set(0)
+		datadogCanary.Set(err.Error())
+		return err
+	}
+	log.Debugf("The canary of the external metrics is healthy: query=%q value=%v", p.canary.query, value)
+	canaryHealthyTelemetry.Set(1)
+	datadogCanary.Set(healthCheckOK)
+	return nil
+}
+
+// checkCanary returns the value of the canary over the query window of the Processor.
+func (p *Processor) checkCanary(ctx context.Context) (float64, error) {
+	s := p.settings()
+	if s.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.queryTimeout)
+		defer cancel()
+	}
+	to := p.now().Unix() - int64(s.queryOffset.Seconds())
+	series, err := p.datadogClient.QueryMetrics(ctx, to-int64(s.queryWindow.Seconds()), to, p.canary.query)
+	if err != nil {
+		return 0, newQueryError(p.canary.query, err)
+	}
+	if len(series) != 1 {
+		return 0, fmt.Errorf("the canary matched %d series, it should match one", len(series))
+	}
+	value, _, ok := reducePoints(s.aggregator, series[0].Points)
+	if !ok {
+		return 0, &QueryError{Query: p.canary.query, Kind: ErrNoDataPoints}
+	}
+	canaryValueTelemetry.Set(value)
+	c := p.canary
+	if (c.min != nil && value < *c.min) || (c.max != nil && value > *c.max) {
+		return value, fmt.Errorf("the value %v of the canary is out of its expected range [%s, %s]", value, formatCanaryBound(c.min, "-inf"), formatCanaryBound(c.max, "+inf"))
+	}
+	return value, nil
+}
+
+// formatCanaryBound returns a bound of the range of the canary, unbounded if it is nil.
+func formatCanaryBound(bound *float64, unbounded string) string {
+	if bound == nil {
+		return unbounded
+	}
+	return strconv.FormatFloat(*bound, 'g', -1, 64)
+}
@@ -0,0 +1,75 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"time"
+
+	"gopkg.in/zorkian/go-datadog-api.v2"
+)
+
+// maxRawCaptures is the largest number of queries whose raw points are captured, the oldest capture is evicted first.
+const maxRawCaptures = 500
+
+// RawCapture is the last raw points of a serie returned by Datadog, and how they were reduced.
+type RawCapture struct {
+	Scope string `json:"scope"`
+	// Aggregation is the aggregator reducing the points, or the transform computing the value from them.
+	Aggregation string              `json:"aggregation"`
+	Points      []datadog.DataPoint `json:"points"`
+	// Timestamp is the time of the capture.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// newRawCapture captures the last points of a serie, up to the given number.
+func newRawCapture(serie datadog.Series, opts queryOptions, points int, now time.Time) *RawCapture {
+	aggregation := opts.aggregator
+	if opts.transform != "" {
+		aggregation = opts.transform
+	}
+	start := 0
+	if len(serie.Points) > points {
+		start = len(serie.Points) - points
+	}
+	c := &RawCapture{
+		Aggregation: aggregation,
+		// The points are copied so that the capture does not retain the whole serie.
+		Points:    append([]datadog.DataPoint(nil), serie.Points[start:]...),
+		Timestamp: now.Unix(),
+	}
+	if serie.Scope != nil {
+		c.Scope = *serie.Scope
+	}
+	return c
+}
+
+// recordCapture records the last capture of the points of a query, see RawCapture.
+func (p *Processor) recordCapture(key string, c *RawCapture) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	if p.state.captures == nil {
+		p.state.captures = make(map[string]*RawCapture)
+	}
+	if _, ok := p.state.captures[key]; !ok && len(p.state.captures) >= maxRawCaptures {
+		oldest := ""
+		for k, capture := range p.state.captures {
+			if oldest == "" || capture.Timestamp < p.state.captures[oldest].Timestamp {
+				oldest = k
+			}
+		}
+		delete(p.state.captures, oldest)
+	}
+	p.state.captures[key] = c
+}
+
+// resetCaptures drops the captured points, e.g. once the capture is disabled.
+func (p *Processor) resetCaptures() {
+	p.stateMutex.Lock()
+	p.state.captures = nil
+	p.stateMutex.Unlock()
+}
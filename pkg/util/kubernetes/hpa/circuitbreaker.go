@@ -0,0 +1,104 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	circuitClosed = "closed"
+	circuitOpen   = "open"
+)
+
+// errCircuitOpen is returned instead of querying Datadog while the circuit breaker is open.
+var errCircuitOpen = errors.New("too many failed queries to Datadog, the queries are suspended")
+
+// isSuspended returns whether err was returned instead of querying Datadog.
+func isSuspended(err error) bool {
+	return err == errCircuitOpen || err == errBudgetExceeded
+}
+
+// circuitBreaker stops the queries to Datadog for a cooldown after maxFailures consecutive failures.
+type circuitBreaker struct {
+	maxFailures int
+	window      time.Duration
+	cooldown    time.Duration
+
+	m            sync.Mutex
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	now          func() time.Time
+}
+
+func newCircuitBreaker(maxFailures int, window, cooldown time.Duration) *circuitBreaker {
+	datadogCircuitBreaker.Set(circuitClosed)
+	return &circuitBreaker{
+		maxFailures: maxFailures,
+		window:      window,
+		cooldown:    cooldown,
+		now:         time.Now,
+	}
+}
+
+// allow returns errCircuitOpen if the breaker is open.
+func (cb *circuitBreaker) allow() error {
+	if cb == nil {
+		return nil
+	}
+	cb.m.Lock()
+	defer cb.m.Unlock()
+	if !cb.openedAt.IsZero() && cb.now().Sub(cb.openedAt) < cb.cooldown {
+		return errCircuitOpen
+	}
+	return nil
+}
+
+// record updates the breaker with the result of a query, only the transient errors are counted as failures.
+func (cb *circuitBreaker) record(err error) {
+	if cb == nil {
+		return
+	}
+	cb.m.Lock()
+	defer cb.m.Unlock()
+
+	if err == nil || !isRetryable(err) {
+		if !cb.openedAt.IsZero() {
+			log.Infof("Datadog answered, resuming the queries of the external metrics")
+			datadogCircuitBreaker.Set(circuitClosed)
+		}
+		cb.failures = 0
+		cb.openedAt = time.Time{}
+		return
+	}
+
+	now := cb.now()
+	if cb.failures == 0 || now.Sub(cb.firstFailure) > cb.window {
+		cb.failures = 0
+		cb.firstFailure = now
+	}
+	cb.failures++
+	// A failure once the cooldown is over opens the breaker again.
+	if cb.failures >= cb.maxFailures || !cb.openedAt.IsZero() {
+		if cb.openedAt.IsZero() {
+			log.Warnf("%d consecutive failed queries to Datadog, suspending the queries of the external metrics for %s: %v", cb.failures, cb.cooldown, err)
+		}
+		cb.openedAt = now
+		datadogCircuitBreaker.Set(circuitOpen)
+	}
+}
+
+// isOpen returns whether the queries are currently suspended.
+func (cb *circuitBreaker) isOpen() bool {
+	return cb.allow() != nil
+}
@@ -0,0 +1,211 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util"
+)
+
+// datadogClient adapts a datadog.Client to the DatadogClient interface.
+type datadogClient struct {
+	*datadog.Client
+	apiKey string
+	appKey string
+}
+
+// series is a datadog.Series whose points can be null.
+type series struct {
+	datadog.Series
+	Points [][2]*float64 `json:"pointlist,omitempty"`
+}
+
+// apiError is an error of the API, formatted like the errors of the Datadog client.
+type apiError struct {
+	status string
+	body   []byte
+	// retryAfter is the delay requested by the Retry-After header of the response, 0 if it is absent.
+	retryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API error %s: %s", e.status, e.body)
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, 0 if it is absent, invalid or in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err != nil || !date.After(now) {
+		return 0
+	}
+	return date.Sub(now)
+}
+
+// retryAfterDelay returns the delay requested by Datadog before retrying a query that failed with err, 0 if none.
+func retryAfterDelay(err error) time.Duration {
+	if apiErr, ok := err.(*apiError); ok {
+		return apiErr.retryAfter
+	}
+	return 0
+}
+
+func newDatadogClient(apiKey, appKey string) *datadogClient {
+	return &datadogClient{
+		Client: datadog.NewClient(apiKey, appKey),
+		apiKey: apiKey,
+		appKey: appKey,
+	}
+}
+
+// QueryMetrics queries the series of the query between from and to, in seconds.
+func (c *datadogClient) QueryMetrics(ctx context.Context, from, to int64, query string) ([]datadog.Series, error) {
+	v := url.Values{}
+	v.Add("from", strconv.FormatInt(from, 10))
+	v.Add("to", strconv.FormatInt(to, 10))
+	v.Add("query", query)
+	v.Add("api_key", c.apiKey)
+	v.Add("application_key", c.appKey)
+
+	req, err := http.NewRequest("GET", c.GetBaseUrl()+"/api/v1/query?"+v.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s", c.redact(err.Error()))
+	}
+	resp, err := c.HttpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		// The URL of the error contains the keys, keep the error to preserve its type.
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = c.redact(urlErr.URL)
+			return nil, urlErr
+		}
+		return nil, fmt.Errorf("%s", c.redact(err.Error()))
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &apiError{
+			status:     resp.Status,
+			body:       body,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+
+	var out struct {
+		Series []series `json:"series,omitempty"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, err
+	}
+	seriesSlice := make([]datadog.Series, 0, len(out.Series))
+	for _, s := range out.Series {
+		serie := s.Series
+		serie.Points = make([]datadog.DataPoint, 0, len(s.Points))
+		for _, point := range s.Points {
+			if point[0] == nil {
+				continue
+			}
+			value := math.NaN()
+			if point[1] != nil {
+				value = *point[1]
+			}
+			serie.Points = append(serie.Points, datadog.DataPoint{*point[0], value})
+		}
+		seriesSlice = append(seriesSlice, serie)
+	}
+	return seriesSlice, nil
+}
+
+// newDatadogTransport returns the transport of the queries to Datadog.
+func newDatadogTransport() (*http.Transport, error) {
+	proxies := &config.Proxy{
+		HTTP:    config.Datadog.GetString("proxy.http"),
+		HTTPS:   config.Datadog.GetString("proxy.https"),
+		NoProxy: config.Datadog.GetStringSlice("proxy.no_proxy"),
+	}
+	// The URL of the proxy can hold credentials, it is left out of the errors.
+	if err := validateProxy(proxies.HTTP); err != nil {
+		return nil, fmt.Errorf("invalid proxy.http to query Datadog, it should be the URL of a proxy, e.g. http://proxy:3128: %s", err)
+	}
+	if err := validateProxy(proxies.HTTPS); err != nil {
+		return nil, fmt.Errorf("invalid proxy.https to query Datadog, it should be the URL of a proxy, e.g. http://proxy:3128: %s", err)
+	}
+
+	transport := util.CreateHTTPTransport()
+	transport.Proxy = util.GetProxyTransportFunc(proxies)
+
+	if caFile := config.Datadog.GetString("external_metrics_provider.ca_file"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the CA file to query Datadog: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid CA file %s to query Datadog, it should hold PEM encoded certificates", caFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	return transport, nil
+}
+
+// validateProxy returns an error if the proxy is set and is not the URL of an http(s) or socks5 proxy.
+func validateProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return errors.New("could not parse the URL")
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5":
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	case u.Host == "":
+		return errors.New("missing host")
+	}
+	return nil
+}
+
+func (c *datadogClient) redact(s string) string {
+	if c.apiKey != "" {
+		s = strings.Replace(s, c.apiKey, "redacted", -1)
+	}
+	if c.appKey != "" {
+		s = strings.Replace(s, c.appKey, "redacted", -1)
+	}
+	return s
+}
@@ -8,15 +8,28 @@
 package hpa
 
 import (
+	"context"
 	"errors"
 	"expvar"
 	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/patrickmn/go-cache"
 	"github.com/paulbellamy/ratecounter"
 	"gopkg.in/zorkian/go-datadog-api.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
@@ -26,60 +39,1038 @@ var (
 	datadogErrors         = &expvar.Int{}
 	datadogQueriesPerHour = &expvar.Int{}
 	datadogQueriesCounter = ratecounter.NewRateCounter(1 * time.Hour)
+	datadogCacheHits      = &expvar.Int{}
+	datadogCacheMisses    = &expvar.Int{}
+	datadogNegativeHits   = &expvar.Int{}
+	datadogCircuitBreaker = &expvar.String{}
 )
 
 func init() {
 	datadogStats.Set("Errors", datadogErrors)
 	datadogStats.Set("QueriesPerHour", datadogQueriesPerHour)
+	datadogStats.Set("CacheHits", datadogCacheHits)
+	datadogStats.Set("CacheMisses", datadogCacheMisses)
+	datadogStats.Set("NegativeCacheHits", datadogNegativeHits)
+	datadogCircuitBreaker.Set(circuitClosed)
+	datadogStats.Set("CircuitBreaker", datadogCircuitBreaker)
 }
 
-// queryDatadogExternal converts the metric name and labels from the HPA format into a Datadog metric.
-// It returns the last value for a bucket of 5 minutes,
-func (p *Processor) queryDatadogExternal(metricName string, tags map[string]string) (int64, error) {
-	if metricName == "" || len(tags) == 0 {
-		return 0, errors.New("invalid metric to query")
+// Point represents the last value of a metric returned by Datadog, the zero Point is an invalid one.
+type Point struct {
+	value     float64
+	timestamp int64
+	valid     bool
+	// transient is set for the invalid points of the queries that failed with a transient error.
+	transient bool
+	// err is the error of the invalid points of the series Datadog answered with, e.g. ErrInvalidValue.
+	err error
+	// raw are the raw points the point was computed from, only for debugging, see RawCapture.
+	raw *RawCapture
+}
+
+const (
+	aggregatorAvg  = "avg"
+	aggregatorMax  = "max"
+	aggregatorMin  = "min"
+	aggregatorSum  = "sum"
+	aggregatorLast = "last"
+)
+
+// percentileStats are the percentiles of the distribution metrics supported by Datadog.
+var percentileStats = map[string]bool{
+	"p50": true,
+	"p75": true,
+	"p90": true,
+	"p95": true,
+	"p99": true,
+}
+
+// rollupMethods are the methods of the Datadog rollups, e.g. `.rollup(sum, 60)`.
+var rollupMethods = map[string]bool{
+	"avg":   true,
+	"sum":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+// transformPerSecond is the transform of the metrics whose value is the per-second rate of a counter, see ratePoints.
+const transformPerSecond = "per_second"
+
+// errCounterReset is the error of the rates whose counter was reset without any earlier rate in the window.
+var errCounterReset = errors.New("the counter of the metric was reset, its rate cannot be computed")
+
+const (
+	interpolationNone   = "none"
+	interpolationLast   = "last"
+	interpolationLinear = "linear"
+)
+
+// isValidAggregator returns whether the aggregator is supported to reduce the points of a serie.
+func isValidAggregator(aggregator string) bool {
+	switch aggregator {
+	case aggregatorAvg, aggregatorMax, aggregatorMin, aggregatorSum, aggregatorLast:
+		return true
 	}
-	bucketSize := config.Datadog.GetInt64("external_metrics_provider.bucket_size")
-	datadogTags := []string{}
+	return false
+}
 
-	for key, val := range tags {
-		datadogTags = append(datadogTags, fmt.Sprintf("%s:%s", key, val))
+// splitAggregator returns the aggregator prefixing the name of a metric, e.g. `max:requests_per_s`, and the name.
+func splitAggregator(metricName string) (string, string) {
+	i := strings.Index(metricName, ":")
+	if i < 0 || !isValidAggregator(metricName[:i]) {
+		return "", metricName
 	}
-	tagString := strings.Join(datadogTags, ",")
+	return metricName[:i], metricName[i+1:]
+}
 
-	// TODO: offer other aggregations than avg.
-	query := fmt.Sprintf("avg:%s{%s}", metricName, tagString)
+// isValidInterpolation returns whether the interpolation is supported to fill the gaps of the series.
+func isValidInterpolation(interpolation string) bool {
+	switch interpolation {
+	case interpolationNone, interpolationLast, interpolationLinear:
+		return true
+	}
+	return false
+}
 
-	datadogQueriesCounter.Incr(1)
-	datadogQueriesPerHour.Set(datadogQueriesCounter.Rate())
+type queryResult struct {
+	series []datadog.Series
+	err    error
+}
 
-	seriesSlice, err := p.datadogClient.QueryMetrics(time.Now().Unix()-bucketSize, time.Now().Unix(), query)
+// queryDatadogExternal converts the metric names and labels from the HPA format into Datadog metrics.
+func (p *Processor) queryDatadogExternal(ctx context.Context, metricNames []string) (_ map[string]Point, err error) {
+	if len(metricNames) == 0 {
+		return nil, errors.New("no metrics to query")
+	}
+	defer func() {
+		if value := recover(); value != nil {
+			query := strings.Join(metricNames, ",")
+			err = newQueryError(query, recoveredPanic(value, query, metricNames))
+		}
+	}()
+	// The metrics of a call share their query options, see queryExternalMetrics.
+	_, opts := p.splitKey(metricNames[0])
+	queryWindow := opts.window
+	s := p.settings()
+
+	processedMetrics := make(map[string]Point, len(metricNames))
+	queries := make([]string, 0, len(metricNames))
+	var queriedMetrics []string
+	for _, metricName := range metricNames {
+		query := p.formatQuery(metricName)
+		if point, ok := p.getCachedPoint(p.cacheKey(metricName)); ok {
+			processedMetrics[metricName] = point
+			continue
+		}
+		if err, ok := p.negativeCache.get(p.cacheKey(metricName), p.now()); ok {
+			// The query failed permanently recently, it is not sent again before the TTL of the negative cache.
+			datadogNegativeHits.Add(1)
+			processedMetrics[metricName] = Point{err: err}
+			continue
+		}
+		queries = append(queries, query)
+		queriedMetrics = append(queriedMetrics, metricName)
+	}
+	if len(queries) == 0 {
+		return processedMetrics, nil
+	}
+	query := strings.Join(queries, ",")
 
+	start := time.Now()
+	seriesSlice, err := p.queryMetrics(ctx, p.client(opts), queryWindow, query)
+	latency := time.Since(start)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if isSuspended(err) {
+		return nil, err
+	}
 	if err != nil {
 		datadogErrors.Add(1)
-		return 0, log.Errorf("Error while executing metric query %s: %s", query, err)
+		queriesTelemetry.WithLabelValues(queryError).Add(float64(len(queriedMetrics)))
+		log.Debugf("Queried Datadog: query=%q result=error latency=%s error=%q", query, latency, err)
+		queryErr := newQueryError(query, err)
+		p.recordError(queryErr)
+		if len(queriedMetrics) == 1 {
+			// The failures of a batch are not cached, its metrics are then queried individually.
+			p.negativeCache.record(p.cacheKey(queriedMetrics[0]), queryErr, p.now())
+		}
+		return nil, queryErr
 	}
-
+	log.Debugf("Queried Datadog: query=%q result=success series=%d latency=%s", query, len(seriesSlice), latency)
 	if len(seriesSlice) == 0 {
-		return 0, log.Errorf("Returned series slice empty")
+		// The query is valid but no serie matches it, e.g. the metric is not reported with these tags.
+		queriesTelemetry.WithLabelValues(queryInvalid).Add(float64(len(queriedMetrics)))
+		for _, metricName := range queriedMetrics {
+			p.negativeCache.record(p.cacheKey(metricName), &QueryError{Query: p.formatQuery(metricName), Kind: ErrNoDataPoints}, p.now())
+		}
+		return processedMetrics, &QueryError{Query: query, Kind: ErrNoDataPoints}
+	}
+
+	// The series of a selector too broad are not aggregated, the metrics of the batch are then queried individually.
+	if p.maxSeriesPerQuery > 0 && len(seriesSlice) > p.maxSeriesPerQuery*len(queriedMetrics) {
+		if len(queriedMetrics) > 1 {
+			return nil, &QueryError{Query: query, Kind: ErrTooManySeries}
+		}
+		log.Warnf("The query of the external metric matched too many series, its selector is too broad: key=%q query=%q series=%d max_series_per_query=%d result=invalid", queriedMetrics[0], query, len(seriesSlice), p.maxSeriesPerQuery)
+		tooManySeriesTelemetry.Inc()
+		queriesTelemetry.WithLabelValues(queryInvalid).Inc()
+		queryErr := &QueryError{Query: query, Kind: ErrTooManySeries}
+		p.negativeCache.record(p.cacheKey(queriedMetrics[0]), queryErr, p.now())
+		processedMetrics[queriedMetrics[0]] = Point{err: queryErr}
+		return processedMetrics, nil
+	}
+
+	// A formula, or a metric of a MetricProvider, is queried alone, its series are not matched by their scope.
+	formula := len(queriedMetrics) == 1 && (p.queriesAlone || strings.HasPrefix(queriedMetrics[0], formulaKeyPrefix))
+	if formula && len(seriesSlice) > 1 && !s.averagesSeries() {
+		log.Debugf("The formula matched several series: query=%q series=%d result=invalid", query, len(seriesSlice))
+		queriesTelemetry.WithLabelValues(queryInvalid).Inc()
+		processedMetrics[queriedMetrics[0]] = Point{err: errFormulaSeries}
+		return processedMetrics, nil
+	}
+	var keys []string
+	seriesByKey := make(map[string][]datadog.Series)
+	for _, serie := range seriesSlice {
+		var key string
+		switch {
+		case formula:
+			key = queriedMetrics[0]
+		case serie.Metric == nil || serie.Scope == nil:
+			log.Debugf("Could not match a serie with any of the queries: query=%q", query)
+			log.Tracef("Serie without metric or scope: %#v", serie)
+			continue
+		default:
+			key = p.withOptions(scopeToKey(*serie.Metric, *serie.Scope), opts)
+		}
+		if _, ok := seriesByKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		seriesByKey[key] = append(seriesByKey[key], serie)
+	}
+	for _, key := range keys {
+		point, ok := p.reduceSeries(key, seriesByKey[key], opts, s)
+		if !ok {
+			continue
+		}
+		processedMetrics[key] = point
+		if point.valid && p.queryCache != nil {
+			p.queryCache.Set(p.cacheKey(key), point, cache.DefaultExpiration)
+		}
+	}
+	for _, metricName := range queriedMetrics {
+		point, ok := processedMetrics[metricName]
+		switch {
+		case ok && point.valid:
+			queriesTelemetry.WithLabelValues(querySuccess).Inc()
+			p.negativeCache.forget(p.cacheKey(metricName))
+		case !ok:
+			queriesTelemetry.WithLabelValues(queryInvalid).Inc()
+			p.negativeCache.record(p.cacheKey(metricName), &QueryError{Query: p.formatQuery(metricName), Kind: ErrNoDataPoints}, p.now())
+		default:
+			queriesTelemetry.WithLabelValues(queryInvalid).Inc()
+		}
+	}
+	return processedMetrics, nil
+}
+
+// reduceSerie reduces a serie of a key to its point with the aggregator of the query options, or to its rate.
+func (p *Processor) reduceSerie(key string, serie datadog.Series, opts queryOptions, s settings) (point Point, points int, ok bool) {
+	for _, dp := range serie.Points {
+		if !math.IsNaN(dp[1]) {
+			points++
+		}
 	}
-	points := seriesSlice[0].Points
+	if len(serie.Points) == 0 {
+		log.Debugf("No points in the serie: key=%q result=invalid", key)
+		return Point{}, 0, false
+	}
+	var raw *RawCapture
+	if s.capturePoints > 0 {
+		raw = newRawCapture(serie, opts, s.capturePoints, p.now())
+		p.recordCapture(p.cacheKey(key), raw)
+	}
+	var value float64
+	var timestamp int64
+	if opts.transform == transformPerSecond {
+		var err error
+		value, timestamp, ok, err = ratePoints(serie.Points)
+		if err != nil {
+			log.Debugf("Could not compute the rate of the serie: key=%q result=invalid error=%q", key, err)
+			return Point{err: err, raw: raw}, points, true
+		}
+	} else {
+		value, timestamp, ok = reducePoints(opts.aggregator, serie.Points)
+	}
+	if !ok {
+		log.Debugf("Only null points in the serie: key=%q result=invalid", key)
+		return Point{}, points, false
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		// Garbage values, e.g. of a division by zero, would make the HPA compute absurd replica counts.
+		log.Debugf("The value of the serie is not a finite number: key=%q result=invalid value=%v", key, value)
+		return Point{err: &QueryError{Query: p.formatQuery(key), Kind: ErrInvalidValue}, raw: raw}, points, true
+	}
+	return Point{
+		value: value,
+		// Datadog returns timestamps in milliseconds.
+		timestamp: timestamp / 1000,
+		valid:     true,
+		raw:       raw,
+	}, points, true
+}
 
-	if len(points) == 0 {
-		return 0, log.Errorf("No points in series")
+// formatQuery returns the query of a metric, with its aggregation, rollup and fill.
+func (p *Processor) formatQuery(metricName string) string {
+	metricName, opts := p.splitKey(metricName)
+	if expr, ok := formulaExpression(metricName); ok {
+		// The operands of a formula are complete queries, they are not aggregated, rolled up or filled again.
+		return expr
+	}
+	spaceAggregator := opts.aggregator
+	if spaceAggregator == aggregatorLast {
+		spaceAggregator = aggregatorAvg
+	}
+	query := fmt.Sprintf("%s:%s", spaceAggregator, metricName)
+	if opts.stat != "" {
+		query = fmt.Sprintf("%s:%s", opts.stat, metricName)
+	}
+	rollupMethod := spaceAggregator
+	if opts.rollupMethod != "" {
+		rollupMethod = opts.rollupMethod
+	}
+	switch {
+	case opts.rollup > 0:
+		query = fmt.Sprintf("%s.rollup(%s, %d)", query, rollupMethod, opts.rollup)
+	case opts.rollupMethod != "":
+		query = fmt.Sprintf("%s.rollup(%s)", query, rollupMethod)
+	}
+	s := p.settings()
+	if s.interpolation == "" || s.interpolation == interpolationNone {
+		return query
+	}
+	if maxAge := int64(s.externalMaxAge.Seconds()); maxAge > 0 {
+		return fmt.Sprintf("%s.fill(%s, %d)", query, s.interpolation, maxAge)
+	}
+	return fmt.Sprintf("%s.fill(%s)", query, s.interpolation)
+}
+
+// queryOptions are the options of the query of a metric, overridden by the annotations of its HPA.
+type queryOptions struct {
+	aggregator string
+	rollup     int
+	// window is the length of the window of the query in seconds.
+	window int64
+	// transform is the transform of the points of the series, empty to reduce them with the aggregator.
+	transform string
+	// stat is the percentile queried instead of the space aggregator, e.g. `p95`.
+	stat string
+	// rollupMethod is the method of the rollup, e.g. `sum`, empty to roll up the points with the aggregator.
+	rollupMethod string
+	// namespace is the namespace whose keys query the metric, see namespaceKeys, empty for the keys of the Processor.
+	namespace string
+}
+
+// defaultQueryOptions returns the query options of the Processor.
+func (p *Processor) defaultQueryOptions() queryOptions {
+	s := p.settings()
+	opts := queryOptions{
+		aggregator: s.aggregator,
+		rollup:     s.rollup,
+		window:     int64(s.queryWindow.Seconds()),
+	}
+	if opts.aggregator == "" {
+		opts.aggregator = aggregatorAvg
+	}
+	if opts.window <= 0 {
+		opts.window = config.Datadog.GetInt64("external_metrics_provider.bucket_size")
+	}
+	if opts.rollup <= 0 {
+		opts.rollup = p.autoRollup(opts.window)
 	}
-	lastValue := int64(points[len(points)-1][1])
-	return lastValue, nil
+	return opts
+}
+
+// metricQueryOptions returns the query options of a metric, the ones of the Processor overridden by its HPA.
+func (p *Processor) metricQueryOptions(em custommetrics.ExternalMetricValue) queryOptions {
+	opts := p.defaultQueryOptions()
+	if em.Aggregator != "" {
+		opts.aggregator = em.Aggregator
+	}
+	// The aggregator prefixing the name of the metric takes precedence over the annotation of its HPA.
+	if aggregator, _ := splitAggregator(em.MetricName); aggregator != "" {
+		opts.aggregator = aggregator
+	}
+	if em.QueryWindow > 0 {
+		opts.window = em.QueryWindow
+		if p.settings().rollup <= 0 {
+			opts.rollup = p.autoRollup(opts.window)
+		}
+	}
+	if em.Rollup > 0 {
+		opts.rollup = int(em.Rollup)
+	}
+	opts.transform = em.Transform
+	opts.stat = em.Stat
+	opts.rollupMethod = em.RollupMethod
+	if _, ok := p.namespaceClients[em.HPA.Namespace]; ok {
+		opts.namespace = em.HPA.Namespace
+	}
+	return opts
+}
+
+// nativeInterval is the interval in seconds of the points of the metrics reported by the Agent.
+const nativeInterval = 15
+
+// autoRollup returns the rollup interval in seconds of the queries of a window without an explicit rollup.
+func (p *Processor) autoRollup(window int64) int {
+	rollupPoints := int64(p.settings().rollupPoints)
+	if rollupPoints <= 0 || window <= 0 {
+		return 0
+	}
+	rollup := (window + rollupPoints - 1) / rollupPoints
+	if rollup <= nativeInterval {
+		return 0
+	}
+	return int(rollup)
+}
+
+// Names of the query options in the keys of the metrics, see withOptions.
+const (
+	optionAggregator   = "aggregator"
+	optionRollup       = "rollup"
+	optionWindow       = "window"
+	optionTransform    = "transform"
+	optionStat         = "stat"
+	optionRollupMethod = "rollupMethod"
+	optionNamespace    = "namespace"
+)
+
+// withOptions returns the key of a metric suffixed with its query options, unless they are the ones of the Processor.
+func (p *Processor) withOptions(key string, opts queryOptions) string {
+	if opts == p.defaultQueryOptions() {
+		return key
+	}
+	values := url.Values{}
+	values.Set(optionAggregator, opts.aggregator)
+	values.Set(optionRollup, strconv.Itoa(opts.rollup))
+	values.Set(optionWindow, strconv.FormatInt(opts.window, 10))
+	for name, value := range map[string]string{
+		optionTransform:    opts.transform,
+		optionStat:         opts.stat,
+		optionRollupMethod: opts.rollupMethod,
+		optionNamespace:    opts.namespace,
+	} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	return fmt.Sprintf("%s[%s]", key, values.Encode())
+}
+
+// splitKey returns the key of a metric without its query options, and the options.
+func (p *Processor) splitKey(key string) (string, queryOptions) {
+	opts := p.defaultQueryOptions()
+	i := strings.LastIndex(key, "}")
+	if i < 0 || !strings.HasPrefix(key[i+1:], "[") || !strings.HasSuffix(key, "]") {
+		return key, opts
+	}
+	values, err := url.ParseQuery(key[i+2 : len(key)-1])
+	if err != nil {
+		return key, opts
+	}
+	rollup, err := strconv.Atoi(values.Get(optionRollup))
+	if err != nil {
+		return key, opts
+	}
+	window, err := strconv.ParseInt(values.Get(optionWindow), 10, 64)
+	if err != nil {
+		return key, opts
+	}
+	return key[:i+1], queryOptions{
+		aggregator:   values.Get(optionAggregator),
+		rollup:       rollup,
+		window:       window,
+		transform:    values.Get(optionTransform),
+		stat:         values.Get(optionStat),
+		rollupMethod: values.Get(optionRollupMethod),
+		namespace:    values.Get(optionNamespace),
+	}
+}
+
+// cacheKey returns the key of the cached point of a metric, with the query options it was queried with.
+func (p *Processor) cacheKey(key string) string {
+	_, opts := p.splitKey(key)
+	cacheKey := p.formatQuery(key)
+	if window := p.defaultQueryOptions().window; opts.window != window {
+		cacheKey = fmt.Sprintf("%s over %ds", cacheKey, opts.window)
+	}
+	if !strings.HasPrefix(cacheKey, opts.aggregator+":") {
+		cacheKey = fmt.Sprintf("%s reduced with %s", cacheKey, opts.aggregator)
+	}
+	if opts.transform != "" {
+		cacheKey = fmt.Sprintf("%s as %s", cacheKey, opts.transform)
+	}
+	if opts.namespace != "" {
+		cacheKey = fmt.Sprintf("%s in %s", cacheKey, opts.namespace)
+	}
+	return cacheKey
+}
+
+// queryMetrics calls QueryMetrics of the client for the last queryWindow seconds, with retries.
+func (p *Processor) queryMetrics(ctx context.Context, client DatadogClient, queryWindow int64, query string) ([]datadog.Series, error) {
+	if err := p.breaker.allow(); err != nil {
+		return nil, err
+	}
+	if err := p.budget.allow(); err != nil {
+		return nil, err
+	}
+	s := p.settings()
+	backoff := s.queryBackoff
+	for attempt := 0; ; attempt++ {
+		p.budget.record()
+		datadogQueriesCounter.Incr(1)
+		datadogQueriesPerHour.Set(datadogQueriesCounter.Rate())
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if s.queryTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, s.queryTimeout)
+		}
+		// The context of the attempt aborts the request, the answer is not waited for in case the DatadogClient
+		// ignores it.
+		res := make(chan queryResult, 1)
+		go func() {
+			var r queryResult
+			// A panic of the client would take down the Cluster Agent, it fails the attempt instead.
+			defer func() {
+				if value := recover(); value != nil {
+					r = queryResult{err: recoveredPanic(value, query, nil)}
+				}
+				res <- r
+			}()
+			start := time.Now()
+			to := start.Unix() - int64(s.queryOffset.Seconds())
+			r.series, r.err = client.QueryMetrics(attemptCtx, to-queryWindow, to, query)
+			queryLatencyTelemetry.Observe(time.Since(start).Seconds())
+		}()
+
+		var r queryResult
+		answered := false
+		select {
+		case <-attemptCtx.Done():
+		case r = <-res:
+			answered = true
+		}
+		// The request aborted by the context fails with an error of its own, e.g. a url.Error.
+		interrupted := attemptCtx.Err() != nil && (!answered || r.err != nil)
+		cancel()
+		if interrupted {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			r = queryResult{err: &queryTimeoutError{timeout: s.queryTimeout}}
+		}
+		// The rate limited queries are retried once the delay requested by Datadog is over, unless it would stall the refresh.
+		retryAfter := retryAfterDelay(r.err)
+		retryable := r.err != nil && (isRetryable(r.err) || (apiErrorStatus(r.err) == 429 && retryAfter > 0))
+		if retryable && retryAfter > p.maxRetryAfter {
+			log.Debugf("Not retrying the query, Datadog requested to wait longer than external_metrics_provider.max_retry_after: query=%q retry_after=%s", query, retryAfter)
+			retryable = false
+		}
+		if r.err == nil || attempt >= s.queryRetries || !retryable {
+			p.breaker.record(r.err)
+			return r.series, r.err
+		}
+
+		wait := backoff
+		if backoff > 0 {
+			wait += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+		}
+		if wait < retryAfter {
+			wait = retryAfter
+		}
+		log.Debugf("Retrying the query after a transient error: query=%q attempt=%d wait=%s error=%q", query, attempt+1, wait, r.err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// queryTimeoutError is the timeout net.Error of the queries not answered within the query timeout.
+type queryTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *queryTimeoutError) Error() string {
+	return fmt.Sprintf("Datadog did not answer the query within %s", e.timeout)
+}
+
+// Timeout implements net.Error.
+func (e *queryTimeoutError) Timeout() bool { return true }
+
+// Temporary implements net.Error.
+func (e *queryTimeoutError) Temporary() bool { return true }
+
+// isRetryable returns whether the error returned by QueryMetrics is transient.
+func isRetryable(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	if strings.Contains(err.Error(), "connection reset") {
+		return true
+	}
+	return apiErrorStatus(err) >= 500
+}
+
+// getCachedPoint returns the point cached for a query, if the Processor has a cache.
+func (p *Processor) getCachedPoint(query string) (Point, bool) {
+	if p.queryCache == nil {
+		return Point{}, false
+	}
+	if cached, ok := p.queryCache.Get(query); ok {
+		datadogCacheHits.Add(1)
+		return cached.(Point), true
+	}
+	datadogCacheMisses.Add(1)
+	return Point{}, false
+}
+
+// reducePoints reduces the non-null points of a serie to a single value using the aggregator.
+func reducePoints(aggregator string, points []datadog.DataPoint) (value float64, timestamp int64, ok bool) {
+	values := make([]float64, 0, len(points))
+	for _, point := range points {
+		if math.IsNaN(point[1]) {
+			continue
+		}
+		values = append(values, point[1])
+		timestamp = int64(point[0])
+	}
+	if len(values) == 0 {
+		return 0, 0, false
+	}
+
+	switch aggregator {
+	case aggregatorLast:
+		return values[len(values)-1], timestamp, true
+	case aggregatorMax:
+		value = values[0]
+		for _, v := range values[1:] {
+			value = math.Max(value, v)
+		}
+	case aggregatorMin:
+		value = values[0]
+		for _, v := range values[1:] {
+			value = math.Min(value, v)
+		}
+	case aggregatorSum, aggregatorAvg:
+		for _, v := range values {
+			value += v
+		}
+		if aggregator == aggregatorAvg {
+			value /= float64(len(values))
+		}
+	default:
+		return 0, 0, false
+	}
+	return value, timestamp, true
+}
+
+// ratePoints returns the per-second rate of a counter between the two most recent non-null points of its serie.
+func ratePoints(points []datadog.DataPoint) (value float64, timestamp int64, ok bool, err error) {
+	values := make([]datadog.DataPoint, 0, len(points))
+	for _, point := range points {
+		if !math.IsNaN(point[1]) {
+			values = append(values, point)
+		}
+	}
+	if len(values) < 2 {
+		return 0, 0, false, nil
+	}
+	for i := len(values) - 1; i > 0; i-- {
+		previous, current := values[i-1], values[i]
+		if current[1] < previous[1] || current[0] <= previous[0] {
+			continue
+		}
+		// Datadog returns timestamps in milliseconds.
+		seconds := (current[0] - previous[0]) / 1000
+		return (current[1] - previous[1]) / seconds, int64(current[0]), true, nil
+	}
+	return 0, 0, false, errCounterReset
+}
+
+// getKey returns the identifier of a metric and its labels, formatted as a Datadog metric and scope.
+func getKey(metricName string, labels map[string]string) string {
+	return formatKey(metricName, labelsToTags(labels, ""))
+}
+
+// labelsToTags converts the labels of a metric selector into Datadog tag filters, sorted by key.
+func labelsToTags(labels map[string]string, delimiter string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	datadogTags := make([]string, 0, len(labels))
+	for _, key := range keys {
+		datadogTags = append(datadogTags, labelToTag(key, labels[key], delimiter))
+	}
+	return datadogTags
+}
+
+// labelToTag returns the tag filter of a label, an OR group of the tags of its values split by the delimiter.
+func labelToTag(key, value, delimiter string) string {
+	if delimiter == "" || !strings.Contains(value, delimiter) {
+		return formatTag(key, value)
+	}
+	var values []string
+	seen := make(map[string]bool)
+	for _, val := range strings.Split(value, delimiter) {
+		if val = strings.TrimSpace(val); val != "" && !seen[val] {
+			seen[val] = true
+			values = append(values, val)
+		}
+	}
+	if len(values) == 0 {
+		return formatTag(key, value)
+	}
+	sort.Strings(values)
+	tags := make([]string, 0, len(values))
+	for _, val := range values {
+		tags = append(tags, formatTag(key, val))
+	}
+	if len(tags) == 1 {
+		return tags[0]
+	}
+	return fmt.Sprintf("(%s)", strings.Join(tags, " OR "))
+}
+
+// getMetricKey is getKey for an external metric, taking the MatchExpressions of its selector into account.
+func getMetricKey(em custommetrics.ExternalMetricValue, delimiter string) (string, error) {
+	datadogTags, err := metricTags(em, delimiter)
+	if err != nil {
+		return "", err
+	}
+	return formatKey(em.MetricName, datadogTags), nil
+}
+
+// metricTags returns the tag filters of the labels and the MatchExpressions of the selector of an external metric.
+func metricTags(em custommetrics.ExternalMetricValue, delimiter string) ([]string, error) {
+	expressionTags, err := expressionsToTags(em.MatchExpressions)
+	if err != nil {
+		return nil, err
+	}
+	return append(labelsToTags(em.Labels, delimiter), expressionTags...), nil
+}
+
+// BuildQuery returns the query sent to Datadog for a metric and its labels.
+func (p *Processor) BuildQuery(metricName string, labels map[string]string) string {
+	datadogTags := labelsToTags(labels, p.labelValueDelimiter)
+	datadogTags = append(datadogTags, p.clusterTags(custommetrics.ExternalMetricValue{MetricName: metricName, Labels: labels})...)
+	aggregator, datadogName := splitAggregator(metricName)
+	key := formatKey(datadogName, datadogTags)
+	if aggregator != "" {
+		opts := p.defaultQueryOptions()
+		opts.aggregator = aggregator
+		key = p.withOptions(key, opts)
+	}
+	return p.formatQuery(key)
+}
+
+// clusterTagKey is the tag of the cluster of the series reported by the Agents running in Kubernetes.
+const clusterTagKey = "kube_cluster_name"
+
+// clusterTags returns the tag filter scoping the query of a metric to the cluster, e.g. `kube_cluster_name:prod`.
+func (p *Processor) clusterTags(em custommetrics.ExternalMetricValue) []string {
+	if p.clusterTag == "" || em.AllClusters {
+		return nil
+	}
+	if _, ok := em.Labels[clusterTagKey]; ok {
+		return nil
+	}
+	for _, expr := range em.MatchExpressions {
+		if expr.Key == clusterTagKey {
+			return nil
+		}
+	}
+	return []string{p.clusterTag}
+}
+
+// clusterTag returns the tag filter of the queries scoped to a cluster, empty if the name cannot be used.
+func clusterTag(clusterName string) string {
+	if clusterName == "" {
+		return ""
+	}
+	if strings.ContainsAny(clusterName, invalidTagChars) {
+		log.Warnf("The cluster name %q cannot be used in a Datadog query, the queries of the external metrics are not scoped to the cluster", clusterName)
+		return ""
+	}
+	return fmt.Sprintf("%s:%s", clusterTagKey, strings.ToLower(clusterName))
+}
+
+// errUnscopedQuery is returned for the external metrics without a selector, or with an empty one.
+var errUnscopedQuery = errors.New("no selector specified for the metric, the query would aggregate it over all its sources")
+
+// queryKey returns the key of the query of an external metric, with its query options.
+func (p *Processor) queryKey(em custommetrics.ExternalMetricValue) (string, error) {
+	key, err := p.metricKey(em)
+	if err != nil || p.metricPolicy == nil {
+		return key, err
+	}
+	if _, denied := p.metricPolicy.deniedMetric(p.formatQuery(key)); denied {
+		return "", ErrMetricNotAllowed
+	}
+	return key, nil
+}
+
+// metricKey is queryKey without the metric policy.
+func (p *Processor) metricKey(em custommetrics.ExternalMetricValue) (string, error) {
+	if em.Multiplier == invalidMultiplier {
+		return "", errInvalidMultiplier
+	}
+	if em.Formula != "" {
+		expr, err := expandFormula(em.Formula, em.FormulaQueries)
+		if err != nil {
+			return "", err
+		}
+		return p.withOptions(formulaKey(expr), p.metricQueryOptions(em)), nil
+	}
+	datadogTags, err := p.queryTags(em)
+	if err != nil {
+		return "", err
+	}
+	_, datadogName := splitAggregator(em.MetricName)
+	if em.QueryTemplate != "" {
+		sort.Strings(datadogTags)
+		query, err := renderQueryTemplate(em.QueryTemplate, datadogName, strings.Join(datadogTags, ","))
+		if err != nil {
+			return "", err
+		}
+		return p.withOptions(formulaKey(query), p.metricQueryOptions(em)), nil
+	}
+	return p.withOptions(formatKey(datadogName, datadogTags), p.metricQueryOptions(em)), nil
+}
+
+// queryTags returns the tag filters scoping the query of a metric.
+func (p *Processor) queryTags(em custommetrics.ExternalMetricValue) ([]string, error) {
+	// The labels of the metric are the ones of its selector, matched by the requests of the HPA controller.
+	if len(em.TargetTags) > 0 {
+		labels := make(map[string]string, len(em.Labels)+len(em.TargetTags))
+		for tag, value := range em.TargetTags {
+			labels[tag] = value
+		}
+		for label, value := range em.Labels {
+			labels[label] = value
+		}
+		em.Labels = labels
+	}
+	clusterTags := p.clusterTags(em)
+	if len(em.Labels)+len(em.MatchExpressions) > 0 {
+		datadogTags, err := metricTags(em, p.labelValueDelimiter)
+		if err != nil {
+			return nil, err
+		}
+		return append(datadogTags, clusterTags...), nil
+	}
+	// The pods and object metrics are always scoped, they have no labels when their target is not supported.
+	if !p.allowUnscopedQueries || em.Type != "" {
+		return nil, errUnscopedQuery
+	}
+	if len(clusterTags) == 0 {
+		clusterTags = []string{"*"}
+	}
+	return clusterTags, nil
+}
+
+// expressionsToTags converts the MatchExpressions of a metric selector into Datadog tag filters.
+func expressionsToTags(expressions []metav1.LabelSelectorRequirement) ([]string, error) {
+	var datadogTags []string
+	for _, expr := range expressions {
+		if strings.ContainsAny(expr.Key, invalidTagChars) {
+			return nil, fmt.Errorf("the key %q cannot be used in a Datadog query", expr.Key)
+		}
+		for _, val := range expr.Values {
+			if strings.ContainsAny(val, invalidTagChars) {
+				return nil, fmt.Errorf("the value %q of %s cannot be used in a Datadog query", val, expr.Key)
+			}
+		}
+		values := make([]string, len(expr.Values))
+		copy(values, expr.Values)
+		sort.Strings(values)
+
+		switch expr.Operator {
+		case metav1.LabelSelectorOpIn, metav1.LabelSelectorOpNotIn:
+			if len(values) == 0 {
+				return nil, fmt.Errorf("the operator %s of %s requires values", expr.Operator, expr.Key)
+			}
+			tags := make([]string, 0, len(values))
+			for _, val := range values {
+				tags = append(tags, formatTag(expr.Key, val))
+			}
+			if expr.Operator == metav1.LabelSelectorOpNotIn {
+				for _, tag := range tags {
+					datadogTags = append(datadogTags, "!"+tag)
+				}
+				continue
+			}
+			if len(tags) == 1 {
+				datadogTags = append(datadogTags, tags[0])
+				continue
+			}
+			datadogTags = append(datadogTags, fmt.Sprintf("(%s)", strings.Join(tags, " OR ")))
+		case metav1.LabelSelectorOpExists, metav1.LabelSelectorOpDoesNotExist:
+			if len(values) != 0 {
+				return nil, fmt.Errorf("the operator %s of %s does not accept values", expr.Operator, expr.Key)
+			}
+			tag := fmt.Sprintf("%s:*", normalizeTag(expr.Key))
+			if expr.Operator == metav1.LabelSelectorOpDoesNotExist {
+				tag = "!" + tag
+			}
+			datadogTags = append(datadogTags, tag)
+		default:
+			return nil, fmt.Errorf("the operator %s of %s is not supported", expr.Operator, expr.Key)
+		}
+	}
+	return datadogTags, nil
+}
+
+// maxTagLength is the length of the longest tag stored by Datadog, the longer tags are truncated.
+const maxTagLength = 200
+
+// formatTag returns the tag filter `key:value` of a label, normalized like the tags of the series.
+func formatTag(key, value string) string {
+	tag := fmt.Sprintf("%s:%s", key, value)
+	normalized := normalizeTag(tag)
+	if normalized != tag {
+		log.Debugf("Normalized the label %s=%s into the Datadog tag %s", key, value, normalized)
+	}
+	return normalized
+}
+
+// normalizeTag returns a tag as Datadog stores it.
+func normalizeTag(tag string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(tag) {
+		switch {
+		case b.Len() == 0 && !unicode.IsLetter(r):
+			// The leading characters other than letters are dropped.
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == ':', r == '.', r == '/':
+			b.WriteRune(r)
+			underscore = false
+		case !underscore:
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	normalized := b.String()
+	if len(normalized) > maxTagLength {
+		end := maxTagLength
+		for !utf8.RuneStart(normalized[end]) {
+			end--
+		}
+		normalized = normalized[:end]
+	}
+	if normalized = strings.TrimRight(normalized, "_"); normalized == "" {
+		return tag
+	}
+	return normalized
+}
+
+// invalidTagChars are the characters that would change the meaning of a Datadog query if used in a tag filter.
+const invalidTagChars = ",(){}*! "
+
+// scopeToKey returns the key of a serie, built from the metric and the tag filters listed in its scope.
+func scopeToKey(metricName, scope string) string {
+	var datadogTags []string
+	for _, tag := range strings.Split(scope, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			datadogTags = append(datadogTags, tag)
+		}
+	}
+	return formatKey(metricName, datadogTags)
+}
+
+func formatKey(metricName string, datadogTags []string) string {
+	sort.Strings(datadogTags)
+	return fmt.Sprintf("%s{%s}", metricName, strings.Join(datadogTags, ","))
 }
 
 // NewDatadogClient generates a new client to query metrics from Datadog
-func NewDatadogClient() (*datadog.Client, error) {
+func NewDatadogClient() (DatadogClient, error) {
 	apiKey := config.Datadog.GetString("api_key")
 	appKey := config.Datadog.GetString("app_key")
 
 	if appKey == "" || apiKey == "" {
 		return nil, errors.New("missing the api/app key pair to query Datadog")
 	}
-	log.Infof("Initialized the Datadog Client for HPA")
-	return datadog.NewClient(apiKey, appKey), nil
+	endpoint, err := getDatadogEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newDatadogTransport()
+	if err != nil {
+		return nil, err
+	}
+	client := newConfiguredClient(apiKey, appKey, endpoint, transport)
+	log.Infof("Initialized the Datadog Client for HPA: endpoint=%q", client.GetBaseUrl())
+
+	fallbackAPIKey := config.Datadog.GetString("external_metrics_provider.fallback_api_key")
+	fallbackAppKey := config.Datadog.GetString("external_metrics_provider.fallback_app_key")
+	if fallbackAPIKey == "" && fallbackAppKey == "" {
+		return client, nil
+	}
+	if fallbackAPIKey == "" || fallbackAppKey == "" {
+		return nil, errors.New("missing the fallback api/app key pair to query Datadog")
+	}
+	fallbackEndpoint := config.Datadog.GetString("external_metrics_provider.fallback_endpoint")
+	if fallbackEndpoint == "" {
+		fallbackEndpoint = client.GetBaseUrl()
+	} else if err := validateEndpoint(fallbackEndpoint); err != nil {
+		return nil, err
+	}
+	fallback := newConfiguredClient(fallbackAPIKey, fallbackAppKey, fallbackEndpoint, transport)
+	log.Infof("Initialized the fallback Datadog Client for HPA: endpoint=%q", fallback.GetBaseUrl())
+	return newFailoverClient(client, fallback), nil
+}
+
+// newConfiguredClient returns a client querying the endpoint through the transport.
+func newConfiguredClient(apiKey, appKey, endpoint string, transport http.RoundTripper) *datadogClient {
+	client := newDatadogClient(apiKey, appKey)
+	client.HttpClient = &http.Client{Transport: transport}
+	if endpoint != "" {
+		client.SetBaseUrl(endpoint)
+	}
+	return client
+}
+
+// getDatadogEndpoint returns the base URL of the Datadog API to query, empty for the default one.
+func getDatadogEndpoint() (string, error) {
+	if endpoint := config.Datadog.GetString("external_metrics_provider.endpoint"); endpoint != "" {
+		return endpoint, validateEndpoint(endpoint)
+	}
+	site := config.Datadog.GetString("site")
+	if site == "" {
+		return "", nil
+	}
+	if strings.Contains(site, "/") {
+		return "", fmt.Errorf("invalid site %q to query Datadog, it should be a domain, e.g. datadoghq.eu", site)
+	}
+	endpoint := "https://api." + site
+	return endpoint, validateEndpoint(endpoint)
+}
+
+// validateEndpoint returns an error if the endpoint is not the URL of an http(s) server.
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q to query Datadog: %s", endpoint, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q to query Datadog, it should be an URL, e.g. https://api.datadoghq.eu", endpoint)
+	}
+	return nil
 }
@@ -0,0 +1,1592 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/zorkian/go-datadog-api.v2"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1531492452, 0)
+	cb := newCircuitBreaker(3, time.Minute, 30*time.Second)
+	cb.now = func() time.Time { return now }
+	serverErr := fmt.Errorf("API error 503 Service Unavailable: ")
+
+	// Query errors do not count as failures.
+	for i := 0; i < 5; i++ {
+		cb.record(fmt.Errorf("API error 400 Bad Request: "))
+	}
+	require.NoError(t, cb.allow())
+
+	// The failures are not consecutive within the window.
+	cb.record(serverErr)
+	cb.record(serverErr)
+	now = now.Add(2 * time.Minute)
+	cb.record(serverErr)
+	require.NoError(t, cb.allow())
+
+	cb.record(serverErr)
+	cb.record(serverErr)
+	assert.Equal(t, errCircuitOpen, cb.allow())
+	assert.Equal(t, circuitOpen, datadogCircuitBreaker.Value())
+
+	// A failure after the cooldown opens the breaker again.
+	now = now.Add(31 * time.Second)
+	require.NoError(t, cb.allow())
+	cb.record(serverErr)
+	assert.Equal(t, errCircuitOpen, cb.allow())
+
+	now = now.Add(31 * time.Second)
+	require.NoError(t, cb.allow())
+	cb.record(nil)
+	assert.False(t, cb.isOpen())
+	assert.Equal(t, circuitClosed, datadogCircuitBreaker.Value())
+
+	var nilBreaker *circuitBreaker
+	nilBreaker.record(serverErr)
+	assert.False(t, nilBreaker.isOpen())
+}
+
+func TestProcessor_UpdateExternalMetricsCircuitOpen(t *testing.T) {
+	calls := 0
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			calls++
+			return nil, fmt.Errorf("API error 502 Bad Gateway: ")
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, breaker: newCircuitBreaker(2, time.Minute, time.Minute)}
+	metrics := []custommetrics.ExternalMetricValue{
+		{MetricName: "requests_per_s", Labels: map[string]string{"foo": "bar"}, ValueFloat: 12, Valid: true},
+		{MetricName: "requests_per_s", Labels: map[string]string{"foo": "baz"}, ValueFloat: 14, Valid: true},
+	}
+
+	// The batch and the first of the individual queries fail.
+	updated, err := p.UpdateExternalMetricsWithContext(context.Background(), metrics)
+	require.Error(t, err)
+	assert.Equal(t, 2, calls)
+	require.Len(t, updated, 0)
+	assert.True(t, p.IsDegraded())
+
+	// The metrics keep their last known value while the queries are suspended.
+	updated, err = p.UpdateExternalMetricsWithContext(context.Background(), metrics)
+	require.Error(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Len(t, updated, 0)
+}
+
+func TestQueryErrorCause(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected error
+	}{
+		{fmt.Errorf("API error 400 Bad Request: {\"errors\": [\"Error parsing query\"]}"), ErrQuerySyntax},
+		{fmt.Errorf("API error 403 Forbidden: {\"errors\": [\"Forbidden\"]}"), ErrQueryUnauthorized},
+		{fmt.Errorf("API error 429 Too Many Requests: "), ErrQueryRateLimited},
+		{fmt.Errorf("API error 502 Bad Gateway: "), ErrDatadogUnreachable},
+		{&url.Error{Op: "Get", URL: "https://api.datadoghq.com", Err: timeoutError{}}, ErrDatadogUnreachable},
+		{nil, ErrNoDataPoints},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.expected), func(t *testing.T) {
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					return nil, tt.err
+				},
+			}
+			p := &Processor{datadogClient: datadogClient}
+
+			_, err := p.validateExternalMetric(context.Background(), "requests_per_s{foo:bar}")
+			require.Error(t, err)
+			assert.Equal(t, tt.expected, errors.Cause(err))
+			queryErr, ok := err.(*QueryError)
+			require.True(t, ok)
+			assert.Equal(t, "avg:requests_per_s{foo:bar}", queryErr.Query)
+			assert.Equal(t, tt.err, queryErr.Err)
+			assert.Equal(t, tt.err, queryErr.Unwrap())
+			assert.True(t, queryErr.Is(tt.expected))
+			// The failure mode is preserved when the error is wrapped.
+			assert.Equal(t, tt.expected, errors.Cause(errors.Wrap(err, "could not validate")))
+		})
+	}
+
+	unknown := fmt.Errorf("unexpected end of JSON input")
+	err := newQueryError("avg:requests_per_s{foo:bar}", unknown)
+	assert.Equal(t, unknown, errors.Cause(err))
+	assert.Equal(t, unknown, err.Unwrap())
+	assert.False(t, err.Is(ErrDatadogUnreachable))
+
+	err = newQueryError("avg:requests_per_s{*}", &queryPanicError{value: "boom"})
+	assert.Equal(t, ErrQueryPanic, errors.Cause(err))
+	assert.False(t, isTransient(err))
+	assert.Equal(t, "QueryPanic", eventReason(err))
+	assert.Equal(t, "error while executing metric query avg:requests_per_s{*}: the query panicked: boom", err.Error())
+}
+
+func TestDatadogClientQueryMetrics(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		if r.URL.Query().Get("api_key") != "api_key" || r.URL.Query().Get("application_key") != "app_key" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors": ["Forbidden"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"series": [{"metric": "requests_per_s", "scope": "foo:bar", "pointlist": [[1531492440000, 12.5], [1531492460000, null]]}]}`)
+	}))
+	defer server.Close()
+
+	client := newDatadogClient("api_key", "app_key")
+	client.SetBaseUrl(server.URL)
+	series, err := client.QueryMetrics(context.Background(), 1531492200, 1531492500, "avg:requests_per_s{foo:bar}")
+	require.NoError(t, err)
+	assert.Equal(t, "avg:requests_per_s{foo:bar}", query)
+	require.Len(t, series, 1)
+	assert.Equal(t, "requests_per_s", *series[0].Metric)
+	assert.Equal(t, "foo:bar", *series[0].Scope)
+	require.Len(t, series[0].Points, 2)
+	assert.Equal(t, 12.5, series[0].Points[0][1])
+	assert.True(t, math.IsNaN(series[0].Points[1][1]))
+
+	client = newDatadogClient("api_key", "wrong_key")
+	client.SetBaseUrl(server.URL)
+	_, err = client.QueryMetrics(context.Background(), 1531492200, 1531492500, "avg:requests_per_s{foo:bar}")
+	require.Error(t, err)
+	assert.Equal(t, 403, apiErrorStatus(err))
+
+	// The keys are redacted from the errors of the requests.
+	client.SetBaseUrl("http://127.0.0.1:0")
+	_, err = client.QueryMetrics(context.Background(), 1531492200, 1531492500, "avg:requests_per_s{foo:bar}")
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "wrong_key")
+}
+
+// connectProxy is an https proxy tunneling the CONNECT requests, it counts the tunnels opened.
+type connectProxy struct {
+	tunnels int32
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	atomic.AddInt32(&p.tunnels, 1)
+	fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func TestNewDatadogClientProxy(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"series": [{"metric": "requests_per_s", "scope": "foo:bar", "pointlist": [[1531492440000, 12.5]]}]}`)
+	}))
+	defer server.Close()
+	proxy := &connectProxy{}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	// The certificate of the test server is only trusted through the CA file.
+	caFile, err := ioutil.TempFile("", "datadog-ca")
+	require.NoError(t, err)
+	defer os.Remove(caFile.Name())
+	err = pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	require.NoError(t, err)
+	caFile.Close()
+
+	defer config.Datadog.Set("api_key", config.Datadog.Get("api_key"))
+	defer config.Datadog.Set("app_key", config.Datadog.Get("app_key"))
+	defer config.Datadog.Set("external_metrics_provider.endpoint", config.Datadog.Get("external_metrics_provider.endpoint"))
+	defer config.Datadog.Set("proxy.https", config.Datadog.Get("proxy.https"))
+	defer config.Datadog.Set("proxy.no_proxy", config.Datadog.Get("proxy.no_proxy"))
+	defer config.Datadog.Set("external_metrics_provider.ca_file", config.Datadog.Get("external_metrics_provider.ca_file"))
+	config.Datadog.Set("api_key", "api_key")
+	config.Datadog.Set("app_key", "app_key")
+	config.Datadog.Set("external_metrics_provider.endpoint", server.URL)
+
+	config.Datadog.Set("proxy.https", proxyServer.URL)
+	client, err := NewDatadogClient()
+	require.NoError(t, err)
+	_, err = client.QueryMetrics(context.Background(), 1531492200, 1531492500, "avg:requests_per_s{foo:bar}")
+	require.Error(t, err, "the certificate of the server should not be trusted")
+
+	config.Datadog.Set("external_metrics_provider.ca_file", caFile.Name())
+	client, err = NewDatadogClient()
+	require.NoError(t, err)
+	series, err := client.QueryMetrics(context.Background(), 1531492200, 1531492500, "avg:requests_per_s{foo:bar}")
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&proxy.tunnels))
+
+	// The hosts of no_proxy are queried directly.
+	config.Datadog.Set("proxy.no_proxy", []string{strings.TrimPrefix(server.URL, "https://")})
+	client, err = NewDatadogClient()
+	require.NoError(t, err)
+	_, err = client.QueryMetrics(context.Background(), 1531492200, 1531492500, "avg:requests_per_s{foo:bar}")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&proxy.tunnels))
+}
+
+func TestNewDatadogClientMisconfigured(t *testing.T) {
+	invalidCA, err := ioutil.TempFile("", "datadog-ca")
+	require.NoError(t, err)
+	defer os.Remove(invalidCA.Name())
+	fmt.Fprint(invalidCA, "not a certificate")
+	invalidCA.Close()
+
+	defer config.Datadog.Set("api_key", config.Datadog.Get("api_key"))
+	defer config.Datadog.Set("app_key", config.Datadog.Get("app_key"))
+	defer config.Datadog.Set("proxy.https", config.Datadog.Get("proxy.https"))
+	defer config.Datadog.Set("external_metrics_provider.ca_file", config.Datadog.Get("external_metrics_provider.ca_file"))
+	config.Datadog.Set("api_key", "api_key")
+	config.Datadog.Set("app_key", "app_key")
+
+	tests := []struct {
+		desc   string
+		proxy  string
+		caFile string
+		error  string
+	}{
+		{"unsupported proxy scheme", "ftp://proxy:21", "", "invalid proxy.https"},
+		{"proxy without host", "http://user:secret@", "", "invalid proxy.https"},
+		{"missing CA file", "", "/nonexistent/ca.pem", "could not read the CA file"},
+		{"invalid CA file", "", invalidCA.Name(), "invalid CA file"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			config.Datadog.Set("proxy.https", tt.proxy)
+			config.Datadog.Set("external_metrics_provider.ca_file", tt.caFile)
+			_, err := NewDatadogClient()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.error)
+			assert.NotContains(t, err.Error(), "secret")
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2018, 7, 13, 14, 34, 12, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-3", 0},
+		{"Fri, 13 Jul 2018 14:34:42 GMT", 30 * time.Second},
+		{"Fri, 13 Jul 2018 14:33:42 GMT", 0},
+		{"soon", 0},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %q", i, tt.value), func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseRetryAfter(tt.value, now))
+		})
+	}
+}
+
+func TestDatadogClientRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"errors": ["Rate limit exceeded"]}`)
+	}))
+	defer server.Close()
+
+	client := newDatadogClient("api_key", "app_key")
+	client.SetBaseUrl(server.URL)
+	_, err := client.QueryMetrics(context.Background(), 1531492200, 1531492500, "avg:requests_per_s{foo:bar}")
+	require.Error(t, err)
+	assert.Equal(t, 429, apiErrorStatus(err))
+	assert.Equal(t, ErrQueryRateLimited, errorKind(err))
+	assert.Equal(t, 2*time.Second, retryAfterDelay(err))
+}
+
+func TestDatadogClientQueryMetricsContext(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request is aborted with its context.
+		<-r.Context().Done()
+		close(done)
+	}))
+	defer server.Close()
+
+	client := newDatadogClient("api_key", "app_key")
+	client.SetBaseUrl(server.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.QueryMetrics(ctx, 1531492200, 1531492500, "avg:requests_per_s{foo:bar}")
+	require.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.NotContains(t, err.Error(), "app_key")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the request was not aborted")
+	}
+}
+
+func TestProcessor_HealthCheck(t *testing.T) {
+	tests := []struct {
+		desc     string
+		err      error
+		expected error
+	}{
+		{"healthy", nil, nil},
+		{"forbidden", fmt.Errorf("API error 403 Forbidden: {\"errors\": [\"Forbidden\"]}"), ErrQueryUnauthorized},
+		{"server error", fmt.Errorf("API error 500 Internal Server Error: "), ErrDatadogUnreachable},
+		{"connection error", fmt.Errorf("dial tcp: connection refused"), ErrDatadogUnreachable},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			var query string
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, q string) ([]datadog.Series, error) {
+					query = q
+					return nil, tt.err
+				},
+			}
+			p := &Processor{datadogClient: datadogClient}
+
+			err := p.HealthCheck(context.Background())
+			assert.Equal(t, healthCheckQuery, query)
+			if tt.expected == nil {
+				assert.NoError(t, err)
+				assert.Equal(t, healthCheckOK, datadogHealth.Value())
+				return
+			}
+			assert.Equal(t, tt.expected, errors.Cause(err))
+			assert.Equal(t, err.Error(), datadogHealth.Value())
+		})
+	}
+}
+
+func TestProcessor_HealthCheckCancelled(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			<-block
+			return nil, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := p.HealthCheck(ctx)
+	assert.Equal(t, ErrDatadogUnreachable, errors.Cause(err))
+}
+
+func TestQueryBudget(t *testing.T) {
+	now := time.Unix(1531492452, 0)
+	b := newQueryBudget(3)
+	b.now = func() time.Time { return now }
+	require.True(t, b.limited())
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.allow())
+		b.record()
+		now = now.Add(10 * time.Second)
+	}
+	assert.Equal(t, errBudgetExceeded, b.allow())
+
+	// The calls older than a minute are not counted anymore.
+	now = now.Add(30 * time.Second)
+	require.NoError(t, b.allow())
+	b.record()
+	assert.Equal(t, errBudgetExceeded, b.allow())
+
+	// Without a max, the calls are only counted.
+	unlimited := newQueryBudget(0)
+	assert.False(t, unlimited.limited())
+	for i := 0; i < 10; i++ {
+		unlimited.record()
+	}
+	assert.NoError(t, unlimited.allow())
+
+	var nilBudget *queryBudget
+	nilBudget.record()
+	assert.NoError(t, nilBudget.allow())
+	assert.False(t, nilBudget.limited())
+}
+
+func TestProcessor_UpdateExternalMetricsBudget(t *testing.T) {
+	metricName := "requests_per_s"
+	now := time.Unix(1531492452, 0)
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			var series []datadog.Series
+			for _, scope := range []string{"role:frontend", "role:backend"} {
+				scope := scope
+				series = append(series, datadog.Series{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(now.Unix() * 1000), 20}},
+				})
+			}
+			return series, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, budget: newQueryBudget(1), current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return now }
+	p.budget.now = p.clock
+	// The metrics are queried in separate batches, the backend one expires first.
+	emList := []custommetrics.ExternalMetricValue{
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default"},
+			Timestamp:  now.Add(-time.Minute).Unix(),
+			ValueFloat: 10,
+			Valid:      true,
+		},
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"role": "backend"},
+			HPA:        custommetrics.ObjectReference{Name: "bar", Namespace: "default"},
+			Timestamp:  now.Add(-2 * time.Minute).Unix(),
+			ValueFloat: 10,
+			Valid:      true,
+			Aggregator: aggregatorMax,
+		},
+	}
+
+	// Only the metric nearest its expiry is refreshed, the other one is deferred with its last value.
+	updated, err := p.UpdateExternalMetricsWithContext(p.getContext(), emList)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"max:requests_per_s{role:backend}"}, queries)
+	require.Len(t, updated, 1)
+	assert.Equal(t, "bar", updated[0].HPA.Name)
+	assert.True(t, updated[0].Valid)
+	assert.Equal(t, 20.0, updated[0].ValueFloat)
+
+	// Once the budget is available again, the deferred metric is refreshed.
+	queries = nil
+	now = now.Add(time.Minute + time.Second)
+	updated, err = p.UpdateExternalMetricsWithContext(p.getContext(), emList[:1])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"avg:requests_per_s{role:frontend}"}, queries)
+	require.Len(t, updated, 1)
+	assert.Equal(t, 20.0, updated[0].ValueFloat)
+}
+
+func TestShouldFailover(t *testing.T) {
+	tests := []struct {
+		desc     string
+		err      error
+		expected bool
+	}{
+		{"connection refused", &url.Error{Op: "Get", URL: "https://api.datadoghq.com", Err: fmt.Errorf("connection refused")}, true},
+		{"server error", fmt.Errorf("API error 503 Service Unavailable: "), true},
+		{"unauthorized", fmt.Errorf("API error 403 Forbidden: {\"errors\": [\"Forbidden\"]}"), true},
+		{"invalid query", fmt.Errorf("API error 400 Bad Request: {\"errors\": [\"Error parsing query\"]}"), false},
+		{"rate limited", fmt.Errorf("API error 429 Too Many Requests: "), false},
+		{"unknown", fmt.Errorf("invalid character"), false},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			assert.Equal(t, tt.expected, shouldFailover(tt.err))
+		})
+	}
+}
+
+func TestFailoverClient(t *testing.T) {
+	var calls []string
+	failing := map[string]error{}
+	newClient := func(name string) DatadogClient {
+		return &fakeDatadogClient{
+			queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+				calls = append(calls, name)
+				if err := failing[name]; err != nil {
+					return nil, err
+				}
+				return []datadog.Series{{Metric: &name}}, nil
+			},
+		}
+	}
+	primary, secondary := newClient("primary"), newClient("secondary")
+	assert.Equal(t, primary, newFailoverClient(primary))
+	client := newFailoverClient(primary, secondary)
+
+	// The primary client is queried while it answers.
+	series, err := client.QueryMetrics(context.Background(), 0, 1, "avg:requests_per_s{*}")
+	require.NoError(t, err)
+	assert.Equal(t, "primary", *series[0].Metric)
+	assert.Equal(t, []string{"primary"}, calls)
+
+	// The errors of the queries are not failed over.
+	calls = nil
+	failing["primary"] = fmt.Errorf("API error 400 Bad Request: ")
+	_, err = client.QueryMetrics(context.Background(), 0, 1, "avg:requests_per_s{*}")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"primary"}, calls)
+
+	// The queries fail over to the secondary client and stick to it.
+	calls = nil
+	failing["primary"] = fmt.Errorf("API error 403 Forbidden: ")
+	series, err = client.QueryMetrics(context.Background(), 0, 1, "avg:requests_per_s{*}")
+	require.NoError(t, err)
+	assert.Equal(t, "secondary", *series[0].Metric)
+	delete(failing, "primary")
+	series, err = client.QueryMetrics(context.Background(), 0, 1, "avg:requests_per_s{*}")
+	require.NoError(t, err)
+	assert.Equal(t, "secondary", *series[0].Metric)
+	assert.Equal(t, []string{"primary", "secondary", "secondary"}, calls)
+
+	// The queries fail back to the primary client once the secondary one fails.
+	calls = nil
+	failing["secondary"] = fmt.Errorf("API error 502 Bad Gateway: ")
+	series, err = client.QueryMetrics(context.Background(), 0, 1, "avg:requests_per_s{*}")
+	require.NoError(t, err)
+	assert.Equal(t, "primary", *series[0].Metric)
+	assert.Equal(t, []string{"secondary", "primary"}, calls)
+
+	// When all the clients fail, the error of the last one is returned and the active client is unchanged.
+	calls = nil
+	failing["primary"] = fmt.Errorf("API error 503 Service Unavailable: ")
+	_, err = client.QueryMetrics(context.Background(), 0, 1, "avg:requests_per_s{*}")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "502")
+	assert.Equal(t, []string{"primary", "secondary"}, calls)
+	assert.Equal(t, 0, client.(*failoverClient).active)
+
+}
+
+func TestNewDatadogClientFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("api_key") != "fallback_api_key" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors": ["Forbidden"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"series": [{"metric": "requests_per_s", "scope": "foo:bar", "pointlist": [[1531492440000, 12.5]]}]}`)
+	}))
+	defer server.Close()
+
+	defer config.Datadog.Set("api_key", config.Datadog.Get("api_key"))
+	defer config.Datadog.Set("app_key", config.Datadog.Get("app_key"))
+	defer config.Datadog.Set("external_metrics_provider.endpoint", config.Datadog.Get("external_metrics_provider.endpoint"))
+	defer config.Datadog.Set("external_metrics_provider.fallback_api_key", config.Datadog.Get("external_metrics_provider.fallback_api_key"))
+	defer config.Datadog.Set("external_metrics_provider.fallback_app_key", config.Datadog.Get("external_metrics_provider.fallback_app_key"))
+	config.Datadog.Set("api_key", "api_key")
+	config.Datadog.Set("app_key", "app_key")
+	config.Datadog.Set("external_metrics_provider.endpoint", server.URL)
+
+	// Both keys of the fallback are required.
+	config.Datadog.Set("external_metrics_provider.fallback_api_key", "fallback_api_key")
+	_, err := NewDatadogClient()
+	require.Error(t, err)
+
+	// The fallback uses the endpoint of the primary client by default.
+	config.Datadog.Set("external_metrics_provider.fallback_app_key", "fallback_app_key")
+	client, err := NewDatadogClient()
+	require.NoError(t, err)
+	require.IsType(t, &failoverClient{}, client)
+	series, err := client.QueryMetrics(context.Background(), 1531492200, 1531492500, "avg:requests_per_s{foo:bar}")
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Equal(t, 1, client.(*failoverClient).active)
+
+	// The endpoint of the failover client is validated by the Processor.
+	assert.Equal(t, server.URL, client.(endpointClient).GetBaseUrl())
+	p, err := NewProcessor(client)
+	require.NoError(t, err)
+	defer p.Stop()
+	assert.Equal(t, client, p.datadogClient)
+}
+
+func TestNegativeCache(t *testing.T) {
+	now := time.Unix(1531492452, 0)
+	c := newNegativeCache(time.Minute)
+	syntaxErr := &QueryError{Query: "avg:foo{bar:baz}", Kind: ErrQuerySyntax}
+	noDataErr := &QueryError{Query: "avg:foo{bar:qux}", Kind: ErrNoDataPoints}
+
+	// The syntax errors are cached at once, until the TTL.
+	c.record("syntax", syntaxErr, now)
+	err, ok := c.get("syntax", now.Add(30*time.Second))
+	require.True(t, ok)
+	assert.Equal(t, syntaxErr, err)
+	_, ok = c.get("syntax", now.Add(time.Minute))
+	assert.False(t, ok)
+
+	// The answers without points are cached once they are consecutive.
+	c.record("nodata", noDataErr, now)
+	_, ok = c.get("nodata", now)
+	assert.False(t, ok)
+	c.record("nodata", noDataErr, now)
+	_, ok = c.get("nodata", now)
+	assert.True(t, ok)
+	c.forget("nodata")
+	_, ok = c.get("nodata", now)
+	assert.False(t, ok)
+	c.record("nodata", noDataErr, now)
+	_, ok = c.get("nodata", now)
+	assert.False(t, ok)
+
+	// The transient errors are not cached.
+	c.record("unreachable", &QueryError{Query: "avg:foo{*}", Kind: ErrDatadogUnreachable}, now)
+	_, ok = c.get("unreachable", now)
+	assert.False(t, ok)
+
+	// The failures not recorded again are forgotten.
+	c.record("other", syntaxErr, now.Add(3*time.Minute))
+	assert.Len(t, c.entries, 1)
+
+	var nilCache *negativeCache
+	nilCache.record("syntax", syntaxErr, now)
+	_, ok = nilCache.get("syntax", now)
+	assert.False(t, ok)
+}
+
+func TestProcessor_NegativeCache(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	current := time.Unix(1531492452, 0)
+	// queries counts the calls querying each metric, alone or in a batch.
+	queries := make(map[string]int)
+	count := func(query string) {
+		for _, metric := range []string{"requets_per_s{role:frontend}", "requests_per_s{role:backend}", "requests_per_s{role:frontend}"} {
+			if strings.Contains(query, metric) {
+				queries[metric]++
+			}
+		}
+	}
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			count(query)
+			switch {
+			case strings.Contains(query, "requets_per_s"):
+				// Datadog rejects the whole batch.
+				return nil, fmt.Errorf("API error 400 Bad Request: {\"errors\": [\"Error parsing query\"]}")
+			case query == "avg:requests_per_s{role:backend}":
+				return nil, nil
+			}
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(current.Unix() * 1000), 12}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, negativeCache: newNegativeCache(2 * time.Minute)}
+	p.clock = func() time.Time { return current }
+	emList := []custommetrics.ExternalMetricValue{
+		{
+			MetricName: "requets_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+		},
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"role": "backend"},
+		},
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"role": "frontend"},
+		},
+	}
+
+	for i := 0; i < 4; i++ {
+		externalMetrics, err := p.ValidateExternalMetrics(context.Background(), emList)
+		require.NoError(t, err)
+		require.Len(t, externalMetrics, 3)
+		assert.False(t, externalMetrics[0].Valid)
+		assert.False(t, externalMetrics[1].Valid)
+		assert.True(t, externalMetrics[2].Valid)
+		current = current.Add(30 * time.Second)
+	}
+	// The syntax error is cached at once, the answer without points once it is consecutive.
+	// The first batch is rejected and its metrics are queried individually, then the broken ones are left out.
+	assert.Equal(t, 2, queries["requets_per_s{role:frontend}"])
+	assert.Equal(t, 3, queries["requests_per_s{role:backend}"])
+	assert.Equal(t, 5, queries["requests_per_s{role:frontend}"])
+
+	// The failures are checked again after the TTL, once the metric is fixed it is valid again.
+	current = current.Add(time.Minute)
+	scope = "role:backend"
+	datadogClient.queryMetricsFunc = func(from, to int64, query string) ([]datadog.Series, error) {
+		count(query)
+		return []datadog.Series{
+			{
+				Metric: &metricName,
+				Scope:  &scope,
+				Points: []datadog.DataPoint{{float64(current.Unix() * 1000), 12}},
+			},
+		}, nil
+	}
+	externalMetrics, err := p.ValidateExternalMetrics(context.Background(), emList[1:2])
+	require.NoError(t, err)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.Equal(t, 4, queries["requests_per_s{role:backend}"])
+}
+
+func TestProcessor_RawCapture(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	now := time.Unix(1531492452, 0)
+	points := []datadog.DataPoint{
+		{float64(now.Unix()*1000 - 40000), 10},
+		{float64(now.Unix()*1000 - 20000), 11},
+		{float64(now.Unix() * 1000), 15},
+	}
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: points}}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{aggregator: aggregatorMax}}
+	p.clock = func() time.Time { return now }
+	emList := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"foo": "bar"}},
+	}
+
+	// The points are not captured by default.
+	metrics, _, err := p.queryExternalMetrics(context.Background(), emList)
+	require.NoError(t, err)
+	assert.Nil(t, metrics["requests_per_s{foo:bar}"].raw)
+	assert.Nil(t, p.State().RawCaptures)
+
+	// The last points are captured along with the aggregator reducing them, and served with the state.
+	p.current.capturePoints = 2
+	metrics, _, err = p.queryExternalMetrics(context.Background(), emList)
+	require.NoError(t, err)
+	expected := RawCapture{
+		Scope:       scope,
+		Aggregation: aggregatorMax,
+		Points:      points[1:],
+		Timestamp:   now.Unix(),
+	}
+	point := metrics["requests_per_s{foo:bar}"]
+	assert.Equal(t, 15.0, point.value)
+	require.NotNil(t, point.raw)
+	assert.Equal(t, expected, *point.raw)
+	assert.Equal(t, map[string]RawCapture{"max:requests_per_s{foo:bar}": expected}, p.State().RawCaptures)
+
+	// The number of captures is bounded, the oldest one is evicted.
+	for i := 0; i < maxRawCaptures; i++ {
+		p.recordCapture(fmt.Sprintf("avg:requests_per_s{foo:%d}", i), &RawCapture{Timestamp: now.Unix() + 1})
+	}
+	captures := p.State().RawCaptures
+	assert.Len(t, captures, maxRawCaptures)
+	assert.NotContains(t, captures, "max:requests_per_s{foo:bar}")
+
+	p.resetCaptures()
+	assert.Nil(t, p.State().RawCaptures)
+}
+
+func TestExpandFormula(t *testing.T) {
+	queries := map[string]string{
+		"a":      "sum:http.errors{service:web}",
+		"b":      "sum:http.requests{service:web}",
+		"req_2":  "sum:http.requests{service:api}",
+		"empty_": "",
+	}
+	tests := []struct {
+		formula  string
+		expected string
+		err      string
+	}{
+		{"a/b", "(sum:http.errors{service:web})/(sum:http.requests{service:web})", ""},
+		{" 100 * a / (b + req_2) ", "100*(sum:http.errors{service:web})/((sum:http.requests{service:web})+(sum:http.requests{service:api}))", ""},
+		{"-a", "-(sum:http.errors{service:web})", ""},
+		{"a/c", "", `references the undefined query "c", set it with the external-metrics.datadoghq.com/query.c annotation`},
+		{"a/empty_", "", `references the undefined query "empty_"`},
+		{"a b", "", "unexpected operand at position 2"},
+		{"a/", "", "incomplete expression"},
+		{"(a/b", "", "incomplete expression"},
+		{"a/b)", "", `unexpected ')' at position 3`},
+		{"a%b", "", `unexpected '%' at position 1`},
+		{"", "", "incomplete expression"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.formula), func(t *testing.T) {
+			expr, err := expandFormula(tt.formula, queries)
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, expr)
+		})
+	}
+}
+
+func TestProcessor_FormulaAnnotation(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	errorRateScope := "service:web"
+	now := time.Unix(1531492452, 0)
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			if query == "(sum:http.errors{service:web})/(sum:http.requests{service:web})" {
+				// Datadog names the series of the formulas after their expression.
+				expression := "(http.errors / http.requests)"
+				return []datadog.Series{{Metric: &expression, Scope: &errorRateScope, Points: []datadog.DataPoint{{float64(now.Unix() * 1000), 0.02}}}}, nil
+			}
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{float64(now.Unix() * 1000), 15}}}}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+	p.clock = func() time.Time { return now }
+	newHPA := func(name string, annotations map[string]string) *autoscalingv2.HorizontalPodAutoscaler {
+		return &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				Metrics: []autoscalingv2.MetricSpec{
+					{
+						Type: autoscalingv2.ExternalMetricSourceType,
+						External: &autoscalingv2.ExternalMetricSource{
+							MetricName:     metricName,
+							MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "frontend"}},
+						},
+					},
+				},
+			},
+		}
+	}
+	operands := map[string]string{
+		formulaQueryAnnotationPrefix + "a": "sum:http.errors{service:web}",
+		formulaQueryAnnotationPrefix + "b": "sum:http.requests{service:web}",
+	}
+	withFormula := func(formula string) map[string]string {
+		annotations := map[string]string{formulaAnnotation: formula}
+		for annotation, query := range operands {
+			annotations[annotation] = query
+		}
+		return annotations
+	}
+
+	// The formula is queried alone, the metrics of the other HPAs still in a batch.
+	externalMetrics := p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("value", nil),
+		newHPA("ratio", withFormula("a/b")),
+		newHPA("typo", withFormula("a/c")),
+	})
+	require.Len(t, externalMetrics, 3)
+	assert.Equal(t, []string{"avg:requests_per_s{role:frontend}", "(sum:http.errors{service:web})/(sum:http.requests{service:web})"}, queries)
+
+	values := make(map[string]custommetrics.ExternalMetricValue)
+	for _, em := range externalMetrics {
+		values[em.HPA.Name] = em
+	}
+	assert.True(t, values["value"].Valid)
+	assert.Equal(t, 15.0, values["value"].ValueFloat)
+	assert.True(t, values["ratio"].Valid)
+	assert.Equal(t, 0.02, values["ratio"].ValueFloat)
+	assert.Equal(t, "(sum:http.errors{service:web})/(sum:http.requests{service:web})", values["ratio"].Query)
+	assert.Equal(t, "a/b", values["ratio"].Formula)
+	// The formulas referencing undefined queries are invalid, with the operand missing.
+	assert.False(t, values["typo"].Valid)
+	assert.Contains(t, values["typo"].LastError, `the undefined query "c"`)
+
+	// The refreshes query the formula with the query options of the HPA.
+	queries = nil
+	ratio := values["ratio"]
+	ratio.Timestamp = 0
+	ratio.LastSuccessTimestamp = 0
+	ratio.QueryWindow = 600
+	updated := p.UpdateExternalMetrics([]custommetrics.ExternalMetricValue{ratio})
+	require.Len(t, updated, 1)
+	assert.True(t, updated[0].Valid)
+	assert.Equal(t, []string{"(sum:http.errors{service:web})/(sum:http.requests{service:web})"}, queries)
+
+	// A formula matching several series is invalid.
+	datadogClient.queryMetricsFunc = func(from, to int64, query string) ([]datadog.Series, error) {
+		point := []datadog.DataPoint{{float64(now.Unix() * 1000), 0.02}}
+		return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: point}, {Metric: &metricName, Scope: &errorRateScope, Points: point}}, nil
+	}
+	updated = p.UpdateExternalMetrics([]custommetrics.ExternalMetricValue{ratio})
+	require.Len(t, updated, 1)
+	assert.False(t, updated[0].Valid)
+	assert.Equal(t, errFormulaSeries.Error(), updated[0].LastError)
+}
+
+func TestRenderQueryTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		scope    string
+		expected string
+		err      error
+	}{
+		{"sum:{metric}{{scope}}.rollup(max, 60)", "role:frontend", "sum:requests_per_s{role:frontend}.rollup(max, 60)", nil},
+		{"top(avg:{metric}{{scope}} by {host}, 5, 'max', 'desc')", "*", "top(avg:requests_per_s{*} by {host}, 5, 'max', 'desc')", nil},
+		{"{metric}{{scope}} / {metric}{{scope}}.rollup(avg, 3600)", "a:b", "requests_per_s{a:b} / requests_per_s{a:b}.rollup(avg, 3600)", nil},
+		{"sum:static{env:prod}", "role:frontend", "sum:static{env:prod}", nil},
+		{" ", "role:frontend", "", errEmptyQueryTemplate},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.template), func(t *testing.T) {
+			query, err := renderQueryTemplate(tt.template, "requests_per_s", tt.scope)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.expected, query)
+		})
+	}
+}
+
+func TestProcessor_QueryTemplateAnnotation(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "kube_cluster_name:prod,role:frontend"
+	now := time.Unix(1531492452, 0)
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{float64(now.Unix() * 1000), 15}}}}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, clusterTag: clusterTag("prod")}
+	p.clock = func() time.Time { return now }
+	newHPA := func(name string, annotations map[string]string) *autoscalingv2.HorizontalPodAutoscaler {
+		return &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				Metrics: []autoscalingv2.MetricSpec{
+					{
+						Type: autoscalingv2.ExternalMetricSourceType,
+						External: &autoscalingv2.ExternalMetricSource{
+							MetricName:     metricName,
+							MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "frontend"}},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	// The template is rendered with the name of the metric and its scope, and queried alone as is.
+	externalMetrics := p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("template", map[string]string{queryTemplateAnnotation: "sum:{metric}{{scope}}.rollup(max, 60)"}),
+	})
+	require.Len(t, externalMetrics, 1)
+	assert.Equal(t, []string{"sum:requests_per_s{kube_cluster_name:prod,role:frontend}.rollup(max, 60)"}, queries)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.Equal(t, 15.0, externalMetrics[0].ValueFloat)
+	assert.Equal(t, "sum:{metric}{{scope}}.rollup(max, 60)", externalMetrics[0].QueryTemplate)
+
+	// An empty template is ignored, the metric is queried like the others.
+	queries = nil
+	externalMetrics = p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("empty", map[string]string{queryTemplateAnnotation: " "}),
+	})
+	require.Len(t, externalMetrics, 1)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.Empty(t, externalMetrics[0].QueryTemplate)
+	assert.Equal(t, []string{"avg:requests_per_s{kube_cluster_name:prod,role:frontend}"}, queries)
+}
+
+func TestLoadCanary(t *testing.T) {
+	defer config.Datadog.Set("external_metrics_provider.canary_query", config.Datadog.Get("external_metrics_provider.canary_query"))
+	defer config.Datadog.Set("external_metrics_provider.canary_interval", config.Datadog.Get("external_metrics_provider.canary_interval"))
+	defer config.Datadog.Set("external_metrics_provider.canary_min", config.Datadog.Get("external_metrics_provider.canary_min"))
+	defer config.Datadog.Set("external_metrics_provider.canary_max", config.Datadog.Get("external_metrics_provider.canary_max"))
+
+	// The canary is disabled by default.
+	assert.Nil(t, loadCanary())
+
+	config.Datadog.Set("external_metrics_provider.canary_query", "avg:datadog.agent.running{*}")
+	config.Datadog.Set("external_metrics_provider.canary_min", "0.5")
+	c := loadCanary()
+	require.NotNil(t, c)
+	assert.Equal(t, "avg:datadog.agent.running{*}", c.query)
+	assert.Equal(t, time.Minute, c.interval)
+	require.NotNil(t, c.min)
+	assert.Equal(t, 0.5, *c.min)
+	assert.Nil(t, c.max)
+
+	// The invalid bounds are ignored.
+	config.Datadog.Set("external_metrics_provider.canary_max", "one")
+	assert.Nil(t, loadCanary().max)
+	config.Datadog.Set("external_metrics_provider.canary_max", "0.1")
+	c = loadCanary()
+	assert.Nil(t, c.min)
+	assert.Nil(t, c.max)
+
+	config.Datadog.Set("external_metrics_provider.canary_interval", 0)
+	assert.Nil(t, loadCanary())
+}
+
+func TestProcessor_CheckCanary(t *testing.T) {
+	metricName := "datadog.agent.running"
+	scope := "*"
+	now := time.Unix(1531492452, 0)
+	serie := datadog.Series{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{float64(now.Unix() * 1000), 1}}}
+	one, two := 1.0, 2.0
+	tests := []struct {
+		desc    string
+		series  []datadog.Series
+		err     error
+		min     *float64
+		max     *float64
+		healthy bool
+		errMsg  string
+	}{
+		{"a value in the range is healthy", []datadog.Series{serie}, nil, &one, &two, true, ""},
+		{"an unbounded value is healthy", []datadog.Series{serie}, nil, nil, nil, true, ""},
+		{"a value out of the range drifted", []datadog.Series{serie}, nil, &two, nil, false, "the value 1 of the canary is out of its expected range [2, +inf]"},
+		{"a rejected key fails", nil, fmt.Errorf("API error 403 Forbidden: "), nil, nil, false, "403 Forbidden"},
+		{"no serie fails", nil, nil, nil, nil, false, "the canary matched 0 series, it should match one"},
+		{"several series fail", []datadog.Series{serie, serie}, nil, nil, nil, false, "the canary matched 2 series, it should match one"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			var query string
+			var to int64
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, end int64, q string) ([]datadog.Series, error) {
+					query, to = q, end
+					return tt.series, tt.err
+				},
+			}
+			p := &Processor{
+				datadogClient: datadogClient,
+				canary:        &canary{query: "avg:datadog.agent.running{*}", interval: time.Minute, min: tt.min, max: tt.max},
+				current:       settings{aggregator: aggregatorAvg, queryOffset: time.Minute, queryWindow: 5 * time.Minute},
+			}
+			p.clock = func() time.Time { return now }
+
+			err := p.CheckCanary(context.Background())
+			assert.Equal(t, "avg:datadog.agent.running{*}", query)
+			assert.Equal(t, now.Unix()-60, to)
+			if tt.healthy {
+				require.NoError(t, err)
+				assert.Equal(t, 1.0, readTelemetry(t, canaryHealthyTelemetry))
+				assert.Equal(t, 1.0, readTelemetry(t, canaryValueTelemetry))
+				assert.Equal(t, healthCheckOK, datadogCanary.Value())
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+			assert.Equal(t, 0.0, readTelemetry(t, canaryHealthyTelemetry))
+			assert.Equal(t, err.Error(), datadogCanary.Value())
+		})
+	}
+
+	// The disabled canary is not queried.
+	p := &Processor{datadogClient: &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			t.Fatal("the disabled canary was queried")
+			return nil, nil
+		},
+	}}
+	assert.NoError(t, p.CheckCanary(context.Background()))
+	p.RunCanary(make(chan struct{}))
+}
+
+func TestProcessor_RunCanary(t *testing.T) {
+	checks := make(chan struct{}, 10)
+	metricName := "datadog.agent.running"
+	scope := "*"
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			checks <- struct{}{}
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{float64(to * 1000), 1}}}}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, canary: &canary{query: "avg:datadog.agent.running{*}", interval: 10 * time.Millisecond}}
+
+	// The canary is checked on start, then every interval until it is stopped.
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		p.RunCanary(stopCh)
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-checks:
+		case <-time.After(time.Second):
+			t.Fatalf("the canary was not checked %d times", i+1)
+		}
+	}
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the canary was not stopped")
+	}
+}
+
+func TestProcessor_ReduceSeries(t *testing.T) {
+	now := time.Unix(1531492452, 0)
+	serie := func(values ...float64) datadog.Series {
+		points := make([]datadog.DataPoint, 0, len(values))
+		for i, v := range values {
+			points = append(points, datadog.DataPoint{float64(now.Add(time.Duration(i-len(values)+1)*time.Minute).Unix() * 1000), v})
+		}
+		return datadog.Series{Points: points}
+	}
+	null := math.NaN()
+	// The series have differing lengths: a pod reporting for the whole window, one that stopped reporting and one
+	// that just started without any point yet.
+	full := serie(10, 20, 30)
+	partial := serie(40, null, null)
+	empty := serie(null, null, null, null)
+
+	tests := []struct {
+		desc       string
+		average    string
+		nullSeries string
+		series     []datadog.Series
+		value      float64
+		ok         bool
+	}{
+		{"the last serie is kept without an average", "", nullSeriesSkip, []datadog.Series{full, partial, empty}, 40, true},
+		{"the series are not averaged with none", seriesAverageNone, nullSeriesZero, []datadog.Series{full, partial, empty}, 40, true},
+		{"the mean skips the null series", seriesAverageMean, nullSeriesSkip, []datadog.Series{full, partial, empty}, 30, true},
+		{"the mean counts the null series as 0", seriesAverageMean, nullSeriesZero, []datadog.Series{full, partial, empty}, 20, true},
+		{"the weighted average skips the null series", seriesAverageWeighted, nullSeriesSkip, []datadog.Series{full, partial, empty}, 25, true},
+		{"the weighted average counts the null points as 0", seriesAverageWeighted, nullSeriesZero, []datadog.Series{full, partial, empty}, 12.5, true},
+		{"a single serie is not averaged", seriesAverageMean, nullSeriesZero, []datadog.Series{partial}, 40, true},
+		{"only null series are left out", seriesAverageMean, nullSeriesZero, []datadog.Series{empty, empty}, 0, false},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			p := &Processor{}
+			s := settings{aggregator: aggregatorAvg, seriesAverage: tt.average, nullSeries: tt.nullSeries}
+			point, ok := p.reduceSeries("requests_per_s{*}", tt.series, queryOptions{aggregator: aggregatorAvg}, s)
+			require.Equal(t, tt.ok, ok)
+			if !ok {
+				return
+			}
+			assert.True(t, point.valid)
+			assert.Equal(t, tt.value, point.value)
+		})
+	}
+
+	// The point of the average is the one of the most recent serie, an invalid serie invalidates it.
+	p := &Processor{}
+	s := settings{seriesAverage: seriesAverageMean, nullSeries: nullSeriesSkip}
+	point, ok := p.reduceSeries("requests_per_s{*}", []datadog.Series{partial, full}, queryOptions{aggregator: aggregatorAvg}, s)
+	require.True(t, ok)
+	assert.Equal(t, now.Unix(), point.timestamp)
+	point, ok = p.reduceSeries("requests_per_s{*}", []datadog.Series{full, serie(math.Inf(1))}, queryOptions{aggregator: aggregatorAvg}, s)
+	require.True(t, ok)
+	assert.False(t, point.valid)
+	require.IsType(t, &QueryError{}, point.err)
+	assert.Equal(t, ErrInvalidValue, point.err.(*QueryError).Kind)
+}
+
+func TestProcessor_SeriesAverageTemplate(t *testing.T) {
+	metricName := "requests_per_s"
+	now := time.Unix(1531492452, 0)
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			var series []datadog.Series
+			for i, pod := range []string{"pod_name:a", "pod_name:b"} {
+				scope := pod
+				points := []datadog.DataPoint{{float64(now.Unix()*1000 - 60000), 10 * float64(i+1)}, {float64(now.Unix() * 1000), 10 * float64(i+1)}}
+				series = append(series, datadog.Series{Metric: &metricName, Scope: &scope, Points: points[i:]})
+			}
+			return series, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{seriesAverage: seriesAverageWeighted, nullSeries: nullSeriesSkip}}
+	p.clock = func() time.Time { return now }
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "default",
+			Annotations: map[string]string{queryTemplateAnnotation: "avg:{metric}{{scope}} by {pod_name}"},
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						MetricName:     metricName,
+						MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "frontend"}},
+					},
+				},
+			},
+		},
+	}
+
+	// The series of the pods are averaged instead of invalidating the query, weighted by their points.
+	externalMetrics := p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{hpa})
+	require.Len(t, externalMetrics, 1)
+	assert.Equal(t, []string{"avg:requests_per_s{role:frontend} by {pod_name}"}, queries)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.InDelta(t, 40.0/3, externalMetrics[0].ValueFloat, 1e-9)
+
+	// Without an average, the query matching several series is invalid.
+	p.current.seriesAverage = seriesAverageNone
+	externalMetrics = p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{hpa})
+	require.Len(t, externalMetrics, 1)
+	assert.False(t, externalMetrics[0].Valid)
+	assert.Equal(t, errFormulaSeries.Error(), externalMetrics[0].LastError)
+}
+
+func TestProcessor_RecoverQueryPanic(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	now := time.Unix(1531492452, 0)
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			if strings.Contains(query, "role:backend") {
+				var series []datadog.Series
+				// An unexpected shape of the answer of Datadog.
+				_ = *series[0].Metric
+			}
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{float64(now.Unix() * 1000), 12}}}}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+	p.clock = func() time.Time { return now }
+	emList := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"role": "frontend"}, HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "default"}},
+		{MetricName: metricName, Labels: map[string]string{"role": "backend"}, HPA: custommetrics.ObjectReference{Name: "bar", Namespace: "default"}},
+	}
+	recovered := readTelemetry(t, recoveredPanicsTelemetry)
+
+	// The panic of the batch is recovered, its metrics are queried individually: only the one panicking is invalid.
+	updated := p.UpdateExternalMetrics(emList)
+	assert.Equal(t, []string{
+		"avg:requests_per_s{role:frontend},avg:requests_per_s{role:backend}",
+		"avg:requests_per_s{role:frontend}",
+		"avg:requests_per_s{role:backend}",
+	}, queries)
+	// The metrics updated are sorted by HPA.
+	require.Len(t, updated, 2)
+	assert.False(t, updated[0].Valid)
+	assert.Contains(t, updated[0].LastError, "the query panicked")
+	assert.True(t, updated[1].Valid)
+	assert.Equal(t, 12.0, updated[1].ValueFloat)
+	assert.Equal(t, recovered+2, readTelemetry(t, recoveredPanicsTelemetry))
+}
+
+func TestLoadNamespaceClients(t *testing.T) {
+	defer config.Datadog.Set("external_metrics_provider.namespace_keys", config.Datadog.Get("external_metrics_provider.namespace_keys"))
+	defer config.Datadog.Set("site", config.Datadog.Get("site"))
+	config.Datadog.Set("site", "datadoghq.com")
+
+	// Without namespace keys, the metrics are all queried with the keys of the Processor.
+	clients, err := loadNamespaceClients()
+	require.NoError(t, err)
+	assert.Nil(t, clients)
+
+	config.Datadog.Set("external_metrics_provider.namespace_keys", map[string]interface{}{
+		"team-a": map[string]interface{}{"api_key": "team-a-api-key", "app_key": "team-a-app-key"},
+		"team-b": map[string]interface{}{"api_key": "team-b-api-key", "app_key": "team-b-app-key", "endpoint": "https://api.datadoghq.eu"},
+	})
+	clients, err = loadNamespaceClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	assert.Equal(t, "https://api.datadoghq.com", clients["team-a"].(endpointClient).GetBaseUrl())
+	assert.Equal(t, "https://api.datadoghq.eu", clients["team-b"].(endpointClient).GetBaseUrl())
+
+	// Without an endpoint configured, the keys are not sent to the default site of the client.
+	config.Datadog.Set("site", "")
+	_, err = loadNamespaceClients()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "team-a")
+	config.Datadog.Set("site", "datadoghq.com")
+
+	// The errors do not quote the keys.
+	config.Datadog.Set("external_metrics_provider.namespace_keys", map[string]interface{}{
+		"team-a": map[string]interface{}{"api_key": "team-a-api-key"},
+	})
+	_, err = loadNamespaceClients()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "team-a")
+	assert.NotContains(t, err.Error(), "team-a-api-key")
+
+	config.Datadog.Set("external_metrics_provider.namespace_keys", map[string]interface{}{
+		"team-a": map[string]interface{}{"api_key": "team-a-api-key", "app_key": "team-a-app-key", "endpoint": "api.datadoghq.eu"},
+	})
+	_, err = loadNamespaceClients()
+	assert.Error(t, err)
+}
+
+func TestNewProcessorNamespaceClientsFailover(t *testing.T) {
+	for _, key := range []string{"api_key", "app_key", "site", "external_metrics_provider.fallback_api_key", "external_metrics_provider.fallback_app_key", "external_metrics_provider.namespace_keys"} {
+		defer config.Datadog.Set(key, config.Datadog.Get(key))
+	}
+	config.Datadog.Set("api_key", "api_key")
+	config.Datadog.Set("app_key", "app_key")
+	config.Datadog.Set("site", "datadoghq.eu")
+	config.Datadog.Set("external_metrics_provider.fallback_api_key", "fallback_api_key")
+	config.Datadog.Set("external_metrics_provider.fallback_app_key", "fallback_app_key")
+	config.Datadog.Set("external_metrics_provider.namespace_keys", map[string]interface{}{
+		"team-a": map[string]interface{}{"api_key": "team-a-api-key", "app_key": "team-a-app-key"},
+	})
+
+	// The namespace clients query the site of the configuration along with the failover client.
+	client, err := NewDatadogClient()
+	require.NoError(t, err)
+	require.IsType(t, &failoverClient{}, client)
+	p, err := NewProcessor(client)
+	require.NoError(t, err)
+	defer p.Stop()
+	assert.Equal(t, "https://api.datadoghq.eu", p.namespaceClients["team-a"].(endpointClient).GetBaseUrl())
+}
+
+func TestProcessor_NamespaceClients(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	now := time.Unix(1531492452, 0)
+	newClient := func(value float64, queries *[]string) *fakeDatadogClient {
+		return &fakeDatadogClient{
+			queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+				*queries = append(*queries, query)
+				return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{float64(now.Unix() * 1000), value}}}}, nil
+			},
+		}
+	}
+	var defaultQueries, teamQueries []string
+	p := &Processor{
+		datadogClient:    newClient(12, &defaultQueries),
+		namespaceClients: map[string]DatadogClient{"team-a": newClient(15, &teamQueries)},
+	}
+	p.clock = func() time.Time { return now }
+	newHPA := func(namespace string) *autoscalingv2.HorizontalPodAutoscaler {
+		return &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: namespace},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				Metrics: []autoscalingv2.MetricSpec{
+					{
+						Type: autoscalingv2.ExternalMetricSourceType,
+						External: &autoscalingv2.ExternalMetricSource{
+							MetricName:     metricName,
+							MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "frontend"}},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	// The metric shared by the HPAs is queried once per organization, with the keys of the namespace of each HPA.
+	externalMetrics := p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{newHPA("default"), newHPA("team-a"), newHPA("team-b")})
+	require.Len(t, externalMetrics, 3)
+	assert.Equal(t, []string{"avg:requests_per_s{role:frontend}"}, defaultQueries)
+	assert.Equal(t, []string{"avg:requests_per_s{role:frontend}"}, teamQueries)
+	values := make(map[string]float64)
+	for _, em := range externalMetrics {
+		assert.True(t, em.Valid)
+		values[em.HPA.Namespace] = em.ValueFloat
+	}
+	assert.Equal(t, map[string]float64{"default": 12, "team-a": 15, "team-b": 12}, values)
+}
+
+type fakeMetricProvider struct {
+	m       sync.Mutex
+	queries []string
+	windows []time.Duration
+	values  map[string]float64
+}
+
+func (f *fakeMetricProvider) QueryValue(_ context.Context, query string, window time.Duration) (float64, time.Time, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.queries = append(f.queries, query)
+	f.windows = append(f.windows, window)
+	value, ok := f.values[query]
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("unknown query %q", query)
+	}
+	return value, time.Unix(1531492452, 0), nil
+}
+
+func TestProcessor_MetricProvider(t *testing.T) {
+	provider := &fakeMetricProvider{values: map[string]float64{
+		"avg:requests_per_s{role:frontend}": 12,
+		"avg:requests_per_s{role:backend}":  math.NaN(),
+	}}
+	p, err := NewProcessorWithProvider(provider)
+	require.NoError(t, err)
+	defer p.Stop()
+	p.queryCache = nil
+	p.clock = func() time.Time { return time.Unix(1531492452, 0) }
+
+	metric := func(role string) autoscalingv2.MetricSpec {
+		return autoscalingv2.MetricSpec{
+			Type: autoscalingv2.ExternalMetricSourceType,
+			External: &autoscalingv2.ExternalMetricSource{
+				MetricName:     "requests_per_s",
+				MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": role}},
+			},
+		}
+	}
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{metric("frontend"), metric("backend"), metric("database")},
+		},
+	}
+
+	// The metrics are queried alone from the provider, over the query window of the Processor.
+	externalMetrics := p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 3)
+	assert.ElementsMatch(t, []string{"avg:requests_per_s{role:frontend}", "avg:requests_per_s{role:backend}", "avg:requests_per_s{role:database}"}, provider.queries)
+	for _, window := range provider.windows {
+		assert.Equal(t, p.settings().queryWindow, window)
+	}
+	assert.True(t, externalMetrics[0].Valid)
+	assert.Equal(t, 12.0, externalMetrics[0].ValueFloat)
+	assert.Equal(t, int64(1531492452), externalMetrics[0].Timestamp)
+	// A value matching no data and a failed query invalidate their metric only.
+	assert.False(t, externalMetrics[1].Valid)
+	assert.Contains(t, externalMetrics[1].LastError, ErrNoDataPoints.Error())
+	assert.False(t, externalMetrics[2].Valid)
+	assert.Contains(t, externalMetrics[2].LastError, "unknown query")
+}
+
+func TestLoadMetricPolicy(t *testing.T) {
+	defer config.Datadog.Set("external_metrics_provider.allowed_metrics", config.Datadog.Get("external_metrics_provider.allowed_metrics"))
+	defer config.Datadog.Set("external_metrics_provider.denied_metrics", config.Datadog.Get("external_metrics_provider.denied_metrics"))
+
+	// All the metrics are allowed by default.
+	assert.Nil(t, loadMetricPolicy())
+
+	// The invalid patterns are ignored.
+	config.Datadog.Set("external_metrics_provider.allowed_metrics", []string{"nginx.*", "[", " "})
+	config.Datadog.Set("external_metrics_provider.denied_metrics", []string{"nginx.debug.*"})
+	mp := loadMetricPolicy()
+	require.NotNil(t, mp)
+	assert.Equal(t, []string{"nginx.*"}, mp.allowed)
+	assert.Equal(t, []string{"nginx.debug.*"}, mp.denied)
+}
+
+func TestMetricPolicy(t *testing.T) {
+	tests := []struct {
+		desc       string
+		policy     *metricPolicy
+		query      string
+		denied     bool
+		metricName string
+	}{
+		{"no policy", nil, "avg:requests_per_s{*}", false, ""},
+		{"allowed", &metricPolicy{allowed: []string{"nginx.*"}}, "avg:nginx.net.request_per_s{role:frontend}", false, ""},
+		{"not allowed", &metricPolicy{allowed: []string{"nginx.*"}}, "avg:requests_per_s{role:frontend}", true, "requests_per_s"},
+		{"denied", &metricPolicy{denied: []string{"*.debug.*"}}, "max:nginx.debug.requests{*}.rollup(max, 60)", true, "nginx.debug.requests"},
+		{"denied takes precedence", &metricPolicy{allowed: []string{"nginx.*"}, denied: []string{"nginx.debug.*"}}, "avg:nginx.debug.requests{*}", true, "nginx.debug.requests"},
+		{"the groups are not metrics", &metricPolicy{allowed: []string{"requests_per_s"}}, "avg:requests_per_s{*} by {pod_name}", false, ""},
+		{"every metric of a formula", &metricPolicy{allowed: []string{"http.*"}}, "(sum:http.errors{service:web})/(sum:billing.cost{*})", true, "billing.cost"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			metricName, denied := tt.policy.deniedMetric(tt.query)
+			assert.Equal(t, tt.denied, denied)
+			assert.Equal(t, tt.metricName, metricName)
+		})
+	}
+}
+
+func TestProcessor_MetricPolicy(t *testing.T) {
+	metricName := "nginx.net.request_per_s"
+	scope := "role:frontend"
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{1531492452000, 12}}}}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, metricPolicy: &metricPolicy{allowed: []string{"nginx.*"}}}
+	p.clock = func() time.Time { return time.Unix(1531492452, 0) }
+	metric := func(name string) autoscalingv2.MetricSpec {
+		return autoscalingv2.MetricSpec{
+			Type: autoscalingv2.ExternalMetricSourceType,
+			External: &autoscalingv2.ExternalMetricSource{
+				MetricName:     name,
+				MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "frontend"}},
+			},
+		}
+	}
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{metric(metricName), metric("aws.billing.estimated_charges")},
+		},
+	}
+
+	// The metric not allowed is invalid and never queried.
+	externalMetrics := p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 2)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.False(t, externalMetrics[1].Valid)
+	assert.Equal(t, ErrMetricNotAllowed.Error(), externalMetrics[1].LastError)
+	assert.Equal(t, []string{"avg:nginx.net.request_per_s{role:frontend}"}, queries)
+
+	// Neither by the refreshes.
+	queries = nil
+	p.UpdateExternalMetrics(externalMetrics[1:])
+	assert.Empty(t, queries)
+
+	// A formula querying a metric not allowed is rejected as well.
+	hpa.Annotations = map[string]string{
+		formulaAnnotation:                  "a/b",
+		formulaQueryAnnotationPrefix + "a": "sum:nginx.net.request_per_s{*}",
+		formulaQueryAnnotationPrefix + "b": "sum:aws.billing.estimated_charges{*}",
+	}
+	hpa.Spec.Metrics = hpa.Spec.Metrics[:1]
+	externalMetrics = p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 1)
+	assert.False(t, externalMetrics[0].Valid)
+	assert.Equal(t, ErrMetricNotAllowed.Error(), externalMetrics[0].LastError)
+	for _, query := range queries {
+		assert.False(t, strings.Contains(query, "aws.billing"), query)
+	}
+}
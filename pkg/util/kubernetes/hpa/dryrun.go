@@ -0,0 +1,106 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2beta1"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+)
+
+// DryRunResult is the result of the query of a metric of an HPA, as it would be served to the autoscaler.
+type DryRunResult struct {
+	MetricName string            `json:"metricName"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	// Query is the query sent to Datadog, empty if the metric cannot be queried.
+	Query string  `json:"query,omitempty"`
+	Value float64 `json:"value"`
+	Valid bool    `json:"valid"`
+	// Error is the reason why the metric is invalid.
+	Error string `json:"error,omitempty"`
+}
+
+// DryRunHPA queries the metrics of an HPA like ProcessHPAs, without storing them.
+func (p *Processor) DryRunHPA(hpa *autoscalingv2.HorizontalPodAutoscaler) ([]DryRunResult, error) {
+	return p.DryRunHPAWithContext(p.getContext(), hpa)
+}
+
+// DryRunHPAWithContext is DryRunHPA, interruptible by the given context.
+func (p *Processor) DryRunHPAWithContext(ctx context.Context, hpa *autoscalingv2.HorizontalPodAutoscaler) ([]DryRunResult, error) {
+	externalMetrics := newHPAMetricValues(hpa)
+	if len(externalMetrics) == 0 {
+		return nil, fmt.Errorf("the HPA %s/%s has no supported metric", hpa.Namespace, hpa.Name)
+	}
+	p.scopeToTarget(hpa, externalMetrics)
+
+	externalMetrics, err := p.ValidateExternalMetrics(ctx, externalMetrics)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]DryRunResult, 0, len(externalMetrics))
+	for _, em := range externalMetrics {
+		results = append(results, DryRunResult{
+			MetricName: em.MetricName,
+			Labels:     em.Labels,
+			Query:      em.Query,
+			Value:      em.ValueFloat,
+			Valid:      em.Valid,
+			Error:      em.LastError,
+		})
+	}
+	return results, nil
+}
+
+// ValidationResult is the result of the validation of an external metric by ValidateAll.
+type ValidationResult struct {
+	// Key identifies the metric: the key of its query, or its name and labels if it cannot be queried.
+	Key   string  `json:"key"`
+	Value float64 `json:"value"`
+	Valid bool    `json:"valid"`
+	// Query is the query sent to Datadog, empty if the metric cannot be queried.
+	Query string `json:"query,omitempty"`
+	// Latency is the duration of the queries validating the metrics, they are batched together.
+	Latency time.Duration `json:"latency"`
+	// Error is the reason why the metric is invalid.
+	Error string `json:"error,omitempty"`
+}
+
+// ValidateAll queries a list of external metrics like a refresh, and returns a result for each of them, in order.
+func (p *Processor) ValidateAll(ctx context.Context, metrics []custommetrics.ExternalMetricValue) []ValidationResult {
+	if len(metrics) == 0 {
+		return nil
+	}
+	externalMetrics := make([]custommetrics.ExternalMetricValue, len(metrics))
+	copy(externalMetrics, metrics)
+
+	start := p.now()
+	// The error of the queries is set on the metrics they leave invalid.
+	externalMetrics, _ = p.ValidateExternalMetrics(ctx, externalMetrics)
+	latency := p.now().Sub(start)
+
+	results := make([]ValidationResult, 0, len(externalMetrics))
+	for _, em := range externalMetrics {
+		key, err := p.queryKey(em)
+		if err != nil {
+			key = getKey(em.MetricName, em.Labels)
+		}
+		results = append(results, ValidationResult{
+			Key:     key,
+			Value:   em.ValueFloat,
+			Valid:   em.Valid,
+			Query:   em.Query,
+			Latency: latency,
+			Error:   em.LastError,
+		})
+	}
+	return results
+}
@@ -0,0 +1,113 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The failure modes of the queries to Datadog, to be compared with the Cause of a QueryError.
+var (
+	// ErrNoDataPoints is returned when Datadog did not return any point for a metric.
+	ErrNoDataPoints = errors.New("no data points")
+	// ErrInvalidValue is returned when the value of a metric is not a finite number, e.g. NaN or Inf.
+	ErrInvalidValue = errors.New("invalid value")
+	// ErrQueryRateLimited is returned when the queries exceed the rate limit of the Datadog API.
+	ErrQueryRateLimited = errors.New("query rate limited")
+	// ErrQuerySyntax is returned when Datadog rejected the query.
+	ErrQuerySyntax = errors.New("invalid query")
+	// ErrQueryUnauthorized is returned when Datadog rejected the api/app key pair.
+	ErrQueryUnauthorized = errors.New("unauthorized query")
+	// ErrDatadogUnreachable is returned on server errors, timeouts and connection failures.
+	ErrDatadogUnreachable = errors.New("datadog unreachable")
+	// ErrTooManySeries is returned when the query of a metric matched more series than max_series_per_query.
+	ErrTooManySeries = errors.New("too many series")
+	// ErrQueryPanic is returned when the query of a metric or the processing of its series panicked.
+	ErrQueryPanic = errors.New("query panicked")
+)
+
+// QueryError is the error of a query to Datadog, its Cause is one of the Err* failure modes.
+type QueryError struct {
+	Query string
+	// Kind is the failure mode of the query, nil if it is unknown.
+	Kind error
+	// Err is the error returned by the Datadog client.
+	Err error
+}
+
+func (e *QueryError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("error while executing metric query %s: %s", e.Query, e.Kind)
+	}
+	return fmt.Sprintf("error while executing metric query %s: %s", e.Query, e.Err)
+}
+
+// Cause returns the failure mode of the query.
+func (e *QueryError) Cause() error {
+	if e.Kind != nil {
+		return e.Kind
+	}
+	return e.Err
+}
+
+// Unwrap returns the error of the Datadog client, for errors.Is and errors.As.
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns whether the failure mode of the query is target, for errors.Is.
+func (e *QueryError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// newQueryError returns the QueryError of a query the client failed with err.
+func newQueryError(query string, err error) *QueryError {
+	return &QueryError{Query: query, Kind: errorKind(err), Err: err}
+}
+
+// errorKind returns the failure mode of an error of the Datadog client, nil if it is unknown.
+func errorKind(err error) error {
+	if _, ok := err.(*queryPanicError); ok {
+		return ErrQueryPanic
+	}
+	switch status := apiErrorStatus(err); {
+	case status == 429:
+		return ErrQueryRateLimited
+	case status == 401 || status == 403:
+		return ErrQueryUnauthorized
+	case status >= 400 && status < 500:
+		return ErrQuerySyntax
+	}
+	if isRetryable(err) {
+		return ErrDatadogUnreachable
+	}
+	return nil
+}
+
+// isTransient returns whether the query failed with an error expected to be resolved by itself, e.g. an outage.
+func isTransient(err error) bool {
+	cause := errors.Cause(err)
+	return cause == ErrDatadogUnreachable || cause == ErrQueryRateLimited
+}
+
+// apiErrorStatus returns the HTTP status of an error of the API, 0 if err is not an error of the API.
+func apiErrorStatus(err error) int {
+	msg := err.Error()
+	i := strings.Index(msg, "API error ")
+	if i < 0 {
+		return 0
+	}
+	var status int
+	if _, err := fmt.Sscanf(msg[i+len("API error "):], "%d", &status); err != nil {
+		return 0
+	}
+	return status
+}
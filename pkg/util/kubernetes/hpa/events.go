@@ -0,0 +1,137 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// The reasons of the events emitted when an external metric becomes valid again, or invalid for an unknown reason.
+const (
+	reasonMetricValid   = "ExternalMetricValid"
+	reasonMetricInvalid = "ExternalMetricInvalid"
+)
+
+// eventReasons are the reasons of the events emitted when an external metric becomes invalid, by cause of its error.
+var eventReasons = map[error]string{
+	ErrNoDataPoints:       "NoDataPoints",
+	ErrInvalidValue:       "InvalidValue",
+	ErrQueryRateLimited:   "QueryRateLimited",
+	ErrQuerySyntax:        "InvalidQuery",
+	ErrQueryUnauthorized:  "QueryUnauthorized",
+	ErrDatadogUnreachable: "DatadogUnreachable",
+	ErrTooManySeries:      "TooManySeries",
+	ErrQueryPanic:         "QueryPanic",
+	errUnscopedQuery:      "UnscopedQuery",
+	errInvalidMultiplier:  "InvalidMultiplier",
+	errOutOfRange:         "OutOfRange",
+	errCounterReset:       "CounterReset",
+	errFormulaSeries:      "InvalidFormula",
+	errEmptyQueryTemplate: "InvalidQueryTemplate",
+	errBootstrapExpired:   "BootstrapExpired",
+	ErrMetricNotAllowed:   "MetricNotAllowed",
+	errPointTooOld:        "PointTooOld",
+}
+
+// eventReason returns the reason of the event of a metric invalidated by an error.
+func eventReason(err error) string {
+	if reason, ok := eventReasons[errors.Cause(err)]; ok {
+		return reason
+	}
+	return reasonMetricInvalid
+}
+
+// hpaReference returns the reference of the HPA of a metric, the object of its events.
+func hpaReference(em custommetrics.ExternalMetricValue) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		APIVersion: "autoscaling/v2beta1",
+		Kind:       "HorizontalPodAutoscaler",
+		Namespace:  em.HPA.Namespace,
+		Name:       em.HPA.Name,
+		UID:        types.UID(em.HPA.UID),
+	}
+}
+
+// eventLimiter drops the events identical to one emitted less than an interval ago.
+type eventLimiter struct {
+	interval time.Duration
+
+	m    sync.Mutex
+	last map[string]time.Time
+}
+
+func newEventLimiter(interval time.Duration) *eventLimiter {
+	return &eventLimiter{
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// allow returns whether the event identified by key can be emitted now, and records it if so.
+func (l *eventLimiter) allow(key string, now time.Time) bool {
+	if l.interval <= 0 {
+		return true
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	// Forget the events emitted before the interval, they do not limit anything.
+	for k, t := range l.last {
+		if now.Sub(t) >= l.interval {
+			delete(l.last, k)
+		}
+	}
+	if _, ok := l.last[key]; ok {
+		return false
+	}
+	l.last[key] = now
+	return true
+}
+
+// SetEventRecorder sets the recorder of the events emitted when the metrics become valid or invalid.
+func (p *Processor) SetEventRecorder(recorder record.EventRecorder, interval time.Duration) {
+	p.eventsMutex.Lock()
+	defer p.eventsMutex.Unlock()
+	p.eventRecorder = recorder
+	p.eventLimiter = newEventLimiter(interval)
+}
+
+// recordTransition emits an event on the HPA of a metric whose validity changed with its refresh.
+func (p *Processor) recordTransition(previous, current custommetrics.ExternalMetricValue, err error) {
+	if previous.Valid == current.Valid {
+		return
+	}
+	p.eventsMutex.RLock()
+	recorder, limiter := p.eventRecorder, p.eventLimiter
+	p.eventsMutex.RUnlock()
+	if recorder == nil || current.HPA.Name == "" {
+		return
+	}
+
+	eventType, reason := v1.EventTypeNormal, reasonMetricValid
+	if !current.Valid {
+		eventType, reason = v1.EventTypeWarning, eventReason(err)
+	}
+	if !limiter.allow(refreshKey(current)+"/"+reason, p.now()) {
+		log.Debugf("Dropped an event identical to a recent one: %s reason=%s", metricFields(current), reason)
+		return
+	}
+	if current.Valid {
+		recorder.Eventf(hpaReference(current), eventType, reason, "The external metric %s is valid, value: %v", current.MetricName, current.ValueFloat)
+		return
+	}
+	recorder.Eventf(hpaReference(current), eventType, reason, "The external metric %s is no longer valid: %s", current.MetricName, current.LastError)
+}
@@ -0,0 +1,101 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"sort"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+)
+
+// FailingMetric is a metric left invalid by the last refresh, for the triage of the failures.
+type FailingMetric struct {
+	// Key identifies the metric: the key of its query, or its name and labels if it cannot be queried.
+	Key string                        `json:"key"`
+	HPA custommetrics.ObjectReference `json:"hpa"`
+	// Reason is the cause of the error of the metric, the reason of the event emitted on its HPA, e.g. `NoDataPoints`.
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+	// Since is the time of the last successful refresh of the metric, or the time it was first seen failing.
+	Since      int64 `json:"since"`
+	FailingFor int64 `json:"failingFor"`
+}
+
+// FailingMetrics returns the metrics left invalid by the last refresh, sorted by HPA and key.
+func (p *Processor) FailingMetrics() []FailingMetric {
+	now := p.now().Unix()
+	p.stateMutex.RLock()
+	failing := make([]FailingMetric, 0, len(p.state.failing))
+	for _, m := range p.state.failing {
+		m.FailingFor = now - m.Since
+		if m.FailingFor < 0 {
+			m.FailingFor = 0
+		}
+		failing = append(failing, m)
+	}
+	p.stateMutex.RUnlock()
+	sort.Slice(failing, func(i, j int) bool {
+		if failing[i].HPA.Namespace != failing[j].HPA.Namespace {
+			return failing[i].HPA.Namespace < failing[j].HPA.Namespace
+		}
+		if failing[i].HPA.Name != failing[j].HPA.Name {
+			return failing[i].HPA.Name < failing[j].HPA.Name
+		}
+		return failing[i].Key < failing[j].Key
+	})
+	return failing
+}
+
+// recordFailures records the metrics left invalid at the end of a refresh of emList.
+func (p *Processor) recordFailures(emList, updated []custommetrics.ExternalMetricValue, reasons map[string]string) {
+	now := p.now().Unix()
+	refreshed := make(map[string]custommetrics.ExternalMetricValue, len(updated))
+	for _, em := range updated {
+		refreshed[refreshKey(em)] = em
+	}
+
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	previous := p.state.failing
+	p.state.failing = make(map[string]FailingMetric)
+	for _, em := range emList {
+		rkey := refreshKey(em)
+		if current, ok := refreshed[rkey]; ok {
+			em = current
+		}
+		if em.Valid {
+			continue
+		}
+		key, err := p.queryKey(em)
+		if err != nil {
+			key = getKey(em.MetricName, em.Labels)
+		}
+		m := FailingMetric{
+			Key:    key,
+			HPA:    em.HPA,
+			Reason: reasons[rkey],
+			Error:  em.LastError,
+			Since:  em.LastSuccessTimestamp,
+		}
+		if last, ok := previous[rkey]; ok {
+			if m.Reason == "" {
+				m.Reason = last.Reason
+			}
+			if m.Since == 0 {
+				m.Since = last.Since
+			}
+		}
+		if m.Reason == "" {
+			m.Reason = reasonMetricInvalid
+		}
+		if m.Since == 0 {
+			m.Since = now
+		}
+		p.state.failing[rkey] = m
+	}
+}
@@ -0,0 +1,90 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// failoverClient is a DatadogClient switching over an ordered list of clients when the active one fails.
+type failoverClient struct {
+	clients []DatadogClient
+
+	m      sync.Mutex
+	active int
+}
+
+// newFailoverClient returns a DatadogClient failing over across the clients in order.
+func newFailoverClient(clients ...DatadogClient) DatadogClient {
+	if len(clients) == 1 {
+		return clients[0]
+	}
+	activeClientTelemetry.Set(0)
+	return &failoverClient{clients: clients}
+}
+
+// QueryMetrics queries the active client, then the next ones in order while the clients queried fail over.
+func (c *failoverClient) QueryMetrics(ctx context.Context, from, to int64, query string) ([]datadog.Series, error) {
+	c.m.Lock()
+	start := c.active
+	c.m.Unlock()
+
+	var err error
+	for i := range c.clients {
+		index := (start + i) % len(c.clients)
+		var series []datadog.Series
+		series, err = c.clients[index].QueryMetrics(ctx, from, to, query)
+		if err == nil || !shouldFailover(err) {
+			c.setActive(index)
+			return series, err
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Debugf("The Datadog client %d failed, trying the next one: query=%q error=%q", index, query, err)
+	}
+	return nil, err
+}
+
+// setActive sets the client queried first by the next queries.
+func (c *failoverClient) setActive(index int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.active == index {
+		return
+	}
+	log.Warnf("Switched the queries of the external metrics to the Datadog client %d (0 is the primary), the client %d failed", index, c.active)
+	c.active = index
+	activeClientTelemetry.Set(float64(index))
+}
+
+// GetBaseUrl returns the base URL queried by the active client, so that the failoverClient is an endpointClient.
+func (c *failoverClient) GetBaseUrl() string {
+	c.m.Lock()
+	active := c.clients[c.active]
+	c.m.Unlock()
+	if cl, ok := active.(endpointClient); ok {
+		return cl.GetBaseUrl()
+	}
+	return ""
+}
+
+// shouldFailover returns whether a client failed with err in a way another client could avoid.
+func shouldFailover(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	kind := errorKind(err)
+	return kind == ErrDatadogUnreachable || kind == ErrQueryUnauthorized
+}
@@ -0,0 +1,142 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// formulaAnnotation sets an arithmetic formula of the queries of the formulaQueryAnnotationPrefix annotations.
+const (
+	formulaAnnotation            = "external-metrics.datadoghq.com/formula"
+	formulaQueryAnnotationPrefix = "external-metrics.datadoghq.com/query."
+)
+
+// formulaKeyPrefix is the prefix of the keys of the formulas and of the rendered query templates.
+const formulaKeyPrefix = "formula:"
+
+// errFormulaSeries is the error of the formulas matching several series, e.g. with operands grouped by a tag.
+var errFormulaSeries = errors.New("the formula matches several series, its queries must be aggregated into a single serie")
+
+// parseFormula returns the formula and the queries of its operands set by the annotations of an HPA.
+func parseFormula(hpa metav1.ObjectMeta) (string, map[string]string) {
+	formula, ok := hpa.Annotations[formulaAnnotation]
+	if !ok {
+		return "", nil
+	}
+	queries := make(map[string]string)
+	for annotation, query := range hpa.Annotations {
+		if strings.HasPrefix(annotation, formulaQueryAnnotationPrefix) {
+			queries[strings.TrimPrefix(annotation, formulaQueryAnnotationPrefix)] = strings.TrimSpace(query)
+		}
+	}
+	if _, err := expandFormula(formula, queries); err != nil {
+		log.Warnf("Invalid %s annotation %q on the HPA %s/%s, its metrics are invalid: %v", formulaAnnotation, formula, hpa.Namespace, hpa.Name, err)
+	}
+	return formula, queries
+}
+
+// expandFormula returns the Datadog query of a formula, with each operand replaced by its query in parentheses.
+func expandFormula(formula string, queries map[string]string) (string, error) {
+	var expr strings.Builder
+	depth := 0
+	// operand is whether an operand is expected next, rather than an operator.
+	operand := true
+	for i := 0; i < len(formula); {
+		c := formula[i]
+		switch {
+		case c == ' ':
+			i++
+			continue
+		case isOperandChar(c, true):
+			if !operand {
+				return "", fmt.Errorf("invalid formula %q: unexpected operand at position %d", formula, i)
+			}
+			j := i + 1
+			for j < len(formula) && isOperandChar(formula[j], false) {
+				j++
+			}
+			name := formula[i:j]
+			query, ok := queries[name]
+			if !ok || query == "" {
+				return "", fmt.Errorf("the formula %q references the undefined query %q, set it with the %s%s annotation", formula, name, formulaQueryAnnotationPrefix, name)
+			}
+			fmt.Fprintf(&expr, "(%s)", query)
+			operand = false
+			i = j
+			continue
+		case c >= '0' && c <= '9' || c == '.':
+			if !operand {
+				return "", fmt.Errorf("invalid formula %q: unexpected number at position %d", formula, i)
+			}
+			j := i + 1
+			for j < len(formula) && (formula[j] >= '0' && formula[j] <= '9' || formula[j] == '.') {
+				j++
+			}
+			expr.WriteString(formula[i:j])
+			operand = false
+			i = j
+			continue
+		case c == '(':
+			if !operand {
+				return "", fmt.Errorf("invalid formula %q: unexpected %q at position %d", formula, c, i)
+			}
+			depth++
+		case c == ')':
+			if operand || depth == 0 {
+				return "", fmt.Errorf("invalid formula %q: unexpected %q at position %d", formula, c, i)
+			}
+			depth--
+		case c == '-' && operand:
+			// A negation.
+		case c == '+' || c == '-' || c == '*' || c == '/':
+			if operand {
+				return "", fmt.Errorf("invalid formula %q: unexpected %q at position %d", formula, c, i)
+			}
+			operand = true
+		default:
+			return "", fmt.Errorf("invalid formula %q: unexpected %q at position %d", formula, c, i)
+		}
+		expr.WriteByte(c)
+		i++
+	}
+	if operand || depth != 0 {
+		return "", fmt.Errorf("invalid formula %q: incomplete expression", formula)
+	}
+	return expr.String(), nil
+}
+
+// isOperandChar returns whether a character can be part of the name of an operand.
+func isOperandChar(c byte, first bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
+}
+
+// formulaKey returns the key of the query of a formula, see formulaKeyPrefix.
+func formulaKey(expr string) string {
+	return fmt.Sprintf("%s{%s}", formulaKeyPrefix, expr)
+}
+
+// formulaExpression returns the expression of the key of a formula, and whether the key is the one of a formula.
+func formulaExpression(key string) (string, bool) {
+	if !strings.HasPrefix(key, formulaKeyPrefix+"{") || !strings.HasSuffix(key, "}") {
+		return "", false
+	}
+	return key[len(formulaKeyPrefix)+1 : len(key)-1], true
+}
@@ -0,0 +1,60 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"context"
+	"expvar"
+	"time"
+)
+
+// healthCheckQuery is a cheap query, of a metric reported by all the Datadog Agents.
+const healthCheckQuery = "avg:datadog.agent.running{*}"
+
+const healthCheckOK = "OK"
+
+var datadogHealth = &expvar.String{}
+
+func init() {
+	datadogStats.Set("Health", datadogHealth)
+}
+
+// HealthCheck queries Datadog to verify that the external metrics can be fetched.
+func (p *Processor) HealthCheck(ctx context.Context) error {
+	err := p.healthCheck(ctx)
+	if err != nil {
+		datadogHealth.Set(err.Error())
+		return err
+	}
+	datadogHealth.Set(healthCheckOK)
+	return nil
+}
+
+func (p *Processor) healthCheck(ctx context.Context) error {
+	// The query is not retried nor accounted by the circuit breaker, to report the current state of the connectivity.
+	res := make(chan queryResult, 1)
+	go func() {
+		now := time.Now().Unix()
+		series, err := p.datadogClient.QueryMetrics(ctx, now-60, now, healthCheckQuery)
+		res <- queryResult{series: series, err: err}
+	}()
+
+	var r queryResult
+	select {
+	case <-ctx.Done():
+		return &QueryError{Query: healthCheckQuery, Kind: ErrDatadogUnreachable, Err: ctx.Err()}
+	case r = <-res:
+	}
+	if r.err == nil {
+		return nil
+	}
+	if errorKind(r.err) == ErrQueryUnauthorized {
+		return &QueryError{Query: healthCheckQuery, Kind: ErrQueryUnauthorized, Err: r.err}
+	}
+	return &QueryError{Query: healthCheckQuery, Kind: ErrDatadogUnreachable, Err: r.err}
+}
@@ -8,114 +8,1423 @@
 package hpa
 
 import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
 	"gopkg.in/zorkian/go-datadog-api.v2"
 	autoscalingv2 "k8s.io/api/autoscaling/v2beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
+// maxAgeAnnotation is the annotation of the HPAs overriding the max age of their metrics, e.g. `10m`.
+const maxAgeAnnotation = "external-metrics.datadoghq.com/max-age"
+
+// The annotations of the HPAs overriding the aggregator, the rollup interval and the window of their queries.
+const (
+	aggregatorAnnotation = "external-metrics.datadoghq.com/aggregator"
+	rollupAnnotation     = "external-metrics.datadoghq.com/rollup"
+	windowAnnotation     = "external-metrics.datadoghq.com/window"
+)
+
+// multiplierAnnotation is the annotation of the HPAs scaling the values of their metrics by a positive factor.
+const multiplierAnnotation = "external-metrics.datadoghq.com/multiplier"
+
+// The annotations of the HPAs bounding the values of their metrics, clamped or rejected by the range mode.
+const (
+	minAnnotation       = "external-metrics.datadoghq.com/min"
+	maxAnnotation       = "external-metrics.datadoghq.com/max"
+	rangeModeAnnotation = "external-metrics.datadoghq.com/range-mode"
+
+	rangeModeClamp  = "clamp"
+	rangeModeReject = "reject"
+)
+
+// statAnnotation is the annotation of the HPAs querying a percentile of their metrics, e.g. `p95`.
+const statAnnotation = "external-metrics.datadoghq.com/stat"
+
+// rollupMethodAnnotation is the annotation of the HPAs rolling up their metrics with a method of their own.
+const rollupMethodAnnotation = "external-metrics.datadoghq.com/rollup-method"
+
+// transformAnnotation is the annotation of the HPAs transforming the values of their metrics, e.g. `per_second`.
+const transformAnnotation = "external-metrics.datadoghq.com/transform"
+
+// allClustersAnnotation is the annotation of the HPAs opting their metrics out of the scope of the cluster.
+const allClustersAnnotation = "external-metrics.datadoghq.com/all-clusters"
+
+// targetSelectorAnnotation is the annotation of the HPAs scoping their metrics to the pods of their scale target.
+const targetSelectorAnnotation = "external-metrics.datadoghq.com/target-selector"
+
+// freezeAnnotation is the annotation of the HPAs freezing their metrics at their last value.
+const freezeAnnotation = "external-metrics.datadoghq.com/freeze"
+
+// invalidMultiplier is the Multiplier of the metrics whose multiplier annotation is invalid, they are not queried.
+const invalidMultiplier = -1
+
+var (
+	// errInvalidMultiplier is the error of the metrics whose multiplier annotation is not a positive number.
+	errInvalidMultiplier = errors.New("the multiplier annotation of the metric is not a positive number")
+	// errScaledValue is the error of the metrics whose value is not a finite number once scaled by their multiplier.
+	errScaledValue = errors.New("the value of the metric scaled by its multiplier is not a finite number")
+	// errOutOfRange is the error of the metrics whose value is out of the bounds of their HPA, in the reject mode.
+	errOutOfRange = errors.New("the value of the metric is out of the bounds of its HPA")
+	// errPointTooOld is the error of the metrics whose latest Datadog point is older than their max age.
+	errPointTooOld = errors.New("the latest point of the metric is older than its max age")
+)
+
+// DatadogClient queries the series of the metrics from Datadog until the context is done.
 type DatadogClient interface {
-	QueryMetrics(from, to int64, query string) ([]datadog.Series, error)
+	QueryMetrics(ctx context.Context, from, to int64, query string) ([]datadog.Series, error)
+}
+
+// endpointClient is implemented by the clients exposing the base URL they query, like datadog.Client.
+type endpointClient interface {
+	GetBaseUrl() string
 }
 
 // Processor embeds the configuration to refresh metrics from Datadog and process HPA structs to ExternalMetrics.
 type Processor struct {
-	externalMaxAge time.Duration
-	datadogClient  DatadogClient
+	// current are the settings reloaded by ReloadConfig, read with settings.
+	settingsMutex sync.RWMutex
+	current       settings
+	queryCache    *cache.Cache
+	negativeCache *negativeCache
+	breaker       *circuitBreaker
+	budget        *queryBudget
+	datadogClient DatadogClient
+
+	// staleGracePeriod is how long a metric is kept valid with its last value when its queries fail transiently.
+	staleGracePeriod time.Duration
+	// maxRetryAfter is the longest delay requested by Datadog with Retry-After that is waited before retrying a query.
+	maxRetryAfter time.Duration
+	// maxSeriesPerQuery is the number of series above which the query of a metric is rejected, 0 if it is unbounded.
+	maxSeriesPerQuery int
+	// canary is the query checked periodically by RunCanary, nil if it is disabled.
+	canary *canary
+	// namespaceClients are the DatadogClients of the namespaces with keys of their own, by namespace.
+	namespaceClients map[string]DatadogClient
+	// allowUnscopedQueries allows the external metrics with an empty selector, queried over all the sources of the metric.
+	allowUnscopedQueries bool
+	// changeThreshold is the relative change of the value of a metric below which RefreshChanged leaves it unchanged.
+	changeThreshold float64
+	// refreshJitter is the fraction of the max age of the metrics by which their refreshes are advanced.
+	refreshJitter float64
+	// warmupTimeout is the longest duration of Warmup, 0 only bounds it by its context.
+	warmupTimeout time.Duration
+	// metricPolicy restricts the metrics queried, nil if all the metrics are allowed. See queryKey.
+	metricPolicy *metricPolicy
+	// queriesAlone queries each metric alone rather than in batches, see NewProcessorWithProvider.
+	queriesAlone bool
+	// bootstrapMaxAge is the age of the stored metrics above which they are not served until refreshed, see Bootstrap.
+	bootstrapMaxAge time.Duration
+	// labelValueDelimiter splits the values of the labels into alternatives matched with OR, empty disables the split.
+	labelValueDelimiter string
+	// clusterTag is the tag filter scoping the queries to the cluster, empty if they are not scoped.
+	clusterTag string
+
+	// refreshed are the times of the last refresh of the metrics left unchanged by RefreshChanged, by refreshKey.
+	refreshedMutex sync.Mutex
+	refreshed      map[string]int64
+
+	// smoothing are the moving averages of the values of the metrics, by refreshKey, see smoothedPoint.
+	smoothingMutex sync.Mutex
+	smoothing      map[string]smoothedValue
+
+	limiterMutex sync.RWMutex
+	limiter      *namespaceLimiter
+
+	// eventRecorder emits the events of the HPAs whose metrics become valid or invalid, see SetEventRecorder.
+	eventsMutex   sync.RWMutex
+	eventRecorder record.EventRecorder
+	eventLimiter  *eventLimiter
+
+	// scaleTargets resolve the pod selectors of the scale targets of the HPAs, see SetScaleTargetListers.
+	scaleTargetsMutex sync.RWMutex
+	scaleTargets      *scaleTargetListers
+
+	// store is the store of the metrics refreshed on demand, see SetStore.
+	storeMutex sync.RWMutex
+	store      custommetrics.Store
+
+	// state is the state of the Processor published for debugging.
+	stateMutex sync.RWMutex
+	state      processorState
+
+	// ctx is the context of the methods called without one, it is cancelled by Stop.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// clock returns the current time, it is replaced in the tests.
+	clock func() time.Time
 }
 
 // NewProcessor returns a new Processor
 func NewProcessor(datadogCl DatadogClient) (*Processor, error) {
-	externalMaxAge := config.Datadog.GetInt("external_metrics_provider.max_age")
-	return &Processor{
-		externalMaxAge: time.Duration(externalMaxAge) * time.Second,
-		datadogClient:  datadogCl,
-	}, nil
+	if cl, ok := datadogCl.(endpointClient); ok {
+		if err := validateEndpoint(cl.GetBaseUrl()); err != nil {
+			return nil, err
+		}
+	}
+	p := &Processor{
+		staleGracePeriod: time.Duration(config.Datadog.GetInt("external_metrics_provider.stale_grace_period")) * time.Second,
+		maxRetryAfter:    time.Duration(config.Datadog.GetInt("external_metrics_provider.max_retry_after")) * time.Second,
+		warmupTimeout:    time.Duration(config.Datadog.GetInt("external_metrics_provider.warmup_timeout")) * time.Second,
+		bootstrapMaxAge:  time.Duration(config.Datadog.GetInt("external_metrics_provider.bootstrap_max_age")) * time.Second,
+		datadogClient:    datadogCl,
+		clock:            time.Now,
+	}
+	p.setSettings(loadSettings())
+	p.allowUnscopedQueries = config.Datadog.GetBool("external_metrics_provider.allow_unscoped_queries")
+	p.maxSeriesPerQuery = config.Datadog.GetInt("external_metrics_provider.max_series_per_query")
+	p.metricPolicy = loadMetricPolicy()
+	p.canary = loadCanary()
+	namespaceClients, err := loadNamespaceClients()
+	if err != nil {
+		return nil, err
+	}
+	p.namespaceClients = namespaceClients
+	p.labelValueDelimiter = config.Datadog.GetString("external_metrics_provider.label_value_delimiter")
+	if config.Datadog.GetBool("external_metrics_provider.scope_to_cluster") {
+		if p.clusterTag = clusterTag(config.Datadog.GetString("cluster_name")); p.clusterTag == "" {
+			log.Infof("The cluster name is not set, the queries of the external metrics are not scoped to the cluster")
+		}
+	}
+	if p.changeThreshold = config.Datadog.GetFloat64("external_metrics_provider.change_threshold"); p.changeThreshold < 0 {
+		log.Warnf("Invalid change threshold %v for the external metrics, every change is stored", p.changeThreshold)
+		p.changeThreshold = 0
+	}
+	if p.refreshJitter = config.Datadog.GetFloat64("external_metrics_provider.refresh_jitter"); p.refreshJitter < 0 || p.refreshJitter >= 1 {
+		log.Warnf("Invalid refresh jitter %v for the external metrics, it must be in [0, 1), the refreshes are not staggered", p.refreshJitter)
+		p.refreshJitter = 0
+	}
+	// The results are cached for a refresh period by default, a negative TTL disables the cache.
+	cacheTTL := config.Datadog.GetInt("external_metrics_provider.query_cache_ttl")
+	if cacheTTL == 0 {
+		cacheTTL = config.Datadog.GetInt("external_metrics_provider.refresh_period")
+	}
+	if cacheTTL > 0 {
+		ttl := time.Duration(cacheTTL) * time.Second
+		p.queryCache = cache.New(ttl, 2*ttl)
+	}
+	if negativeTTL := config.Datadog.GetInt("external_metrics_provider.negative_cache_ttl"); negativeTTL > 0 {
+		p.negativeCache = newNegativeCache(time.Duration(negativeTTL) * time.Second)
+	}
+	if maxFailures := config.Datadog.GetInt("external_metrics_provider.breaker_max_failures"); maxFailures > 0 {
+		window := time.Duration(config.Datadog.GetInt("external_metrics_provider.breaker_window")) * time.Second
+		cooldown := time.Duration(config.Datadog.GetInt("external_metrics_provider.breaker_cooldown")) * time.Second
+		p.breaker = newCircuitBreaker(maxFailures, window, cooldown)
+	}
+	p.budget = newQueryBudget(config.Datadog.GetInt("external_metrics_provider.max_queries_per_minute"))
+	p.ResetRateLimiter()
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p, nil
+}
+
+// Stop interrupts the calls of the methods without a context and releases the resources of the Processor.
+func (p *Processor) Stop() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	if p.queryCache != nil {
+		p.queryCache.Flush()
+	}
+	p.limiterMutex.Lock()
+	p.limiter = nil
+	p.limiterMutex.Unlock()
+	p.refreshedMutex.Lock()
+	p.refreshed = nil
+	p.refreshedMutex.Unlock()
+	p.ResetSmoothing()
+	// The metrics are no longer refreshed by this Processor.
+	setMetricsTelemetry(0, 0, 0)
+	p.resetStaleness()
+	p.unpublish()
+}
+
+// now returns the current time of the clock of the Processor.
+func (p *Processor) now() time.Time {
+	if p.clock == nil {
+		return time.Now()
+	}
+	return p.clock()
+}
+
+// getContext returns the context of the methods called without one.
+func (p *Processor) getContext() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+// ResetRateLimiter creates the per namespace rate limiter of the queries from the configuration.
+func (p *Processor) ResetRateLimiter() {
+	var limiter *namespaceLimiter
+	if qps := config.Datadog.GetFloat64("external_metrics_provider.per_namespace_qps"); qps > 0 {
+		limiter = newNamespaceLimiter(qps, config.Datadog.GetInt("external_metrics_provider.refresh_period"))
+	}
+	p.limiterMutex.Lock()
+	p.limiter = limiter
+	p.limiterMutex.Unlock()
+}
+
+func (p *Processor) getLimiter() *namespaceLimiter {
+	p.limiterMutex.RLock()
+	defer p.limiterMutex.RUnlock()
+	return p.limiter
 }
 
 // ComputeDeleteExternalMetrics returns a diff of a list of ExternalMetrics with the given HPA Objects.
 func ComputeDeleteExternalMetrics(list []*autoscalingv2.HorizontalPodAutoscaler, emList []custommetrics.ExternalMetricValue) (toDelete []custommetrics.ExternalMetricValue) {
+	return ComputeDeleteExternalMetricsWithGracePeriod(list, emList, 0, make(map[string]time.Time), time.Now())
+}
+
+// ComputeDeleteExternalMetricsWithGracePeriod is ComputeDeleteExternalMetrics with a grace period, as of now.
+func ComputeDeleteExternalMetricsWithGracePeriod(list []*autoscalingv2.HorizontalPodAutoscaler, emList []custommetrics.ExternalMetricValue, gracePeriod time.Duration, missingSince map[string]time.Time, now time.Time) (toDelete []custommetrics.ExternalMetricValue) {
+	for _, deleted := range ComputeGCExternalMetrics(list, nil, emList, gracePeriod, missingSince, now) {
+		toDelete = append(toDelete, deleted.Metric)
+	}
+	return toDelete
+}
+
+// GCReason is the reason an ExternalMetric is deleted by the GC.
+type GCReason string
+
+const (
+	// GCReasonHPADeleted is the reason of the metrics whose HPA has been missing for longer than the grace period.
+	GCReasonHPADeleted GCReason = "HPA-deleted"
+	// GCReasonUIDChanged is the reason of the metrics of an HPA recreated with the same namespace and name.
+	GCReasonUIDChanged GCReason = "UID-changed"
+	// GCReasonOrphaned is the reason of the metrics without any HPA, that no autoscaler listed can ever match.
+	GCReasonOrphaned GCReason = "orphaned"
+)
+
+// gcReasons are the reasons of the GC, in the order of the summaries.
+var gcReasons = []GCReason{GCReasonHPADeleted, GCReasonUIDChanged, GCReasonOrphaned}
+
+// GCDeletion is an ExternalMetric to delete, along with the reason of its deletion.
+type GCDeletion struct {
+	Metric custommetrics.ExternalMetricValue
+	Reason GCReason
+}
+
+// ComputeGCExternalMetrics returns the ExternalMetrics of the HPAs and WPAs missing from the lists as of now to delete, with the reason.
+func ComputeGCExternalMetrics(list []*autoscalingv2.HorizontalPodAutoscaler, wpaList []metav1.ObjectMeta, emList []custommetrics.ExternalMetricValue, gracePeriod time.Duration, missingSince map[string]time.Time, now time.Time) []GCDeletion {
 	uids := make(map[string]struct{})
+	// names are the namespaces and names of the autoscalers listed.
+	names := make(map[string]struct{})
 	for _, hpa := range list {
 		uids[string(hpa.UID)] = struct{}{}
+		names[hpa.Namespace+"/"+hpa.Name] = struct{}{}
+	}
+	for _, wpa := range wpaList {
+		uids[string(wpa.UID)] = struct{}{}
+		names[wpa.Namespace+"/"+wpa.Name] = struct{}{}
 	}
 
-	var deleted []custommetrics.ExternalMetricValue
+	missing := make(map[string]struct{})
+	var deleted []GCDeletion
 	for _, em := range emList {
-		if _, ok := uids[em.HPA.UID]; !ok {
-			deleted = append(deleted, em)
+		if _, ok := uids[em.HPA.UID]; ok {
+			continue
+		}
+		if _, ok := names[em.HPA.Namespace+"/"+em.HPA.Name]; ok && em.HPA.Name != "" {
+			log.Debugf("The HPA %s/%s was recreated, deleting the metric %s of its previous UID %s", em.HPA.Namespace, em.HPA.Name, em.MetricName, em.HPA.UID)
+			deleted = append(deleted, GCDeletion{Metric: em, Reason: GCReasonUIDChanged})
+			continue
+		}
+		reason := GCReasonHPADeleted
+		if em.HPA.UID == "" && em.HPA.Name == "" {
+			reason = GCReasonOrphaned
+		}
+		missing[em.HPA.UID] = struct{}{}
+		since, ok := missingSince[em.HPA.UID]
+		if !ok {
+			since = now
+			missingSince[em.HPA.UID] = now
+		}
+		if now.Sub(since) >= gracePeriod {
+			log.Debugf("Deleting the metric %s of the HPA %s/%s: uid=%q reason=%s", em.MetricName, em.HPA.Namespace, em.HPA.Name, em.HPA.UID, reason)
+			deleted = append(deleted, GCDeletion{Metric: em, Reason: reason})
+		}
+	}
+	// Forget the HPAs listed again, and the ones whose metrics were deleted.
+	for uid := range missingSince {
+		if _, ok := missing[uid]; !ok {
+			delete(missingSince, uid)
 		}
 	}
 
 	return deleted
 }
 
+// SummarizeGC returns the number of metrics deleted by the GC by reason, to log it.
+func SummarizeGC(deleted []GCDeletion) string {
+	counts := make(map[GCReason]int, len(gcReasons))
+	for _, d := range deleted {
+		counts[d.Reason]++
+	}
+	var parts []string
+	for _, reason := range gcReasons {
+		if counts[reason] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[reason], reason))
+		}
+	}
+	summary := fmt.Sprintf("%d metrics removed", len(deleted))
+	if len(parts) > 0 {
+		summary = fmt.Sprintf("%s (%s)", summary, strings.Join(parts, ", "))
+	}
+	return summary
+}
+
+// ReconcileExternalMetrics returns the changes turning the current ExternalMetrics into the desired ones.
+func ReconcileExternalMetrics(current, desired []custommetrics.ExternalMetricValue) (toUpsert, toDelete []custommetrics.ExternalMetricValue) {
+	currentByKey := make(map[string]custommetrics.ExternalMetricValue, len(current))
+	for _, em := range current {
+		currentByKey[reconcileKey(em)] = em
+	}
+	desiredKeys := make(map[string]struct{}, len(desired))
+	for _, em := range desired {
+		key := reconcileKey(em)
+		if _, ok := desiredKeys[key]; ok {
+			continue
+		}
+		desiredKeys[key] = struct{}{}
+		if previous, ok := currentByKey[key]; ok && em.Frozen && previous.Valid {
+			// The HPAs synced again do not replace the values their frozen metrics are serving.
+			previous.Frozen = true
+			em = previous
+		}
+		if previous, ok := currentByKey[key]; ok && reflect.DeepEqual(withoutTimestamps(previous), withoutTimestamps(em)) {
+			continue
+		}
+		toUpsert = append(toUpsert, em)
+	}
+	for _, em := range current {
+		if _, ok := desiredKeys[reconcileKey(em)]; !ok {
+			toDelete = append(toDelete, em)
+		}
+	}
+	return toUpsert, toDelete
+}
+
+// reconcileKey identifies a metric of an HPA by its name, selector and the UID of the HPA.
+func reconcileKey(em custommetrics.ExternalMetricValue) string {
+	key, err := getMetricKey(em, "")
+	if err != nil {
+		// The expressions of the selector cannot be queried, they still tell the metrics apart.
+		key = fmt.Sprintf("%s%v", getKey(em.MetricName, em.Labels), em.MatchExpressions)
+	}
+	return fmt.Sprintf("%s/%s/%s", em.HPA.UID, em.Type, key)
+}
+
+// withoutTimestamps returns the metric without the times of its refreshes, to compare it with another version.
+func withoutTimestamps(em custommetrics.ExternalMetricValue) custommetrics.ExternalMetricValue {
+	em.Timestamp = 0
+	em.LastSuccessTimestamp = 0
+	return em
+}
+
 // UpdateExternalMetrics does the validation and processing of the ExternalMetrics
 func (p *Processor) UpdateExternalMetrics(emList []custommetrics.ExternalMetricValue) (updated []custommetrics.ExternalMetricValue) {
-	maxAge := int64(p.externalMaxAge.Seconds())
-	var err error
+	updated, _ = p.UpdateExternalMetricsWithContext(p.getContext(), emList)
+	return updated
+}
+
+// UpdateExternalMetricsWithContext does the validation and processing of the ExternalMetrics until the context is done.
+func (p *Processor) UpdateExternalMetricsWithContext(ctx context.Context, emList []custommetrics.ExternalMetricValue) (updated []custommetrics.ExternalMetricValue, err error) {
+	updated, _, err = p.updateExternalMetrics(ctx, emList)
+	return updated, err
+}
+
+// RefreshChanged refreshes the metrics like UpdateExternalMetrics, but only returns the metrics that changed.
+func (p *Processor) RefreshChanged(emList []custommetrics.ExternalMetricValue) (changed []custommetrics.ExternalMetricValue, unchanged int) {
+	changed, unchanged, _ = p.RefreshChangedWithContext(p.getContext(), emList)
+	return changed, unchanged
+}
 
+// RefreshChangedWithContext is RefreshChanged, interruptible by the given context.
+func (p *Processor) RefreshChangedWithContext(ctx context.Context, emList []custommetrics.ExternalMetricValue) (changed []custommetrics.ExternalMetricValue, unchanged int, err error) {
+	updated, previous, err := p.updateExternalMetrics(ctx, emList)
+
+	p.refreshedMutex.Lock()
+	defer p.refreshedMutex.Unlock()
+	// Only the refreshes of the metrics still in the store are kept.
+	refreshed := make(map[string]int64)
 	for _, em := range emList {
-		if metav1.Now().Unix()-em.Timestamp <= maxAge && em.Valid {
+		key := refreshKey(em)
+		if ts, ok := p.refreshed[key]; ok {
+			refreshed[key] = ts
+		}
+	}
+	for i, em := range updated {
+		key := refreshKey(em)
+		if p.hasChanged(previous[i], em) {
+			changed = append(changed, em)
+			delete(refreshed, key)
 			continue
 		}
-		em.Valid = false
-		em.Timestamp = metav1.Now().Unix()
-		em.Value, em.Valid, err = p.validateExternalMetric(em.MetricName, em.Labels)
-		if err != nil {
-			log.Debugf("Could not fetch the external metric %s from Datadog, metric is no longer valid: %s", em.MetricName, err)
+		unchanged++
+		if em.Valid && em.LastError == "" {
+			refreshed[key] = em.LastSuccessTimestamp
 		}
-		log.Debugf("Updated the external metric %#v", em)
+	}
+	p.refreshed = refreshed
+	return changed, unchanged, err
+}
+
+// hasChanged returns whether a refreshed metric needs to be stored again.
+func (p *Processor) hasChanged(previous, current custommetrics.ExternalMetricValue) bool {
+	if previous.Valid != current.Valid || previous.Stale != current.Stale || previous.LastError != current.LastError || previous.Query != current.Query {
+		return true
+	}
+	return math.Abs(current.ValueFloat-previous.ValueFloat) > p.changeThreshold*math.Abs(previous.ValueFloat)
+}
+
+// refreshKey identifies a metric of an HPA, for the refreshes of the metrics left unchanged in the store.
+func refreshKey(em custommetrics.ExternalMetricValue) string {
+	key, _ := getMetricKey(em, "")
+	return fmt.Sprintf("%s/%s/%s/%s", em.HPA.Namespace, em.HPA.Name, em.Type, key)
+}
+
+// lastRefresh returns the time of the last successful refresh of a metric.
+func (p *Processor) lastRefresh(em custommetrics.ExternalMetricValue) int64 {
+	last := em.LastSuccessTimestamp
+	if last == 0 {
+		last = em.Timestamp
+	}
+	p.refreshedMutex.Lock()
+	defer p.refreshedMutex.Unlock()
+	if ts, ok := p.refreshed[refreshKey(em)]; ok && ts > last {
+		return ts
+	}
+	return last
+}
+
+// updateExternalMetrics is UpdateExternalMetricsWithContext, also returning the previous versions of the metrics updated.
+func (p *Processor) updateExternalMetrics(ctx context.Context, emList []custommetrics.ExternalMetricValue) (updated, previous []custommetrics.ExternalMetricValue, err error) {
+	start := p.now()
+	now := start.Unix()
+	var toUpdate []custommetrics.ExternalMetricValue
+	// stale is the number of the valid metrics serving a value older than their max age, see inGracePeriod.
+	var valid, invalid, stale int
+	limiter := p.getLimiter()
+
+	for _, em := range emList {
+		if em.Frozen && em.Valid {
+			// The frozen metrics keep serving their last value until the annotation is removed from their HPA.
+			valid++
+			log.Warnf("The external metric is frozen by its HPA, serving its last value: %s result=frozen value=%v last_update=%d", metricFields(em), em.ValueFloat, em.LastSuccessTimestamp)
+			continue
+		}
+		if em.Frozen {
+			log.Warnf("The external metric is frozen by its HPA but has no valid value to serve, querying it: %s", metricFields(em))
+		}
+		if now-p.lastRefresh(em) <= p.refreshAge(em) && em.Valid {
+			valid++
+			continue
+		}
+		if !limiter.allow(em.HPA.Namespace) {
+			// The throttled metrics are left untouched, with their last value and timestamp.
+			log.Debugf("Throttled the query of the external metric, keeping its last value: %s result=throttled", metricFields(em))
+			if em.Valid {
+				valid++
+				if em.Stale {
+					stale++
+				}
+			} else {
+				invalid++
+			}
+			continue
+		}
+		toUpdate = append(toUpdate, em)
+	}
+	if len(toUpdate) == 0 {
+		p.recordRefresh(valid, invalid, stale, start)
+		p.recordStaleness(emList, nil)
+		p.recordFailures(emList, nil, nil)
+		return nil, nil, nil
+	}
+	if p.budget.limited() {
+		// The budget is spent on the metrics nearest their expiry first, the others are deferred once it is spent.
+		sort.SliceStable(toUpdate, func(i, j int) bool {
+			return p.lastRefresh(toUpdate[i])+p.refreshAge(toUpdate[i]) < p.lastRefresh(toUpdate[j])+p.refreshAge(toUpdate[j])
+		})
+	}
+
+	metrics, errs, err := p.queryExternalMetrics(ctx, toUpdate)
+	// reasons are the causes of the errors of the metrics invalidated, by refreshKey.
+	reasons := make(map[string]string)
+	for _, em := range toUpdate {
+		key, keyErr := p.queryKey(em)
+		point, processed := metrics[key]
+		// When the refresh is interrupted, the metrics whose query failed transiently are left untouched as well.
+		processed = (processed && !point.transient) || keyErr != nil
+		if err != nil && !processed {
+			// The refresh was interrupted before this metric could be queried, leave it untouched.
+			if em.Valid {
+				valid++
+				if em.Stale {
+					stale++
+				}
+			} else {
+				invalid++
+			}
+			continue
+		}
+		point, pointErr := p.checkedPoint(em, point)
+		point = p.smoothedPoint(em, point)
+		if em.Valid && !point.valid && point.transient && p.inGracePeriod(em) {
+			// Keep serving the last value rather than dropping the target of the HPA during an outage.
+			valid++
+			log.Infof("Could not refresh the external metric from Datadog, keeping its last value: %s result=stale last_update=%d", metricFields(em), p.lastRefresh(em))
+			previous = append(previous, em)
+			em.LastError = lastError(keyErr, errs[key])
+			// The value is flagged once it is older than the max age, it would have been invalidated without the grace period.
+			em.Stale = p.now().Unix()-p.lastRefresh(em) > p.maxAge(em)
+			if em.Stale {
+				stale++
+			}
+			updated = append(updated, em)
+			continue
+		}
+		if em.Valid && !point.valid {
+			invalidatedByAgeTelemetry.Inc()
+		}
+		previous = append(previous, em)
+		invalidErr := p.setPoint(&em, key, point, keyErr, pointErr, errs[key])
+		if !em.Valid {
+			reasons[refreshKey(em)] = eventReason(invalidErr)
+		}
+		p.recordTransition(previous[len(previous)-1], em, invalidErr)
+		if !em.Valid {
+			invalid++
+			log.Warnf("Could not fetch the external metric from Datadog, the metric is no longer valid: %s result=invalid", metricFields(em))
+		} else {
+			valid++
+			log.Debugf("Updated the external metric: %s result=success value=%v", metricFields(em), em.ValueFloat)
+		}
+		log.Tracef("Updated the external metric %#v", em)
 		updated = append(updated, em)
 	}
-	return updated
+	p.recordRefresh(valid, invalid, stale, start)
+	p.recordStaleness(emList, updated)
+	p.recordFailures(emList, updated, reasons)
+	sort.Stable(byMetric{updated: updated, previous: previous})
+	if err != nil {
+		return updated, previous, errors.Wrap(err, "could not update all the external metrics")
+	}
+	return updated, previous, nil
+}
+
+// byMetric sorts the metrics updated by a refresh along with their previous versions.
+type byMetric struct {
+	updated, previous []custommetrics.ExternalMetricValue
+}
+
+func (b byMetric) Len() int { return len(b.updated) }
+
+func (b byMetric) Swap(i, j int) {
+	b.updated[i], b.updated[j] = b.updated[j], b.updated[i]
+	b.previous[i], b.previous[j] = b.previous[j], b.previous[i]
+}
+
+func (b byMetric) Less(i, j int) bool {
+	a, c := b.updated[i], b.updated[j]
+	if a.HPA.Namespace != c.HPA.Namespace {
+		return a.HPA.Namespace < c.HPA.Namespace
+	}
+	if a.HPA.Name != c.HPA.Name {
+		return a.HPA.Name < c.HPA.Name
+	}
+	if a.HPA.UID != c.HPA.UID {
+		return a.HPA.UID < c.HPA.UID
+	}
+	// The key is the metric name followed by its labels sorted by key.
+	return getKey(a.MetricName, a.Labels) < getKey(c.MetricName, c.Labels)
+}
+
+// setPoint sets the value of a metric refreshed with the point of its key, or returns the error invalidating it.
+func (p *Processor) setPoint(em *custommetrics.ExternalMetricValue, key string, point Point, keyErr, pointErr, queryErr error) error {
+	if keyErr == nil {
+		em.Query = p.formatQuery(key)
+	}
+	em.Value = int64(point.value)
+	em.ValueFloat = point.value
+	em.Valid = point.valid
+	em.Stale = false
+	if em.Valid {
+		em.LastError = ""
+		em.LastSuccessTimestamp = p.now().Unix()
+		em.Timestamp = pointTimestamp(point, em.LastSuccessTimestamp)
+		return nil
+	}
+	invalidErr := pointErr
+	if invalidErr == nil {
+		invalidErr = metricError(keyErr, queryErr)
+	}
+	em.LastError = invalidErr.Error()
+	return invalidErr
+}
+
+// pointTimestamp returns the timestamp of a valid point, the time of its refresh if its provider has none.
+func pointTimestamp(point Point, now int64) int64 {
+	if point.timestamp == 0 {
+		return now
+	}
+	return point.timestamp
+}
+
+// maxAge returns the max age in seconds of the value of a metric, set by the annotation of its HPA or by the Processor.
+func (p *Processor) maxAge(em custommetrics.ExternalMetricValue) int64 {
+	if em.MaxAge > 0 {
+		return em.MaxAge
+	}
+	return int64(p.settings().externalMaxAge.Seconds())
+}
+
+// refreshAge returns the age in seconds after which a metric is refreshed, its max age minus its jitter.
+func (p *Processor) refreshAge(em custommetrics.ExternalMetricValue) int64 {
+	maxAge := p.maxAge(em)
+	if p.refreshJitter <= 0 {
+		return maxAge
+	}
+	h := fnv.New32a()
+	h.Write([]byte(refreshKey(em)))
+	spread := float64(h.Sum32()) / math.MaxUint32
+	return maxAge - int64(float64(maxAge)*p.refreshJitter*spread)
+}
+
+// inGracePeriod returns whether the last successful refresh of a metric is within the stale grace period.
+func (p *Processor) inGracePeriod(em custommetrics.ExternalMetricValue) bool {
+	return p.now().Unix()-p.lastRefresh(em) <= int64(p.staleGracePeriod.Seconds())
 }
 
 // ProcessHPAs processes the HorizontalPodAutoscalers into a list of ExternalMetricValues.
 func (p *Processor) ProcessHPAs(hpa *autoscalingv2.HorizontalPodAutoscaler) []custommetrics.ExternalMetricValue {
+	externalMetrics, _ := p.ProcessHPAsWithContext(p.getContext(), hpa)
+	return externalMetrics
+}
+
+// ProcessHPAsWithContext processes the HorizontalPodAutoscalers into a list of ExternalMetricValues until the context is done.
+func (p *Processor) ProcessHPAsWithContext(ctx context.Context, hpa *autoscalingv2.HorizontalPodAutoscaler) ([]custommetrics.ExternalMetricValue, error) {
+	externalMetrics := p.ExtractExternalMetrics(hpa)
+	if len(externalMetrics) == 0 {
+		return nil, nil
+	}
+	externalMetrics, err := p.ValidateExternalMetrics(ctx, externalMetrics)
+	if err != nil {
+		return externalMetrics, errors.Wrapf(err, "could not validate the external metrics of %s/%s", hpa.Namespace, hpa.Name)
+	}
+	return externalMetrics, nil
+}
+
+// ProcessHPAList processes a list of HorizontalPodAutoscalers into a list of ExternalMetricValues.
+func (p *Processor) ProcessHPAList(hpas []*autoscalingv2.HorizontalPodAutoscaler) []custommetrics.ExternalMetricValue {
+	externalMetrics, _ := p.ProcessHPAListWithContext(p.getContext(), hpas)
+	return externalMetrics
+}
+
+// ProcessHPAListWithContext is ProcessHPAList, interruptible by the given context.
+func (p *Processor) ProcessHPAListWithContext(ctx context.Context, hpas []*autoscalingv2.HorizontalPodAutoscaler) ([]custommetrics.ExternalMetricValue, error) {
 	var externalMetrics []custommetrics.ExternalMetricValue
-	var err error
+	for _, hpa := range hpas {
+		externalMetrics = append(externalMetrics, p.ExtractExternalMetrics(hpa)...)
+	}
+	if len(externalMetrics) == 0 {
+		return nil, nil
+	}
+
+	externalMetrics, err := p.ValidateExternalMetrics(ctx, externalMetrics)
+	if err != nil {
+		return externalMetrics, errors.Wrapf(err, "could not validate the external metrics of %d HPAs", len(hpas))
+	}
+	return externalMetrics, nil
+}
 
+// ExtractExternalMetrics returns the ExternalMetricValues of the supported metrics of an HPA, without querying them.
+func (p *Processor) ExtractExternalMetrics(hpa *autoscalingv2.HorizontalPodAutoscaler) []custommetrics.ExternalMetricValue {
 	if len(hpa.Spec.Metrics) == 0 {
 		log.Errorf("Error processing %s/%s's external metrics, empty list", hpa.Namespace, hpa.Name)
 		return nil
 	}
+	externalMetrics := newHPAMetricValues(hpa)
+	p.scopeToTarget(hpa, externalMetrics)
+	p.setPodSelectors(hpa, externalMetrics)
+	return externalMetrics
+}
 
+// newHPAMetricValues returns the ExternalMetricValues of the supported metrics of an HPA, not validated yet.
+func newHPAMetricValues(hpa *autoscalingv2.HorizontalPodAutoscaler) []custommetrics.ExternalMetricValue {
+	var externalMetrics []custommetrics.ExternalMetricValue
 	for _, metricSpec := range hpa.Spec.Metrics {
 		switch metricSpec.Type {
 		case autoscalingv2.ExternalMetricSourceType:
-			m := custommetrics.ExternalMetricValue{
-				MetricName: metricSpec.External.MetricName,
-				Timestamp:  metav1.Now().Unix(),
-				HPA: custommetrics.ObjectReference{
-					Name:      hpa.Name,
-					Namespace: hpa.Namespace,
-					UID:       string(hpa.UID),
-				},
-				Labels: metricSpec.External.MetricSelector.MatchLabels,
+			if metricSpec.External == nil {
+				log.Warnf("The external metric of the HPA %s/%s has no source specified, it is skipped", hpa.Namespace, hpa.Name)
+				continue
+			}
+			m := newExternalMetricValue(hpa.ObjectMeta, metricSpec.External.MetricName, metricSpec.External.MetricSelector)
+			externalMetrics = append(externalMetrics, m)
+		case autoscalingv2.PodsMetricSourceType:
+			if metricSpec.Pods == nil {
+				log.Warnf("The pods metric of the HPA %s/%s has no source specified, it is skipped", hpa.Namespace, hpa.Name)
+				continue
+			}
+			m, err := newPodsMetricValue(hpa, metricSpec.Pods.MetricName)
+			if err != nil {
+				log.Warnf("The pods targeted by the HPA cannot be represented in a Datadog query, the metric is invalid: %s result=invalid error=%q", metricFields(m), err)
+				m.LastError = err.Error()
 			}
-			m.Value, m.Valid, err = p.validateExternalMetric(m.MetricName, m.Labels)
+			externalMetrics = append(externalMetrics, m)
+		case autoscalingv2.ObjectMetricSourceType:
+			if metricSpec.Object == nil {
+				log.Warnf("The object metric of the HPA %s/%s has no source specified, it is skipped", hpa.Namespace, hpa.Name)
+				continue
+			}
+			m, err := newObjectMetricValue(hpa.ObjectMeta, metricSpec.Object.MetricName, metricSpec.Object.Target)
 			if err != nil {
-				log.Debugf("Could not fetch the external metric %s from Datadog, metric is no longer valid: %s", m.MetricName, err)
+				log.Warnf("The object described by the metric cannot be represented in a Datadog query, the metric is invalid: %s result=invalid error=%q", metricFields(m), err)
+				m.LastError = err.Error()
 			}
 			externalMetrics = append(externalMetrics, m)
 		default:
 			log.Debugf("Unsupported metric type %s", metricSpec.Type)
 		}
 	}
+	setAnnotations(hpa.ObjectMeta, externalMetrics)
 	return externalMetrics
 }
 
-// validateExternalMetric queries Datadog to validate the availability and value of an external metric
-func (p *Processor) validateExternalMetric(metricName string, labels map[string]string) (value int64, valid bool, err error) {
-	val, err := p.queryDatadogExternal(metricName, labels)
+// setAnnotations sets the max age, the query options and the multiplier of the annotations of an HPA on its metrics.
+func setAnnotations(hpa metav1.ObjectMeta, externalMetrics []custommetrics.ExternalMetricValue) {
+	maxAge := parseMaxAge(hpa)
+	aggregator := parseAggregator(hpa)
+	rollup := parseSeconds(hpa, rollupAnnotation)
+	window := parseSeconds(hpa, windowAnnotation)
+	multiplier := parseMultiplier(hpa)
+	min, max := parseBound(hpa, minAnnotation), parseBound(hpa, maxAnnotation)
+	if min != nil && max != nil && *min > *max {
+		log.Warnf("The %s annotation is greater than the %s annotation on the HPA %s/%s, its metrics are not bounded", minAnnotation, maxAnnotation, hpa.Namespace, hpa.Name)
+		min, max = nil, nil
+	}
+	rangeMode := parseRangeMode(hpa)
+	allClusters := parseAllClusters(hpa)
+	transform := parseTransform(hpa)
+	stat := parseStat(hpa)
+	rollupMethod := parseRollupMethod(hpa)
+	formula, formulaQueries := parseFormula(hpa)
+	queryTemplate := parseQueryTemplate(hpa)
+	frozen := parseFreeze(hpa)
+	smoothingAlpha := parseSmoothingAlpha(hpa)
+	for i := range externalMetrics {
+		externalMetrics[i].Frozen = frozen
+		if externalMetrics[i].Type == "" {
+			externalMetrics[i].Formula = formula
+			externalMetrics[i].FormulaQueries = formulaQueries
+			externalMetrics[i].QueryTemplate = queryTemplate
+		}
+		externalMetrics[i].AllClusters = allClusters["*"] || allClusters[externalMetrics[i].MetricName]
+		if maxAge > 0 {
+			externalMetrics[i].MaxAge = maxAge
+		}
+		externalMetrics[i].Aggregator = aggregator
+		externalMetrics[i].Rollup = rollup
+		externalMetrics[i].QueryWindow = window
+		externalMetrics[i].Multiplier = multiplier
+		externalMetrics[i].Min = min
+		externalMetrics[i].Max = max
+		externalMetrics[i].RangeMode = rangeMode
+		externalMetrics[i].Transform = transform
+		externalMetrics[i].Stat = stat
+		externalMetrics[i].RollupMethod = rollupMethod
+		externalMetrics[i].SmoothingAlpha = smoothingAlpha
+		if multiplier == invalidMultiplier && externalMetrics[i].LastError == "" {
+			externalMetrics[i].LastError = errInvalidMultiplier.Error()
+		}
+	}
+}
+
+// parseMaxAge returns the max age in seconds set by the annotation of an HPA, 0 if it is absent or invalid.
+func parseMaxAge(hpa metav1.ObjectMeta) int64 {
+	return parseSeconds(hpa, maxAgeAnnotation)
+}
+
+// parseAggregator returns the aggregator set by the annotation of an HPA, empty if it is absent or invalid.
+func parseAggregator(hpa metav1.ObjectMeta) string {
+	value, ok := hpa.Annotations[aggregatorAnnotation]
+	if !ok {
+		return ""
+	}
+	if !isValidAggregator(value) {
+		log.Warnf("Invalid %s annotation %q on the HPA %s/%s, using the default", aggregatorAnnotation, value, hpa.Namespace, hpa.Name)
+		return ""
+	}
+	return value
+}
+
+// parseSeconds returns the number of seconds or the duration set by an annotation, 0 if it is absent or invalid.
+func parseSeconds(hpa metav1.ObjectMeta, annotation string) int64 {
+	value, ok := hpa.Annotations[annotation]
+	if !ok {
+		return 0
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
 	if err != nil {
-		return val, false, err
+		var d time.Duration
+		if d, err = time.ParseDuration(value); err == nil {
+			seconds = int64(d.Seconds())
+		}
+	}
+	if err != nil || seconds <= 0 {
+		log.Warnf("Invalid %s annotation %q on the HPA %s/%s, using the default", annotation, value, hpa.Namespace, hpa.Name)
+		return 0
+	}
+	return seconds
+}
+
+// parseMultiplier returns the multiplier set by the annotation of an HPA, 0 if it is absent.
+func parseMultiplier(hpa metav1.ObjectMeta) float64 {
+	value, ok := hpa.Annotations[multiplierAnnotation]
+	if !ok {
+		return 0
+	}
+	multiplier, err := strconv.ParseFloat(value, 64)
+	if err != nil || multiplier <= 0 || math.IsNaN(multiplier) || math.IsInf(multiplier, 0) {
+		log.Warnf("Invalid %s annotation %q on the HPA %s/%s, its metrics are invalid", multiplierAnnotation, value, hpa.Namespace, hpa.Name)
+		return invalidMultiplier
+	}
+	return multiplier
+}
+
+// parseBound returns the bound set by an annotation of an HPA, nil if it is absent or not a finite number.
+func parseBound(hpa metav1.ObjectMeta, annotation string) *float64 {
+	value, ok := hpa.Annotations[annotation]
+	if !ok {
+		return nil
+	}
+	bound, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(bound) || math.IsInf(bound, 0) {
+		log.Warnf("Invalid %s annotation %q on the HPA %s/%s, its metrics are not bounded by it", annotation, value, hpa.Namespace, hpa.Name)
+		return nil
+	}
+	return &bound
+}
+
+// parseRangeMode returns the range mode set by the annotation of an HPA, empty if it is absent or invalid.
+func parseRangeMode(hpa metav1.ObjectMeta) string {
+	value, ok := hpa.Annotations[rangeModeAnnotation]
+	if !ok {
+		return ""
+	}
+	if value != rangeModeClamp && value != rangeModeReject {
+		log.Warnf("Invalid %s annotation %q on the HPA %s/%s, using %q", rangeModeAnnotation, value, hpa.Namespace, hpa.Name, rangeModeReject)
+		return ""
+	}
+	return value
+}
+
+// parseStat returns the percentile stat set by the annotation of an HPA, empty if it is absent or unsupported.
+func parseStat(hpa metav1.ObjectMeta) string {
+	value, ok := hpa.Annotations[statAnnotation]
+	if !ok {
+		return ""
+	}
+	if !percentileStats[value] {
+		log.Warnf("Unsupported %s annotation %q on the HPA %s/%s, its metrics are queried with the aggregator", statAnnotation, value, hpa.Namespace, hpa.Name)
+		return ""
+	}
+	return value
+}
+
+// parseRollupMethod returns the rollup method set by the annotation of an HPA, empty if it is absent or unsupported.
+func parseRollupMethod(hpa metav1.ObjectMeta) string {
+	value, ok := hpa.Annotations[rollupMethodAnnotation]
+	if !ok {
+		return ""
+	}
+	if !rollupMethods[value] {
+		log.Warnf("Unsupported %s annotation %q on the HPA %s/%s, its metrics are rolled up with the aggregator", rollupMethodAnnotation, value, hpa.Namespace, hpa.Name)
+		return ""
+	}
+	return value
+}
+
+// parseTransform returns the transform set by the annotation of an HPA, empty if it is absent or invalid.
+func parseTransform(hpa metav1.ObjectMeta) string {
+	value, ok := hpa.Annotations[transformAnnotation]
+	if !ok {
+		return ""
+	}
+	if value != transformPerSecond {
+		log.Warnf("Invalid %s annotation %q on the HPA %s/%s, its metrics are not transformed", transformAnnotation, value, hpa.Namespace, hpa.Name)
+		return ""
+	}
+	return value
+}
+
+// parseAllClusters returns the names of the metrics opted out of the scope of the cluster, `*` for all of them.
+func parseAllClusters(hpa metav1.ObjectMeta) map[string]bool {
+	value, ok := hpa.Annotations[allClustersAnnotation]
+	if !ok {
+		return nil
+	}
+	if all, err := strconv.ParseBool(value); err == nil {
+		return map[string]bool{"*": all}
+	}
+	names := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// parseFreeze returns whether the annotation of an HPA freezes its metrics at their last value.
+func parseFreeze(hpa metav1.ObjectMeta) bool {
+	value, ok := hpa.Annotations[freezeAnnotation]
+	if !ok {
+		return false
+	}
+	frozen, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Warnf("Invalid %s annotation %q on the HPA %s/%s, its metrics are not frozen", freezeAnnotation, value, hpa.Namespace, hpa.Name)
+		return false
+	}
+	return frozen
+}
+
+// checkedPoint returns the scaled point of a metric, invalid if it is older than the max age of the metric.
+func (p *Processor) checkedPoint(em custommetrics.ExternalMetricValue, point Point) (Point, error) {
+	if !point.valid || point.timestamp == 0 {
+		return scaledValue(em, point)
+	}
+	maxAge := p.maxAge(em)
+	end := p.now().Unix() - int64(p.settings().queryOffset.Seconds())
+	if age := end - point.timestamp - int64(p.metricQueryOptions(em).rollup); maxAge > 0 && age > maxAge {
+		log.Debugf("The latest point of the external metric is older than its max age: %s point_ts=%d age=%d max_age=%d", metricFields(em), point.timestamp, age, maxAge)
+		point.valid = false
+		return point, errPointTooOld
+	}
+	return scaledValue(em, point)
+}
+
+// scaledValue returns the point of a metric multiplied by the multiplier of its HPA, and bounded.
+func scaledValue(em custommetrics.ExternalMetricValue, point Point) (Point, error) {
+	if !point.valid {
+		return point, nil
+	}
+	if em.Multiplier > 0 {
+		point.value *= em.Multiplier
+		if math.IsNaN(point.value) || math.IsInf(point.value, 0) {
+			point.valid = false
+			return point, errScaledValue
+		}
+	}
+	return boundedValue(em, point)
+}
+
+// boundedValue returns the point of a metric with its value checked against the bounds of its HPA.
+func boundedValue(em custommetrics.ExternalMetricValue, point Point) (Point, error) {
+	bounded := point.value
+	if em.Min != nil && bounded < *em.Min {
+		bounded = *em.Min
+	}
+	if em.Max != nil && bounded > *em.Max {
+		bounded = *em.Max
+	}
+	if bounded == point.value {
+		return point, nil
+	}
+	if em.RangeMode == rangeModeClamp {
+		log.Debugf("Clamped the value of the external metric to the bounds of its HPA: %s value=%v bounded=%v", metricFields(em), point.value, bounded)
+		point.value = bounded
+		return point, nil
+	}
+	log.Warnf("The value of the external metric is out of the bounds of its HPA, the metric is invalid: %s value=%v", metricFields(em), point.value)
+	point.valid = false
+	return point, errOutOfRange
+}
+
+// newExternalMetricValue returns the ExternalMetricValue of a metric referenced by an HPA.
+func newExternalMetricValue(hpa metav1.ObjectMeta, metricName string, selector *metav1.LabelSelector) custommetrics.ExternalMetricValue {
+	m := custommetrics.ExternalMetricValue{
+		MetricName: metricName,
+		HPA: custommetrics.ObjectReference{
+			Name:      hpa.Name,
+			Namespace: hpa.Namespace,
+			UID:       string(hpa.UID),
+		},
+	}
+	if selector != nil {
+		m.Labels = selector.MatchLabels
+		m.MatchExpressions = selector.MatchExpressions
+	}
+	return m
+}
+
+// targetTags are the tags set by the Datadog Agent on the metrics of the pods of a scalable resource.
+var targetTags = map[string]string{
+	"Deployment":  "kube_deployment",
+	"ReplicaSet":  "kube_replica_set",
+	"StatefulSet": "kube_stateful_set",
+}
+
+// objectTags are the tags scoping the metrics of the objects that can be described by an Object metric.
+var objectTags = map[string]string{
+	"Deployment":  "kube_deployment",
+	"ReplicaSet":  "kube_replica_set",
+	"StatefulSet": "kube_stateful_set",
+	"Service":     "kube_service",
+	"Ingress":     "kube_ingress",
+	"Pod":         "pod_name",
+}
+
+// newPodsMetricValue returns the ExternalMetricValue of a Pods metric referenced by an HPA.
+func newPodsMetricValue(hpa *autoscalingv2.HorizontalPodAutoscaler, metricName string) (custommetrics.ExternalMetricValue, error) {
+	m := newExternalMetricValue(hpa.ObjectMeta, metricName, nil)
+	m.Type = custommetrics.PodsMetricType
+	target := hpa.Spec.ScaleTargetRef
+	tag, ok := targetTags[target.Kind]
+	if !ok {
+		return m, fmt.Errorf("unsupported scale target kind %s", target.Kind)
+	}
+	m.Labels = map[string]string{
+		"kube_namespace": hpa.Namespace,
+		tag:              target.Name,
+	}
+	return m, nil
+}
+
+// newObjectMetricValue returns the ExternalMetricValue of an Object metric referenced by an HPA.
+func newObjectMetricValue(hpa metav1.ObjectMeta, metricName string, target autoscalingv2.CrossVersionObjectReference) (custommetrics.ExternalMetricValue, error) {
+	m := newExternalMetricValue(hpa, metricName, nil)
+	m.Type = custommetrics.ObjectMetricType
+	m.Object = &custommetrics.DescribedObject{
+		Kind:       target.Kind,
+		Name:       target.Name,
+		APIVersion: target.APIVersion,
+	}
+	tag, ok := objectTags[target.Kind]
+	if !ok {
+		return m, fmt.Errorf("unsupported described object kind %s", target.Kind)
+	}
+	if target.Name == "" {
+		return m, fmt.Errorf("the described %s has no name", target.Kind)
+	}
+	m.Labels = map[string]string{
+		"kube_namespace": hpa.Namespace,
+		tag:              target.Name,
+	}
+	return m, nil
+}
+
+// ValidateExternalMetrics queries Datadog for a list of external metrics and sets their values.
+func (p *Processor) ValidateExternalMetrics(ctx context.Context, externalMetrics []custommetrics.ExternalMetricValue) ([]custommetrics.ExternalMetricValue, error) {
+	metrics, errs, err := p.queryExternalMetrics(ctx, externalMetrics)
+	now := p.now().Unix()
+	for i, m := range externalMetrics {
+		// Metrics without a key cannot be queried and are left invalid.
+		key, keyErr := p.queryKey(m)
+		if keyErr != nil {
+			// The targets of the pods and object metrics and the formulas that cannot be queried are reported when
+			// they are built.
+			switch {
+			case keyErr == ErrMetricNotAllowed:
+				key, _ := p.metricKey(m)
+				metricName, _ := p.metricPolicy.deniedMetric(p.formatQuery(key))
+				log.Warnf("The external metric references a metric not allowed by the metric policy, it is never queried: %s denied_metric=%q result=invalid error=%q", metricFields(m), metricName, keyErr)
+			case m.Type != "":
+			case m.Formula != "":
+			case keyErr == errInvalidMultiplier:
+			case keyErr == errUnscopedQuery:
+				log.Warnf("The external metric has no selector specified, the metric is invalid unless external_metrics_provider.allow_unscoped_queries is set: %s result=invalid error=%q", metricFields(m), keyErr)
+			default:
+				log.Warnf("The selector of the external metric cannot be represented in a Datadog query, the metric is invalid: %s result=invalid error=%q", metricFields(m), keyErr)
+			}
+			if m.LastError == "" {
+				externalMetrics[i].LastError = keyErr.Error()
+			}
+			continue
+		}
+		point, pointErr := p.checkedPoint(m, metrics[key])
+		point = p.smoothedPoint(m, point)
+		externalMetrics[i].Query = p.formatQuery(key)
+		externalMetrics[i].Value = int64(point.value)
+		externalMetrics[i].ValueFloat = point.value
+		externalMetrics[i].Valid = point.valid
+		if point.valid {
+			externalMetrics[i].LastSuccessTimestamp = now
+			externalMetrics[i].Timestamp = pointTimestamp(point, now)
+		} else {
+			queryErr := errs[key]
+			if pointErr != nil {
+				queryErr = pointErr
+			} else if queryErr == nil {
+				queryErr = err
+			}
+			externalMetrics[i].LastError = lastError(nil, queryErr)
+			log.Warnf("Could not fetch the external metric from Datadog, the metric is invalid: %s result=invalid", metricFields(externalMetrics[i]))
+		}
+	}
+	return externalMetrics, err
+}
+
+// lastError returns the error reported for a metric that could not be fetched, see metricError.
+func lastError(keyErr, queryErr error) string {
+	return metricError(keyErr, queryErr).Error()
+}
+
+// metricError returns the error of a metric that could not be fetched.
+func metricError(keyErr, queryErr error) error {
+	switch {
+	case keyErr != nil:
+		return keyErr
+	case queryErr != nil:
+		return queryErr
+	}
+	return ErrNoDataPoints
+}
+
+// QueryExternalMetrics queries Datadog for the values of a list of external metrics, keyed by getMetricKey.
+func (p *Processor) QueryExternalMetrics(emList []custommetrics.ExternalMetricValue) map[string]Point {
+	metrics, _ := p.QueryExternalMetricsWithContext(p.getContext(), emList)
+	return metrics
+}
+
+// QueryExternalMetricsWithContext is QueryExternalMetrics, interruptible by the given context.
+func (p *Processor) QueryExternalMetricsWithContext(ctx context.Context, emList []custommetrics.ExternalMetricValue) (map[string]Point, error) {
+	metrics, _, err := p.queryExternalMetrics(ctx, emList)
+	return metrics, err
+}
+
+// queryExternalMetrics is QueryExternalMetricsWithContext, also returning the errors of the failed queries by key.
+func (p *Processor) queryExternalMetrics(ctx context.Context, emList []custommetrics.ExternalMetricValue) (map[string]Point, map[string]error, error) {
+	uniqueQueries := make(map[string]struct{})
+	var batch []string
+
+	for _, em := range emList {
+		if em.MetricName == "" {
+			log.Debugf("Invalid external metric to query: %s", metricFields(em))
+			log.Tracef("Invalid external metric to query: %#v", em)
+			continue
+		}
+		key, err := p.queryKey(em)
+		if err != nil {
+			log.Debugf("Invalid selector for the external metric: %s error=%q", metricFields(em), err)
+			continue
+		}
+		if _, ok := uniqueQueries[key]; ok {
+			continue
+		}
+		uniqueQueries[key] = struct{}{}
+		batch = append(batch, key)
+	}
+	if len(batch) == 0 {
+		return nil, nil, nil
+	}
+	if len(batch) < len(emList) {
+		log.Debugf("Deduplicated the external metrics to query: metrics=%d unique=%d", len(emList), len(batch))
+	}
+
+	// The query options apply to a whole batch, the formulas and the metrics of a MetricProvider are queried alone.
+	var groups []batchGroup
+	batches := make(map[batchGroup][]string)
+	for _, key := range batch {
+		_, opts := p.splitKey(key)
+		group := batchGroup{opts: opts}
+		if p.queriesAlone || strings.HasPrefix(key, formulaKeyPrefix) {
+			group.alone = key
+		}
+		if _, ok := batches[group]; !ok {
+			groups = append(groups, group)
+		}
+		batches[group] = append(batches[group], key)
+	}
+	if len(groups) == 1 {
+		return p.queryBatch(ctx, batch)
+	}
+	metrics := make(map[string]Point, len(batch))
+	errs := make(map[string]error)
+	for _, group := range groups {
+		batchMetrics, batchErrs, err := p.queryBatch(ctx, batches[group])
+		for key, point := range batchMetrics {
+			metrics[key] = point
+		}
+		for key, err := range batchErrs {
+			errs[key] = err
+		}
+		if err != nil {
+			return metrics, errs, err
+		}
+	}
+	return metrics, errs, nil
+}
+
+// batchGroup groups the metrics queried in the same batch.
+type batchGroup struct {
+	opts  queryOptions
+	alone string
+}
+
+// queryBatch queries a batch of unique metrics, and falls back to querying them individually if it is rejected.
+func (p *Processor) queryBatch(ctx context.Context, batch []string) (map[string]Point, map[string]error, error) {
+	metrics, err := p.queryDatadogExternal(ctx, batch)
+	if err == nil {
+		return metrics, pointErrors(metrics), nil
+	}
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	if errors.Cause(err) == ErrNoDataPoints {
+		// Datadog answered without any serie, the metrics not answered by the cache are invalid.
+		log.Warnf("No serie matched the external metrics in Datadog, they are invalid: metrics=%d error=%q", len(batch), err)
+		errs := pointErrors(metrics)
+		for _, key := range batch {
+			if _, ok := metrics[key]; !ok {
+				errs[key] = err
+			}
+		}
+		return metrics, errs, nil
+	}
+	if isSuspended(err) {
+		return nil, nil, err
+	}
+	if len(batch) == 1 {
+		log.Warnf("Could not fetch the external metric from Datadog: key=%q error=%q", batch[0], err)
+		errs := map[string]error{batch[0]: err}
+		if isTransient(err) {
+			return map[string]Point{batch[0]: {transient: true}}, errs, nil
+		}
+		return nil, errs, nil
+	}
+
+	// If the batch was rejected as a whole (e.g. one of the queries is malformed),
+	// query the metrics individually so that a single failure does not invalidate the others.
+	log.Debugf("Could not query the batch of external metrics, querying them individually: metrics=%d error=%q", len(batch), err)
+	return p.queryIndividually(ctx, batch)
+}
+
+// pointErrors returns the errors of the invalid points Datadog answered with, by key.
+func pointErrors(metrics map[string]Point) map[string]error {
+	errs := make(map[string]error)
+	for key, point := range metrics {
+		if point.err != nil {
+			errs[key] = point.err
+		}
+	}
+	return errs
+}
+
+// queryIndividually queries the metrics one by one, with up to queryConcurrency queries in flight.
+func (p *Processor) queryIndividually(ctx context.Context, keys []string) (map[string]Point, map[string]error, error) {
+	workers := p.settings().queryConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(keys) {
+		workers = len(keys)
+	}
+	// The queries in flight are interrupted when the circuit breaker opens.
+	queryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mutex sync.Mutex
+	var suspendedErr error
+	metrics := make(map[string]Point, len(keys))
+	errs := make([]error, len(keys))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				point, err := p.validateExternalMetric(queryCtx, keys[i])
+				mutex.Lock()
+				switch {
+				case isSuspended(err):
+					suspendedErr = err
+					cancel()
+				case queryCtx.Err() != nil:
+					// The query was interrupted, the metric is left out.
+				case err != nil:
+					errs[i] = err
+					if isTransient(err) {
+						metrics[keys[i]] = Point{transient: true}
+					}
+				default:
+					// The point is stored as is, like the points of a batch, with its timestamp and error.
+					metrics[keys[i]] = point
+					errs[i] = point.err
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+feed:
+	for i := range keys {
+		select {
+		case indexes <- i:
+		case <-queryCtx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	failed := make(map[string]error)
+	for i, err := range errs {
+		if err != nil {
+			failed[keys[i]] = err
+			log.Warnf("Could not fetch the external metric from Datadog: key=%q error=%q", keys[i], err)
+		}
+	}
+	if len(failed) > 0 {
+		log.Debugf("Could not fetch some of the external metrics individually: metrics=%d failed=%d", len(keys), len(failed))
+	}
+	if suspendedErr != nil {
+		return metrics, failed, suspendedErr
+	}
+	return metrics, failed, ctx.Err()
+}
+
+// metricFields returns the identity of an external metric as key=value fields, to filter the logs on.
+func metricFields(em custommetrics.ExternalMetricValue) string {
+	key, _ := getMetricKey(em, "")
+	return fmt.Sprintf("metric=%q key=%q hpa_namespace=%q hpa_name=%q hpa_uid=%q", em.MetricName, key, em.HPA.Namespace, em.HPA.Name, em.HPA.UID)
+}
+
+// IsDegraded returns whether the queries to Datadog are suspended after too many failures.
+func (p *Processor) IsDegraded() bool {
+	return p.breaker.isOpen()
+}
+
+// validateExternalMetric queries Datadog to validate the availability and value of an external metric.
+func (p *Processor) validateExternalMetric(ctx context.Context, key string) (Point, error) {
+	metrics, err := p.queryDatadogExternal(ctx, []string{key})
+	if err != nil {
+		return Point{}, err
+	}
+	point, ok := metrics[key]
+	if !ok {
+		return Point{}, &QueryError{Query: key, Kind: ErrNoDataPoints}
 	}
-	return val, true, nil
+	return point, nil
 }
@@ -8,24 +8,45 @@
 package hpa
 
 import (
+	"context"
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	autoscalingv2 "k8s.io/api/autoscaling/v2beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/zorkian/go-datadog-api.v2"
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 type fakeDatadogClient struct {
 	queryMetricsFunc func(from, to int64, query string) ([]datadog.Series, error)
 }
 
-func (d *fakeDatadogClient) QueryMetrics(from, to int64, query string) ([]datadog.Series, error) {
+func (d *fakeDatadogClient) QueryMetrics(_ context.Context, from, to int64, query string) ([]datadog.Series, error) {
 	if d.queryMetricsFunc != nil {
 		return d.queryMetricsFunc(from, to, query)
 	}
@@ -34,6 +55,7 @@ func (d *fakeDatadogClient) QueryMetrics(from, to int64, query string) ([]datado
 
 func TestProcessor_UpdateExternalMetrics(t *testing.T) {
 	metricName := "requests_per_s"
+	scope := "foo:bar"
 	tests := []struct {
 		desc     string
 		metrics  []custommetrics.ExternalMetricValue
@@ -52,6 +74,7 @@ func TestProcessor_UpdateExternalMetrics(t *testing.T) {
 			[]datadog.Series{
 				{
 					Metric: &metricName,
+					Scope:  &scope,
 					Points: []datadog.DataPoint{
 						{1531492452, 12},
 						{1531492486, 14},
@@ -62,8 +85,39 @@ func TestProcessor_UpdateExternalMetrics(t *testing.T) {
 				{
 					MetricName: "requests_per_s",
 					Labels:     map[string]string{"foo": "bar"},
-					Value:      14,
+					Value:      13,
+					ValueFloat: 13,
 					Valid:      true,
+					Query:      "avg:requests_per_s{foo:bar}",
+				},
+			},
+		},
+		{
+			"update fractional metric",
+			[]custommetrics.ExternalMetricValue{
+				{
+					MetricName: "requests_per_s",
+					Labels:     map[string]string{"foo": "bar"},
+					Valid:      false,
+				},
+			},
+			[]datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{
+						{1531492452, 0.8},
+					},
+				},
+			},
+			[]custommetrics.ExternalMetricValue{
+				{
+					MetricName: "requests_per_s",
+					Labels:     map[string]string{"foo": "bar"},
+					Value:      0,
+					ValueFloat: 0.8,
+					Valid:      true,
+					Query:      "avg:requests_per_s{foo:bar}",
 				},
 			},
 		},
@@ -85,6 +139,7 @@ func TestProcessor_UpdateExternalMetrics(t *testing.T) {
 			strippedTs := make([]custommetrics.ExternalMetricValue, 0)
 			for _, m := range externalMetrics {
 				m.Timestamp = 0
+				m.LastSuccessTimestamp = 0
 				strippedTs = append(strippedTs, m)
 			}
 
@@ -93,6 +148,76 @@ func TestProcessor_UpdateExternalMetrics(t *testing.T) {
 	}
 }
 
+func TestProcessor_UpdateExternalMetricsWithContext(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	metrics := []custommetrics.ExternalMetricValue{
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"foo": "bar"},
+			Valid:      false,
+		},
+		{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"foo": "baz"},
+			Valid:      false,
+		},
+	}
+
+	t.Run("cancelled before the query", func(t *testing.T) {
+		block := make(chan struct{})
+		defer close(block)
+		datadogClient := &fakeDatadogClient{
+			queryMetricsFunc: func(int64, int64, string) ([]datadog.Series, error) {
+				<-block
+				return nil, nil
+			},
+		}
+		hpaCl := &Processor{datadogClient: datadogClient}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		updated, err := hpaCl.UpdateExternalMetricsWithContext(ctx, metrics)
+		assert.Empty(t, updated)
+		assert.Equal(t, context.Canceled, errors.Cause(err))
+	})
+
+	t.Run("cancelled mid-refresh", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		calls := 0
+		datadogClient := &fakeDatadogClient{
+			queryMetricsFunc: func(int64, int64, string) ([]datadog.Series, error) {
+				calls++
+				switch calls {
+				case 1:
+					// Reject the batch so that the metrics are queried one by one.
+					return nil, fmt.Errorf("API error 400 Bad Request")
+				case 3:
+					cancel()
+					return nil, fmt.Errorf("interrupted")
+				}
+				return []datadog.Series{
+					{
+						Metric: &metricName,
+						Scope:  &scope,
+						Points: []datadog.DataPoint{{1531492452000, 14}},
+					},
+				}, nil
+			},
+		}
+		hpaCl := &Processor{datadogClient: datadogClient}
+
+		updated, err := hpaCl.UpdateExternalMetricsWithContext(ctx, metrics)
+		assert.Equal(t, context.Canceled, errors.Cause(err))
+		assert.Equal(t, 3, calls)
+		require.Len(t, updated, 1)
+		assert.Equal(t, map[string]string{"foo": "bar"}, updated[0].Labels)
+		assert.Equal(t, int64(14), updated[0].Value)
+		assert.True(t, updated[0].Valid)
+	})
+}
+
 func TestProcessor_ComputeDeleteExternalMetrics(t *testing.T) {
 	tests := []struct {
 		desc     string
@@ -161,8 +286,277 @@ func TestProcessor_ComputeDeleteExternalMetrics(t *testing.T) {
 	}
 }
 
+func TestProcessor_ComputeDeleteExternalMetricsWithGracePeriod(t *testing.T) {
+	list := []*autoscalingv2.HorizontalPodAutoscaler{
+		{ObjectMeta: v1.ObjectMeta{UID: types.UID("1")}},
+	}
+	emList := []custommetrics.ExternalMetricValue{
+		{MetricName: "requests_per_s_one", HPA: custommetrics.ObjectReference{UID: "1"}},
+		{MetricName: "requests_per_s_two", HPA: custommetrics.ObjectReference{UID: "2"}},
+		{MetricName: "requests_per_s_three", HPA: custommetrics.ObjectReference{UID: "3"}},
+	}
+	now := time.Unix(1531492452, 0)
+	missingSince := map[string]time.Time{
+		// Missing for longer than the grace period.
+		"3": now.Add(-10 * time.Minute),
+		// Listed again.
+		"1": now.Add(-10 * time.Minute),
+	}
+
+	deleted := ComputeDeleteExternalMetricsWithGracePeriod(list, emList, 5*time.Minute, missingSince, now)
+	require.Len(t, deleted, 1)
+	assert.Equal(t, "requests_per_s_three", deleted[0].MetricName)
+	// The HPA 2 is first seen missing, the HPA 1 is forgotten.
+	assert.Len(t, missingSince, 2)
+	assert.Contains(t, missingSince, "2")
+	assert.Contains(t, missingSince, "3")
+
+	// The metrics of the HPA 3 were deleted, the HPA 2 is now listed.
+	list = append(list, &autoscalingv2.HorizontalPodAutoscaler{ObjectMeta: v1.ObjectMeta{UID: types.UID("2")}})
+	deleted = ComputeDeleteExternalMetricsWithGracePeriod(list, emList[:2], 5*time.Minute, missingSince, now)
+	assert.Len(t, deleted, 0)
+	assert.Len(t, missingSince, 0)
+}
+
+func TestComputeGCExternalMetricsGracePeriod(t *testing.T) {
+	gracePeriod := 5 * time.Minute
+	now := time.Unix(1531492452, 0)
+	tests := []struct {
+		desc     string
+		missing  time.Duration
+		expected int
+	}{
+		{"just below the grace period", gracePeriod - time.Second, 0},
+		{"at the grace period", gracePeriod, 1},
+		{"just above the grace period", gracePeriod + time.Second, 1},
+	}
+
+	emList := []custommetrics.ExternalMetricValue{
+		{MetricName: "requests_per_s", HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1"}},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			missingSince := map[string]time.Time{"1": now.Add(-tt.missing)}
+			deleted := ComputeGCExternalMetrics(nil, nil, emList, gracePeriod, missingSince, now)
+			assert.Len(t, deleted, tt.expected)
+		})
+	}
+}
+
+func TestProcessor_ComputeDeleteExternalMetricsRecreatedHPA(t *testing.T) {
+	list := []*autoscalingv2.HorizontalPodAutoscaler{
+		{ObjectMeta: v1.ObjectMeta{Name: "foo", Namespace: "default", UID: types.UID("2")}},
+	}
+	emList := []custommetrics.ExternalMetricValue{
+		// The metrics of the HPA foo before it was recreated.
+		{MetricName: "requests_per_s", HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1"}},
+		{MetricName: "queue_length", HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1"}},
+		{MetricName: "errors_per_s", HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "2"}},
+		// An HPA with the same name in another namespace, missing from the list.
+		{MetricName: "requests_per_s", HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "other", UID: "3"}},
+	}
+	missingSince := make(map[string]time.Time)
+
+	// The metrics of the previous UID are deleted within the grace period, the missing HPA is kept.
+	deleted := ComputeDeleteExternalMetricsWithGracePeriod(list, emList, 5*time.Minute, missingSince, time.Now())
+	assert.ElementsMatch(t, emList[:2], deleted)
+	assert.Len(t, missingSince, 1)
+	assert.Contains(t, missingSince, "3")
+
+	// Once the recreated HPA is deleted in turn, its metrics are kept for the grace period.
+	deleted = ComputeDeleteExternalMetricsWithGracePeriod(nil, emList[2:3], 5*time.Minute, missingSince, time.Now())
+	assert.Len(t, deleted, 0)
+	assert.Contains(t, missingSince, "2")
+}
+
+func TestComputeGCExternalMetrics(t *testing.T) {
+	list := []*autoscalingv2.HorizontalPodAutoscaler{
+		{ObjectMeta: v1.ObjectMeta{Name: "foo", Namespace: "default", UID: types.UID("2")}},
+	}
+	emList := []custommetrics.ExternalMetricValue{
+		{MetricName: "requests_per_s_one", HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1"}},
+		{MetricName: "requests_per_s_two", HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "2"}},
+		{MetricName: "requests_per_s_three", HPA: custommetrics.ObjectReference{Name: "bar", Namespace: "default", UID: "3"}},
+		{MetricName: "requests_per_s_four", HPA: custommetrics.ObjectReference{Name: "baz", Namespace: "default", UID: "4"}},
+		{MetricName: "requests_per_s_five"},
+	}
+
+	deleted := ComputeGCExternalMetrics(list, nil, emList, 0, make(map[string]time.Time), time.Now())
+	require.Len(t, deleted, 4)
+	assert.Equal(t, GCDeletion{Metric: emList[0], Reason: GCReasonUIDChanged}, deleted[0])
+	assert.Equal(t, GCDeletion{Metric: emList[2], Reason: GCReasonHPADeleted}, deleted[1])
+	assert.Equal(t, GCDeletion{Metric: emList[3], Reason: GCReasonHPADeleted}, deleted[2])
+	assert.Equal(t, GCDeletion{Metric: emList[4], Reason: GCReasonOrphaned}, deleted[3])
+	assert.Equal(t, "4 metrics removed (2 HPA-deleted, 1 UID-changed, 1 orphaned)", SummarizeGC(deleted))
+
+	// The wrapper returns the same metrics, without their reasons.
+	assert.Equal(t, []custommetrics.ExternalMetricValue{emList[0], emList[2], emList[3], emList[4]}, ComputeDeleteExternalMetricsWithGracePeriod(list, emList, 0, make(map[string]time.Time), time.Now()))
+
+	// The metrics of the HPAs missing for less than the grace period are kept, the recreated ones are not.
+	deleted = ComputeGCExternalMetrics(list, nil, emList, time.Hour, make(map[string]time.Time), time.Now())
+	require.Len(t, deleted, 1)
+	assert.Equal(t, GCReasonUIDChanged, deleted[0].Reason)
+	assert.Equal(t, "1 metrics removed (1 UID-changed)", SummarizeGC(deleted))
+	assert.Equal(t, "0 metrics removed", SummarizeGC(nil))
+
+	// The metrics of the WPAs listed are kept like the ones of the HPAs.
+	wpaList := []metav1.ObjectMeta{{Name: "bar", Namespace: "default", UID: types.UID("3")}}
+	deleted = ComputeGCExternalMetrics(list, wpaList, emList, 0, make(map[string]time.Time), time.Now())
+	require.Len(t, deleted, 3)
+	assert.Equal(t, "3 metrics removed (1 HPA-deleted, 1 UID-changed, 1 orphaned)", SummarizeGC(deleted))
+}
+
+func TestReconcileExternalMetrics(t *testing.T) {
+	metric := func(name, uid string, labels map[string]string, value float64, ts int64) custommetrics.ExternalMetricValue {
+		return custommetrics.ExternalMetricValue{
+			MetricName: name,
+			Labels:     labels,
+			HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: uid},
+			ValueFloat: value,
+			Valid:      true,
+			Timestamp:  ts,
+		}
+	}
+	frontend := map[string]string{"role": "frontend"}
+	backend := map[string]string{"role": "backend"}
+
+	tests := []struct {
+		desc     string
+		current  []custommetrics.ExternalMetricValue
+		desired  []custommetrics.ExternalMetricValue
+		upserted []custommetrics.ExternalMetricValue
+		deleted  []custommetrics.ExternalMetricValue
+	}{
+		{
+			"nothing to reconcile",
+			nil,
+			nil,
+			nil,
+			nil,
+		},
+		{
+			"new metrics are upserted",
+			nil,
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10)},
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10)},
+			nil,
+		},
+		{
+			"metrics not desired anymore are deleted",
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10)},
+			nil,
+			nil,
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10)},
+		},
+		{
+			"metrics differing only by their timestamps are unchanged",
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10)},
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 20)},
+			nil,
+			nil,
+		},
+		{
+			"metrics whose value changed are upserted",
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10)},
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 13, 20)},
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 13, 20)},
+			nil,
+		},
+		{
+			"metrics whose selector changed are replaced",
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10)},
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", backend, 12, 10)},
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", backend, 12, 10)},
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10)},
+		},
+		{
+			"metrics of another HPA are distinct",
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10)},
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10), metric("requests_per_s", "2", frontend, 12, 10)},
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "2", frontend, 12, 10)},
+			nil,
+		},
+		{
+			"duplicate desired metrics are upserted once",
+			nil,
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10), metric("requests_per_s", "1", frontend, 13, 10)},
+			[]custommetrics.ExternalMetricValue{metric("requests_per_s", "1", frontend, 12, 10)},
+			nil,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			upserted, deleted := ReconcileExternalMetrics(tt.current, tt.desired)
+			assert.Equal(t, tt.upserted, upserted)
+			assert.Equal(t, tt.deleted, deleted)
+		})
+	}
+}
+
+func TestProcessor_ProcessWPAs(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "dcos_version:1.9.4"
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{1531492452000, 12}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+	wpa := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "datadoghq.com/v1alpha1",
+			"kind":       "WatermarkPodAutoscaler",
+			"metadata": map[string]interface{}{
+				"name":        "foo",
+				"namespace":   "default",
+				"uid":         "1111",
+				"annotations": map[string]interface{}{multiplierAnnotation: "2"},
+			},
+			"spec": map[string]interface{}{
+				"metrics": []interface{}{
+					map[string]interface{}{
+						"type": "External",
+						"external": map[string]interface{}{
+							"metricName":     metricName,
+							"metricSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"dcos_version": "1.9.4"}},
+							"highWatermark":  "20",
+							"lowWatermark":   "10",
+						},
+					},
+					// Only the External metrics are served for the WPAs.
+					map[string]interface{}{"type": "Resource"},
+				},
+			},
+		},
+	}
+
+	externalMetrics := p.ProcessWPAs(wpa)
+	require.Len(t, externalMetrics, 1)
+	em := externalMetrics[0]
+	assert.Equal(t, metricName, em.MetricName)
+	assert.Equal(t, map[string]string{"dcos_version": "1.9.4"}, em.Labels)
+	assert.Equal(t, custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1111"}, em.HPA)
+	assert.Equal(t, "avg:requests_per_s{dcos_version:1.9.4}", em.Query)
+	assert.True(t, em.Valid)
+	// The annotations of the WPA apply to its metrics.
+	assert.Equal(t, 24.0, em.ValueFloat)
+
+	// The WPAs without metrics have none to serve.
+	unstructured.RemoveNestedField(wpa.Object, "spec", "metrics")
+	assert.Empty(t, p.ProcessWPAs(wpa))
+}
+
 func TestProcessor_ProcessHPAs(t *testing.T) {
 	metricName := "requests_per_s"
+	scopeOne := "dcos_version:1.9.4"
+	scopeTwo := "dcos_version:2.1.9"
 	tests := []struct {
 		desc     string
 		metrics  autoscalingv2.HorizontalPodAutoscaler
@@ -191,6 +585,7 @@ func TestProcessor_ProcessHPAs(t *testing.T) {
 			[]datadog.Series{
 				{
 					Metric: &metricName,
+					Scope:  &scopeOne,
 					Points: []datadog.DataPoint{
 						{1531492452, 12},
 						{1531492486, 14},
@@ -201,8 +596,10 @@ func TestProcessor_ProcessHPAs(t *testing.T) {
 				{
 					MetricName: "requests_per_s",
 					Labels:     map[string]string{"dcos_version": "1.9.4"},
-					Value:      14,
+					Value:      13,
+					ValueFloat: 13,
 					Valid:      true,
+					Query:      "avg:requests_per_s{dcos_version:1.9.4}",
 				},
 			},
 		},
@@ -228,6 +625,7 @@ func TestProcessor_ProcessHPAs(t *testing.T) {
 			[]datadog.Series{
 				{
 					Metric: &metricName,
+					Scope:  &scopeOne,
 					Points: nil,
 				},
 			},
@@ -236,7 +634,33 @@ func TestProcessor_ProcessHPAs(t *testing.T) {
 					MetricName: "requests_per_s",
 					Labels:     map[string]string{"dcos_version": "1.9.4"},
 					Value:      0,
+					ValueFloat: 0,
+					Valid:      false,
+					Query:      "avg:requests_per_s{dcos_version:1.9.4}",
+					LastError:  "no data points",
+				},
+			},
+		},
+		{
+			"process hpa external metric without selector",
+			autoscalingv2.HorizontalPodAutoscaler{
+				Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+					Metrics: []autoscalingv2.MetricSpec{
+						{
+							Type: autoscalingv2.ExternalMetricSourceType,
+							External: &autoscalingv2.ExternalMetricSource{
+								MetricName: metricName,
+							},
+						},
+					},
+				},
+			},
+			nil,
+			[]custommetrics.ExternalMetricValue{
+				{
+					MetricName: "requests_per_s",
 					Valid:      false,
+					LastError:  errUnscopedQuery.Error(),
 				},
 			},
 		},
@@ -273,6 +697,15 @@ func TestProcessor_ProcessHPAs(t *testing.T) {
 			[]datadog.Series{
 				{
 					Metric: &metricName,
+					Scope:  &scopeOne,
+					Points: []datadog.DataPoint{
+						{1531492452, 22},
+						{1531492486, 12},
+					},
+				},
+				{
+					Metric: &metricName,
+					Scope:  &scopeTwo,
 					Points: []datadog.DataPoint{
 						{1531492452, 22},
 						{1531492486, 12},
@@ -283,14 +716,18 @@ func TestProcessor_ProcessHPAs(t *testing.T) {
 				{
 					MetricName: "requests_per_s",
 					Labels:     map[string]string{"dcos_version": "1.9.4"},
-					Value:      12,
+					Value:      17,
+					ValueFloat: 17,
 					Valid:      true,
+					Query:      "avg:requests_per_s{dcos_version:1.9.4}",
 				},
 				{
 					MetricName: "requests_per_s",
 					Labels:     map[string]string{"dcos_version": "2.1.9"},
-					Value:      12,
+					Value:      17,
+					ValueFloat: 17,
 					Valid:      true,
+					Query:      "avg:requests_per_s{dcos_version:2.1.9}",
 				},
 			},
 		},
@@ -312,9 +749,4321 @@ func TestProcessor_ProcessHPAs(t *testing.T) {
 			strippedTs := make([]custommetrics.ExternalMetricValue, 0)
 			for _, m := range externalMetrics {
 				m.Timestamp = 0
+				m.LastSuccessTimestamp = 0
 				strippedTs = append(strippedTs, m)
 			}
 			assert.ElementsMatch(t, tt.expected, strippedTs)
 		})
 	}
 }
+
+func TestProcessor_QueryExternalMetrics(t *testing.T) {
+	metricName := "requests_per_s"
+	scopeOne := "foo:bar"
+	scopeTwo := "foo:baz"
+	tests := []struct {
+		desc            string
+		metrics         []custommetrics.ExternalMetricValue
+		queryMetricFunc func(query string) ([]datadog.Series, error)
+		expectedCalls   int
+		expected        map[string]Point
+	}{
+		{
+			"unique queries are batched in a single call",
+			[]custommetrics.ExternalMetricValue{
+				{MetricName: metricName, Labels: map[string]string{"foo": "bar"}},
+				{MetricName: metricName, Labels: map[string]string{"foo": "bar"}},
+				{MetricName: metricName, Labels: map[string]string{"foo": "baz"}},
+			},
+			func(query string) ([]datadog.Series, error) {
+				if query != "avg:requests_per_s{foo:bar},avg:requests_per_s{foo:baz}" {
+					return nil, fmt.Errorf("unexpected query %s", query)
+				}
+				return []datadog.Series{
+					{
+						Metric: &metricName,
+						Scope:  &scopeOne,
+						Points: []datadog.DataPoint{{1531492452000, 12}},
+					},
+					{
+						Metric: &metricName,
+						Scope:  &scopeTwo,
+						Points: []datadog.DataPoint{{1531492452000, 14}},
+					},
+				}, nil
+			},
+			1,
+			map[string]Point{
+				"requests_per_s{foo:bar}": {value: 12, timestamp: 1531492452, valid: true},
+				"requests_per_s{foo:baz}": {value: 14, timestamp: 1531492452, valid: true},
+			},
+		},
+		{
+			"a serie without points only invalidates its metric",
+			[]custommetrics.ExternalMetricValue{
+				{MetricName: metricName, Labels: map[string]string{"foo": "bar"}},
+				{MetricName: metricName, Labels: map[string]string{"foo": "baz"}},
+			},
+			func(query string) ([]datadog.Series, error) {
+				return []datadog.Series{
+					{
+						Metric: &metricName,
+						Scope:  &scopeOne,
+						Points: nil,
+					},
+					{
+						Metric: &metricName,
+						Scope:  &scopeTwo,
+						Points: []datadog.DataPoint{{1531492452000, 14}},
+					},
+				}, nil
+			},
+			1,
+			map[string]Point{
+				"requests_per_s{foo:baz}": {value: 14, timestamp: 1531492452, valid: true},
+			},
+		},
+		{
+			"a rejected batch is queried metric by metric",
+			[]custommetrics.ExternalMetricValue{
+				{MetricName: metricName, Labels: map[string]string{"foo": "bar"}},
+				{MetricName: metricName, Labels: map[string]string{"foo": "baz"}},
+			},
+			func(query string) ([]datadog.Series, error) {
+				if query != "avg:requests_per_s{foo:baz}" {
+					return nil, fmt.Errorf("API error 400 Bad Request")
+				}
+				return []datadog.Series{
+					{
+						Metric: &metricName,
+						Scope:  &scopeTwo,
+						Points: []datadog.DataPoint{{1531492452000, 14}},
+					},
+				}, nil
+			},
+			3,
+			map[string]Point{
+				"requests_per_s{foo:baz}": {value: 14, timestamp: 1531492452, valid: true},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			calls := 0
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(_, _ int64, query string) ([]datadog.Series, error) {
+					calls++
+					return tt.queryMetricFunc(query)
+				},
+			}
+			hpaCl := &Processor{datadogClient: datadogClient}
+
+			points := hpaCl.QueryExternalMetrics(tt.metrics)
+			assert.Equal(t, tt.expected, points)
+			assert.Equal(t, tt.expectedCalls, calls)
+		})
+	}
+}
+
+func TestReducePoints(t *testing.T) {
+	points := []datadog.DataPoint{
+		{1531492452000, 12},
+		{1531492470000, 20},
+		{1531492486000, 10},
+	}
+	tests := []struct {
+		aggregator string
+		points     []datadog.DataPoint
+		value      float64
+		ok         bool
+	}{
+		{aggregatorAvg, points, 14, true},
+		{aggregatorMax, points, 20, true},
+		{aggregatorMin, points, 10, true},
+		{aggregatorSum, points, 42, true},
+		{aggregatorLast, points, 10, true},
+		{aggregatorAvg, nil, 0, false},
+		{"median", points, 0, false},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.aggregator), func(t *testing.T) {
+			value, timestamp, ok := reducePoints(tt.aggregator, tt.points)
+			require.Equal(t, tt.ok, ok)
+			if !ok {
+				return
+			}
+			assert.Equal(t, tt.value, value)
+			assert.Equal(t, int64(1531492486000), timestamp)
+		})
+	}
+}
+
+func TestReducePointsNull(t *testing.T) {
+	null := math.NaN()
+	tests := []struct {
+		desc      string
+		points    []datadog.DataPoint
+		value     float64
+		timestamp int64
+		ok        bool
+	}{
+		{
+			"trailing null points",
+			[]datadog.DataPoint{{1531492452000, 10}, {1531492470000, 20}, {1531492486000, null}, {1531492500000, null}},
+			20,
+			1531492470000,
+			true,
+		},
+		{
+			"null points in the middle",
+			[]datadog.DataPoint{{1531492452000, 10}, {1531492470000, null}, {1531492486000, 30}},
+			30,
+			1531492486000,
+			true,
+		},
+		{
+			"only null points",
+			[]datadog.DataPoint{{1531492452000, null}, {1531492470000, null}},
+			0,
+			0,
+			false,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			value, timestamp, ok := reducePoints(aggregatorLast, tt.points)
+			require.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.value, value)
+			assert.Equal(t, tt.timestamp, timestamp)
+		})
+	}
+
+	// The null points are not averaged as 0.
+	value, _, ok := reducePoints(aggregatorAvg, []datadog.DataPoint{{1531492452000, 10}, {1531492470000, 20}, {1531492486000, null}})
+	require.True(t, ok)
+	assert.Equal(t, 15.0, value)
+}
+
+func TestRatePoints(t *testing.T) {
+	null := math.NaN()
+	tests := []struct {
+		desc      string
+		points    []datadog.DataPoint
+		value     float64
+		timestamp int64
+		ok        bool
+		err       error
+	}{
+		{
+			"increasing counter",
+			[]datadog.DataPoint{{1531492440000, 100}, {1531492460000, 200}, {1531492480000, 260}},
+			3,
+			1531492480000,
+			true,
+			nil,
+		},
+		{
+			"trailing null points",
+			[]datadog.DataPoint{{1531492440000, 100}, {1531492460000, 200}, {1531492480000, null}},
+			5,
+			1531492460000,
+			true,
+			nil,
+		},
+		{
+			"counter reset",
+			[]datadog.DataPoint{{1531492440000, 100}, {1531492460000, 200}, {1531492480000, 20}},
+			5,
+			1531492460000,
+			true,
+			nil,
+		},
+		{
+			"counter reset without an earlier rate",
+			[]datadog.DataPoint{{1531492460000, 200}, {1531492480000, 20}},
+			0,
+			0,
+			false,
+			errCounterReset,
+		},
+		{
+			"single point",
+			[]datadog.DataPoint{{1531492460000, 200}, {1531492480000, null}},
+			0,
+			0,
+			false,
+			nil,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			value, timestamp, ok, err := ratePoints(tt.points)
+			assert.Equal(t, tt.err, err)
+			require.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.value, value)
+			assert.Equal(t, tt.timestamp, timestamp)
+		})
+	}
+}
+
+func TestProcessor_QueryExternalMetricsTrailingNullPoints(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	metrics := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"foo": "bar"}},
+	}
+	tests := []struct {
+		desc     string
+		points   []datadog.DataPoint
+		expected map[string]Point
+	}{
+		{
+			"the last bucket is not aggregated yet",
+			[]datadog.DataPoint{{1531492440000, 12}, {1531492460000, 14}, {1531492480000, math.NaN()}},
+			map[string]Point{"requests_per_s{foo:bar}": {value: 13, timestamp: 1531492460, valid: true}},
+		},
+		{
+			// The age of the point is checked against the max age of each metric rather than the one of the Processor.
+			"the metric is no longer reported",
+			[]datadog.DataPoint{{1531492300000, 12}, {1531492400000, math.NaN()}, {1531492500000, math.NaN()}},
+			map[string]Point{"requests_per_s{foo:bar}": {value: 12, timestamp: 1531492300, valid: true}},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: tt.points}}, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: time.Minute}}
+
+			assert.Equal(t, tt.expected, p.QueryExternalMetrics(metrics))
+		})
+	}
+}
+
+func TestProcessor_QueryExternalMetricsNoData(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	metrics := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"foo": "bar"}, Valid: true},
+		{MetricName: metricName, Labels: map[string]string{"foo": "baz"}, Valid: true},
+	}
+	tests := []struct {
+		desc   string
+		series []datadog.Series
+		err    error
+	}{
+		{"no series", []datadog.Series{}, ErrNoDataPoints},
+		{"no points", []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{}}}, nil},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			var queries int
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					queries++
+					return tt.series, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient}
+
+			points, err := p.queryDatadogExternal(context.Background(), []string{"requests_per_s{foo:bar}"})
+			assert.Equal(t, tt.err, errors.Cause(err))
+			assert.Empty(t, points)
+
+			// The metrics are invalid, they are not queried again individually.
+			queries = 0
+			updated := p.UpdateExternalMetrics(metrics)
+			assert.Equal(t, 1, queries)
+			require.Len(t, updated, 2)
+			assert.False(t, updated[0].Valid)
+			assert.False(t, updated[1].Valid)
+		})
+	}
+}
+
+func TestProcessor_QueryExternalMetricsAggregator(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	series := []datadog.Series{
+		{
+			Metric: &metricName,
+			Scope:  &scope,
+			Points: []datadog.DataPoint{
+				{1531492452000, 12},
+				{1531492486000, 14},
+			},
+		},
+	}
+	metrics := []custommetrics.ExternalMetricValue{
+		{MetricName: "requests_per_s", Labels: map[string]string{"foo": "bar"}},
+	}
+
+	tests := []struct {
+		aggregator string
+		query      string
+		value      float64
+	}{
+		{"", "avg:requests_per_s{foo:bar}", 13},
+		{aggregatorMax, "max:requests_per_s{foo:bar}", 14},
+		{aggregatorSum, "sum:requests_per_s{foo:bar}", 26},
+		{aggregatorLast, "avg:requests_per_s{foo:bar}", 14},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.aggregator), func(t *testing.T) {
+			var query string
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, q string) ([]datadog.Series, error) {
+					query = q
+					return series, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient, current: settings{aggregator: tt.aggregator}}
+
+			points := p.QueryExternalMetrics(metrics)
+			assert.Equal(t, tt.query, query)
+			require.Contains(t, points, "requests_per_s{foo:bar}")
+			assert.Equal(t, tt.value, points["requests_per_s{foo:bar}"].value)
+		})
+	}
+}
+
+func TestLabelsToTags(t *testing.T) {
+	labels := map[string]string{
+		"role":         "worker",
+		"env":          "prod",
+		"kube_service": "frontend",
+		"app":          "nginx",
+		"zone":         "us-east-1a",
+	}
+	assert.Equal(t, []string{"app:nginx", "env:prod", "kube_service:frontend", "role:worker", "zone:us-east-1a"}, labelsToTags(labels, ""))
+	assert.Empty(t, labelsToTags(nil, ""))
+
+	// The queries built from the same labels are identical whatever the iteration order of the map.
+	p := &Processor{}
+	query := p.BuildQuery("requests_per_s", labels)
+	assert.Equal(t, "avg:requests_per_s{app:nginx,env:prod,kube_service:frontend,role:worker,zone:us-east-1a}", query)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, query, p.BuildQuery("requests_per_s", labels))
+	}
+}
+
+func TestLabelsToTagsDelimiter(t *testing.T) {
+	tests := []struct {
+		desc      string
+		labels    map[string]string
+		delimiter string
+		expected  []string
+	}{
+		{
+			"no delimiter, the value is a single tag",
+			map[string]string{"env": "prod,staging"},
+			"",
+			[]string{"env:prod_staging"},
+		},
+		{
+			"alternative values are matched with OR",
+			map[string]string{"env": "staging,prod", "role": "worker"},
+			",",
+			[]string{"(env:prod OR env:staging)", "role:worker"},
+		},
+		{
+			"empty and duplicate values are ignored",
+			map[string]string{"env": " prod, ,prod,"},
+			",",
+			[]string{"env:prod"},
+		},
+		{
+			"custom delimiter",
+			map[string]string{"env": "prod|dev", "zone": "us-east-1a,b"},
+			"|",
+			[]string{"(env:dev OR env:prod)", "zone:us-east-1a_b"},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			assert.Equal(t, tt.expected, labelsToTags(tt.labels, tt.delimiter))
+		})
+	}
+}
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		tag      string
+		expected string
+	}{
+		{"kube_namespace:default", "kube_namespace:default"},
+		{"app.kubernetes.io/name:Web-Frontend", "app.kubernetes.io/name:web-frontend"},
+		{"env:prod staging", "env:prod_staging"},
+		{"team:a&&b__c", "team:a_b_c"},
+		{"_1role:worker!", "role:worker"},
+		{"région:Île-de-France", "région:île-de-france"},
+		{"1234", "1234"},
+		{"name:" + strings.Repeat("a", 250), "name:" + strings.Repeat("a", maxTagLength-len("name:"))},
+		{"name:" + strings.Repeat("a", 194) + "é", "name:" + strings.Repeat("a", 194)},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.tag), func(t *testing.T) {
+			assert.Equal(t, tt.expected, normalizeTag(tt.tag))
+		})
+	}
+}
+
+func TestLabelsToTagsNormalized(t *testing.T) {
+	labels := map[string]string{"App": "Web.Frontend", "env": "Prod|Staging"}
+	assert.Equal(t, []string{"app:web.frontend", "(env:prod OR env:staging)"}, labelsToTags(labels, "|"))
+
+	tags, err := expressionsToTags([]metav1.LabelSelectorRequirement{
+		{Key: "Tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"Edge"}},
+		{Key: "Zone", Operator: metav1.LabelSelectorOpExists},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tier:edge", "zone:*"}, tags)
+}
+
+func TestGetMetricKey(t *testing.T) {
+	tests := []struct {
+		desc        string
+		expressions []metav1.LabelSelectorRequirement
+		expected    string
+		err         bool
+	}{
+		{
+			"labels only",
+			nil,
+			"requests_per_s{role:worker}",
+			false,
+		},
+		{
+			"in with a single value",
+			[]metav1.LabelSelectorRequirement{
+				{Key: "env", Operator: metav1.LabelSelectorOpIn, Values: []string{"prod"}},
+			},
+			"requests_per_s{env:prod,role:worker}",
+			false,
+		},
+		{
+			"in with several values",
+			[]metav1.LabelSelectorRequirement{
+				{Key: "env", Operator: metav1.LabelSelectorOpIn, Values: []string{"prod", "dev"}},
+			},
+			"requests_per_s{(env:dev OR env:prod),role:worker}",
+			false,
+		},
+		{
+			"not in",
+			[]metav1.LabelSelectorRequirement{
+				{Key: "env", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"prod", "dev"}},
+			},
+			"requests_per_s{!env:dev,!env:prod,role:worker}",
+			false,
+		},
+		{
+			"exists and does not exist",
+			[]metav1.LabelSelectorRequirement{
+				{Key: "env", Operator: metav1.LabelSelectorOpExists},
+				{Key: "canary", Operator: metav1.LabelSelectorOpDoesNotExist},
+			},
+			"requests_per_s{!canary:*,env:*,role:worker}",
+			false,
+		},
+		{
+			"in without values",
+			[]metav1.LabelSelectorRequirement{
+				{Key: "env", Operator: metav1.LabelSelectorOpIn},
+			},
+			"",
+			true,
+		},
+		{
+			"unsupported operator",
+			[]metav1.LabelSelectorRequirement{
+				{Key: "env", Operator: "Gt", Values: []string{"1"}},
+			},
+			"",
+			true,
+		},
+		{
+			"value changing the query",
+			[]metav1.LabelSelectorRequirement{
+				{Key: "env", Operator: metav1.LabelSelectorOpIn, Values: []string{"prod,role:*"}},
+			},
+			"",
+			true,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			em := custommetrics.ExternalMetricValue{
+				MetricName:       "requests_per_s",
+				Labels:           map[string]string{"role": "worker"},
+				MatchExpressions: tt.expressions,
+			}
+			key, err := getMetricKey(em, "")
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, key)
+		})
+	}
+}
+
+func TestProcessor_ProcessHPAsMatchExpressions(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:worker,(env:dev OR env:prod)"
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						MetricName: metricName,
+						MetricSelector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{"role": "worker"},
+							MatchExpressions: []metav1.LabelSelectorRequirement{
+								{Key: "env", Operator: metav1.LabelSelectorOpIn, Values: []string{"prod", "dev"}},
+							},
+						},
+					},
+				},
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						MetricName: metricName,
+						MetricSelector: &metav1.LabelSelector{
+							MatchExpressions: []metav1.LabelSelectorRequirement{
+								{Key: "env", Operator: "Gt", Values: []string{"1"}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{1531492452000, 12}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+
+	externalMetrics := p.ProcessHPAs(hpa)
+	// The metric with an unsupported expression is not queried with a partial selector.
+	assert.Equal(t, []string{"avg:requests_per_s{(env:dev OR env:prod),role:worker}"}, queries)
+	require.Len(t, externalMetrics, 2)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.Equal(t, 12.0, externalMetrics[0].ValueFloat)
+	assert.False(t, externalMetrics[1].Valid)
+}
+
+func TestProcessor_ProcessHPAsLabelValueDelimiter(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "(env:prod OR env:staging),role:worker"
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						MetricName: metricName,
+						MetricSelector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{"role": "worker", "env": "prod,staging"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{1531492452000, 12}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, labelValueDelimiter: ","}
+
+	externalMetrics := p.ProcessHPAs(hpa)
+	assert.Equal(t, []string{"avg:requests_per_s{(env:prod OR env:staging),role:worker}"}, queries)
+	require.Len(t, externalMetrics, 1)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.Equal(t, 12.0, externalMetrics[0].ValueFloat)
+	assert.Equal(t, "prod,staging", externalMetrics[0].Labels["env"])
+	assert.Equal(t, queries[0], p.BuildQuery(metricName, externalMetrics[0].Labels))
+}
+
+func TestProcessor_QueryExternalMetricsCache(t *testing.T) {
+	metricName := "requests_per_s"
+	scopeOne := "foo:bar"
+	scopeTwo := "foo:baz"
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scopeOne,
+					Points: []datadog.DataPoint{{1531492452000, 12}},
+				},
+				{
+					Metric: &metricName,
+					Scope:  &scopeTwo,
+					Points: []datadog.DataPoint{{1531492452000, 14}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, queryCache: cache.New(time.Minute, time.Minute)}
+	one := custommetrics.ExternalMetricValue{MetricName: metricName, Labels: map[string]string{"foo": "bar"}}
+	two := custommetrics.ExternalMetricValue{MetricName: metricName, Labels: map[string]string{"foo": "baz"}}
+	hits, misses := datadogCacheHits.Value(), datadogCacheMisses.Value()
+
+	metrics := p.QueryExternalMetrics([]custommetrics.ExternalMetricValue{one})
+	assert.Equal(t, []string{"avg:requests_per_s{foo:bar}"}, queries)
+	assert.Equal(t, 12.0, metrics["requests_per_s{foo:bar}"].value)
+
+	// The second serie was cached along with the first one, no query is sent.
+	metrics = p.QueryExternalMetrics([]custommetrics.ExternalMetricValue{one, two})
+	assert.Len(t, queries, 1)
+	assert.Equal(t, 12.0, metrics["requests_per_s{foo:bar}"].value)
+	assert.Equal(t, 14.0, metrics["requests_per_s{foo:baz}"].value)
+	assert.Equal(t, hits+2, datadogCacheHits.Value())
+	assert.Equal(t, misses+1, datadogCacheMisses.Value())
+
+	p.queryCache.Flush()
+	p.QueryExternalMetrics([]custommetrics.ExternalMetricValue{one, two})
+	assert.Equal(t, []string{"avg:requests_per_s{foo:bar}", "avg:requests_per_s{foo:bar},avg:requests_per_s{foo:baz}"}, queries)
+}
+
+func TestProcessor_UpdateExternalMetricsDeduplication(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar,role:worker"
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{1531492452000, 12}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+	metrics := []custommetrics.ExternalMetricValue{
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"foo": "bar", "role": "worker"},
+			HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1"},
+		},
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"role": "worker", "foo": "bar"},
+			HPA:        custommetrics.ObjectReference{Name: "bar", Namespace: "default", UID: "2"},
+		},
+	}
+
+	updated := p.UpdateExternalMetrics(metrics)
+	assert.Equal(t, []string{"avg:requests_per_s{foo:bar,role:worker}"}, queries)
+	require.Len(t, updated, 2)
+	for _, em := range updated {
+		assert.True(t, em.Valid)
+		assert.Equal(t, 12.0, em.ValueFloat)
+	}
+	assert.Equal(t, "bar", updated[0].HPA.Name)
+	assert.Equal(t, "foo", updated[1].HPA.Name)
+}
+
+func TestProcessor_UpdateExternalMetricsOrder(t *testing.T) {
+	metricName := "requests_per_s"
+	now := time.Unix(1531492452, 0)
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			var series []datadog.Series
+			for _, scope := range []string{"role:backend", "role:frontend"} {
+				scope := scope
+				series = append(series, datadog.Series{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(now.Unix() * 1000), 12}},
+				})
+			}
+			return series, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+	p.clock = func() time.Time { return now }
+	metric := func(ns, name, uid, role string) custommetrics.ExternalMetricValue {
+		return custommetrics.ExternalMetricValue{
+			MetricName: metricName,
+			Labels:     map[string]string{"role": role},
+			HPA:        custommetrics.ObjectReference{Name: name, Namespace: ns, UID: uid},
+		}
+	}
+	emList := []custommetrics.ExternalMetricValue{
+		metric("team-b", "web", "1", "frontend"),
+		metric("team-a", "web", "2", "frontend"),
+		metric("team-a", "web", "1", "frontend"),
+		metric("team-a", "api", "3", "frontend"),
+		metric("team-a", "web", "1", "backend"),
+	}
+
+	// The metrics are sorted by HPA namespace, name and UID, then metric name and labels, whatever their order.
+	expected := []string{"team-a/api/3/frontend", "team-a/web/1/backend", "team-a/web/1/frontend", "team-a/web/2/frontend", "team-b/web/1/frontend"}
+	for i := 0; i < 2; i++ {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			var order []string
+			for _, em := range p.UpdateExternalMetrics(emList) {
+				order = append(order, fmt.Sprintf("%s/%s/%s/%s", em.HPA.Namespace, em.HPA.Name, em.HPA.UID, em.Labels["role"]))
+			}
+			assert.Equal(t, expected, order)
+		})
+		emList[0], emList[4] = emList[4], emList[0]
+	}
+
+	// The previous versions of the metrics stay paired with the metrics updated: only the metrics whose value changed
+	// are stored again.
+	emList = p.UpdateExternalMetrics(emList)
+	for i := range emList {
+		emList[i].Timestamp = 0
+		emList[i].LastSuccessTimestamp = 0
+	}
+	emList[0].ValueFloat = 0
+	emList[4].ValueFloat = 0
+	emList[0], emList[4] = emList[4], emList[0]
+	changed, unchanged := p.RefreshChanged(emList)
+	assert.Equal(t, 3, unchanged)
+	require.Len(t, changed, 2)
+	assert.Equal(t, "api", changed[0].HPA.Name)
+	assert.Equal(t, "team-b", changed[1].HPA.Namespace)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{fmt.Errorf("API error 502 Bad Gateway: upstream unavailable"), true},
+		{fmt.Errorf("API error 500 Internal Server Error: {}"), true},
+		{fmt.Errorf("API error 400 Bad Request: {\"errors\": [\"Error parsing query\"]}"), false},
+		{fmt.Errorf("API error 403 Forbidden: {\"errors\": [\"Forbidden\"]}"), false},
+		{&url.Error{Op: "Get", URL: "https://api.datadoghq.com", Err: timeoutError{}}, true},
+		{fmt.Errorf("read tcp 10.0.0.1:443: read: connection reset by peer"), true},
+		{fmt.Errorf("no metrics to query"), false},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.err), func(t *testing.T) {
+			assert.Equal(t, tt.retryable, isRetryable(tt.err))
+		})
+	}
+}
+
+func TestProcessor_QueryMetricsRetries(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	series := []datadog.Series{
+		{
+			Metric: &metricName,
+			Scope:  &scope,
+			Points: []datadog.DataPoint{{1531492452000, 12}},
+		},
+	}
+	tests := []struct {
+		desc     string
+		errors   []error
+		calls    int
+		expected bool
+	}{
+		{
+			"transient errors are retried",
+			[]error{fmt.Errorf("API error 502 Bad Gateway: "), timeoutError{}},
+			3,
+			true,
+		},
+		{
+			"query errors are not retried",
+			[]error{fmt.Errorf("API error 400 Bad Request: ")},
+			1,
+			false,
+		},
+		{
+			"the last error is returned after the last retry",
+			[]error{fmt.Errorf("API error 502 Bad Gateway: "), fmt.Errorf("API error 503 Service Unavailable: "), fmt.Errorf("API error 504 Gateway Timeout: ")},
+			3,
+			false,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			calls := 0
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					calls++
+					if calls <= len(tt.errors) {
+						return nil, tt.errors[calls-1]
+					}
+					return series, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient, current: settings{queryRetries: 2, queryBackoff: time.Millisecond}}
+
+			metrics, err := p.queryDatadogExternal(context.Background(), []string{"requests_per_s{foo:bar}"})
+			assert.Equal(t, tt.calls, calls)
+			if !tt.expected {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errors[len(tt.errors)-1].Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, metrics["requests_per_s{foo:bar}"].valid)
+		})
+	}
+}
+
+func TestProcessor_QueryMetricsTimeout(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	series := []datadog.Series{
+		{
+			Metric: &metricName,
+			Scope:  &scope,
+			Points: []datadog.DataPoint{{1531492452000, 12}},
+		},
+	}
+	tests := []struct {
+		desc     string
+		hanging  int
+		calls    int
+		expected bool
+	}{
+		{"a hanging attempt is retried", 1, 2, true},
+		{"the timeout is returned after the last retry", 3, 3, false},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+			var m sync.Mutex
+			calls := 0
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					m.Lock()
+					calls++
+					hangs := calls <= tt.hanging
+					m.Unlock()
+					if hangs {
+						<-release
+					}
+					return series, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient, current: settings{queryRetries: 2, queryBackoff: time.Millisecond, queryTimeout: 20 * time.Millisecond}}
+
+			start := time.Now()
+			metrics, err := p.queryDatadogExternal(context.Background(), []string{"requests_per_s{foo:bar}"})
+			assert.True(t, time.Since(start) < time.Second)
+			m.Lock()
+			assert.Equal(t, tt.calls, calls)
+			m.Unlock()
+			if !tt.expected {
+				require.Error(t, err)
+				assert.Equal(t, ErrDatadogUnreachable, errors.Cause(err))
+				assert.True(t, isTransient(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, metrics["requests_per_s{foo:bar}"].valid)
+		})
+	}
+
+	// The context bounds the attempts, its error is returned rather than the timeout.
+	p := &Processor{
+		datadogClient: &fakeDatadogClient{
+			queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+				time.Sleep(100 * time.Millisecond)
+				return series, nil
+			},
+		},
+		current: settings{queryTimeout: time.Second},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := p.queryDatadogExternal(ctx, []string{"requests_per_s{foo:bar}"})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestProcessor_QueryMaxSeries(t *testing.T) {
+	metricName := "requests_per_s"
+	newSeries := func(scopes ...string) []datadog.Series {
+		series := make([]datadog.Series, 0, len(scopes))
+		for i := range scopes {
+			series = append(series, datadog.Series{Metric: &metricName, Scope: &scopes[i], Points: []datadog.DataPoint{{1531492452000, 12}}})
+		}
+		return series
+	}
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			switch query {
+			case "avg:requests_per_s{role:frontend}":
+				return newSeries("role:frontend"), nil
+			case "avg:requests_per_s{role:backend}":
+				return newSeries("role:backend,host:a", "role:backend,host:b", "role:backend,host:c"), nil
+			}
+			return newSeries("role:frontend", "role:backend,host:a", "role:backend,host:b", "role:backend,host:c", "role:backend,host:d"), nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, maxSeriesPerQuery: 2}
+	tooManySeries := readTelemetry(t, tooManySeriesTelemetry)
+
+	// The batch matching too many series is queried individually, only the metric matching too many is invalid.
+	metrics, errs, err := p.queryBatch(context.Background(), []string{"requests_per_s{role:frontend}", "requests_per_s{role:backend}"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"avg:requests_per_s{role:frontend},avg:requests_per_s{role:backend}", "avg:requests_per_s{role:frontend}", "avg:requests_per_s{role:backend}"}, queries)
+	assert.True(t, metrics["requests_per_s{role:frontend}"].valid)
+	assert.False(t, metrics["requests_per_s{role:backend}"].valid)
+	require.Len(t, errs, 1)
+	assert.Equal(t, ErrTooManySeries, errors.Cause(errs["requests_per_s{role:backend}"]))
+	assert.Equal(t, "TooManySeries", eventReason(errs["requests_per_s{role:backend}"]))
+	assert.Equal(t, tooManySeries+1, readTelemetry(t, tooManySeriesTelemetry))
+}
+
+// contextDatadogClient is a DatadogClient answering with a function of the context of the queries.
+type contextDatadogClient func(ctx context.Context, query string) ([]datadog.Series, error)
+
+func (c contextDatadogClient) QueryMetrics(ctx context.Context, from, to int64, query string) ([]datadog.Series, error) {
+	return c(ctx, query)
+}
+
+func TestProcessor_QueryMetricsContext(t *testing.T) {
+	// The attempts timing out cancel the context of their query.
+	cancelled := make(chan struct{}, 2)
+	p := &Processor{
+		datadogClient: contextDatadogClient(func(ctx context.Context, query string) ([]datadog.Series, error) {
+			<-ctx.Done()
+			cancelled <- struct{}{}
+			return nil, ctx.Err()
+		}),
+		current: settings{queryRetries: 1, queryTimeout: 10 * time.Millisecond},
+	}
+	_, err := p.queryDatadogExternal(context.Background(), []string{"requests_per_s{foo:bar}"})
+	require.Error(t, err)
+	assert.Equal(t, ErrDatadogUnreachable, errors.Cause(err))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatalf("the context of the attempt %d was not cancelled", i)
+		}
+	}
+
+	// The cancellation of the refresh reaches the query.
+	ctx, cancel := context.WithCancel(context.Background())
+	p.datadogClient = contextDatadogClient(func(qctx context.Context, query string) ([]datadog.Series, error) {
+		cancel()
+		<-qctx.Done()
+		return nil, qctx.Err()
+	})
+	p.current.queryTimeout = time.Minute
+	_, err = p.queryDatadogExternal(ctx, []string{"requests_per_s{foo:bar}"})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestProcessor_QueryMetricsRetryAfter(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	series := []datadog.Series{
+		{
+			Metric: &metricName,
+			Scope:  &scope,
+			Points: []datadog.DataPoint{{1531492452000, 12}},
+		},
+	}
+	rateLimited := func(retryAfter time.Duration) error {
+		return &apiError{status: "429 Too Many Requests", body: []byte(`{"errors": ["Rate limit exceeded"]}`), retryAfter: retryAfter}
+	}
+	tests := []struct {
+		desc     string
+		err      error
+		calls    int
+		expected bool
+	}{
+		{"the delay requested is waited before retrying", rateLimited(50 * time.Millisecond), 2, true},
+		{"the rate limited queries without delay are not retried", rateLimited(0), 1, false},
+		{"the delays longer than the max are not waited", rateLimited(time.Minute), 1, false},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			calls := 0
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					calls++
+					if calls == 1 {
+						return nil, tt.err
+					}
+					return series, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient, maxRetryAfter: time.Second, current: settings{queryRetries: 2, queryBackoff: time.Millisecond}}
+
+			start := time.Now()
+			metrics, err := p.queryDatadogExternal(context.Background(), []string{"requests_per_s{foo:bar}"})
+			assert.Equal(t, tt.calls, calls)
+			if !tt.expected {
+				require.Error(t, err)
+				assert.Equal(t, ErrQueryRateLimited, errors.Cause(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, metrics["requests_per_s{foo:bar}"].valid)
+			assert.True(t, time.Since(start) >= retryAfterDelay(tt.err))
+		})
+	}
+}
+
+func TestProcessor_QueryWindowRollup(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	metrics := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"foo": "bar"}},
+	}
+	tests := []struct {
+		desc     string
+		p        *Processor
+		query    string
+		duration int64
+	}{
+		{"defaults", &Processor{}, "avg:requests_per_s{foo:bar}", 300},
+		{"window", &Processor{current: settings{queryWindow: 15 * time.Minute}}, "avg:requests_per_s{foo:bar}", 900},
+		{"rollup", &Processor{current: settings{aggregator: aggregatorMax, rollup: 60}}, "max:requests_per_s{foo:bar}.rollup(max, 60)", 300},
+		{"no interpolation", &Processor{current: settings{interpolation: interpolationNone, externalMaxAge: 10 * time.Minute}}, "avg:requests_per_s{foo:bar}", 300},
+		{"interpolation", &Processor{current: settings{interpolation: interpolationLast, externalMaxAge: 10 * time.Minute}}, "avg:requests_per_s{foo:bar}.fill(last, 600)", 300},
+		{"interpolation without max age", &Processor{current: settings{interpolation: interpolationLinear}}, "avg:requests_per_s{foo:bar}.fill(linear)", 300},
+		{"rollup and interpolation", &Processor{current: settings{rollup: 60, interpolation: interpolationLast, externalMaxAge: time.Minute}}, "avg:requests_per_s{foo:bar}.rollup(avg, 60).fill(last, 60)", 300},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			var query string
+			var duration int64
+			tt.p.datadogClient = &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, q string) ([]datadog.Series, error) {
+					query, duration = q, to-from
+					return []datadog.Series{
+						{
+							Metric: &metricName,
+							Scope:  &scope,
+							Points: []datadog.DataPoint{{1531492452000, 12}},
+						},
+					}, nil
+				},
+			}
+
+			points := tt.p.QueryExternalMetrics(metrics)
+			assert.Equal(t, tt.query, query)
+			assert.Equal(t, tt.query, tt.p.BuildQuery(metricName, map[string]string{"foo": "bar"}))
+			assert.Equal(t, tt.duration, duration)
+			assert.True(t, points["requests_per_s{foo:bar}"].valid)
+		})
+	}
+}
+
+func TestProcessor_ProcessHPAsPods(t *testing.T) {
+	metricName := "queue_depth"
+	scope := "kube_deployment:worker,kube_namespace:default"
+	tests := []struct {
+		desc     string
+		kind     string
+		queries  []string
+		expected custommetrics.ExternalMetricValue
+	}{
+		{
+			"deployment",
+			"Deployment",
+			[]string{"avg:queue_depth{kube_deployment:worker,kube_namespace:default}"},
+			custommetrics.ExternalMetricValue{
+				MetricName: metricName,
+				Labels:     map[string]string{"kube_namespace": "default", "kube_deployment": "worker"},
+				HPA:        custommetrics.ObjectReference{Name: "worker", Namespace: "default"},
+				Value:      2,
+				ValueFloat: 2.5,
+				Valid:      true,
+				Type:       custommetrics.PodsMetricType,
+				Query:      "avg:queue_depth{kube_deployment:worker,kube_namespace:default}",
+			},
+		},
+		{
+			"unsupported target",
+			"DaemonSet",
+			nil,
+			custommetrics.ExternalMetricValue{
+				MetricName: metricName,
+				HPA:        custommetrics.ObjectReference{Name: "worker", Namespace: "default"},
+				Type:       custommetrics.PodsMetricType,
+				LastError:  "unsupported scale target kind DaemonSet",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			hpa := &autoscalingv2.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: "default"},
+				Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+					ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{Kind: tt.kind, Name: "worker"},
+					Metrics: []autoscalingv2.MetricSpec{
+						{
+							Type: autoscalingv2.PodsMetricSourceType,
+							Pods: &autoscalingv2.PodsMetricSource{MetricName: metricName},
+						},
+					},
+				},
+			}
+			var queries []string
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					queries = append(queries, query)
+					return []datadog.Series{
+						{
+							Metric: &metricName,
+							Scope:  &scope,
+							Points: []datadog.DataPoint{{1531492452000, 2.5}},
+						},
+					}, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient}
+
+			externalMetrics := p.ProcessHPAs(hpa)
+			assert.Equal(t, tt.queries, queries)
+			require.Len(t, externalMetrics, 1)
+			externalMetrics[0].Timestamp = 0
+			externalMetrics[0].LastSuccessTimestamp = 0
+			assert.Equal(t, tt.expected, externalMetrics[0])
+		})
+	}
+}
+
+func TestProcessor_ProcessHPAsObject(t *testing.T) {
+	metricName := "nginx.requests_per_s"
+	scope := "kube_ingress:frontend,kube_namespace:default"
+	tests := []struct {
+		desc     string
+		target   autoscalingv2.CrossVersionObjectReference
+		queries  []string
+		expected custommetrics.ExternalMetricValue
+	}{
+		{
+			"ingress",
+			autoscalingv2.CrossVersionObjectReference{Kind: "Ingress", Name: "frontend", APIVersion: "extensions/v1beta1"},
+			[]string{"avg:nginx.requests_per_s{kube_ingress:frontend,kube_namespace:default}"},
+			custommetrics.ExternalMetricValue{
+				MetricName: metricName,
+				Labels:     map[string]string{"kube_namespace": "default", "kube_ingress": "frontend"},
+				HPA:        custommetrics.ObjectReference{Name: "frontend", Namespace: "default"},
+				Value:      120,
+				ValueFloat: 120.5,
+				Valid:      true,
+				Type:       custommetrics.ObjectMetricType,
+				Object:     &custommetrics.DescribedObject{Kind: "Ingress", Name: "frontend", APIVersion: "extensions/v1beta1"},
+				Query:      "avg:nginx.requests_per_s{kube_ingress:frontend,kube_namespace:default}",
+			},
+		},
+		{
+			"unsupported kind",
+			autoscalingv2.CrossVersionObjectReference{Kind: "ConfigMap", Name: "frontend"},
+			nil,
+			custommetrics.ExternalMetricValue{
+				MetricName: metricName,
+				HPA:        custommetrics.ObjectReference{Name: "frontend", Namespace: "default"},
+				Type:       custommetrics.ObjectMetricType,
+				Object:     &custommetrics.DescribedObject{Kind: "ConfigMap", Name: "frontend"},
+				LastError:  "unsupported described object kind ConfigMap",
+			},
+		},
+		{
+			"missing name",
+			autoscalingv2.CrossVersionObjectReference{Kind: "Ingress"},
+			nil,
+			custommetrics.ExternalMetricValue{
+				MetricName: metricName,
+				HPA:        custommetrics.ObjectReference{Name: "frontend", Namespace: "default"},
+				Type:       custommetrics.ObjectMetricType,
+				Object:     &custommetrics.DescribedObject{Kind: "Ingress"},
+				LastError:  "the described Ingress has no name",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			hpa := &autoscalingv2.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{Name: "frontend", Namespace: "default"},
+				Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+					Metrics: []autoscalingv2.MetricSpec{
+						{
+							Type:   autoscalingv2.ObjectMetricSourceType,
+							Object: &autoscalingv2.ObjectMetricSource{Target: tt.target, MetricName: metricName},
+						},
+					},
+				},
+			}
+			var queries []string
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					queries = append(queries, query)
+					return []datadog.Series{
+						{
+							Metric: &metricName,
+							Scope:  &scope,
+							Points: []datadog.DataPoint{{1531492452000, 120.5}},
+						},
+					}, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient}
+
+			externalMetrics := p.ProcessHPAs(hpa)
+			assert.Equal(t, tt.queries, queries)
+			require.Len(t, externalMetrics, 1)
+			externalMetrics[0].Timestamp = 0
+			externalMetrics[0].LastSuccessTimestamp = 0
+			assert.Equal(t, tt.expected, externalMetrics[0])
+		})
+	}
+}
+
+func TestProcessor_ProcessHPAList(t *testing.T) {
+	metricName := "nginx.net.request_per_s"
+	scopes := []string{"dcos_version:1.9.4", "dcos_version:1.10.0"}
+	newHPA := func(name, uid string, selectors ...map[string]string) *autoscalingv2.HorizontalPodAutoscaler {
+		hpa := &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(uid)},
+		}
+		for _, selector := range selectors {
+			hpa.Spec.Metrics = append(hpa.Spec.Metrics, autoscalingv2.MetricSpec{
+				Type: autoscalingv2.ExternalMetricSourceType,
+				External: &autoscalingv2.ExternalMetricSource{
+					MetricName:     metricName,
+					MetricSelector: &metav1.LabelSelector{MatchLabels: selector},
+				},
+			})
+		}
+		return hpa
+	}
+	hpas := []*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("foo", "1111", map[string]string{"dcos_version": "1.9.4"}),
+		newHPA("bar", "2222", map[string]string{"dcos_version": "1.9.4"}, map[string]string{"dcos_version": "1.10.0"}),
+		newHPA("empty", "3333"),
+	}
+
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scopes[0],
+					Points: []datadog.DataPoint{{1531492452000, 12}},
+				},
+				{
+					Metric: &metricName,
+					Scope:  &scopes[1],
+					Points: []datadog.DataPoint{{1531492452000, 14}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+
+	externalMetrics := p.ProcessHPAList(hpas)
+	// The metric shared by the HPAs is only queried once, in the same call as the others.
+	assert.Equal(t, []string{"avg:nginx.net.request_per_s{dcos_version:1.9.4},avg:nginx.net.request_per_s{dcos_version:1.10.0}"}, queries)
+	for i := range externalMetrics {
+		externalMetrics[i].Timestamp = 0
+		externalMetrics[i].LastSuccessTimestamp = 0
+	}
+	assert.Equal(t, []custommetrics.ExternalMetricValue{
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"dcos_version": "1.9.4"},
+			HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1111"},
+			Value:      12,
+			ValueFloat: 12,
+			Valid:      true,
+			Query:      "avg:nginx.net.request_per_s{dcos_version:1.9.4}",
+		},
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"dcos_version": "1.9.4"},
+			HPA:        custommetrics.ObjectReference{Name: "bar", Namespace: "default", UID: "2222"},
+			Value:      12,
+			ValueFloat: 12,
+			Valid:      true,
+			Query:      "avg:nginx.net.request_per_s{dcos_version:1.9.4}",
+		},
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"dcos_version": "1.10.0"},
+			HPA:        custommetrics.ObjectReference{Name: "bar", Namespace: "default", UID: "2222"},
+			Value:      14,
+			ValueFloat: 14,
+			Valid:      true,
+			Query:      "avg:nginx.net.request_per_s{dcos_version:1.10.0}",
+		},
+	}, externalMetrics)
+
+	assert.Empty(t, p.ProcessHPAList(nil))
+}
+
+func TestProcessor_ExtractExternalMetrics(t *testing.T) {
+	metricName := "nginx.net.request_per_s"
+	scope := "dcos_version:1.9.4"
+	newHPA := func(name, uid string, annotations map[string]string) *autoscalingv2.HorizontalPodAutoscaler {
+		return &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(uid), Annotations: annotations},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				Metrics: []autoscalingv2.MetricSpec{
+					{
+						Type: autoscalingv2.ExternalMetricSourceType,
+						External: &autoscalingv2.ExternalMetricSource{
+							MetricName:     metricName,
+							MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"dcos_version": "1.9.4"}},
+						},
+					},
+				},
+			},
+		}
+	}
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{1531492452000, 12}}}}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+	p.clock = func() time.Time { return time.Unix(1531492452, 0) }
+
+	// The metrics are extracted with the annotations of their HPA, without querying Datadog.
+	var externalMetrics []custommetrics.ExternalMetricValue
+	for _, hpa := range []*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("foo", "1111", nil),
+		newHPA("bar", "2222", map[string]string{maxAgeAnnotation: "120"}),
+		{ObjectMeta: metav1.ObjectMeta{Name: "empty", Namespace: "default", UID: types.UID("3333")}},
+	} {
+		externalMetrics = append(externalMetrics, p.ExtractExternalMetrics(hpa)...)
+	}
+	assert.Empty(t, queries)
+	assert.Equal(t, []custommetrics.ExternalMetricValue{
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"dcos_version": "1.9.4"},
+			HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1111"},
+		},
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"dcos_version": "1.9.4"},
+			HPA:        custommetrics.ObjectReference{Name: "bar", Namespace: "default", UID: "2222"},
+			MaxAge:     120,
+		},
+	}, externalMetrics)
+
+	// They are then validated in a batch, the metric shared by the HPAs is only queried once.
+	externalMetrics, err := p.ValidateExternalMetrics(context.Background(), externalMetrics)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"avg:nginx.net.request_per_s{dcos_version:1.9.4}"}, queries)
+	require.Len(t, externalMetrics, 2)
+	for _, em := range externalMetrics {
+		assert.True(t, em.Valid)
+		assert.Equal(t, 12.0, em.ValueFloat)
+	}
+}
+
+func TestProcessor_ProcessHPAsNilSelector(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "*"
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{1531492452000, 12}}}}, nil
+		},
+	}
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{
+				{Type: autoscalingv2.ExternalMetricSourceType, External: &autoscalingv2.ExternalMetricSource{MetricName: metricName}},
+				// The metrics without a source are skipped rather than dereferenced.
+				{Type: autoscalingv2.ExternalMetricSourceType},
+				{Type: autoscalingv2.PodsMetricSourceType},
+				{Type: autoscalingv2.ObjectMetricSourceType},
+			},
+		},
+	}
+
+	// The metric without a selector is invalid unless the unscoped queries are allowed.
+	p := &Processor{datadogClient: datadogClient}
+	externalMetrics := p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 1)
+	assert.False(t, externalMetrics[0].Valid)
+	assert.Equal(t, "no selector specified for the metric, the query would aggregate it over all its sources", externalMetrics[0].LastError)
+	assert.Empty(t, queries)
+
+	p.allowUnscopedQueries = true
+	externalMetrics = p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 1)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.Equal(t, 12.0, externalMetrics[0].ValueFloat)
+	assert.Equal(t, []string{"avg:requests_per_s{*}"}, queries)
+}
+
+func TestProcessor_ProcessHPAsUnscoped(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "*"
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						MetricName:     metricName,
+						MetricSelector: &metav1.LabelSelector{},
+					},
+				},
+			},
+		},
+	}
+	tests := []struct {
+		desc          string
+		allowUnscoped bool
+		queries       []string
+		valid         bool
+	}{
+		{"unscoped queries rejected", false, nil, false},
+		{"unscoped queries allowed", true, []string{"avg:requests_per_s{*}"}, true},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			var queries []string
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					queries = append(queries, query)
+					return []datadog.Series{
+						{
+							Metric: &metricName,
+							Scope:  &scope,
+							Points: []datadog.DataPoint{{1531492452000, 120}},
+						},
+					}, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient, allowUnscopedQueries: tt.allowUnscoped}
+
+			externalMetrics := p.ProcessHPAs(hpa)
+			assert.Equal(t, tt.queries, queries)
+			require.Len(t, externalMetrics, 1)
+			assert.Equal(t, tt.valid, externalMetrics[0].Valid)
+
+			// The metrics are refreshed the same way.
+			queries = nil
+			externalMetrics[0].Timestamp = 0
+			externalMetrics[0].LastSuccessTimestamp = 0
+			updated := p.UpdateExternalMetrics(externalMetrics)
+			assert.Equal(t, tt.queries, queries)
+			require.Len(t, updated, 1)
+			assert.Equal(t, tt.valid, updated[0].Valid)
+		})
+	}
+
+	// The pods and object metrics without a supported target are never queried over all the sources.
+	p := &Processor{allowUnscopedQueries: true}
+	_, err := p.queryKey(custommetrics.ExternalMetricValue{MetricName: metricName, Type: custommetrics.ObjectMetricType})
+	assert.Equal(t, errUnscopedQuery, err)
+}
+
+func TestClusterTag(t *testing.T) {
+	tests := []struct {
+		desc        string
+		clusterName string
+		expected    string
+	}{
+		{"no cluster name", "", ""},
+		{"cluster name", "prod-eu", "kube_cluster_name:prod-eu"},
+		{"lowercased", "Prod-EU", "kube_cluster_name:prod-eu"},
+		{"invalid characters", "prod eu", ""},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			assert.Equal(t, tt.expected, clusterTag(tt.clusterName))
+		})
+	}
+}
+
+func TestParseAllClustersAnnotation(t *testing.T) {
+	tests := []struct {
+		desc        string
+		annotations map[string]string
+		expected    map[string]bool
+	}{
+		{"no annotation", nil, nil},
+		{"all metrics", map[string]string{allClustersAnnotation: "true"}, map[string]bool{"*": true}},
+		{"no metric", map[string]string{allClustersAnnotation: "false"}, map[string]bool{"*": false}},
+		{"listed metrics", map[string]string{allClustersAnnotation: "requests_per_s, queue_length,"}, map[string]bool{"requests_per_s": true, "queue_length": true}},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			hpa := metav1.ObjectMeta{Name: "foo", Namespace: "default", Annotations: tt.annotations}
+			assert.Equal(t, tt.expected, parseAllClusters(hpa))
+		})
+	}
+}
+
+func TestProcessor_ProcessHPAsScopeToCluster(t *testing.T) {
+	newMetric := func(metricName string, labels map[string]string) autoscalingv2.MetricSpec {
+		return autoscalingv2.MetricSpec{
+			Type: autoscalingv2.ExternalMetricSourceType,
+			External: &autoscalingv2.ExternalMetricSource{
+				MetricName:     metricName,
+				MetricSelector: &metav1.LabelSelector{MatchLabels: labels},
+			},
+		}
+	}
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "default",
+			Annotations: map[string]string{allClustersAnnotation: "queue_length"},
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{
+				newMetric("requests_per_s", map[string]string{"service": "checkout"}),
+				newMetric("queue_length", map[string]string{"service": "checkout"}),
+				newMetric("errors_per_s", map[string]string{"service": "checkout", "kube_cluster_name": "prod-us"}),
+			},
+		},
+	}
+
+	// newSerie returns a serie of Datadog, the scope of a serie is the one of the query it matches.
+	newSerie := func(metricName, scope string) datadog.Series {
+		return datadog.Series{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{1531492452000, 12}}}
+	}
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{
+				newSerie("requests_per_s", "kube_cluster_name:prod-eu,service:checkout"),
+				newSerie("queue_length", "service:checkout"),
+				newSerie("errors_per_s", "kube_cluster_name:prod-us,service:checkout"),
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, clusterTag: clusterTag("prod-eu")}
+
+	// The metrics are scoped to the cluster, unless they are opted out or their selector filters the cluster.
+	externalMetrics := p.ProcessHPAs(hpa)
+	require.Len(t, queries, 1)
+	for _, query := range []string{
+		"avg:requests_per_s{kube_cluster_name:prod-eu,service:checkout}",
+		"avg:queue_length{service:checkout}",
+		"avg:errors_per_s{kube_cluster_name:prod-us,service:checkout}",
+	} {
+		assert.Contains(t, queries[0], query)
+	}
+	require.Len(t, externalMetrics, 3)
+	for _, em := range externalMetrics {
+		assert.True(t, em.Valid, em.MetricName)
+	}
+	assert.False(t, externalMetrics[0].AllClusters)
+	assert.True(t, externalMetrics[1].AllClusters)
+	assert.Equal(t, "avg:requests_per_s{kube_cluster_name:prod-eu,service:checkout}", p.BuildQuery("requests_per_s", map[string]string{"service": "checkout"}))
+
+	// Without the scope, the selectors are queried as is.
+	queries = nil
+	p = &Processor{datadogClient: datadogClient}
+	p.ProcessHPAs(hpa)
+	require.Len(t, queries, 1)
+	assert.Contains(t, queries[0], "avg:requests_per_s{service:checkout}")
+	assert.NotContains(t, queries[0], "prod-eu")
+}
+
+func TestGetDatadogEndpoint(t *testing.T) {
+	tests := []struct {
+		desc     string
+		endpoint string
+		site     string
+		expected string
+		err      bool
+	}{
+		{"default", "", "", "", false},
+		{"site", "", "datadoghq.eu", "https://api.datadoghq.eu", false},
+		{"endpoint", "https://api.ddog-gov.com", "datadoghq.eu", "https://api.ddog-gov.com", false},
+		{"site as an URL", "", "https://datadoghq.eu", "", true},
+		{"endpoint without scheme", "api.datadoghq.eu", "", "api.datadoghq.eu", true},
+	}
+	defer config.Datadog.Set("external_metrics_provider.endpoint", config.Datadog.Get("external_metrics_provider.endpoint"))
+	defer config.Datadog.Set("site", config.Datadog.Get("site"))
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			config.Datadog.Set("external_metrics_provider.endpoint", tt.endpoint)
+			config.Datadog.Set("site", tt.site)
+
+			endpoint, err := getDatadogEndpoint()
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, endpoint)
+		})
+	}
+}
+
+func TestNewProcessorEndpoint(t *testing.T) {
+	client := newDatadogClient("api_key", "app_key")
+	client.SetBaseUrl("datadoghq.eu")
+	_, err := NewProcessor(client)
+	assert.Error(t, err)
+
+	client.SetBaseUrl("https://api.datadoghq.eu")
+	_, err = NewProcessor(client)
+	assert.NoError(t, err)
+}
+
+func TestProcessor_UpdateExternalMetricsStale(t *testing.T) {
+	metricName := "requests_per_s"
+	tests := []struct {
+		desc        string
+		gracePeriod time.Duration
+		age         int64
+		err         error
+		expected    bool
+	}{
+		{"transient error in the grace period", 5 * time.Minute, 120, fmt.Errorf("API error 503 Service Unavailable: unavailable"), true},
+		{"rate limited in the grace period", 5 * time.Minute, 120, fmt.Errorf("API error 429 Too Many Requests: rate limited"), true},
+		{"transient error after the grace period", 5 * time.Minute, 600, fmt.Errorf("API error 503 Service Unavailable: unavailable"), false},
+		{"invalid query in the grace period", 5 * time.Minute, 120, fmt.Errorf("API error 400 Bad Request: invalid query"), false},
+		{"no grace period", 0, 120, fmt.Errorf("API error 503 Service Unavailable: unavailable"), false},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					return nil, tt.err
+				},
+			}
+			p := &Processor{datadogClient: datadogClient, staleGracePeriod: tt.gracePeriod, current: settings{externalMaxAge: time.Minute}}
+			lastUpdate := metav1.Now().Unix() - tt.age
+			metrics := []custommetrics.ExternalMetricValue{
+				{
+					MetricName: metricName,
+					Labels:     map[string]string{"role": "worker"},
+					HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default"},
+					Timestamp:  lastUpdate,
+					Value:      12,
+					ValueFloat: 12,
+					Valid:      true,
+					// The last refresh succeeded.
+					LastSuccessTimestamp: lastUpdate,
+				},
+			}
+
+			updated := p.UpdateExternalMetrics(metrics)
+			require.Len(t, updated, 1)
+			assert.Contains(t, updated[0].LastError, tt.err.Error())
+			assert.Equal(t, lastUpdate, updated[0].LastSuccessTimestamp)
+			if tt.expected {
+				// The metric keeps its last value and the timestamp of its last refresh, along with the error of the query.
+				assert.True(t, updated[0].Valid)
+				assert.Equal(t, 12.0, updated[0].ValueFloat)
+				assert.Equal(t, lastUpdate, updated[0].Timestamp)
+				// The value is older than the max age, it is flagged and counted as stale.
+				assert.True(t, updated[0].Stale)
+				assert.Equal(t, 1, p.State().Stale)
+				return
+			}
+			// The metric keeps the timestamp of its last point.
+			assert.False(t, updated[0].Valid)
+			assert.False(t, updated[0].Stale)
+			assert.Equal(t, lastUpdate, updated[0].Timestamp)
+		})
+	}
+}
+
+func TestNewProcessorInterpolation(t *testing.T) {
+	defer config.Datadog.Set("external_metrics_provider.interpolation", config.Datadog.Get("external_metrics_provider.interpolation"))
+
+	config.Datadog.Set("external_metrics_provider.interpolation", interpolationLinear)
+	p, err := NewProcessor(&fakeDatadogClient{})
+	require.NoError(t, err)
+	assert.Equal(t, interpolationLinear, p.settings().interpolation)
+
+	config.Datadog.Set("external_metrics_provider.interpolation", "spline")
+	p, err = NewProcessor(&fakeDatadogClient{})
+	require.NoError(t, err)
+	assert.Equal(t, interpolationNone, p.settings().interpolation)
+}
+
+func TestProcessor_QueryExternalMetricsConcurrency(t *testing.T) {
+	metricName := "requests_per_s"
+	var metrics []custommetrics.ExternalMetricValue
+	expected := make(map[string]Point)
+	for i := 0; i < 20; i++ {
+		labels := map[string]string{"foo": fmt.Sprintf("bar%02d", i)}
+		metrics = append(metrics, custommetrics.ExternalMetricValue{MetricName: metricName, Labels: labels})
+		if i%5 != 0 {
+			expected[getKey(metricName, labels)] = Point{value: float64(i), timestamp: 1531492452, valid: true}
+		}
+	}
+
+	var mutex sync.Mutex
+	var inFlight, maxInFlight int
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			mutex.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mutex.Unlock()
+			defer func() {
+				mutex.Lock()
+				inFlight--
+				mutex.Unlock()
+			}()
+			time.Sleep(10 * time.Millisecond)
+
+			// The batch is rejected, as well as the queries of one metric out of five.
+			var i int
+			if _, err := fmt.Sscanf(query, "avg:requests_per_s{foo:bar%02d}", &i); err != nil || i%5 == 0 {
+				return nil, fmt.Errorf("API error 400 Bad Request")
+			}
+			scope := fmt.Sprintf("foo:bar%02d", i)
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{1531492452000, float64(i)}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{queryConcurrency: 4}}
+
+	points, err := p.QueryExternalMetricsWithContext(context.Background(), metrics)
+	require.NoError(t, err)
+	assert.Equal(t, expected, points)
+	assert.True(t, maxInFlight > 1, "the metrics should be queried concurrently")
+	assert.True(t, maxInFlight <= 4, "at most 4 queries should be in flight, got %d", maxInFlight)
+}
+
+func TestProcessor_Stop(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	block := make(chan struct{})
+	defer close(block)
+	calls := make(chan struct{}, 10)
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			calls <- struct{}{}
+			<-block
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{1531492452000, 12}},
+				},
+			}, nil
+		},
+	}
+	p, err := NewProcessor(datadogClient)
+	require.NoError(t, err)
+	p.queryCache.Set("avg:requests_per_s{foo:baz}", Point{value: 14, valid: true}, cache.DefaultExpiration)
+	metrics := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"foo": "bar"}, Valid: true},
+	}
+
+	// The refresh in flight is interrupted, the metrics are left untouched.
+	done := make(chan []custommetrics.ExternalMetricValue)
+	go func() {
+		done <- p.UpdateExternalMetrics(metrics)
+	}()
+	<-calls
+	p.Stop()
+	select {
+	case updated := <-done:
+		assert.Len(t, updated, 0)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the refresh was not interrupted")
+	}
+	assert.Equal(t, 0, p.queryCache.ItemCount())
+
+	// A new Processor can be built afterwards.
+	p, err = NewProcessor(datadogClient)
+	require.NoError(t, err)
+	assert.NoError(t, p.getContext().Err())
+}
+
+func TestProcessor_UpdateExternalMetricsMaxAge(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:worker"
+	now := time.Unix(1531492452, 0)
+	tests := []struct {
+		desc    string
+		age     int64
+		clock   time.Duration
+		queried bool
+	}{
+		{"just below the max age", 29, 0, false},
+		{"at the max age", 30, 0, false},
+		{"just above the max age", 31, 0, true},
+		{"at the max age once the clock advanced", 0, 30 * time.Second, false},
+		{"above the max age once the clock advanced", 0, 31 * time.Second, true},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			var queried bool
+			current := now
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					queried = true
+					return []datadog.Series{
+						{
+							Metric: &metricName,
+							Scope:  &scope,
+							Points: []datadog.DataPoint{{float64(current.Unix() * 1000), 14}},
+						},
+					}, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 30 * time.Second}}
+			p.clock = func() time.Time { return current }
+			metrics := []custommetrics.ExternalMetricValue{
+				{
+					MetricName: metricName,
+					Labels:     map[string]string{"role": "worker"},
+					Timestamp:  now.Unix() - tt.age,
+					Value:      12,
+					ValueFloat: 12,
+					Valid:      true,
+				},
+			}
+
+			current = current.Add(tt.clock)
+			updated := p.UpdateExternalMetrics(metrics)
+			assert.Equal(t, tt.queried, queried)
+			if !tt.queried {
+				assert.Empty(t, updated)
+				return
+			}
+			require.Len(t, updated, 1)
+			assert.True(t, updated[0].Valid)
+			assert.Equal(t, 14.0, updated[0].ValueFloat)
+			assert.Equal(t, current.Unix(), updated[0].Timestamp)
+			assert.Equal(t, current.Unix(), updated[0].LastSuccessTimestamp)
+			assert.Empty(t, updated[0].LastError)
+		})
+	}
+}
+
+func TestProcessor_UpdateExternalMetricsPointAge(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:worker"
+	now := time.Unix(1531492452, 0)
+	tests := []struct {
+		desc        string
+		pointAge    int64
+		queryOffset time.Duration
+		rollup      int
+		maxAge      int64
+		valid       bool
+	}{
+		{"recent point", 10, 0, 0, 0, true},
+		{"point at the max age", 30, 0, 0, 0, true},
+		{"point older than the max age", 31, 0, 0, 0, false},
+		{"point at the max age from the end of the window", 90, time.Minute, 0, 0, true},
+		{"point older than the max age from the end of the window", 91, time.Minute, 0, 0, false},
+		{"point at the max age from the end of its rollup interval", 90, 0, 60, 0, true},
+		{"point older than the max age from the end of its rollup interval", 91, 0, 60, 0, false},
+		{"point within the max age of the HPA", 120, 0, 0, 300, true},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					return []datadog.Series{
+						{
+							Metric: &metricName,
+							Scope:  &scope,
+							Points: []datadog.DataPoint{{float64((now.Unix() - tt.pointAge) * 1000), 14}},
+						},
+					}, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 30 * time.Second, queryOffset: tt.queryOffset, rollup: tt.rollup}}
+			p.clock = func() time.Time { return now }
+			metrics := []custommetrics.ExternalMetricValue{
+				{
+					MetricName: metricName,
+					Labels:     map[string]string{"role": "worker"},
+					MaxAge:     tt.maxAge,
+					Timestamp:  now.Unix() - 600,
+					ValueFloat: 12,
+					Valid:      true,
+				},
+			}
+
+			// The metric is fetched now, its max age is evaluated against the timestamp of its point.
+			updated := p.UpdateExternalMetrics(metrics)
+			require.Len(t, updated, 1)
+			assert.Equal(t, tt.valid, updated[0].Valid)
+			if tt.valid {
+				assert.Equal(t, 14.0, updated[0].ValueFloat)
+				assert.Equal(t, now.Unix()-tt.pointAge, updated[0].Timestamp)
+				assert.Equal(t, now.Unix(), updated[0].LastSuccessTimestamp)
+				assert.Empty(t, updated[0].LastError)
+			} else {
+				assert.Equal(t, errPointTooOld.Error(), updated[0].LastError)
+			}
+
+			// So are the ones of the metrics of a new HPA.
+			validated, err := p.ValidateExternalMetrics(context.Background(), []custommetrics.ExternalMetricValue{{MetricName: metricName, Labels: map[string]string{"role": "worker"}, MaxAge: tt.maxAge}})
+			require.NoError(t, err)
+			require.Len(t, validated, 1)
+			assert.Equal(t, tt.valid, validated[0].Valid)
+		})
+	}
+}
+
+func TestProcessor_QueryIndividuallyPoints(t *testing.T) {
+	metricName := "requests_per_s"
+	now := time.Unix(1531492452, 0)
+	values := map[string]float64{"role:fresh": 10, "role:old": 12}
+	ages := map[string]int64{"role:fresh": 10, "role:old": 100}
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			if strings.Contains(query, ",") {
+				return nil, fmt.Errorf("API error 400 Bad Request: {\"errors\": [\"Error parsing query\"]}")
+			}
+			for scope, value := range values {
+				if strings.Contains(query, scope) {
+					scope := scope
+					return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{float64((now.Unix() - ages[scope]) * 1000), value}}}}, nil
+				}
+			}
+			return nil, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return now }
+	emList := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"role": "fresh"}, HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "default"}, SmoothingAlpha: 0.5},
+		{MetricName: metricName, Labels: map[string]string{"role": "old"}, HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "default"}},
+	}
+
+	// The batch is rejected, the points queried individually keep their timestamp: the old one is too old.
+	updated := p.UpdateExternalMetrics(emList)
+	require.Len(t, updated, 2)
+	assert.True(t, updated[0].Valid)
+	assert.Equal(t, 10.0, updated[0].ValueFloat)
+	assert.Equal(t, now.Unix()-10, updated[0].Timestamp)
+	assert.False(t, updated[1].Valid)
+	assert.Equal(t, errPointTooOld.Error(), updated[1].LastError)
+
+	// The next point is averaged with the first one.
+	now = now.Add(time.Minute)
+	values["role:fresh"] = 30
+	updated = p.UpdateExternalMetrics(updated)
+	require.Len(t, updated, 2)
+	assert.True(t, updated[0].Valid)
+	assert.Equal(t, 20.0, updated[0].ValueFloat)
+	assert.Equal(t, now.Unix()-10, updated[0].Timestamp)
+}
+
+func TestProcessor_RefreshAgeJitter(t *testing.T) {
+	p := &Processor{current: settings{externalMaxAge: 100 * time.Second}}
+	metrics := make([]custommetrics.ExternalMetricValue, 0, 20)
+	for i := 0; i < 20; i++ {
+		metrics = append(metrics, custommetrics.ExternalMetricValue{
+			MetricName: "requests_per_s",
+			Labels:     map[string]string{"role": "worker"},
+			HPA:        custommetrics.ObjectReference{Name: fmt.Sprintf("foo-%d", i), Namespace: "default"},
+		})
+	}
+
+	// Without jitter, the metrics are refreshed at their max age.
+	for _, em := range metrics {
+		assert.Equal(t, int64(100), p.refreshAge(em))
+	}
+
+	// With a jitter, the refreshes are advanced by up to the jitter of the max age, spread across the metrics and
+	// stable for each of them.
+	p.refreshJitter = 0.2
+	ages := make(map[int64]bool)
+	for _, em := range metrics {
+		age := p.refreshAge(em)
+		assert.True(t, age > 80 && age <= 100, "refresh age %d out of the jitter", age)
+		assert.Equal(t, age, p.refreshAge(em))
+		ages[age] = true
+	}
+	assert.True(t, len(ages) > 1, "the refreshes are not spread: %v", ages)
+
+	// The max age of the annotation is jittered too.
+	em := metrics[0]
+	em.MaxAge = 10
+	age := p.refreshAge(em)
+	assert.True(t, age > 8 && age <= 10, "refresh age %d out of the jitter", age)
+}
+
+func TestParseFlagAnnotations(t *testing.T) {
+	tests := []struct {
+		desc        string
+		parse       func(metav1.ObjectMeta) bool
+		annotations map[string]string
+		expected    bool
+	}{
+		{"no freeze annotation", parseFreeze, nil, false},
+		{"freeze", parseFreeze, map[string]string{freezeAnnotation: "true"}, true},
+		{"no freeze", parseFreeze, map[string]string{freezeAnnotation: "false"}, false},
+		{"invalid freeze", parseFreeze, map[string]string{freezeAnnotation: "always"}, false},
+		{"no target selector annotation", parseTargetSelector, nil, false},
+		{"target selector", parseTargetSelector, map[string]string{targetSelectorAnnotation: "true"}, true},
+		{"no target selector", parseTargetSelector, map[string]string{targetSelectorAnnotation: "false"}, false},
+		{"invalid target selector", parseTargetSelector, map[string]string{targetSelectorAnnotation: "yes"}, false},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.parse(metav1.ObjectMeta{Annotations: tt.annotations}))
+		})
+	}
+}
+
+func TestProcessor_UpdateExternalMetricsFrozen(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:worker"
+	now := time.Unix(1531492452, 0)
+	var queried int
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queried++
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(now.Unix() * 1000), 14}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return now }
+	frozen := custommetrics.ExternalMetricValue{
+		MetricName: metricName,
+		Labels:     map[string]string{"role": "worker"},
+		Timestamp:  now.Unix() - 3600,
+		Value:      12,
+		ValueFloat: 12,
+		Valid:      true,
+		Frozen:     true,
+	}
+
+	// A valid frozen metric is not queried past its max age, it keeps serving its last value.
+	updated := p.UpdateExternalMetrics([]custommetrics.ExternalMetricValue{frozen})
+	assert.Empty(t, updated)
+	assert.Equal(t, 0, queried)
+	state := p.State()
+	assert.Equal(t, 1, state.Valid)
+	assert.Equal(t, 0, state.Invalid)
+
+	// A frozen metric without any valid value is queried.
+	frozen.Valid = false
+	updated = p.UpdateExternalMetrics([]custommetrics.ExternalMetricValue{frozen})
+	assert.Equal(t, 1, queried)
+	require.Len(t, updated, 1)
+	assert.True(t, updated[0].Valid)
+	assert.True(t, updated[0].Frozen)
+	assert.Equal(t, 14.0, updated[0].ValueFloat)
+}
+
+func TestReconcileExternalMetricsFrozen(t *testing.T) {
+	stored := custommetrics.ExternalMetricValue{
+		MetricName: "requests_per_s",
+		Labels:     map[string]string{"role": "worker"},
+		HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1111"},
+		Timestamp:  1531492452,
+		Value:      12,
+		ValueFloat: 12,
+		Valid:      true,
+	}
+	synced := stored
+	synced.Timestamp = 1531492500
+	synced.Value = 14
+	synced.ValueFloat = 14
+	synced.Frozen = true
+
+	// Freezing the metric keeps its stored value.
+	toUpsert, toDelete := ReconcileExternalMetrics([]custommetrics.ExternalMetricValue{stored}, []custommetrics.ExternalMetricValue{synced})
+	assert.Empty(t, toDelete)
+	require.Len(t, toUpsert, 1)
+	assert.True(t, toUpsert[0].Frozen)
+	assert.Equal(t, 12.0, toUpsert[0].ValueFloat)
+	assert.Equal(t, stored.Timestamp, toUpsert[0].Timestamp)
+
+	// The frozen metric is left unchanged by the next syncs of its HPA.
+	toUpsert, toDelete = ReconcileExternalMetrics(toUpsert, []custommetrics.ExternalMetricValue{synced})
+	assert.Empty(t, toUpsert)
+	assert.Empty(t, toDelete)
+
+	// A frozen metric without any valid value takes the value of the sync.
+	stored.Valid = false
+	toUpsert, _ = ReconcileExternalMetrics([]custommetrics.ExternalMetricValue{stored}, []custommetrics.ExternalMetricValue{synced})
+	require.Len(t, toUpsert, 1)
+	assert.Equal(t, 14.0, toUpsert[0].ValueFloat)
+}
+
+func TestParseMaxAge(t *testing.T) {
+	tests := []struct {
+		desc        string
+		annotations map[string]string
+		expected    int64
+	}{
+		{"no annotation", nil, 0},
+		{"seconds", map[string]string{maxAgeAnnotation: "600"}, 600},
+		{"duration", map[string]string{maxAgeAnnotation: "10m"}, 600},
+		{"unparseable", map[string]string{maxAgeAnnotation: "ten minutes"}, 0},
+		{"negative", map[string]string{maxAgeAnnotation: "-60"}, 0},
+		{"zero", map[string]string{maxAgeAnnotation: "0s"}, 0},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			hpa := metav1.ObjectMeta{Name: "foo", Namespace: "default", Annotations: tt.annotations}
+			assert.Equal(t, tt.expected, parseMaxAge(hpa))
+		})
+	}
+}
+
+func TestProcessor_MaxAgeAnnotation(t *testing.T) {
+	metricName := "batch.backlog"
+	scope := "job:nightly"
+	now := time.Unix(1531492452, 0)
+	current := now
+	var queries int
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries++
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64((current.Unix() - 60) * 1000), 42}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return current }
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "nightly",
+			Namespace:   "default",
+			Annotations: map[string]string{maxAgeAnnotation: "10m"},
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						MetricName:     metricName,
+						MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"job": "nightly"}},
+					},
+				},
+			},
+		},
+	}
+
+	externalMetrics := p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 1)
+	assert.Equal(t, int64(600), externalMetrics[0].MaxAge)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.Equal(t, now.Unix()-60, externalMetrics[0].Timestamp)
+
+	// The metric is not refreshed before the max age of its HPA, longer than the one of the Processor.
+	queries = 0
+	current = now.Add(10 * time.Minute)
+	assert.Empty(t, p.UpdateExternalMetrics(externalMetrics))
+	assert.Equal(t, 0, queries)
+
+	current = now.Add(10*time.Minute + time.Second)
+	updated := p.UpdateExternalMetrics(externalMetrics)
+	assert.Equal(t, 1, queries)
+	require.Len(t, updated, 1)
+	assert.Equal(t, int64(600), updated[0].MaxAge)
+	// The timestamp is the one of the point, older than the refresh.
+	assert.True(t, updated[0].Valid)
+	assert.Equal(t, current.Unix()-60, updated[0].Timestamp)
+	assert.Equal(t, current.Unix(), updated[0].LastSuccessTimestamp)
+}
+
+func TestParseFloatAnnotations(t *testing.T) {
+	tests := []struct {
+		desc        string
+		parse       func(metav1.ObjectMeta) float64
+		annotations map[string]string
+		expected    float64
+	}{
+		{"no annotation", parseMultiplier, nil, 0},
+		{"factor", parseMultiplier, map[string]string{multiplierAnnotation: "0.000001"}, 0.000001},
+		{"integer", parseMultiplier, map[string]string{multiplierAnnotation: "8"}, 8},
+		{"unparseable", parseMultiplier, map[string]string{multiplierAnnotation: "mega"}, invalidMultiplier},
+		{"negative", parseMultiplier, map[string]string{multiplierAnnotation: "-2"}, invalidMultiplier},
+		{"zero", parseMultiplier, map[string]string{multiplierAnnotation: "0"}, invalidMultiplier},
+		{"not a number", parseMultiplier, map[string]string{multiplierAnnotation: "NaN"}, invalidMultiplier},
+		{"infinite", parseMultiplier, map[string]string{multiplierAnnotation: "+Inf"}, invalidMultiplier},
+		{"no smoothing annotation", parseSmoothingAlpha, nil, 0},
+		{"smoothing alpha", parseSmoothingAlpha, map[string]string{smoothingAlphaAnnotation: "0.3"}, 0.3},
+		{"no smoothing", parseSmoothingAlpha, map[string]string{smoothingAlphaAnnotation: "1"}, 1},
+		{"zero smoothing alpha", parseSmoothingAlpha, map[string]string{smoothingAlphaAnnotation: "0"}, 0},
+		{"smoothing alpha greater than 1", parseSmoothingAlpha, map[string]string{smoothingAlphaAnnotation: "1.5"}, 0},
+		{"smoothing alpha not a number", parseSmoothingAlpha, map[string]string{smoothingAlphaAnnotation: "half"}, 0},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			hpa := metav1.ObjectMeta{Name: "foo", Namespace: "default", Annotations: tt.annotations}
+			assert.Equal(t, tt.expected, tt.parse(hpa))
+		})
+	}
+}
+
+func TestProcessor_MultiplierAnnotation(t *testing.T) {
+	metricName := "kafka.log.bytes"
+	scope := "topic:events"
+	value := 42e6
+	now := time.Unix(1531492452, 0)
+	current := now
+	var queries int
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries++
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(current.Unix() * 1000), value}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return current }
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "events",
+			Namespace:   "default",
+			Annotations: map[string]string{multiplierAnnotation: "0.000001"},
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						MetricName:     metricName,
+						MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"topic": "events"}},
+					},
+				},
+			},
+		},
+	}
+
+	externalMetrics := p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 1)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.InDelta(t, 42, externalMetrics[0].ValueFloat, 1e-9)
+	assert.Equal(t, int64(42), externalMetrics[0].Value)
+
+	// The refreshed values are scaled as well.
+	value = 84e6
+	current = now.Add(time.Minute)
+	updated := p.UpdateExternalMetrics(externalMetrics)
+	require.Len(t, updated, 1)
+	assert.True(t, updated[0].Valid)
+	assert.InDelta(t, 84, updated[0].ValueFloat, 1e-9)
+
+	// A value overflowing once scaled is invalid.
+	hpa.Annotations[multiplierAnnotation] = "1e300"
+	value = 1e300
+	externalMetrics = p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 1)
+	assert.False(t, externalMetrics[0].Valid)
+	assert.Equal(t, errScaledValue.Error(), externalMetrics[0].LastError)
+
+	// The metrics of an invalid multiplier are neither queried nor served.
+	hpa.Annotations[multiplierAnnotation] = "0"
+	queries = 0
+	externalMetrics = p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 1)
+	assert.False(t, externalMetrics[0].Valid)
+	assert.Equal(t, errInvalidMultiplier.Error(), externalMetrics[0].LastError)
+	updated = p.UpdateExternalMetrics(externalMetrics)
+	require.Len(t, updated, 1)
+	assert.False(t, updated[0].Valid)
+	assert.Equal(t, errInvalidMultiplier.Error(), updated[0].LastError)
+	assert.Equal(t, 0, queries)
+}
+
+func TestParseQueryOptionsAnnotations(t *testing.T) {
+	tests := []struct {
+		desc        string
+		annotations map[string]string
+		aggregator  string
+		rollup      int64
+		window      int64
+	}{
+		{"no annotation", nil, "", 0, 0},
+		{"all options", map[string]string{aggregatorAnnotation: "max", rollupAnnotation: "60", windowAnnotation: "5m"}, "max", 60, 300},
+		{"invalid aggregator", map[string]string{aggregatorAnnotation: "median"}, "", 0, 0},
+		{"invalid rollup", map[string]string{rollupAnnotation: "a minute"}, "", 0, 0},
+		{"negative window", map[string]string{windowAnnotation: "-2m"}, "", 0, 0},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			hpa := metav1.ObjectMeta{Name: "foo", Namespace: "default", Annotations: tt.annotations}
+			assert.Equal(t, tt.aggregator, parseAggregator(hpa))
+			assert.Equal(t, tt.rollup, parseSeconds(hpa, rollupAnnotation))
+			assert.Equal(t, tt.window, parseSeconds(hpa, windowAnnotation))
+		})
+	}
+}
+
+func TestProcessor_QueryOptionsAnnotations(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	now := time.Unix(1531492452, 0)
+	windows := make(map[string]int64)
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			windows[query] = to - from
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{
+						{float64(now.Unix()*1000 - 60000), 10},
+						{float64(now.Unix() * 1000), 20},
+					},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 30 * time.Second, queryWindow: 2 * time.Minute}}
+	p.clock = func() time.Time { return now }
+	newHPA := func(name string, annotations map[string]string) *autoscalingv2.HorizontalPodAutoscaler {
+		return &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				Metrics: []autoscalingv2.MetricSpec{
+					{
+						Type: autoscalingv2.ExternalMetricSourceType,
+						External: &autoscalingv2.ExternalMetricSource{
+							MetricName:     metricName,
+							MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "frontend"}},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	// The same metric is queried separately for the HPA overriding the query options.
+	externalMetrics := p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("default", nil),
+		newHPA("peak", map[string]string{aggregatorAnnotation: "max", rollupAnnotation: "30", windowAnnotation: "10m"}),
+	})
+	require.Len(t, externalMetrics, 2)
+	assert.Equal(t, map[string]int64{
+		"avg:requests_per_s{role:frontend}":                 120,
+		"max:requests_per_s{role:frontend}.rollup(max, 30)": 600,
+	}, windows)
+
+	values := make(map[string]custommetrics.ExternalMetricValue)
+	for _, em := range externalMetrics {
+		values[em.HPA.Name] = em
+	}
+	assert.True(t, values["default"].Valid)
+	assert.Equal(t, 15.0, values["default"].ValueFloat)
+	assert.Equal(t, "avg:requests_per_s{role:frontend}", values["default"].Query)
+	assert.True(t, values["peak"].Valid)
+	assert.Equal(t, 20.0, values["peak"].ValueFloat)
+	assert.Equal(t, "max:requests_per_s{role:frontend}.rollup(max, 30)", values["peak"].Query)
+	assert.Equal(t, "max", values["peak"].Aggregator)
+	assert.Equal(t, int64(30), values["peak"].Rollup)
+	assert.Equal(t, int64(600), values["peak"].QueryWindow)
+}
+
+func TestProcessor_CacheQueryOptions(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	now := time.Unix(1531492452, 0)
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(now.Unix()*1000 - 60000), 10}, {float64(now.Unix() * 1000), 20}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{
+		datadogClient:    datadogClient,
+		queryCache:       cache.New(time.Minute, time.Minute),
+		namespaceClients: map[string]DatadogClient{"team-a": datadogClient},
+	}
+	p.clock = func() time.Time { return now }
+	newHPA := func(name, namespace, aggregator string) *autoscalingv2.HorizontalPodAutoscaler {
+		hpa := &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				Metrics: []autoscalingv2.MetricSpec{
+					{
+						Type: autoscalingv2.ExternalMetricSourceType,
+						External: &autoscalingv2.ExternalMetricSource{
+							MetricName:     metricName,
+							MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "frontend"}},
+						},
+					},
+				},
+			},
+		}
+		if aggregator != "" {
+			hpa.Annotations = map[string]string{aggregatorAnnotation: aggregator}
+		}
+		return hpa
+	}
+	hpas := []*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("avg", "default", ""),
+		newHPA("max", "default", "max"),
+		// The last point is queried with avg, like the metrics of the avg aggregator.
+		newHPA("last", "default", "last"),
+		newHPA("team", "team-a", ""),
+	}
+	process := func() map[string]float64 {
+		values := make(map[string]float64)
+		for _, em := range p.ProcessHPAList(hpas) {
+			require.True(t, em.Valid)
+			values[em.HPA.Name] = em.ValueFloat
+		}
+		return values
+	}
+
+	// The metrics with identical names and labels but different aggregations are queried and cached independently.
+	assert.Equal(t, map[string]float64{"avg": 15, "max": 20, "last": 20, "team": 15}, process())
+	assert.ElementsMatch(t, []string{
+		"avg:requests_per_s{role:frontend}",
+		"max:requests_per_s{role:frontend}",
+		"avg:requests_per_s{role:frontend}",
+		"avg:requests_per_s{role:frontend}",
+	}, queries)
+	assert.Equal(t, 4, p.queryCache.ItemCount())
+
+	// They are all served by the cache afterwards, each with its own value.
+	queries = nil
+	assert.Equal(t, map[string]float64{"avg": 15, "max": 20, "last": 20, "team": 15}, process())
+	assert.Empty(t, queries)
+}
+
+func TestProcessor_TransformAnnotation(t *testing.T) {
+	metricName := "requests"
+	scope := "role:frontend"
+	now := time.Unix(1531492452, 0)
+	var points []datadog.DataPoint
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: points}}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, queryCache: cache.New(time.Minute, time.Minute), current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return now }
+	newHPA := func(name string, annotations map[string]string) *autoscalingv2.HorizontalPodAutoscaler {
+		return &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				Metrics: []autoscalingv2.MetricSpec{
+					{
+						Type: autoscalingv2.ExternalMetricSourceType,
+						External: &autoscalingv2.ExternalMetricSource{
+							MetricName:     metricName,
+							MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "frontend"}},
+						},
+					},
+				},
+			},
+		}
+	}
+	hpas := []*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("value", nil),
+		newHPA("rate", map[string]string{transformAnnotation: transformPerSecond}),
+		newHPA("invalid", map[string]string{transformAnnotation: "per_minute"}),
+	}
+	process := func() map[string]custommetrics.ExternalMetricValue {
+		values := make(map[string]custommetrics.ExternalMetricValue)
+		for _, em := range p.ProcessHPAList(hpas) {
+			values[em.HPA.Name] = em
+		}
+		return values
+	}
+
+	// The same query is sent separately for the rate, and its result is not served from the cache of the value.
+	points = []datadog.DataPoint{{float64(now.Unix()*1000 - 20000), 1000}, {float64(now.Unix() * 1000), 1200}}
+	values := process()
+	require.Len(t, values, 3)
+	assert.Equal(t, []string{"avg:requests{role:frontend}", "avg:requests{role:frontend}"}, queries)
+	assert.Equal(t, 1100.0, values["value"].ValueFloat)
+	assert.True(t, values["rate"].Valid)
+	assert.Equal(t, 10.0, values["rate"].ValueFloat)
+	assert.Equal(t, transformPerSecond, values["rate"].Transform)
+	assert.Equal(t, "", values["invalid"].Transform)
+	assert.Equal(t, 1100.0, values["invalid"].ValueFloat)
+
+	// A reset of the counter without an earlier rate in the window invalidates the rate.
+	p.queryCache.Flush()
+	points = []datadog.DataPoint{{float64(now.Unix()*1000 - 20000), 1200}, {float64(now.Unix() * 1000), 10}}
+	values = process()
+	assert.True(t, values["value"].Valid)
+	assert.False(t, values["rate"].Valid)
+	assert.Equal(t, errCounterReset.Error(), values["rate"].LastError)
+}
+
+func TestParseStringAnnotations(t *testing.T) {
+	tests := []struct {
+		desc        string
+		parse       func(metav1.ObjectMeta) string
+		annotations map[string]string
+		expected    string
+	}{
+		{"no stat annotation", parseStat, nil, ""},
+		{"p95", parseStat, map[string]string{statAnnotation: "p95"}, "p95"},
+		{"p50", parseStat, map[string]string{statAnnotation: "p50"}, "p50"},
+		{"unsupported percentile", parseStat, map[string]string{statAnnotation: "p42"}, ""},
+		{"aggregator", parseStat, map[string]string{statAnnotation: "max"}, ""},
+		{"no rollup method annotation", parseRollupMethod, nil, ""},
+		{"sum", parseRollupMethod, map[string]string{rollupMethodAnnotation: "sum"}, "sum"},
+		{"count", parseRollupMethod, map[string]string{rollupMethodAnnotation: "count"}, "count"},
+		{"unsupported method", parseRollupMethod, map[string]string{rollupMethodAnnotation: "last"}, ""},
+		{"percentile", parseRollupMethod, map[string]string{rollupMethodAnnotation: "p95"}, ""},
+		{"no query template annotation", parseQueryTemplate, nil, ""},
+		{"query template", parseQueryTemplate, map[string]string{queryTemplateAnnotation: "sum:{metric}{{scope}}.rollup(max, 60)"}, "sum:{metric}{{scope}}.rollup(max, 60)"},
+		{"blank query template", parseQueryTemplate, map[string]string{queryTemplateAnnotation: "  "}, ""},
+		{"empty query template", parseQueryTemplate, map[string]string{queryTemplateAnnotation: ""}, ""},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			hpa := metav1.ObjectMeta{Name: "foo", Namespace: "default", Annotations: tt.annotations}
+			assert.Equal(t, tt.expected, tt.parse(hpa))
+		})
+	}
+}
+
+func TestProcessor_StatAnnotation(t *testing.T) {
+	metricName := "request.latency"
+	scope := "service:checkout"
+	now := time.Unix(1531492452, 0)
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			value := 0.2
+			if strings.HasPrefix(query, "p95:") {
+				value = 0.8
+			}
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(now.Unix() * 1000), value}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, queryCache: cache.New(time.Minute, time.Minute), current: settings{rollup: 60}}
+	p.clock = func() time.Time { return now }
+	newHPA := func(name string, annotations map[string]string) *autoscalingv2.HorizontalPodAutoscaler {
+		return &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				Metrics: []autoscalingv2.MetricSpec{
+					{
+						Type: autoscalingv2.ExternalMetricSourceType,
+						External: &autoscalingv2.ExternalMetricSource{
+							MetricName:     metricName,
+							MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"service": "checkout"}},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	// The percentile replaces the space aggregator, the metrics of the unsupported percentiles are aggregated.
+	externalMetrics := p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("avg", nil),
+		newHPA("p95", map[string]string{statAnnotation: "p95"}),
+		newHPA("invalid", map[string]string{statAnnotation: "p42"}),
+	})
+	require.Len(t, externalMetrics, 3)
+	assert.ElementsMatch(t, []string{
+		"avg:request.latency{service:checkout}.rollup(avg, 60)",
+		"p95:request.latency{service:checkout}.rollup(avg, 60)",
+	}, queries)
+	values := make(map[string]custommetrics.ExternalMetricValue)
+	for _, em := range externalMetrics {
+		values[em.HPA.Name] = em
+	}
+	assert.Equal(t, 0.2, values["avg"].ValueFloat)
+	assert.Equal(t, 0.8, values["p95"].ValueFloat)
+	assert.Equal(t, "p95", values["p95"].Stat)
+	assert.Equal(t, "p95:request.latency{service:checkout}.rollup(avg, 60)", values["p95"].Query)
+	assert.Equal(t, "", values["invalid"].Stat)
+	assert.Equal(t, 0.2, values["invalid"].ValueFloat)
+}
+
+func TestProcessor_RollupMethodAnnotation(t *testing.T) {
+	metricName := "nginx.net.request_per_s"
+	scope := "service:checkout"
+	now := time.Unix(1531492452, 0)
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			value := 12.0
+			if strings.Contains(query, ".rollup(sum") {
+				value = 720
+			}
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(now.Unix() * 1000), value}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, queryCache: cache.New(time.Minute, time.Minute), current: settings{rollup: 60}}
+	p.clock = func() time.Time { return now }
+	newHPA := func(name string, annotations map[string]string) *autoscalingv2.HorizontalPodAutoscaler {
+		return &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				Metrics: []autoscalingv2.MetricSpec{
+					{
+						Type: autoscalingv2.ExternalMetricSourceType,
+						External: &autoscalingv2.ExternalMetricSource{
+							MetricName:     metricName,
+							MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"service": "checkout"}},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	// The rollup method replaces the aggregator in the rollup only, the metrics of the unsupported methods are
+	// rolled up with the aggregator.
+	externalMetrics := p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("gauge", nil),
+		newHPA("count", map[string]string{rollupMethodAnnotation: "sum"}),
+		newHPA("invalid", map[string]string{rollupMethodAnnotation: "median"}),
+	})
+	require.Len(t, externalMetrics, 3)
+	assert.ElementsMatch(t, []string{
+		"avg:nginx.net.request_per_s{service:checkout}.rollup(avg, 60)",
+		"avg:nginx.net.request_per_s{service:checkout}.rollup(sum, 60)",
+	}, queries)
+	values := make(map[string]custommetrics.ExternalMetricValue)
+	for _, em := range externalMetrics {
+		values[em.HPA.Name] = em
+	}
+	assert.Equal(t, 12.0, values["gauge"].ValueFloat)
+	assert.Equal(t, 720.0, values["count"].ValueFloat)
+	assert.Equal(t, "sum", values["count"].RollupMethod)
+	assert.Equal(t, "avg:nginx.net.request_per_s{service:checkout}.rollup(sum, 60)", values["count"].Query)
+	assert.Equal(t, "", values["invalid"].RollupMethod)
+	assert.Equal(t, 12.0, values["invalid"].ValueFloat)
+
+	// Without a rollup interval, the points are rolled up with the method over the interval picked by Datadog.
+	p.current.rollup = 0
+	key := p.withOptions("nginx.net.request_per_s{service:checkout}", queryOptions{aggregator: aggregatorAvg, window: 300, rollupMethod: "count"})
+	assert.Equal(t, "nginx.net.request_per_s{service:checkout}[aggregator=avg&rollup=0&rollupMethod=count&window=300]", key)
+	name, opts := p.splitKey(key)
+	assert.Equal(t, "nginx.net.request_per_s{service:checkout}", name)
+	assert.Equal(t, "count", opts.rollupMethod)
+	assert.Equal(t, "avg:nginx.net.request_per_s{service:checkout}.rollup(count)", p.formatQuery(key))
+}
+
+func TestProcessor_SplitKey(t *testing.T) {
+	p := &Processor{current: settings{aggregator: aggregatorAvg, queryWindow: 5 * time.Minute}}
+	tests := []struct {
+		desc string
+		key  string
+		opts queryOptions
+	}{
+		{"default options", "requests_per_s{foo:bar}", p.defaultQueryOptions()},
+		{"aggregator and rollup", "requests_per_s{foo:bar}", queryOptions{aggregator: aggregatorMax, rollup: 60, window: 120}},
+		{"all the options", "latency{foo:bar}", queryOptions{aggregator: aggregatorAvg, rollup: 60, window: 300, transform: transformPerSecond, stat: "p95", rollupMethod: "sum", namespace: "team-a"}},
+		{"escaped options", "formula:{(sum:a{*})/(sum:b{*})}", queryOptions{aggregator: aggregatorSum, window: 600, namespace: "a,b]}[c=d&e"}},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			key, opts := p.splitKey(p.withOptions(tt.key, tt.opts))
+			assert.Equal(t, tt.key, key)
+			assert.Equal(t, tt.opts, opts)
+		})
+	}
+
+	// The keys whose options cannot be decoded are left as they are, with the options of the Processor.
+	for _, key := range []string{"requests_per_s{foo:bar}[avg,0,300]", "requests_per_s{foo:bar}[aggregator=avg]", "requests_per_s{foo:bar}[%zz]"} {
+		name, opts := p.splitKey(key)
+		assert.Equal(t, key, name)
+		assert.Equal(t, p.defaultQueryOptions(), opts)
+	}
+}
+
+func TestAutoRollup(t *testing.T) {
+	tests := []struct {
+		window       int64
+		rollupPoints int
+		expected     int
+	}{
+		{300, 150, 0},
+		{2250, 150, 0},
+		{2251, 150, 16},
+		{3600, 150, 24},
+		{86400, 150, 576},
+		{3600, 60, 60},
+		{3600, 0, 0},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d window=%d points=%d", i, tt.window, tt.rollupPoints), func(t *testing.T) {
+			p := &Processor{current: settings{rollupPoints: tt.rollupPoints}}
+			assert.Equal(t, tt.expected, p.autoRollup(tt.window))
+		})
+	}
+}
+
+func TestProcessor_QueryAutoRollup(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	now := time.Unix(1531492452, 0)
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(now.Unix() * 1000), 12}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{queryWindow: time.Hour, rollupPoints: 150}}
+	p.clock = func() time.Time { return now }
+	emList := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"role": "frontend"}},
+		// The rollup follows the window of the HPA, unless the HPA sets the rollup.
+		{MetricName: metricName, Labels: map[string]string{"role": "frontend"}, QueryWindow: 300},
+		{MetricName: metricName, Labels: map[string]string{"role": "frontend"}, QueryWindow: 7200, Rollup: 30},
+	}
+
+	externalMetrics, err := p.ValidateExternalMetrics(context.Background(), emList)
+	require.NoError(t, err)
+	require.Len(t, externalMetrics, 3)
+	assert.Equal(t, "avg:requests_per_s{role:frontend}.rollup(avg, 24)", externalMetrics[0].Query)
+	assert.Equal(t, "avg:requests_per_s{role:frontend}", externalMetrics[1].Query)
+	assert.Equal(t, "avg:requests_per_s{role:frontend}.rollup(avg, 30)", externalMetrics[2].Query)
+	assert.Len(t, queries, 3)
+
+	// An explicit rollup of the Processor is not overridden.
+	p.current.rollup = 60
+	assert.Equal(t, "avg:requests_per_s{role:frontend}.rollup(avg, 60)", p.BuildQuery(metricName, map[string]string{"role": "frontend"}))
+}
+
+func TestParseRangeAnnotations(t *testing.T) {
+	zero, ten := 0.0, 10.0
+	tests := []struct {
+		desc        string
+		annotations map[string]string
+		min         *float64
+		max         *float64
+		rangeMode   string
+	}{
+		{"no annotation", nil, nil, nil, ""},
+		{"bounds", map[string]string{minAnnotation: "0", maxAnnotation: "10", rangeModeAnnotation: "clamp"}, &zero, &ten, rangeModeClamp},
+		{"min only", map[string]string{minAnnotation: "0", rangeModeAnnotation: "reject"}, &zero, nil, rangeModeReject},
+		{"unparseable", map[string]string{minAnnotation: "zero", maxAnnotation: "10"}, nil, &ten, ""},
+		{"infinite", map[string]string{maxAnnotation: "+Inf"}, nil, nil, ""},
+		{"min greater than max", map[string]string{minAnnotation: "10", maxAnnotation: "0"}, nil, nil, ""},
+		{"invalid mode", map[string]string{maxAnnotation: "10", rangeModeAnnotation: "drop"}, nil, &ten, ""},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			hpa := metav1.ObjectMeta{Name: "foo", Namespace: "default", Annotations: tt.annotations}
+			externalMetrics := []custommetrics.ExternalMetricValue{{MetricName: "requests_per_s"}}
+			setAnnotations(hpa, externalMetrics)
+			assert.Equal(t, tt.min, externalMetrics[0].Min)
+			assert.Equal(t, tt.max, externalMetrics[0].Max)
+			assert.Equal(t, tt.rangeMode, externalMetrics[0].RangeMode)
+		})
+	}
+}
+
+func TestBoundedValue(t *testing.T) {
+	min, max := 1.0, 10.0
+	tests := []struct {
+		desc      string
+		rangeMode string
+		value     float64
+		expected  float64
+		valid     bool
+		err       error
+	}{
+		{"clamp in range", rangeModeClamp, 5, 5, true, nil},
+		{"clamp min", rangeModeClamp, 1, 1, true, nil},
+		{"clamp max", rangeModeClamp, 10, 10, true, nil},
+		{"clamp below min", rangeModeClamp, 0.5, 1, true, nil},
+		{"clamp above max", rangeModeClamp, 1e6, 10, true, nil},
+		{"reject in range", rangeModeReject, 5, 5, true, nil},
+		{"reject min", rangeModeReject, 1, 1, true, nil},
+		{"reject max", rangeModeReject, 10, 10, true, nil},
+		{"reject below min", rangeModeReject, 0.5, 0.5, false, errOutOfRange},
+		{"reject above max", rangeModeReject, 1e6, 1e6, false, errOutOfRange},
+		{"default mode above max", "", 1e6, 1e6, false, errOutOfRange},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			em := custommetrics.ExternalMetricValue{MetricName: "requests_per_s", Min: &min, Max: &max, RangeMode: tt.rangeMode}
+			point, err := boundedValue(em, Point{value: tt.value, valid: true})
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.expected, point.value)
+			assert.Equal(t, tt.valid, point.valid)
+		})
+	}
+}
+
+func TestProcessor_RangeAnnotations(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	value := 1e9
+	now := time.Unix(1531492452, 0)
+	current := now
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(current.Unix() * 1000), value}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return current }
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "frontend",
+			Namespace:   "default",
+			Annotations: map[string]string{maxAnnotation: "1000", multiplierAnnotation: "0.001"},
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						MetricName:     metricName,
+						MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "frontend"}},
+					},
+				},
+			},
+		},
+	}
+
+	// The bounds apply to the scaled value, an implausible value invalidates the metric by default.
+	externalMetrics := p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 1)
+	assert.False(t, externalMetrics[0].Valid)
+	assert.Equal(t, errOutOfRange.Error(), externalMetrics[0].LastError)
+
+	hpa.Annotations[rangeModeAnnotation] = rangeModeClamp
+	externalMetrics = p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 1)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.Equal(t, 1000.0, externalMetrics[0].ValueFloat)
+
+	// The refreshed values are bounded as well.
+	value = 5e5
+	current = now.Add(time.Minute)
+	updated := p.UpdateExternalMetrics(externalMetrics)
+	require.Len(t, updated, 1)
+	assert.True(t, updated[0].Valid)
+	assert.Equal(t, 500.0, updated[0].ValueFloat)
+
+	value = 2e6
+	current = now.Add(2 * time.Minute)
+	updated = p.UpdateExternalMetrics(updated)
+	require.Len(t, updated, 1)
+	assert.True(t, updated[0].Valid)
+	assert.Equal(t, 1000.0, updated[0].ValueFloat)
+}
+
+func TestProcessor_QueryDatadogExternalInvalidValues(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	tests := []struct {
+		desc   string
+		points []datadog.DataPoint
+	}{
+		{"infinite point", []datadog.DataPoint{{1531492452000, 12}, {1531492462000, math.Inf(1)}}},
+		{"negative infinite point", []datadog.DataPoint{{1531492452000, math.Inf(-1)}}},
+		{"not a number once reduced", []datadog.DataPoint{{1531492452000, math.Inf(1)}, {1531492462000, math.Inf(-1)}}},
+		{"overflow once reduced", []datadog.DataPoint{{1531492452000, math.MaxFloat64}, {1531492462000, math.MaxFloat64}}},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: tt.points}}, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient}
+
+			points, err := p.queryDatadogExternal(context.Background(), []string{"requests_per_s{foo:bar}"})
+			require.NoError(t, err)
+			point := points["requests_per_s{foo:bar}"]
+			assert.False(t, point.valid)
+			assert.Equal(t, ErrInvalidValue, errors.Cause(point.err))
+
+			// The metric is invalid rather than served with the garbage value.
+			externalMetrics, err := p.ValidateExternalMetrics(context.Background(), []custommetrics.ExternalMetricValue{
+				{MetricName: metricName, Labels: map[string]string{"foo": "bar"}},
+			})
+			require.NoError(t, err)
+			require.Len(t, externalMetrics, 1)
+			assert.False(t, externalMetrics[0].Valid)
+			assert.Equal(t, float64(0), externalMetrics[0].ValueFloat)
+			assert.Contains(t, externalMetrics[0].LastError, ErrInvalidValue.Error())
+		})
+	}
+}
+
+func TestProcessor_RefreshChanged(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	now := time.Unix(1531492452, 0)
+	current := now
+	value := 10.0
+	var queries int
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries++
+			if math.IsNaN(value) {
+				return nil, nil
+			}
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(current.Unix() * 1000), value}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, changeThreshold: 0.1, current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return current }
+	stored := []custommetrics.ExternalMetricValue{
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"foo": "bar"},
+			HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default"},
+			Query:      "avg:requests_per_s{foo:bar}",
+			Timestamp:  now.Add(-time.Minute).Unix(),
+			Value:      10,
+			ValueFloat: 10,
+			Valid:      true,
+		},
+	}
+
+	// The value did not change, the metric does not need to be stored again.
+	changed, unchanged := p.RefreshChanged(stored)
+	assert.Empty(t, changed)
+	assert.Equal(t, 1, unchanged)
+	assert.Equal(t, 1, queries)
+
+	// The metric left unchanged in the store is not refreshed before its max age.
+	current = now.Add(30 * time.Second)
+	changed, unchanged = p.RefreshChanged(stored)
+	assert.Empty(t, changed)
+	assert.Equal(t, 0, unchanged)
+	assert.Equal(t, 1, queries)
+
+	// The changes below the threshold are ignored.
+	current = now.Add(31 * time.Second)
+	value = 10.9
+	changed, unchanged = p.RefreshChanged(stored)
+	assert.Empty(t, changed)
+	assert.Equal(t, 1, unchanged)
+	assert.Equal(t, 2, queries)
+
+	current = now.Add(62 * time.Second)
+	value = 11.5
+	changed, unchanged = p.RefreshChanged(stored)
+	require.Len(t, changed, 1)
+	assert.Equal(t, 0, unchanged)
+	assert.Equal(t, 11.5, changed[0].ValueFloat)
+	assert.Equal(t, current.Unix(), changed[0].Timestamp)
+	stored = changed
+
+	// An invalidated metric is a change.
+	current = now.Add(93 * time.Second)
+	value = math.NaN()
+	changed, unchanged = p.RefreshChanged(stored)
+	require.Len(t, changed, 1)
+	assert.Equal(t, 0, unchanged)
+	assert.False(t, changed[0].Valid)
+	assert.Contains(t, changed[0].LastError, ErrNoDataPoints.Error())
+}
+
+func TestSplitAggregator(t *testing.T) {
+	tests := []struct {
+		metricName  string
+		aggregator  string
+		datadogName string
+	}{
+		{"requests_per_s", "", "requests_per_s"},
+		{"max:requests_per_s", "max", "requests_per_s"},
+		{"last:nginx.net.request_per_s", "last", "nginx.net.request_per_s"},
+		{"p95:latency", "", "p95:latency"},
+		{":requests_per_s", "", ":requests_per_s"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.metricName), func(t *testing.T) {
+			aggregator, datadogName := splitAggregator(tt.metricName)
+			assert.Equal(t, tt.aggregator, aggregator)
+			assert.Equal(t, tt.datadogName, datadogName)
+		})
+	}
+}
+
+func TestProcessor_AggregatorPrefix(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			value := 12.0
+			if strings.HasPrefix(query, "max:") {
+				value = 30
+			}
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{float64(time.Now().Unix() * 1000), value}}}}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+	newHPA := func(name, uid string, metricNames ...string) *autoscalingv2.HorizontalPodAutoscaler {
+		hpa := &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(uid)},
+		}
+		for _, metricName := range metricNames {
+			hpa.Spec.Metrics = append(hpa.Spec.Metrics, autoscalingv2.MetricSpec{
+				Type: autoscalingv2.ExternalMetricSourceType,
+				External: &autoscalingv2.ExternalMetricSource{
+					MetricName:     metricName,
+					MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "frontend"}},
+				},
+			})
+		}
+		return hpa
+	}
+
+	// The aggregations of the same metric are distinct metrics, queried with their aggregator.
+	externalMetrics := p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("web", "1111", "avg:requests_per_s", "max:requests_per_s"),
+		newHPA("api", "2222", "requests_per_s"),
+	})
+	require.Len(t, externalMetrics, 3)
+	assert.ElementsMatch(t, []string{"avg:requests_per_s{role:frontend}", "max:requests_per_s{role:frontend}"}, queries)
+	values := make(map[string]float64)
+	reconcileKeys := make(map[string]bool)
+	for _, em := range externalMetrics {
+		assert.True(t, em.Valid)
+		values[em.HPA.Name+"/"+em.MetricName] = em.ValueFloat
+		reconcileKeys[reconcileKey(em)] = true
+	}
+	assert.Equal(t, map[string]float64{"web/avg:requests_per_s": 12, "web/max:requests_per_s": 30, "api/requests_per_s": 12}, values)
+	assert.Len(t, reconcileKeys, 3)
+
+	// The prefix takes precedence over the aggregator annotation of the HPA.
+	hpa := newHPA("web", "1111", "max:requests_per_s")
+	hpa.Annotations = map[string]string{aggregatorAnnotation: "min"}
+	queries = nil
+	externalMetrics = p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{hpa})
+	require.Len(t, externalMetrics, 1)
+	assert.Equal(t, []string{"max:requests_per_s{role:frontend}"}, queries)
+	assert.Equal(t, "max:requests_per_s{role:frontend}", p.BuildQuery("max:requests_per_s", map[string]string{"role": "frontend"}))
+}
+
+func TestProcessor_ZeroValue(t *testing.T) {
+	metricName := "queue.depth"
+	scope := "queue:jobs"
+	null := math.NaN()
+	tests := []struct {
+		desc        string
+		annotations map[string]string
+		points      []datadog.DataPoint
+		valid       bool
+	}{
+		{"a zero average", nil, []datadog.DataPoint{{1531492392000, 0}, {1531492452000, 0}}, true},
+		{"a zero maximum", map[string]string{aggregatorAnnotation: "max"}, []datadog.DataPoint{{1531492452000, 0}}, true},
+		{"a zero last", map[string]string{aggregatorAnnotation: "last"}, []datadog.DataPoint{{1531492392000, 5}, {1531492452000, 0}}, true},
+		{"a zero sum", map[string]string{aggregatorAnnotation: "sum"}, []datadog.DataPoint{{1531492452000, 0}}, true},
+		{"a zero rate", map[string]string{transformAnnotation: "per_second"}, []datadog.DataPoint{{1531492392000, 7}, {1531492452000, 7}}, true},
+		{"a zero scaled", map[string]string{multiplierAnnotation: "1000"}, []datadog.DataPoint{{1531492452000, 0}}, true},
+		{"a zero at the min bound", map[string]string{minAnnotation: "0"}, []datadog.DataPoint{{1531492452000, 0}}, true},
+		{"a zero with trailing nulls", nil, []datadog.DataPoint{{1531492392000, 0}, {1531492452000, null}}, true},
+		{"only null points", nil, []datadog.DataPoint{{1531492392000, null}, {1531492452000, null}}, false},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.desc), func(t *testing.T) {
+			datadogClient := &fakeDatadogClient{
+				queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+					return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: tt.points}}, nil
+				},
+			}
+			p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 5 * time.Minute}}
+			p.clock = func() time.Time { return time.Unix(1531492452, 0) }
+			hpa := &autoscalingv2.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", Annotations: tt.annotations},
+				Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+					Metrics: []autoscalingv2.MetricSpec{
+						{
+							Type: autoscalingv2.ExternalMetricSourceType,
+							External: &autoscalingv2.ExternalMetricSource{
+								MetricName:     metricName,
+								MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"queue": "jobs"}},
+							},
+						},
+					},
+				},
+			}
+
+			// A point of Datadog whose value is 0 is valid, only the absence of a point invalidates the metric.
+			externalMetrics := p.ProcessHPAs(hpa)
+			require.Len(t, externalMetrics, 1)
+			assert.Equal(t, tt.valid, externalMetrics[0].Valid, externalMetrics[0].LastError)
+			assert.Equal(t, 0.0, externalMetrics[0].ValueFloat)
+			assert.Equal(t, 0.0, externalMetrics[0].GetValue())
+			if !tt.valid {
+				assert.Contains(t, externalMetrics[0].LastError, ErrNoDataPoints.Error())
+				return
+			}
+			assert.Empty(t, externalMetrics[0].LastError)
+
+			// The refreshes keep the zero valid as well.
+			externalMetrics[0].Timestamp = 0
+			externalMetrics[0].LastSuccessTimestamp = 0
+			updated := p.UpdateExternalMetrics(externalMetrics)
+			require.Len(t, updated, 1)
+			assert.True(t, updated[0].Valid)
+			assert.Equal(t, 0.0, updated[0].ValueFloat)
+		})
+	}
+}
+
+func readTelemetry(t *testing.T, m prometheus.Metric) float64 {
+	var metric dto.Metric
+	require.NoError(t, m.Write(&metric))
+	switch {
+	case metric.Counter != nil:
+		return metric.Counter.GetValue()
+	case metric.Gauge != nil:
+		return metric.Gauge.GetValue()
+	case metric.Histogram != nil:
+		return float64(metric.Histogram.GetSampleCount())
+	}
+	return 0
+}
+
+func TestProcessor_UpdateExternalMetricsTelemetry(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(time.Now().Unix() * 1000), 12}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: time.Minute}}
+	metrics := []custommetrics.ExternalMetricValue{
+		// Refreshed from Datadog.
+		{MetricName: metricName, Labels: map[string]string{"foo": "bar"}},
+		// Stale and missing from Datadog.
+		{MetricName: metricName, Labels: map[string]string{"foo": "baz"}, Valid: true},
+		// Up to date.
+		{MetricName: metricName, Labels: map[string]string{"foo": "qux"}, Valid: true, Timestamp: metav1.Now().Unix()},
+	}
+
+	success := readTelemetry(t, queriesTelemetry.WithLabelValues(querySuccess))
+	invalid := readTelemetry(t, queriesTelemetry.WithLabelValues(queryInvalid))
+	latency := readTelemetry(t, queryLatencyTelemetry)
+	invalidatedByAge := readTelemetry(t, invalidatedByAgeTelemetry)
+
+	p.UpdateExternalMetrics(metrics)
+
+	assert.Equal(t, success+1, readTelemetry(t, queriesTelemetry.WithLabelValues(querySuccess)))
+	assert.Equal(t, invalid+1, readTelemetry(t, queriesTelemetry.WithLabelValues(queryInvalid)))
+	assert.Equal(t, latency+1, readTelemetry(t, queryLatencyTelemetry))
+	assert.Equal(t, invalidatedByAge+1, readTelemetry(t, invalidatedByAgeTelemetry))
+	assert.Equal(t, 2.0, readTelemetry(t, metricsTelemetry.WithLabelValues("valid")))
+	assert.Equal(t, 1.0, readTelemetry(t, metricsTelemetry.WithLabelValues("invalid")))
+
+	datadogClient.queryMetricsFunc = func(from, to int64, query string) ([]datadog.Series, error) {
+		return nil, fmt.Errorf("API error 400 Bad Request: ")
+	}
+	queryErrors := readTelemetry(t, queriesTelemetry.WithLabelValues(queryError))
+	p.UpdateExternalMetrics(metrics[:1])
+	assert.Equal(t, queryErrors+1, readTelemetry(t, queriesTelemetry.WithLabelValues(queryError)))
+}
+
+func TestProcessor_StalenessTelemetry(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	now := time.Unix(1531492452, 0)
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(now.Unix()*1000 - 20000), 12}},
+				},
+			}, nil
+		},
+	}
+	current := now
+	p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: time.Minute}}
+	p.clock = func() time.Time { return current }
+	p.Publish()
+	defer p.unpublish()
+	hpa := func(name string) custommetrics.ObjectReference {
+		return custommetrics.ObjectReference{Name: name, Namespace: "default"}
+	}
+	metrics := []custommetrics.ExternalMetricValue{
+		// Refreshed from Datadog.
+		{MetricName: metricName, Labels: map[string]string{"foo": "bar"}, HPA: hpa("refreshed")},
+		// Up to date, with the point of its last refresh.
+		{MetricName: metricName, Labels: map[string]string{"foo": "qux"}, HPA: hpa("fresh"), Valid: true, Timestamp: now.Unix() - 40, LastSuccessTimestamp: now.Unix() - 10},
+		// Stored by an older version, with the time of its refresh as its timestamp.
+		{MetricName: metricName, Labels: map[string]string{"foo": "quux"}, HPA: hpa("older"), Valid: true, Timestamp: now.Unix() - 10},
+	}
+
+	assert.Equal(t, 0.0, lastRefreshAge())
+	p.UpdateExternalMetrics(metrics)
+	assert.Equal(t, 20.0, readTelemetry(t, stalenessTelemetry.WithLabelValues("default", "refreshed", metricName)))
+	assert.Equal(t, 40.0, readTelemetry(t, stalenessTelemetry.WithLabelValues("default", "fresh", metricName)))
+	assert.Equal(t, 10.0, readTelemetry(t, stalenessTelemetry.WithLabelValues("default", "older", metricName)))
+
+	// The age of the last refresh grows until the next one.
+	current = current.Add(15 * time.Second)
+	assert.Equal(t, 15.0, lastRefreshAge())
+
+	// The metrics no longer refreshed are no longer reported.
+	p.UpdateExternalMetrics(metrics[1:2])
+	assert.Equal(t, 0.0, lastRefreshAge())
+	assert.Equal(t, 55.0, readTelemetry(t, stalenessTelemetry.WithLabelValues("default", "fresh", metricName)))
+	assert.False(t, stalenessTelemetry.DeleteLabelValues("default", "refreshed", metricName))
+	assert.False(t, stalenessTelemetry.DeleteLabelValues("default", "older", metricName))
+
+	p.resetStaleness()
+	assert.False(t, stalenessTelemetry.DeleteLabelValues("default", "fresh", metricName))
+}
+
+func TestProcessor_UpdateExternalMetricsRateLimit(t *testing.T) {
+	metricName := "requests_per_s"
+	scopes := []string{"foo:bar", "foo:baz", "foo:qux"}
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			var series []datadog.Series
+			for i := range scopes {
+				series = append(series, datadog.Series{
+					Metric: &metricName,
+					Scope:  &scopes[i],
+					Points: []datadog.DataPoint{{1531492452000, 12}},
+				})
+			}
+			return series, nil
+		},
+	}
+	// A burst of 2 metrics per namespace, refilled every 10 seconds.
+	p := &Processor{datadogClient: datadogClient, limiter: newNamespaceLimiter(0.1, 20)}
+	metrics := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"foo": "bar"}, HPA: custommetrics.ObjectReference{Namespace: "noisy"}},
+		{MetricName: metricName, Labels: map[string]string{"foo": "baz"}, HPA: custommetrics.ObjectReference{Namespace: "noisy"}},
+		{MetricName: metricName, Labels: map[string]string{"foo": "qux"}, HPA: custommetrics.ObjectReference{Namespace: "noisy"}, ValueFloat: 10, Timestamp: 1531492400, Valid: true},
+		{MetricName: metricName, Labels: map[string]string{"foo": "bar"}, HPA: custommetrics.ObjectReference{Namespace: "quiet"}},
+	}
+
+	updated := p.UpdateExternalMetrics(metrics)
+	require.Len(t, updated, 3)
+	for _, em := range updated {
+		assert.True(t, em.Valid)
+		// The throttled metric is not updated and keeps its last value in the store.
+		assert.NotEqual(t, "foo:qux", em.Labels["foo"])
+	}
+
+	// The limit is lifted once the configuration is reloaded.
+	defer config.Datadog.Set("external_metrics_provider.per_namespace_qps", config.Datadog.Get("external_metrics_provider.per_namespace_qps"))
+	config.Datadog.Set("external_metrics_provider.per_namespace_qps", 0)
+	p.ResetRateLimiter()
+	assert.Len(t, p.UpdateExternalMetrics(metrics), 4)
+}
+
+func TestProcessor_DryRunHPA(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:worker"
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{1531492452000, 12.5}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						MetricName:     metricName,
+						MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "worker"}},
+					},
+				},
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						MetricName:     metricName,
+						MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "web"}},
+					},
+				},
+			},
+		},
+	}
+
+	results, err := p.DryRunHPA(hpa)
+	require.NoError(t, err)
+	assert.Equal(t, []DryRunResult{
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"role": "worker"},
+			Query:      "avg:requests_per_s{role:worker}",
+			Value:      12.5,
+			Valid:      true,
+		},
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"role": "web"},
+			Query:      "avg:requests_per_s{role:web}",
+			Error:      ErrNoDataPoints.Error(),
+		},
+	}, results)
+
+	// An HPA without supported metrics is reported, as it would not be served any metric.
+	hpa.Spec.Metrics = []autoscalingv2.MetricSpec{{Type: autoscalingv2.ResourceMetricSourceType}}
+	_, err = p.DryRunHPA(hpa)
+	assert.Error(t, err)
+}
+
+func TestProcessor_ValidateAll(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:worker"
+	current := time.Unix(1531492452, 0)
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			current = current.Add(200 * time.Millisecond)
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(current.Unix() * 1000), 12.5}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+	p.clock = func() time.Time { return current }
+	metrics := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"role": "worker"}},
+		{MetricName: metricName, Labels: map[string]string{"role": "web"}},
+		{MetricName: metricName, Labels: map[string]string{"role": "worker"}},
+		{MetricName: metricName},
+	}
+
+	results := p.ValidateAll(context.Background(), metrics)
+	// The metrics are queried in a single batch, the duplicates once.
+	assert.Equal(t, []string{"avg:requests_per_s{role:worker},avg:requests_per_s{role:web}"}, queries)
+	assert.Equal(t, []ValidationResult{
+		{
+			Key:     "requests_per_s{role:worker}",
+			Value:   12.5,
+			Valid:   true,
+			Query:   "avg:requests_per_s{role:worker}",
+			Latency: 200 * time.Millisecond,
+		},
+		{
+			Key:     "requests_per_s{role:web}",
+			Query:   "avg:requests_per_s{role:web}",
+			Latency: 200 * time.Millisecond,
+			Error:   ErrNoDataPoints.Error(),
+		},
+		{
+			Key:     "requests_per_s{role:worker}",
+			Value:   12.5,
+			Valid:   true,
+			Query:   "avg:requests_per_s{role:worker}",
+			Latency: 200 * time.Millisecond,
+		},
+		{
+			Key:     "requests_per_s{}",
+			Latency: 200 * time.Millisecond,
+			Error:   errUnscopedQuery.Error(),
+		},
+	}, results)
+	// The metrics given are left as is.
+	assert.False(t, metrics[0].Valid)
+	assert.Empty(t, metrics[0].Query)
+
+	assert.Nil(t, p.ValidateAll(context.Background(), nil))
+}
+
+func TestProcessor_State(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "foo:bar"
+	now := time.Unix(1531492452, 0)
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			if strings.Contains(query, "foo:baz") {
+				return nil, fmt.Errorf("API error 400 Bad Request: {\"errors\": [\"Error parsing query\"]}")
+			}
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(now.Unix() * 1000), 12}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{
+		datadogClient: datadogClient,
+		queryCache:    cache.New(time.Minute, time.Minute),
+		breaker:       newCircuitBreaker(5, time.Minute, time.Minute),
+	}
+	p.clock = func() time.Time { return now }
+	p.Publish()
+	defer p.unpublish()
+
+	emList := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"foo": "bar"}, HPA: custommetrics.ObjectReference{Name: "foo", Namespace: "default"}},
+		{MetricName: metricName, Labels: map[string]string{"foo": "baz"}, HPA: custommetrics.ObjectReference{Name: "bar", Namespace: "default"}},
+	}
+
+	// The state can be read while the metrics are refreshed.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			p.State()
+		}
+	}()
+	p.UpdateExternalMetrics(emList)
+	wg.Wait()
+
+	state := p.State()
+	assert.Equal(t, 2, state.Metrics)
+	assert.Equal(t, 1, state.Valid)
+	assert.Equal(t, 1, state.Invalid)
+	assert.Equal(t, 1, state.CacheSize)
+	assert.Equal(t, circuitClosed, state.CircuitBreaker)
+	assert.Equal(t, now.Unix(), state.LastRefresh)
+	assert.Contains(t, state.LastError, "Error parsing query")
+
+	// The state of the published Processor is served as an expvar.
+	var published ProcessorState
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get(processorStateVar).String()), &published))
+	assert.Equal(t, state, published)
+
+	p.unpublish()
+	assert.Equal(t, "null", expvar.Get(processorStateVar).String())
+	assert.Equal(t, circuitDisabled, (&Processor{}).State().CircuitBreaker)
+}
+
+func TestProcessor_Warmup(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	now := time.Unix(1531492452, 0)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	var m sync.Mutex
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			m.Lock()
+			queries = append(queries, query)
+			m.Unlock()
+			if strings.HasPrefix(query, "max:") {
+				<-unblock
+			}
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(now.Unix() * 1000), 12}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{
+		datadogClient: datadogClient,
+		queryCache:    cache.New(time.Minute, time.Minute),
+		warmupTimeout: 100 * time.Millisecond,
+		current:       settings{externalMaxAge: 30 * time.Second},
+	}
+	p.clock = func() time.Time { return now }
+	emList := []custommetrics.ExternalMetricValue{
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default"},
+			Timestamp:  now.Add(-time.Hour).Unix(),
+			Valid:      true,
+		},
+	}
+
+	// The metrics are queried regardless of their age, the ones given are not modified.
+	warmed, err := p.Warmup(context.Background(), emList)
+	require.NoError(t, err)
+	require.Len(t, warmed, 1)
+	assert.True(t, warmed[0].Valid)
+	assert.Equal(t, 12.0, warmed[0].ValueFloat)
+	assert.Equal(t, now.Unix(), warmed[0].Timestamp)
+	assert.Equal(t, now.Add(-time.Hour).Unix(), emList[0].Timestamp)
+	assert.Equal(t, []string{"avg:requests_per_s{role:frontend}"}, queries)
+
+	// The cache is warm, the metrics of the HPAs are not queried again.
+	queries = nil
+	externalMetrics, err := p.ValidateExternalMetrics(context.Background(), []custommetrics.ExternalMetricValue{emList[0]})
+	require.NoError(t, err)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.Empty(t, queries)
+
+	// A warmup slower than the timeout returns the metrics validated so far.
+	queries = nil
+	emList = append(emList, custommetrics.ExternalMetricValue{
+		MetricName: metricName,
+		Labels:     map[string]string{"role": "frontend"},
+		HPA:        custommetrics.ObjectReference{Name: "bar", Namespace: "default"},
+		Aggregator: aggregatorMax,
+		Valid:      true,
+	})
+	warmed, err = p.Warmup(context.Background(), emList)
+	assert.Error(t, err)
+	require.Len(t, warmed, 1)
+	assert.Equal(t, "foo", warmed[0].HPA.Name)
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, []string{"max:requests_per_s{role:frontend}"}, queries)
+}
+
+func TestEventReason(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{ErrNoDataPoints, "NoDataPoints"},
+		{&QueryError{Query: "avg:foo{bar:baz}", Kind: ErrQueryUnauthorized}, "QueryUnauthorized"},
+		{&QueryError{Query: "avg:foo{bar:baz}", Err: fmt.Errorf("unknown")}, reasonMetricInvalid},
+		{errOutOfRange, "OutOfRange"},
+		{fmt.Errorf("the operator Gt of env is not supported"), reasonMetricInvalid},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.expected), func(t *testing.T) {
+			assert.Equal(t, tt.expected, eventReason(tt.err))
+		})
+	}
+}
+
+func TestEventLimiter(t *testing.T) {
+	now := time.Unix(1531492452, 0)
+	l := newEventLimiter(time.Minute)
+	assert.True(t, l.allow("foo", now))
+	assert.False(t, l.allow("foo", now.Add(30*time.Second)))
+	assert.True(t, l.allow("bar", now.Add(30*time.Second)))
+	assert.True(t, l.allow("foo", now.Add(time.Minute)))
+
+	unlimited := newEventLimiter(0)
+	assert.True(t, unlimited.allow("foo", now))
+	assert.True(t, unlimited.allow("foo", now))
+}
+
+func TestProcessor_UpdateExternalMetricsEvents(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	current := time.Unix(1531492452, 0)
+	reported := true
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			if !reported {
+				return nil, nil
+			}
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(current.Unix() * 1000), 12}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return current }
+	recorder := record.NewFakeRecorder(10)
+	p.SetEventRecorder(recorder, 5*time.Minute)
+
+	em := custommetrics.ExternalMetricValue{
+		MetricName: metricName,
+		Labels:     map[string]string{"role": "frontend"},
+		HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1234"},
+		Timestamp:  current.Add(-time.Hour).Unix(),
+		Valid:      true,
+	}
+	// refresh advances the clock past the max age of the metric and refreshes it.
+	refresh := func() {
+		current = current.Add(time.Minute)
+		updated := p.UpdateExternalMetrics([]custommetrics.ExternalMetricValue{em})
+		require.Len(t, updated, 1)
+		em = updated[0]
+	}
+
+	// A metric staying valid does not emit any event.
+	refresh()
+	require.True(t, em.Valid)
+	assert.Empty(t, recorder.Events)
+
+	// The invalidation of the metric is a warning with the reason of its error.
+	reported = false
+	refresh()
+	require.False(t, em.Valid)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning NoDataPoints The external metric requests_per_s is no longer valid")
+
+	// The metric staying invalid does not emit any event, its validation does.
+	refresh()
+	assert.Empty(t, recorder.Events)
+	reported = true
+	refresh()
+	require.True(t, em.Valid)
+	require.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Normal ExternalMetricValid The external metric requests_per_s is valid, value: 12", <-recorder.Events)
+
+	// A flapping metric does not emit the identical events again before the interval.
+	reported = false
+	refresh()
+	reported = true
+	refresh()
+	assert.Empty(t, recorder.Events)
+
+	// Without a recorder, no events are emitted.
+	p.SetEventRecorder(nil, 0)
+	reported = false
+	refresh()
+	assert.False(t, em.Valid)
+}
+
+func TestProcessor_ReloadConfig(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	var queries []string
+	var window, to int64
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, end int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			window, to = end-from, end
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(time.Now().Unix() * 1000), 12}},
+				},
+			}, nil
+		},
+	}
+	defer config.Datadog.Set("external_metrics_provider.rollup", config.Datadog.Get("external_metrics_provider.rollup"))
+	defer config.Datadog.Set("external_metrics_provider.query_offset", config.Datadog.Get("external_metrics_provider.query_offset"))
+	defer config.Datadog.Set("external_metrics_provider.query_window", config.Datadog.Get("external_metrics_provider.query_window"))
+	defer config.Datadog.Set("external_metrics_provider.query_concurrency", config.Datadog.Get("external_metrics_provider.query_concurrency"))
+	p, err := NewProcessor(datadogClient)
+	require.NoError(t, err)
+	defer p.Stop()
+	emList := []custommetrics.ExternalMetricValue{
+		{MetricName: metricName, Labels: map[string]string{"role": "frontend"}},
+	}
+	refresh := func() {
+		updated := p.UpdateExternalMetrics(emList)
+		require.Len(t, updated, 1)
+		assert.True(t, updated[0].Valid)
+	}
+
+	// Unchanged settings leave the cache as is.
+	refresh()
+	p.ReloadConfig()
+	refresh()
+	assert.Equal(t, []string{"avg:requests_per_s{role:frontend}"}, queries)
+	// The window ends before now by the default offset.
+	assert.InDelta(t, time.Now().Unix()-60, to, 1)
+
+	// The settings the queries do not depend on are reloaded without flushing the cache.
+	config.Datadog.Set("external_metrics_provider.query_concurrency", 8)
+	p.ReloadConfig()
+	assert.Equal(t, 8, p.settings().queryConcurrency)
+	refresh()
+	assert.Len(t, queries, 1)
+
+	// A new window changes the queries without changing their keys, the results cached for the previous window are
+	// not served.
+	config.Datadog.Set("external_metrics_provider.query_window", 600)
+	p.ReloadConfig()
+	refresh()
+	assert.Equal(t, []string{"avg:requests_per_s{role:frontend}", "avg:requests_per_s{role:frontend}"}, queries)
+	assert.Equal(t, int64(600), window)
+
+	// A new rollup changes the queries.
+	config.Datadog.Set("external_metrics_provider.rollup", 60)
+	p.ReloadConfig()
+	refresh()
+	assert.Len(t, queries, 3)
+	assert.Equal(t, "avg:requests_per_s{role:frontend}.rollup(avg, 60)", queries[2])
+
+	// A new offset moves the window without changing its length.
+	config.Datadog.Set("external_metrics_provider.query_offset", 0)
+	p.ReloadConfig()
+	refresh()
+	assert.Len(t, queries, 4)
+	assert.Equal(t, int64(600), window)
+	assert.InDelta(t, time.Now().Unix(), to, 1)
+}
+
+func TestLoadSettingsMaxAge(t *testing.T) {
+	tests := []struct {
+		maxAge   int
+		expected time.Duration
+	}{
+		{0, minExternalMaxAge},
+		{-60, minExternalMaxAge},
+		{14, minExternalMaxAge},
+		{15, 15 * time.Second},
+		{16, 16 * time.Second},
+		{60, time.Minute},
+	}
+
+	defer config.Datadog.Set("external_metrics_provider.max_age", config.Datadog.Get("external_metrics_provider.max_age"))
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %d", i, tt.maxAge), func(t *testing.T) {
+			config.Datadog.Set("external_metrics_provider.max_age", tt.maxAge)
+			assert.Equal(t, tt.expected, loadSettings().externalMaxAge)
+		})
+	}
+
+	// The max age of the Processor is clamped, its metrics are not refreshed on every refresh.
+	config.Datadog.Set("external_metrics_provider.max_age", 0)
+	p, err := NewProcessor(&fakeDatadogClient{})
+	require.NoError(t, err)
+	defer p.Stop()
+	assert.Equal(t, int64(15), p.maxAge(custommetrics.ExternalMetricValue{}))
+}
+
+func TestLoadSettingsSeriesAverage(t *testing.T) {
+	tests := []struct {
+		seriesAverage string
+		nullSeries    string
+		average       string
+		null          string
+	}{
+		{"none", "skip", seriesAverageNone, nullSeriesSkip},
+		{"weighted", "zero", seriesAverageWeighted, nullSeriesZero},
+		{"mean", "skip", seriesAverageMean, nullSeriesSkip},
+		// The unsupported values fall back on their default.
+		{"median", "nan", seriesAverageNone, nullSeriesSkip},
+	}
+
+	defer config.Datadog.Set("external_metrics_provider.series_average", config.Datadog.Get("external_metrics_provider.series_average"))
+	defer config.Datadog.Set("external_metrics_provider.null_series", config.Datadog.Get("external_metrics_provider.null_series"))
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("#%d %s %s", i, tt.seriesAverage, tt.nullSeries), func(t *testing.T) {
+			config.Datadog.Set("external_metrics_provider.series_average", tt.seriesAverage)
+			config.Datadog.Set("external_metrics_provider.null_series", tt.nullSeries)
+			s := loadSettings()
+			assert.Equal(t, tt.average, s.seriesAverage)
+			assert.Equal(t, tt.null, s.nullSeries)
+			assert.Equal(t, tt.average != seriesAverageNone, s.averagesSeries())
+		})
+	}
+}
+
+func TestProcessor_ScopeToTarget(t *testing.T) {
+	defer config.Datadog.Set("kubernetes_pod_labels_as_tags", config.Datadog.Get("kubernetes_pod_labels_as_tags"))
+	config.Datadog.Set("kubernetes_pod_labels_as_tags", map[string]string{"App": "app", "tier": "service_tier"})
+
+	metricName := "requests_per_s"
+	var queries []string
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries = append(queries, query)
+			return nil, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "default",
+			Annotations: map[string]string{targetSelectorAnnotation: "true"},
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{Kind: "Deployment", Name: "web"},
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						MetricName:     metricName,
+						MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"service_tier": "edge"}},
+					},
+				},
+				{
+					Type: autoscalingv2.PodsMetricSourceType,
+					Pods: &autoscalingv2.PodsMetricSource{MetricName: metricName},
+				},
+			},
+		},
+	}
+
+	// Without listers, the metrics are left as is and the Pods metric has no pod selector.
+	externalMetrics := p.ProcessHPAs(hpa)
+	assert.Equal(t, []string{"avg:requests_per_s{service_tier:edge},avg:requests_per_s{kube_deployment:web,kube_namespace:default}"}, queries)
+	require.Len(t, externalMetrics, 2)
+	assert.Empty(t, externalMetrics[1].PodSelector)
+
+	indexer := k8scache.NewIndexer(k8scache.MetaNamespaceKeyFunc, k8scache.Indexers{})
+	err := indexer.Add(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web", "tier": "frontend", "pod-template-hash": "1234"}},
+		},
+	})
+	require.NoError(t, err)
+	p.SetScaleTargetListers(
+		appslisters.NewDeploymentLister(indexer),
+		appslisters.NewStatefulSetLister(k8scache.NewIndexer(k8scache.MetaNamespaceKeyFunc, k8scache.Indexers{})),
+		appslisters.NewReplicaSetLister(k8scache.NewIndexer(k8scache.MetaNamespaceKeyFunc, k8scache.Indexers{})),
+	)
+
+	// The labels collected as tags are added, the ones of the selectors of the metrics take precedence.
+	queries = nil
+	externalMetrics = p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 2)
+	assert.Equal(t, []string{"avg:requests_per_s{app:web,service_tier:edge},avg:requests_per_s{app:web,kube_deployment:web,kube_namespace:default,service_tier:frontend}"}, queries)
+	// The Pods metric is served for the pods of the target.
+	assert.Empty(t, externalMetrics[0].PodSelector)
+	assert.Equal(t, "app=web,pod-template-hash=1234,tier=frontend", externalMetrics[1].PodSelector)
+	// The selectors of the HPA and the labels of its metrics are left as is.
+	assert.Equal(t, map[string]string{"service_tier": "edge"}, hpa.Spec.Metrics[0].External.MetricSelector.MatchLabels)
+	assert.Equal(t, map[string]string{"service_tier": "edge"}, externalMetrics[0].Labels)
+	assert.Equal(t, map[string]string{"app": "web", "service_tier": "frontend"}, externalMetrics[0].TargetTags)
+
+	// The metrics selected with expressions are still matched by their selector.
+	queries = nil
+	hpa.Spec.Metrics[0].External.MetricSelector.MatchExpressions = []metav1.LabelSelectorRequirement{
+		{Key: "region", Operator: metav1.LabelSelectorOpIn, Values: []string{"eu", "us"}},
+	}
+	externalMetrics = p.ProcessHPAs(hpa)
+	require.Len(t, externalMetrics, 2)
+	assert.Equal(t, []string{"avg:requests_per_s{(region:eu OR region:us),app:web,service_tier:edge},avg:requests_per_s{app:web,kube_deployment:web,kube_namespace:default,service_tier:frontend}"}, queries)
+	assert.Equal(t, map[string]string{"service_tier": "edge"}, externalMetrics[0].Labels)
+	assert.Equal(t, hpa.Spec.Metrics[0].External.MetricSelector.MatchExpressions, externalMetrics[0].MatchExpressions)
+	hpa.Spec.Metrics[0].External.MetricSelector.MatchExpressions = nil
+
+	// A missing target leaves the metrics as is.
+	queries = nil
+	hpa.Spec.ScaleTargetRef = autoscalingv2.CrossVersionObjectReference{Kind: "StatefulSet", Name: "db"}
+	externalMetrics = p.ProcessHPAs(hpa)
+	assert.Equal(t, []string{"avg:requests_per_s{service_tier:edge},avg:requests_per_s{kube_namespace:default,kube_stateful_set:db}"}, queries)
+	assert.Empty(t, externalMetrics[1].PodSelector)
+
+	// The metrics of the HPAs without the annotation are not scoped to their target.
+	queries = nil
+	hpa.Annotations = nil
+	hpa.Spec.ScaleTargetRef = autoscalingv2.CrossVersionObjectReference{Kind: "Deployment", Name: "web"}
+	externalMetrics = p.ProcessHPAs(hpa)
+	assert.Equal(t, []string{"avg:requests_per_s{service_tier:edge},avg:requests_per_s{kube_deployment:web,kube_namespace:default}"}, queries)
+	// Their Pods metrics are still served for the pods of their target.
+	assert.Equal(t, "app=web,pod-template-hash=1234,tier=frontend", externalMetrics[1].PodSelector)
+}
+
+func TestProcessor_FailingMetrics(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	current := time.Unix(1531492452, 0)
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  &scope,
+					Points: []datadog.DataPoint{{float64(current.Unix() * 1000), 12}},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return current }
+	emList := []custommetrics.ExternalMetricValue{
+		{
+			MetricName: metricName,
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default"},
+		},
+		{
+			MetricName:           metricName,
+			Labels:               map[string]string{"role": "backend"},
+			HPA:                  custommetrics.ObjectReference{Name: "bar", Namespace: "default"},
+			LastSuccessTimestamp: current.Unix() - 60,
+		},
+		{
+			MetricName: "requets_per_s",
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default"},
+		},
+	}
+	assert.Empty(t, p.FailingMetrics())
+
+	// The metrics without points are failing since their last success, or since they were first seen failing.
+	emList = p.UpdateExternalMetrics(emList)
+	require.Len(t, emList, 3)
+	current = current.Add(30 * time.Second)
+	emList = p.UpdateExternalMetrics(emList)
+	require.Len(t, emList, 2)
+	failing := p.FailingMetrics()
+	require.Len(t, failing, 2)
+	assert.Equal(t, FailingMetric{
+		Key:        "requests_per_s{role:backend}",
+		HPA:        custommetrics.ObjectReference{Name: "bar", Namespace: "default"},
+		Reason:     "NoDataPoints",
+		Error:      ErrNoDataPoints.Error(),
+		Since:      current.Unix() - 90,
+		FailingFor: 90,
+	}, failing[0])
+	assert.Equal(t, "requets_per_s{role:frontend}", failing[1].Key)
+	assert.Equal(t, "NoDataPoints", failing[1].Reason)
+	assert.Equal(t, current.Unix()-30, failing[1].Since)
+	assert.Equal(t, int64(30), failing[1].FailingFor)
+	assert.Equal(t, failing, p.State().Failing)
+
+	// The metrics fixed are no longer failing.
+	scope = "role:backend"
+	current = current.Add(30 * time.Second)
+	p.UpdateExternalMetrics(emList)
+	failing = p.FailingMetrics()
+	require.Len(t, failing, 1)
+	assert.Equal(t, "requets_per_s{role:frontend}", failing[0].Key)
+	assert.Equal(t, int64(60), failing[0].FailingFor)
+}
+
+func TestProcessor_Bootstrap(t *testing.T) {
+	now := time.Unix(1531492452, 0)
+	metric := func(name string, age time.Duration, valid bool) custommetrics.ExternalMetricValue {
+		return custommetrics.ExternalMetricValue{
+			MetricName: name,
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        custommetrics.ObjectReference{Name: "foo", Namespace: "default"},
+			Timestamp:  now.Add(-age).Unix(),
+			ValueFloat: 12,
+			Valid:      valid,
+		}
+	}
+	emList := []custommetrics.ExternalMetricValue{
+		metric("fresh", 10*time.Second, true),
+		metric("stale", 2*time.Minute, true),
+		metric("expired", time.Hour, true),
+		metric("invalid", time.Hour, false),
+	}
+
+	// The bootstrap is disabled by default.
+	p := &Processor{current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return now }
+	assert.False(t, p.Bootstraps())
+	assert.Empty(t, p.Bootstrap(emList))
+
+	// The fresh metric is left untouched, the one older than its max age is served as stale and the one older than
+	// the bootstrap max age is invalid.
+	p.bootstrapMaxAge = 5 * time.Minute
+	require.True(t, p.Bootstraps())
+	bootstrapped := p.Bootstrap(emList)
+	require.Len(t, bootstrapped, 2)
+	for i, tt := range []struct {
+		name      string
+		valid     bool
+		stale     bool
+		lastError string
+	}{
+		{"stale", true, true, ""},
+		{"expired", false, false, errBootstrapExpired.Error()},
+	} {
+		t.Run(fmt.Sprintf("#%d %s", i, tt.name), func(t *testing.T) {
+			em := bootstrapped[i]
+			assert.Equal(t, tt.name, em.MetricName)
+			assert.Equal(t, tt.valid, em.Valid)
+			assert.Equal(t, tt.stale, em.Stale)
+			assert.Equal(t, tt.lastError, em.LastError)
+			assert.Equal(t, 12.0, em.ValueFloat)
+		})
+	}
+	// The metrics given are not modified.
+	assert.True(t, emList[2].Valid)
+	assert.False(t, emList[1].Stale)
+
+	// The metrics already flagged stale are not stored again.
+	assert.Len(t, p.Bootstrap(bootstrapped[:1]), 0)
+}
+
+func TestProcessor_SmoothedPoint(t *testing.T) {
+	em := custommetrics.ExternalMetricValue{
+		MetricName:     "requests_per_s",
+		Labels:         map[string]string{"role": "frontend"},
+		HPA:            custommetrics.ObjectReference{Name: "foo", Namespace: "default"},
+		SmoothingAlpha: 0.5,
+	}
+	p := &Processor{}
+
+	// The first value seeds the average, each point is averaged once.
+	assert.Equal(t, 10.0, p.smoothedPoint(em, Point{value: 10, timestamp: 1, valid: true}).value)
+	assert.Equal(t, 20.0, p.smoothedPoint(em, Point{value: 30, timestamp: 2, valid: true}).value)
+	assert.Equal(t, 20.0, p.smoothedPoint(em, Point{value: 30, timestamp: 2, valid: true}).value)
+
+	// The other metrics of the HPA and the metrics without alpha are not averaged with it.
+	other := em
+	other.Labels = map[string]string{"role": "backend"}
+	assert.Equal(t, 40.0, p.smoothedPoint(other, Point{value: 40, timestamp: 2, valid: true}).value)
+	unsmoothed := em
+	unsmoothed.SmoothingAlpha = 0
+	assert.Equal(t, 40.0, p.smoothedPoint(unsmoothed, Point{value: 40, timestamp: 3, valid: true}).value)
+
+	// A transient failure keeps the average, an invalidated metric restarts it.
+	assert.False(t, p.smoothedPoint(em, Point{transient: true}).valid)
+	assert.Equal(t, 30.0, p.smoothedPoint(em, Point{value: 40, timestamp: 3, valid: true}).value)
+	p.smoothedPoint(em, Point{})
+	assert.Equal(t, 50.0, p.smoothedPoint(em, Point{value: 50, timestamp: 4, valid: true}).value)
+
+	// The averages are forgotten on a leader change.
+	p.ResetSmoothing()
+	assert.Equal(t, 70.0, p.smoothedPoint(em, Point{value: 70, timestamp: 5, valid: true}).value)
+}
+
+func TestProcessor_SmoothingAlphaAnnotation(t *testing.T) {
+	metricName := "requests_per_s"
+	scope := "role:frontend"
+	now := time.Unix(1531492452, 0)
+	value := 10.0
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{float64(now.Unix() * 1000), value}}}}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, current: settings{externalMaxAge: 30 * time.Second}}
+	p.clock = func() time.Time { return now }
+	hpa := metav1.ObjectMeta{Name: "foo", Namespace: "default", Annotations: map[string]string{smoothingAlphaAnnotation: "0.25"}}
+	emList := []custommetrics.ExternalMetricValue{newExternalMetricValue(hpa, metricName, &metav1.LabelSelector{MatchLabels: map[string]string{"role": "frontend"}})}
+	setAnnotations(hpa, emList)
+	require.Equal(t, 0.25, emList[0].SmoothingAlpha)
+
+	// The refreshes of the metric serve the moving average of its values.
+	emList = p.UpdateExternalMetrics(emList)
+	require.Len(t, emList, 1)
+	assert.Equal(t, 10.0, emList[0].ValueFloat)
+	now = now.Add(time.Minute)
+	value = 50
+	emList = p.UpdateExternalMetrics(emList)
+	require.Len(t, emList, 1)
+	assert.True(t, emList[0].Valid)
+	assert.Equal(t, 20.0, emList[0].ValueFloat)
+}
+
+func TestProcessor_RefreshMetric(t *testing.T) {
+	metricName := "requests_per_s"
+	hpaRef := custommetrics.ObjectReference{Name: "foo", Namespace: "default", UID: "1111"}
+	metric := func(name string, value float64) custommetrics.ExternalMetricValue {
+		return custommetrics.ExternalMetricValue{
+			MetricName: name,
+			Labels:     map[string]string{"role": "frontend"},
+			HPA:        hpaRef,
+			Timestamp:  1531492452,
+			ValueFloat: value,
+			Valid:      true,
+		}
+	}
+	store, err := custommetrics.NewConfigMapStore(fake.NewSimpleClientset(), "default", "datadog-hpa")
+	require.NoError(t, err)
+	require.NoError(t, store.SetExternalMetricValues([]custommetrics.ExternalMetricValue{metric(metricName, 1), metric("errors_per_s", 2)}))
+
+	var queries int
+	var queryErr error
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queries++
+			scope := "role:frontend"
+			return []datadog.Series{{Metric: &metricName, Scope: &scope, Points: []datadog.DataPoint{{1531492500000, float64(10 * queries)}}}}, queryErr
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, queryCache: cache.New(time.Minute, time.Minute)}
+	p.clock = func() time.Time { return time.Unix(1531492560, 0) }
+
+	// The metrics are only refreshed with a store.
+	_, err = p.RefreshMetric(context.Background(), "default/foo/requests_per_s")
+	assert.Equal(t, errNoStore, err)
+	p.SetStore(store)
+
+	for i, key := range []string{"default/bar/requests_per_s", "default/foo/requests", "default/foo/requests_per_s{role:frontend}"} {
+		t.Run(fmt.Sprintf("#%d unknown metric", i), func(t *testing.T) {
+			_, err := p.RefreshMetric(context.Background(), key)
+			assert.Equal(t, ErrMetricNotFound, errors.Cause(err))
+		})
+	}
+	assert.Equal(t, 0, queries)
+
+	// The metric is queried bypassing the cache, stored and returned.
+	key := MetricRefreshKey(metric(metricName, 1))
+	assert.Equal(t, "default/foo/requests_per_s", key)
+	for i := 1; i <= 2; i++ {
+		em, err := p.RefreshMetric(context.Background(), key)
+		require.NoError(t, err)
+		assert.Equal(t, i, queries)
+		assert.True(t, em.Valid)
+		assert.Equal(t, float64(10*i), em.ValueFloat)
+		assert.Equal(t, int64(1531492500), em.Timestamp)
+		assert.Equal(t, int64(1531492560), em.LastSuccessTimestamp)
+		assert.Equal(t, "avg:requests_per_s{role:frontend}", em.Query)
+	}
+	emList, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	require.Len(t, emList, 2)
+	for _, em := range emList {
+		if em.MetricName == metricName {
+			assert.Equal(t, 20.0, em.ValueFloat)
+		} else {
+			assert.Equal(t, 2.0, em.ValueFloat)
+		}
+	}
+
+	// A transient failure leaves the stored metric untouched.
+	queryErr = errors.New("API error 503 Service Unavailable: unavailable")
+	em, err := p.RefreshMetric(context.Background(), key)
+	require.Error(t, err)
+	assert.True(t, em.Valid)
+	assert.Equal(t, 20.0, em.ValueFloat)
+}
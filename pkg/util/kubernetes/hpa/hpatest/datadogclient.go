@@ -0,0 +1,104 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// Package hpatest provides a fake DatadogClient to drive the hpa.Processor deterministically in the tests.
+package hpatest
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"gopkg.in/zorkian/go-datadog-api.v2"
+)
+
+// Query is a call to QueryMetrics recorded by a MockDatadogClient.
+type Query struct {
+	From  int64
+	To    int64
+	Query string
+}
+
+// response is the answer of a MockDatadogClient to the queries containing its substring.
+type response struct {
+	substring string
+	series    []datadog.Series
+	err       error
+}
+
+// MockDatadogClient is an in-memory DatadogClient answering the queries with the series registered for the
+// substrings they contain, e.g. the scope of a metric. The queries of a batch contain the substrings of several
+// metrics, the series of all of them are returned together. It is safe for concurrent use.
+type MockDatadogClient struct {
+	m         sync.Mutex
+	responses []response
+	queries   []Query
+}
+
+// NewMockDatadogClient returns a MockDatadogClient without any response, its queries return no series.
+func NewMockDatadogClient() *MockDatadogClient {
+	return &MockDatadogClient{}
+}
+
+// SetSeries registers the series returned by the queries containing the substring.
+func (c *MockDatadogClient) SetSeries(substring string, series ...datadog.Series) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.responses = append(c.responses, response{substring: substring, series: series})
+}
+
+// SetError registers the error returned by the queries containing the substring, in place of any series.
+func (c *MockDatadogClient) SetError(substring string, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.responses = append(c.responses, response{substring: substring, err: err})
+}
+
+// QueryMetrics records the query and returns the series registered for the substrings it contains, or the first
+// error registered for one of them.
+func (c *MockDatadogClient) QueryMetrics(_ context.Context, from, to int64, query string) ([]datadog.Series, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.queries = append(c.queries, Query{From: from, To: to, Query: query})
+
+	var series []datadog.Series
+	for _, r := range c.responses {
+		if !strings.Contains(query, r.substring) {
+			continue
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		series = append(series, r.series...)
+	}
+	return series, nil
+}
+
+// Queries returns the queries issued so far, in order.
+func (c *MockDatadogClient) Queries() []Query {
+	c.m.Lock()
+	defer c.m.Unlock()
+	queries := make([]Query, len(c.queries))
+	copy(queries, c.queries)
+	return queries
+}
+
+// Reset forgets the queries issued so far and the responses registered.
+func (c *MockDatadogClient) Reset() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.responses = nil
+	c.queries = nil
+}
+
+// NewSeries returns a serie of a metric and scope with the given points, whose timestamps are in milliseconds
+// like the ones returned by Datadog.
+func NewSeries(metric, scope string, points ...datadog.DataPoint) datadog.Series {
+	return datadog.Series{
+		Metric: &metric,
+		Scope:  &scope,
+		Points: points,
+	}
+}
@@ -0,0 +1,81 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpatest_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/zorkian/go-datadog-api.v2"
+	autoscalingv2 "k8s.io/api/autoscaling/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/hpa"
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/hpa/hpatest"
+)
+
+var _ hpa.DatadogClient = &hpatest.MockDatadogClient{}
+
+func newHPA(name string, roles ...string) *autoscalingv2.HorizontalPodAutoscaler {
+	autoscaler := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+	}
+	for _, role := range roles {
+		autoscaler.Spec.Metrics = append(autoscaler.Spec.Metrics, autoscalingv2.MetricSpec{
+			Type: autoscalingv2.ExternalMetricSourceType,
+			External: &autoscalingv2.ExternalMetricSource{
+				MetricName:     "requests_per_s",
+				MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": role}},
+			},
+		})
+	}
+	return autoscaler
+}
+
+func TestMockDatadogClient(t *testing.T) {
+	now := float64(time.Now().Unix() * 1000)
+	client := hpatest.NewMockDatadogClient()
+	client.SetSeries("{role:frontend}", hpatest.NewSeries("requests_per_s", "role:frontend", datadog.DataPoint{now, 12}))
+	client.SetSeries("{role:backend}", hpatest.NewSeries("requests_per_s", "role:backend", datadog.DataPoint{now, 14}))
+
+	p, err := hpa.NewProcessor(client)
+	require.NoError(t, err)
+	defer p.Stop()
+
+	// The metric shared by the HPAs is queried once, in the same batch as the other one.
+	externalMetrics := p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("foo", "frontend"),
+		newHPA("bar", "frontend", "backend"),
+	})
+	require.Len(t, externalMetrics, 3)
+	for _, em := range externalMetrics {
+		assert.True(t, em.Valid)
+	}
+	queries := client.Queries()
+	require.Len(t, queries, 1)
+	assert.Equal(t, "avg:requests_per_s{role:frontend},avg:requests_per_s{role:backend}", queries[0].Query)
+
+	// The metrics cached by the Processor are not queried again, the queries of the others fail.
+	client.Reset()
+	client.SetSeries("{role:frontend}", hpatest.NewSeries("requests_per_s", "role:frontend", datadog.DataPoint{now, 12}))
+	client.SetError("{role:broken}", errors.New("invalid query"))
+	externalMetrics = p.ProcessHPAList([]*autoscalingv2.HorizontalPodAutoscaler{
+		newHPA("baz", "frontend", "broken"),
+	})
+	require.Len(t, externalMetrics, 2)
+	assert.True(t, externalMetrics[0].Valid)
+	assert.False(t, externalMetrics[1].Valid)
+	queries = client.Queries()
+	require.NotEmpty(t, queries)
+	for _, q := range queries {
+		assert.Equal(t, "avg:requests_per_s{role:broken}", q.Query)
+	}
+}
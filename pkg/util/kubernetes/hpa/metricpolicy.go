@@ -0,0 +1,95 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// ErrMetricNotAllowed is the error of the metrics whose query references a metric the policy does not allow.
+var ErrMetricNotAllowed = errors.New("the metric is not allowed by the metric policy of the Cluster Agent")
+
+// queryMetricName matches the names of the metrics of a query, followed by their scope.
+var queryMetricName = regexp.MustCompile(`[A-Za-z][A-Za-z0-9_.]*\{`)
+
+// metricPolicy restricts the metrics queried to the allowed glob patterns, the denied ones taking precedence.
+type metricPolicy struct {
+	allowed []string
+	denied  []string
+}
+
+// loadMetricPolicy returns the metric policy of the configuration, nil if it allows all the metrics.
+func loadMetricPolicy() *metricPolicy {
+	mp := &metricPolicy{
+		allowed: validPatterns("external_metrics_provider.allowed_metrics"),
+		denied:  validPatterns("external_metrics_provider.denied_metrics"),
+	}
+	if len(mp.allowed)+len(mp.denied) == 0 {
+		return nil
+	}
+	log.Infof("Restricting the external metrics queried: allowed=%q denied=%q", mp.allowed, mp.denied)
+	return mp
+}
+
+// validPatterns returns the valid glob patterns of a setting.
+func validPatterns(setting string) []string {
+	var patterns []string
+	for _, pattern := range config.Datadog.GetStringSlice(setting) {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Warnf("Invalid pattern %q in %s, it is ignored: %v", pattern, setting, err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// allows returns whether the metric policy allows querying a metric, a nil policy allows all the metrics.
+func (mp *metricPolicy) allows(metricName string) bool {
+	if mp == nil {
+		return true
+	}
+	if matchesAny(mp.denied, metricName) {
+		return false
+	}
+	return len(mp.allowed) == 0 || matchesAny(mp.allowed, metricName)
+}
+
+// deniedMetric returns the first metric of a query the metric policy does not allow.
+func (mp *metricPolicy) deniedMetric(query string) (metricName string, denied bool) {
+	if mp == nil {
+		return "", false
+	}
+	for _, match := range queryMetricName.FindAllString(query, -1) {
+		metricName = strings.TrimSuffix(match, "{")
+		if !mp.allows(metricName) {
+			return metricName, true
+		}
+	}
+	return "", false
+}
+
+// matchesAny returns whether a metric name matches one of the glob patterns.
+func matchesAny(patterns []string, metricName string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, metricName); matched {
+			return true
+		}
+	}
+	return false
+}
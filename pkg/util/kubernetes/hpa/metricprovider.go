@@ -0,0 +1,52 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"gopkg.in/zorkian/go-datadog-api.v2"
+)
+
+// MetricProvider queries the value of a metric from a backend other than Datadog, e.g. Prometheus.
+type MetricProvider interface {
+	QueryValue(ctx context.Context, query string, window time.Duration) (float64, time.Time, error)
+}
+
+// NewProcessorWithProvider returns a new Processor querying the metrics from a MetricProvider.
+func NewProcessorWithProvider(provider MetricProvider) (*Processor, error) {
+	p, err := NewProcessor(&providerClient{provider: provider})
+	if err != nil {
+		return nil, err
+	}
+	p.queriesAlone = true
+	return p, nil
+}
+
+// providerClient adapts a MetricProvider to the DatadogClient interface.
+type providerClient struct {
+	provider MetricProvider
+}
+
+// QueryMetrics queries the value of the query over the window from from to to, in seconds.
+func (c *providerClient) QueryMetrics(ctx context.Context, from, to int64, query string) ([]datadog.Series, error) {
+	value, ts, err := c.provider.QueryValue(ctx, query, time.Duration(to-from)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsNaN(value) {
+		return nil, nil
+	}
+	timestamp := to
+	if !ts.IsZero() {
+		timestamp = ts.Unix()
+	}
+	return []datadog.Series{{Points: []datadog.DataPoint{{float64(timestamp * 1000), value}}}}, nil
+}
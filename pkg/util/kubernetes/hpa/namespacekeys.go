@@ -0,0 +1,74 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// namespaceKeys are the api/app key pair, and optional endpoint, querying the metrics of a namespace.
+type namespaceKeys struct {
+	APIKey   string `mapstructure:"api_key"`
+	AppKey   string `mapstructure:"app_key"`
+	Endpoint string `mapstructure:"endpoint"`
+}
+
+// loadNamespaceClients returns the DatadogClients of external_metrics_provider.namespace_keys, by namespace.
+func loadNamespaceClients() (map[string]DatadogClient, error) {
+	var keys map[string]namespaceKeys
+	if err := config.Datadog.UnmarshalKey("external_metrics_provider.namespace_keys", &keys); err != nil {
+		// The error of the decoding could quote the keys.
+		return nil, errors.New("could not load external_metrics_provider.namespace_keys, it must map the namespaces to their api_key, app_key and endpoint")
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	transport, err := newDatadogTransport()
+	if err != nil {
+		return nil, err
+	}
+	defaultEndpoint, err := getDatadogEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]string, 0, len(keys))
+	clients := make(map[string]DatadogClient, len(keys))
+	for namespace, k := range keys {
+		if k.APIKey == "" || k.AppKey == "" {
+			return nil, fmt.Errorf("missing the api/app key pair of the namespace %s to query Datadog", namespace)
+		}
+		endpoint := k.Endpoint
+		if endpoint == "" {
+			endpoint = defaultEndpoint
+		} else if err := validateEndpoint(endpoint); err != nil {
+			return nil, err
+		}
+		if endpoint == "" {
+			// The keys would be sent to the default site of the client, whatever the site of the organization.
+			return nil, fmt.Errorf("missing the endpoint of the namespace %s to query Datadog, set its endpoint, external_metrics_provider.endpoint or site", namespace)
+		}
+		clients[namespace] = newConfiguredClient(k.APIKey, k.AppKey, endpoint, transport)
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	log.Infof("Initialized the Datadog Clients for the HPAs of the namespaces with keys of their own: namespaces=%q", namespaces)
+	return clients, nil
+}
+
+// client returns the DatadogClient querying the metrics of the query options.
+func (p *Processor) client(opts queryOptions) DatadogClient {
+	if client, ok := p.namespaceClients[opts.namespace]; ok && opts.namespace != "" {
+		return client
+	}
+	return p.datadogClient
+}
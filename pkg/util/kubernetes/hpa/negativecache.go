@@ -0,0 +1,111 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// noDataThreshold is the number of consecutive answers without points after which a query is cached.
+const noDataThreshold = 2
+
+// negativeEntry is the last failure of a query, and the number of consecutive failures.
+type negativeEntry struct {
+	err      error
+	failures int
+	// last is the time of the last failure.
+	last time.Time
+	// until is the time until which the failure is served instead of querying Datadog, zero while it is not.
+	until time.Time
+}
+
+// negativeCache caches the permanent failures of the queries for a short TTL.
+type negativeCache struct {
+	ttl time.Duration
+
+	m       sync.Mutex
+	entries map[string]*negativeEntry
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		entries: make(map[string]*negativeEntry),
+	}
+}
+
+// get returns the failure cached for a query, if it is still served at now.
+func (c *negativeCache) get(key string, now time.Time) (error, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || !now.Before(entry.until) {
+		return nil, false
+	}
+	return entry.err, true
+}
+
+// record records a failure of a query, the errors that are not permanent are not recorded.
+func (c *negativeCache) record(key string, err error, now time.Time) {
+	if c == nil {
+		return
+	}
+	cause := errors.Cause(err)
+	if cause != ErrQuerySyntax && cause != ErrNoDataPoints {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.prune(now)
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &negativeEntry{}
+		c.entries[key] = entry
+	}
+	entry.err = err
+	entry.failures++
+	entry.last = now
+	if cause == ErrQuerySyntax || entry.failures >= noDataThreshold {
+		entry.until = now.Add(c.ttl)
+	}
+}
+
+// forget forgets the failures of a query that succeeded.
+func (c *negativeCache) forget(key string) {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.entries, key)
+}
+
+// flush forgets all the failures, e.g. when the queries change.
+func (c *negativeCache) flush() {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.entries = make(map[string]*negativeEntry)
+}
+
+// prune forgets the failures of the queries that did not fail again for twice the TTL, e.g. the ones of deleted HPAs.
+func (c *negativeCache) prune(now time.Time) {
+	for key, entry := range c.entries {
+		if now.Sub(entry.last) > 2*c.ttl {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// queryPanicError is the error of a query whose processing panicked, of failure mode ErrQueryPanic.
+type queryPanicError struct {
+	value interface{}
+}
+
+func (e *queryPanicError) Error() string {
+	return fmt.Sprintf("the query panicked: %v", e.value)
+}
+
+// recoveredPanic logs and counts a panic recovered while querying the external metrics of keys.
+func recoveredPanic(value interface{}, query string, keys []string) error {
+	recoveredPanicsTelemetry.Inc()
+	log.Errorf("Recovered a panic while querying the external metrics, they are invalid: query=%q keys=%q panic=%q\n%s", query, keys, fmt.Sprint(value), debug.Stack())
+	return &queryPanicError{value: value}
+}
@@ -0,0 +1,52 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"math"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// namespaceLimiter is a token bucket per namespace of HPAs, consumed by each metric queried for a namespace.
+type namespaceLimiter struct {
+	qps   float64
+	burst int
+
+	m        sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// newNamespaceLimiter returns a limiter allowing qps metric queries per second and namespace.
+func newNamespaceLimiter(qps float64, refreshPeriod int) *namespaceLimiter {
+	burst := int(math.Ceil(qps * float64(refreshPeriod)))
+	if burst < 1 {
+		burst = 1
+	}
+	return &namespaceLimiter{
+		qps:      qps,
+		burst:    burst,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// allow returns whether a metric of the namespace can be queried now.
+func (l *namespaceLimiter) allow(namespace string) bool {
+	if l == nil {
+		return true
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	limiter, ok := l.limiters[namespace]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(l.qps), l.burst)
+		l.limiters[namespace] = limiter
+	}
+	return limiter.Allow()
+}
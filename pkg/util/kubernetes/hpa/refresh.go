@@ -0,0 +1,105 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+var (
+	// ErrMetricNotFound is the error of RefreshMetric for a key matching none of the stored metrics.
+	ErrMetricNotFound = errors.New("no stored external metric matches the key")
+	// errNoStore is the error of RefreshMetric for a Processor without a store, see SetStore.
+	errNoStore = errors.New("the Processor has no store of the external metrics")
+	// errFrozenMetric is the error of RefreshMetric for a metric frozen by its HPA, it keeps serving its last value.
+	errFrozenMetric = errors.New("the external metric is frozen by its HPA, it is not refreshed")
+)
+
+// SetStore sets the store of the metrics refreshed on demand by RefreshMetric.
+func (p *Processor) SetStore(store custommetrics.Store) {
+	p.storeMutex.Lock()
+	p.store = store
+	p.storeMutex.Unlock()
+}
+
+func (p *Processor) getStore() custommetrics.Store {
+	p.storeMutex.RLock()
+	defer p.storeMutex.RUnlock()
+	return p.store
+}
+
+// MetricRefreshKey returns the key of a metric for RefreshMetric, e.g. `default/web/nginx.net.request_per_s`.
+func MetricRefreshKey(em custommetrics.ExternalMetricValue) string {
+	return fmt.Sprintf("%s/%s/%s", em.HPA.Namespace, em.HPA.Name, em.MetricName)
+}
+
+// RefreshMetric re-queries a stored metric on demand, bypassing the caches, and stores it.
+func (p *Processor) RefreshMetric(ctx context.Context, key string) (custommetrics.ExternalMetricValue, error) {
+	store := p.getStore()
+	if store == nil {
+		return custommetrics.ExternalMetricValue{}, errNoStore
+	}
+	emList, err := store.ListAllExternalMetricValues()
+	if err != nil {
+		return custommetrics.ExternalMetricValue{}, errors.Wrap(err, "could not list the external metrics")
+	}
+	em, err := findMetric(emList, key)
+	if err != nil {
+		return custommetrics.ExternalMetricValue{}, err
+	}
+	if em.Frozen && em.Valid {
+		return em, errFrozenMetric
+	}
+
+	queryKey, keyErr := p.queryKey(em)
+	if keyErr == nil {
+		p.forgetCached(queryKey)
+	}
+	metrics, errs, err := p.queryExternalMetrics(ctx, []custommetrics.ExternalMetricValue{em})
+	if err != nil {
+		return em, errors.Wrap(err, "could not refresh the external metric")
+	}
+	point, pointErr := p.checkedPoint(em, metrics[queryKey])
+	if keyErr == nil && !point.valid && point.transient {
+		return em, errors.Wrap(metricError(nil, errs[queryKey]), "could not refresh the external metric, it is left untouched")
+	}
+	point = p.smoothedPoint(em, point)
+	previous := em
+	invalidErr := p.setPoint(&em, queryKey, point, keyErr, pointErr, errs[queryKey])
+	p.recordTransition(previous, em, invalidErr)
+	if err = store.SetExternalMetricValues([]custommetrics.ExternalMetricValue{em}); err != nil {
+		return em, errors.Wrap(err, "could not store the refreshed external metric")
+	}
+	log.Infof("Refreshed the external metric on demand: %s valid=%t value=%v", metricFields(em), em.Valid, em.ValueFloat)
+	return em, nil
+}
+
+// findMetric returns the metric of a list with a key of RefreshMetric.
+func findMetric(emList []custommetrics.ExternalMetricValue, key string) (custommetrics.ExternalMetricValue, error) {
+	for _, em := range emList {
+		if MetricRefreshKey(em) == key {
+			return em, nil
+		}
+	}
+	return custommetrics.ExternalMetricValue{}, errors.Wrapf(ErrMetricNotFound, "key %q", key)
+}
+
+// forgetCached forgets the point and the failure cached for a key, so that it is queried again.
+func (p *Processor) forgetCached(key string) {
+	cacheKey := p.cacheKey(key)
+	if p.queryCache != nil {
+		p.queryCache.Delete(cacheKey)
+	}
+	p.negativeCache.forget(cacheKey)
+}
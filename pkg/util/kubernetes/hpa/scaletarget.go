@@ -0,0 +1,173 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// scaleTargetListers list the scalable resources targeted by the HPAs, to resolve the selectors of their pods.
+type scaleTargetListers struct {
+	deployments  appslisters.DeploymentLister
+	statefulSets appslisters.StatefulSetLister
+	replicaSets  appslisters.ReplicaSetLister
+}
+
+// SetScaleTargetListers sets the listers of the scale targets of the HPAs.
+func (p *Processor) SetScaleTargetListers(deployments appslisters.DeploymentLister, statefulSets appslisters.StatefulSetLister, replicaSets appslisters.ReplicaSetLister) {
+	p.scaleTargetsMutex.Lock()
+	defer p.scaleTargetsMutex.Unlock()
+	p.scaleTargets = &scaleTargetListers{
+		deployments:  deployments,
+		statefulSets: statefulSets,
+		replicaSets:  replicaSets,
+	}
+}
+
+// selector returns the pod selector of a scale target.
+func (l *scaleTargetListers) selector(namespace string, target autoscalingv2.CrossVersionObjectReference) (*metav1.LabelSelector, error) {
+	switch target.Kind {
+	case "Deployment":
+		deployment, err := l.deployments.Deployments(namespace).Get(target.Name)
+		if err != nil {
+			return nil, err
+		}
+		return deployment.Spec.Selector, nil
+	case "StatefulSet":
+		statefulSet, err := l.statefulSets.StatefulSets(namespace).Get(target.Name)
+		if err != nil {
+			return nil, err
+		}
+		return statefulSet.Spec.Selector, nil
+	case "ReplicaSet":
+		replicaSet, err := l.replicaSets.ReplicaSets(namespace).Get(target.Name)
+		if err != nil {
+			return nil, err
+		}
+		return replicaSet.Spec.Selector, nil
+	}
+	return nil, fmt.Errorf("unsupported scale target kind %s", target.Kind)
+}
+
+// setPodSelectors sets the pod selector of the scale target of an HPA on its Pods metrics.
+func (p *Processor) setPodSelectors(hpa *autoscalingv2.HorizontalPodAutoscaler, externalMetrics []custommetrics.ExternalMetricValue) {
+	var pods []int
+	for i, m := range externalMetrics {
+		if m.Type == custommetrics.PodsMetricType && m.LastError == "" {
+			pods = append(pods, i)
+		}
+	}
+	if len(pods) == 0 {
+		return
+	}
+	p.scaleTargetsMutex.RLock()
+	listers := p.scaleTargets
+	p.scaleTargetsMutex.RUnlock()
+	if listers == nil {
+		log.Warnf("The scale targets are not listed, the Pods metrics of the HPA %s/%s are not served", hpa.Namespace, hpa.Name)
+		return
+	}
+	target := hpa.Spec.ScaleTargetRef
+	labelSelector, err := listers.selector(hpa.Namespace, target)
+	if err == nil && labelSelector == nil {
+		err = fmt.Errorf("the %s has no selector", target.Kind)
+	}
+	var selector labels.Selector
+	if err == nil {
+		selector, err = metav1.LabelSelectorAsSelector(labelSelector)
+	}
+	if err != nil {
+		log.Warnf("Could not resolve the pods of the scale target %s %s of the HPA %s/%s, its Pods metrics are not served: %v", target.Kind, target.Name, hpa.Namespace, hpa.Name, err)
+		return
+	}
+	for _, i := range pods {
+		externalMetrics[i].PodSelector = selector.String()
+	}
+}
+
+// parseTargetSelector returns whether the annotation of an HPA opts its metrics in the scope of its scale target.
+func parseTargetSelector(hpa metav1.ObjectMeta) bool {
+	value, ok := hpa.Annotations[targetSelectorAnnotation]
+	if !ok {
+		return false
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Warnf("Invalid %s annotation %q on the HPA %s/%s, its metrics are not scoped to its scale target", targetSelectorAnnotation, value, hpa.Namespace, hpa.Name)
+		return false
+	}
+	return enabled
+}
+
+// podLabelsAsTags returns the tags set by the Datadog Agent from the labels of the pods, by lowercased label.
+func podLabelsAsTags() map[string]string {
+	labelsAsTags := make(map[string]string)
+	for label, tag := range config.Datadog.GetStringMapString("kubernetes_pod_labels_as_tags") {
+		labelsAsTags[strings.ToLower(label)] = tag
+	}
+	return labelsAsTags
+}
+
+// scopeToTarget sets the labels of the pod selector of the scale target of an HPA as the target tags of its metrics.
+func (p *Processor) scopeToTarget(hpa *autoscalingv2.HorizontalPodAutoscaler, externalMetrics []custommetrics.ExternalMetricValue) {
+	if !parseTargetSelector(hpa.ObjectMeta) {
+		return
+	}
+	p.scaleTargetsMutex.RLock()
+	listers := p.scaleTargets
+	p.scaleTargetsMutex.RUnlock()
+	if listers == nil {
+		log.Warnf("The scale targets are not listed, the metrics of the HPA %s/%s are not scoped to its scale target", hpa.Namespace, hpa.Name)
+		return
+	}
+	target := hpa.Spec.ScaleTargetRef
+	selector, err := listers.selector(hpa.Namespace, target)
+	if err != nil {
+		log.Warnf("Could not resolve the scale target %s %s of the HPA %s/%s, its metrics are not scoped to it: %v", target.Kind, target.Name, hpa.Namespace, hpa.Name, err)
+		return
+	}
+	if selector == nil {
+		return
+	}
+	if len(selector.MatchExpressions) > 0 {
+		log.Debugf("The expressions of the selector of the scale target %s %s of the HPA %s/%s are not added to its metrics", target.Kind, target.Name, hpa.Namespace, hpa.Name)
+	}
+
+	labelsAsTags := podLabelsAsTags()
+	tags := make(map[string]string)
+	for label, value := range selector.MatchLabels {
+		tag, ok := labelsAsTags[strings.ToLower(label)]
+		if !ok {
+			log.Debugf("The label %s of the pods of the HPA %s/%s is not collected as a tag, it is not added to its metrics", label, hpa.Namespace, hpa.Name)
+			continue
+		}
+		tags[tag] = value
+	}
+	if len(tags) == 0 {
+		log.Warnf("None of the labels of the pods of the HPA %s/%s are collected as tags, its metrics are not scoped to its scale target", hpa.Namespace, hpa.Name)
+		return
+	}
+
+	for i, m := range externalMetrics {
+		if (m.Type != "" && m.Type != custommetrics.PodsMetricType) || m.LastError != "" {
+			continue
+		}
+		externalMetrics[i].TargetTags = tags
+	}
+}
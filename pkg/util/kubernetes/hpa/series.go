@@ -0,0 +1,98 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// The averages across the series of a key, e.g. the series of the pods of a query grouped by `pod_name`.
+const (
+	seriesAverageNone     = "none"
+	seriesAverageMean     = "mean"
+	seriesAverageWeighted = "weighted"
+)
+
+// The handling of the series with only null points in the window when they are averaged.
+const (
+	nullSeriesSkip = "skip"
+	nullSeriesZero = "zero"
+)
+
+// isValidSeriesAverage returns whether the average of the series of a key is supported.
+func isValidSeriesAverage(average string) bool {
+	switch average {
+	case seriesAverageNone, seriesAverageMean, seriesAverageWeighted:
+		return true
+	}
+	return false
+}
+
+// isValidNullSeries returns whether the handling of the null series is supported.
+func isValidNullSeries(nullSeries string) bool {
+	switch nullSeries {
+	case nullSeriesSkip, nullSeriesZero:
+		return true
+	}
+	return false
+}
+
+// averagesSeries returns whether the series of a key are averaged.
+func (s settings) averagesSeries() bool {
+	return s.seriesAverage != "" && s.seriesAverage != seriesAverageNone
+}
+
+// reduceSeries reduces the series of a key to its point, averaged with the series average of the settings.
+func (p *Processor) reduceSeries(key string, series []datadog.Series, opts queryOptions, s settings) (Point, bool) {
+	var point Point
+	var found bool
+	if !s.averagesSeries() || len(series) == 1 {
+		for _, serie := range series {
+			if seriePoint, _, ok := p.reduceSerie(key, serie, opts, s); ok {
+				point, found = seriePoint, true
+			}
+		}
+		return point, found
+	}
+
+	var sum, weights float64
+	for _, serie := range series {
+		seriePoint, points, ok := p.reduceSerie(key, serie, opts, s)
+		if ok && !seriePoint.valid {
+			return seriePoint, true
+		}
+		weight := 1.0
+		if !ok {
+			// The series with non-null points left out, e.g. too old, are not null series.
+			if points > 0 || s.nullSeries != nullSeriesZero {
+				continue
+			}
+			if s.seriesAverage == seriesAverageWeighted {
+				weight = float64(len(serie.Points))
+			}
+			weights += weight
+			continue
+		}
+		if s.seriesAverage == seriesAverageWeighted {
+			weight = float64(points)
+		}
+		sum += seriePoint.value * weight
+		weights += weight
+		if !found || seriePoint.timestamp > point.timestamp {
+			point, found = seriePoint, true
+		}
+	}
+	if !found || weights == 0 {
+		return Point{}, false
+	}
+	point.value = sum / weights
+	log.Debugf("Averaged the series of the key: key=%q series=%d average=%s null_series=%s value=%v", key, len(series), s.seriesAverage, s.nullSeries, point.value)
+	return point, true
+}
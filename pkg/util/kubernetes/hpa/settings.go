@@ -0,0 +1,139 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// settings are the settings of the Processor that ReloadConfig reads again from the configuration.
+type settings struct {
+	externalMaxAge   time.Duration
+	aggregator       string
+	queryWindow      time.Duration
+	queryOffset      time.Duration
+	rollup           int
+	rollupPoints     int
+	interpolation    string
+	seriesAverage    string
+	nullSeries       string
+	queryRetries     int
+	queryBackoff     time.Duration
+	queryTimeout     time.Duration
+	queryConcurrency int
+	// capturePoints is the number of raw points captured for each query, 0 if they are not captured.
+	capturePoints int
+}
+
+// minExternalMaxAge is the shortest max age of the external metrics, the interval of the points of the Agent.
+const minExternalMaxAge = nativeInterval * time.Second
+
+// querySettings returns the settings the queries and the results cached for them depend on.
+func (s settings) querySettings() settings {
+	s.queryRetries, s.queryBackoff, s.queryTimeout, s.queryConcurrency, s.capturePoints = 0, 0, 0, 0, 0
+	return s
+}
+
+// loadSettings reads the settings of the Processor from the configuration, falling back on the defaults.
+func loadSettings() settings {
+	externalMaxAge := time.Duration(config.Datadog.GetInt("external_metrics_provider.max_age")) * time.Second
+	if externalMaxAge < minExternalMaxAge {
+		log.Warnf("Invalid max age %s for the external metrics, it should be at least %s, using %s", externalMaxAge, minExternalMaxAge, minExternalMaxAge)
+		externalMaxAge = minExternalMaxAge
+	}
+	aggregator := config.Datadog.GetString("external_metrics_provider.aggregator")
+	if !isValidAggregator(aggregator) {
+		log.Warnf("Unsupported aggregator %q for the external metrics, using %q", aggregator, aggregatorAvg)
+		aggregator = aggregatorAvg
+	}
+	interpolation := config.Datadog.GetString("external_metrics_provider.interpolation")
+	if !isValidInterpolation(interpolation) {
+		log.Warnf("Unsupported interpolation %q for the external metrics, using %q", interpolation, interpolationNone)
+		interpolation = interpolationNone
+	}
+	seriesAverage := config.Datadog.GetString("external_metrics_provider.series_average")
+	if !isValidSeriesAverage(seriesAverage) {
+		log.Warnf("Unsupported series average %q for the external metrics, using %q", seriesAverage, seriesAverageNone)
+		seriesAverage = seriesAverageNone
+	}
+	nullSeries := config.Datadog.GetString("external_metrics_provider.null_series")
+	if !isValidNullSeries(nullSeries) {
+		log.Warnf("Unsupported handling %q of the null series of the external metrics, using %q", nullSeries, nullSeriesSkip)
+		nullSeries = nullSeriesSkip
+	}
+	// The query window used to be configured as the bucket size.
+	queryWindow := config.Datadog.GetInt("external_metrics_provider.query_window")
+	if queryWindow <= 0 {
+		queryWindow = config.Datadog.GetInt("external_metrics_provider.bucket_size")
+	}
+	queryOffset := config.Datadog.GetInt("external_metrics_provider.query_offset")
+	if queryOffset < 0 {
+		log.Warnf("Invalid query offset %d for the external metrics, the queries end now", queryOffset)
+		queryOffset = 0
+	}
+	var capturePoints int
+	if config.Datadog.GetBool("external_metrics_provider.capture_raw") {
+		capturePoints = config.Datadog.GetInt("external_metrics_provider.capture_raw_points")
+	}
+	return settings{
+		externalMaxAge:   externalMaxAge,
+		aggregator:       aggregator,
+		queryWindow:      time.Duration(queryWindow) * time.Second,
+		queryOffset:      time.Duration(queryOffset) * time.Second,
+		rollup:           config.Datadog.GetInt("external_metrics_provider.rollup"),
+		rollupPoints:     config.Datadog.GetInt("external_metrics_provider.rollup_points"),
+		interpolation:    interpolation,
+		seriesAverage:    seriesAverage,
+		nullSeries:       nullSeries,
+		queryRetries:     config.Datadog.GetInt("external_metrics_provider.query_retries"),
+		queryBackoff:     time.Duration(config.Datadog.GetInt("external_metrics_provider.query_backoff")) * time.Millisecond,
+		queryTimeout:     time.Duration(config.Datadog.GetInt("external_metrics_provider.query_timeout")) * time.Second,
+		queryConcurrency: config.Datadog.GetInt("external_metrics_provider.query_concurrency"),
+		capturePoints:    capturePoints,
+	}
+}
+
+// settings returns the current settings of the Processor.
+func (p *Processor) settings() settings {
+	p.settingsMutex.RLock()
+	defer p.settingsMutex.RUnlock()
+	return p.current
+}
+
+// setSettings sets the settings of the Processor and returns the previous ones.
+func (p *Processor) setSettings(s settings) settings {
+	p.settingsMutex.Lock()
+	defer p.settingsMutex.Unlock()
+	previous := p.current
+	p.current = s
+	return previous
+}
+
+// ReloadConfig reads the settings of the Processor again, and flushes the caches if the queries changed.
+func (p *Processor) ReloadConfig() {
+	s := loadSettings()
+	previous := p.setSettings(s)
+	if previous == s {
+		return
+	}
+	log.Infof("Reloaded the settings of the external metrics: max_age=%s aggregator=%s window=%s offset=%s rollup=%d rollup_points=%d interpolation=%s series_average=%s null_series=%s query_retries=%d query_backoff=%s query_timeout=%s query_concurrency=%d capture_raw_points=%d",
+		s.externalMaxAge, s.aggregator, s.queryWindow, s.queryOffset, s.rollup, s.rollupPoints, s.interpolation, s.seriesAverage, s.nullSeries, s.queryRetries, s.queryBackoff, s.queryTimeout, s.queryConcurrency, s.capturePoints)
+	if s.capturePoints == 0 {
+		p.resetCaptures()
+	}
+	if previous.querySettings() == s.querySettings() {
+		return
+	}
+	if p.queryCache != nil {
+		p.queryCache.Flush()
+	}
+	p.negativeCache.flush()
+}
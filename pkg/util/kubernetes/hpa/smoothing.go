@@ -0,0 +1,80 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"math"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// smoothingAlphaAnnotation is the weight in ]0, 1] of the latest value in the moving average of a metric.
+const smoothingAlphaAnnotation = "external-metrics.datadoghq.com/smoothing-alpha"
+
+// smoothedValue is the moving average of the values of a metric, and the timestamp of the last point averaged.
+type smoothedValue struct {
+	value     float64
+	timestamp int64
+}
+
+// parseSmoothingAlpha returns the smoothing alpha set by the annotation of an HPA, 0 if it is absent or invalid.
+func parseSmoothingAlpha(hpa metav1.ObjectMeta) float64 {
+	value, ok := hpa.Annotations[smoothingAlphaAnnotation]
+	if !ok {
+		return 0
+	}
+	alpha, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(alpha) || alpha <= 0 || alpha > 1 {
+		log.Warnf("Invalid %s annotation %q on the HPA %s/%s, its metrics are not smoothed", smoothingAlphaAnnotation, value, hpa.Namespace, hpa.Name)
+		return 0
+	}
+	return alpha
+}
+
+// smoothedPoint returns the point of a metric with its value replaced by the moving average of its values.
+func (p *Processor) smoothedPoint(em custommetrics.ExternalMetricValue, point Point) Point {
+	if em.SmoothingAlpha <= 0 || em.SmoothingAlpha >= 1 {
+		return point
+	}
+	key := refreshKey(em)
+	p.smoothingMutex.Lock()
+	defer p.smoothingMutex.Unlock()
+	if !point.valid {
+		if !point.transient {
+			delete(p.smoothing, key)
+		}
+		return point
+	}
+	previous, ok := p.smoothing[key]
+	switch {
+	case !ok:
+	case point.timestamp <= previous.timestamp:
+		point.value = previous.value
+		return point
+	default:
+		raw := point.value
+		point.value = em.SmoothingAlpha*raw + (1-em.SmoothingAlpha)*previous.value
+		log.Debugf("Smoothed the value of the external metric: %s value=%v smoothed=%v alpha=%v", metricFields(em), raw, point.value, em.SmoothingAlpha)
+	}
+	if p.smoothing == nil {
+		p.smoothing = make(map[string]smoothedValue)
+	}
+	p.smoothing[key] = smoothedValue{value: point.value, timestamp: point.timestamp}
+	return point
+}
+
+// ResetSmoothing forgets the moving averages of the values of the metrics.
+func (p *Processor) ResetSmoothing() {
+	p.smoothingMutex.Lock()
+	p.smoothing = nil
+	p.smoothingMutex.Unlock()
+}
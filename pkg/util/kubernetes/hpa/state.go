@@ -0,0 +1,149 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// processorStateVar is the expvar publishing the state of the running Processor.
+const processorStateVar = "external-metrics-processor"
+
+const circuitDisabled = "disabled"
+
+var (
+	publishedMutex sync.RWMutex
+	published      *Processor
+)
+
+func init() {
+	expvar.Publish(processorStateVar, expvar.Func(func() interface{} {
+		publishedMutex.RLock()
+		p := published
+		publishedMutex.RUnlock()
+		if p == nil {
+			return nil
+		}
+		return p.State()
+	}))
+}
+
+// ProcessorState is the state of a Processor, for debugging.
+type ProcessorState struct {
+	// Metrics is the number of metrics of the last refresh, Valid, Invalid and Stale their number by state.
+	Metrics int `json:"metrics"`
+	Valid   int `json:"valid"`
+	Invalid int `json:"invalid"`
+	Stale   int `json:"stale"`
+	// CacheSize is the number of query results cached, CacheHitRatio the ratio of the queries answered by the cache.
+	CacheSize     int     `json:"cacheSize"`
+	CacheHitRatio float64 `json:"cacheHitRatio"`
+	// CircuitBreaker is closed, open or disabled.
+	CircuitBreaker string `json:"circuitBreaker"`
+	// LastRefresh is the time of the end of the last refresh, LastRefreshDuration its duration in seconds.
+	LastRefresh         int64   `json:"lastRefresh,omitempty"`
+	LastRefreshDuration float64 `json:"lastRefreshDuration"`
+	// LastError is the last error of the queries to Datadog.
+	LastError string `json:"lastError,omitempty"`
+	// RawCaptures are the last raw points of the queries to Datadog by query, see RawCapture.
+	RawCaptures map[string]RawCapture `json:"rawCaptures,omitempty"`
+	// Failing are the metrics left invalid by the last refresh, see FailingMetrics.
+	Failing []FailingMetric `json:"failing,omitempty"`
+}
+
+// processorState is the state recorded by a Processor, guarded by its stateMutex.
+type processorState struct {
+	valid, invalid      int
+	stale               int
+	lastRefresh         time.Time
+	lastRefreshDuration time.Duration
+	lastError           string
+	captures            map[string]*RawCapture
+	// staleness are the labels of the staleness reported for the metrics, see recordStaleness.
+	staleness map[stalenessLabels]bool
+	// failing are the metrics left invalid by the last refresh by refreshKey, see recordFailures.
+	failing map[string]FailingMetric
+}
+
+// Publish makes the Processor the one whose state is published, until Stop.
+func (p *Processor) Publish() {
+	publishedMutex.Lock()
+	published = p
+	publishedMutex.Unlock()
+}
+
+// unpublish stops publishing the state of the Processor, if it is still the published one.
+func (p *Processor) unpublish() {
+	publishedMutex.Lock()
+	if published == p {
+		published = nil
+	}
+	publishedMutex.Unlock()
+}
+
+// State returns the current state of the Processor, it can be called while the metrics are refreshed.
+func (p *Processor) State() ProcessorState {
+	p.stateMutex.RLock()
+	state := ProcessorState{
+		Metrics:             p.state.valid + p.state.invalid,
+		Valid:               p.state.valid,
+		Invalid:             p.state.invalid,
+		Stale:               p.state.stale,
+		LastRefreshDuration: p.state.lastRefreshDuration.Seconds(),
+		LastError:           p.state.lastError,
+	}
+	if !p.state.lastRefresh.IsZero() {
+		state.LastRefresh = p.state.lastRefresh.Unix()
+	}
+	if len(p.state.captures) > 0 {
+		state.RawCaptures = make(map[string]RawCapture, len(p.state.captures))
+		for key, capture := range p.state.captures {
+			state.RawCaptures[key] = *capture
+		}
+	}
+	p.stateMutex.RUnlock()
+
+	if failing := p.FailingMetrics(); len(failing) > 0 {
+		state.Failing = failing
+	}
+	if p.queryCache != nil {
+		state.CacheSize = p.queryCache.ItemCount()
+	}
+	if hits, misses := datadogCacheHits.Value(), datadogCacheMisses.Value(); hits+misses > 0 {
+		state.CacheHitRatio = float64(hits) / float64(hits+misses)
+	}
+	switch {
+	case p.breaker == nil:
+		state.CircuitBreaker = circuitDisabled
+	case p.breaker.isOpen():
+		state.CircuitBreaker = circuitOpen
+	default:
+		state.CircuitBreaker = circuitClosed
+	}
+	return state
+}
+
+// recordRefresh records the result of a refresh of the metrics started at start, and reports it as telemetry.
+func (p *Processor) recordRefresh(valid, invalid, stale int, start time.Time) {
+	setMetricsTelemetry(valid-stale, invalid, stale)
+	now := p.now()
+	p.stateMutex.Lock()
+	p.state.valid, p.state.invalid, p.state.stale = valid, invalid, stale
+	p.state.lastRefresh = now
+	p.state.lastRefreshDuration = now.Sub(start)
+	p.stateMutex.Unlock()
+}
+
+// recordError records the last error of the queries to Datadog.
+func (p *Processor) recordError(err error) {
+	p.stateMutex.Lock()
+	p.state.lastError = err.Error()
+	p.stateMutex.Unlock()
+}
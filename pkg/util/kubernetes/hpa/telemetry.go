@@ -0,0 +1,215 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+)
+
+const (
+	telemetryNamespace = "datadog_cluster_agent"
+	telemetrySubsystem = "external_metrics"
+
+	querySuccess = "success"
+	queryError   = "error"
+	queryInvalid = "invalid"
+)
+
+// The metrics are registered in the default registry, served by the custom metrics server.
+var (
+	queriesTelemetry = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "queries_total",
+			Help:      "Number of external metrics queried from Datadog, by result: success, error or invalid (no point returned).",
+		},
+		[]string{"result"},
+	)
+	queryLatencyTelemetry = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "query_duration_seconds",
+			Help:      "Latency of the calls to the Datadog metrics query API.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+		},
+	)
+	metricsTelemetry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "metrics",
+			Help:      "Number of external metrics in the store by state: valid, stale (served past their max age within external_metrics_provider.stale_grace_period) or invalid.",
+		},
+		[]string{"state"},
+	)
+	querySpendTelemetry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "queries_per_minute",
+			Help:      "Number of calls to the Datadog metrics query API over the last minute, counted against external_metrics_provider.max_queries_per_minute.",
+		},
+	)
+	activeClientTelemetry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "active_client",
+			Help:      "Index of the Datadog client queried for the external metrics, 0 for the primary, then the fallbacks in order.",
+		},
+	)
+	tooManySeriesTelemetry = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "too_many_series_total",
+			Help:      "Number of queries of external metrics rejected for matching more series than external_metrics_provider.max_series_per_query, their selector is too broad.",
+		},
+	)
+	recoveredPanicsTelemetry = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "recovered_panics_total",
+			Help:      "Number of panics recovered while querying the external metrics or processing their series, the metrics queried are invalid.",
+		},
+	)
+	canaryHealthyTelemetry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "canary_healthy",
+			Help:      "Whether the last check of the canary of external_metrics_provider.canary_query succeeded with a value in its expected range: 1 if it did, 0 if it failed or drifted.",
+		},
+	)
+	canaryValueTelemetry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "canary_value",
+			Help:      "Last value of the canary of external_metrics_provider.canary_query returned by Datadog.",
+		},
+	)
+	invalidatedByAgeTelemetry = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "invalidated_by_age_total",
+			Help:      "Number of valid external metrics older than the max age that could not be refreshed.",
+		},
+	)
+	lastRefreshAgeTelemetry = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "last_refresh_age_seconds",
+			Help:      "Seconds since the end of the last refresh of the external metrics, 0 before the first refresh of the leader.",
+		},
+		lastRefreshAge,
+	)
+	stalenessTelemetry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: telemetryNamespace,
+			Subsystem: telemetrySubsystem,
+			Name:      "staleness_seconds",
+			Help:      "Age in seconds of the Datadog point of the value served for each external metric, by HPA and metric, updated at the end of each refresh.",
+		},
+		[]string{"namespace", "hpa", "metric"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queriesTelemetry, queryLatencyTelemetry, metricsTelemetry, querySpendTelemetry, activeClientTelemetry, tooManySeriesTelemetry, recoveredPanicsTelemetry, canaryHealthyTelemetry, canaryValueTelemetry, invalidatedByAgeTelemetry, lastRefreshAgeTelemetry, stalenessTelemetry)
+}
+
+// setMetricsTelemetry reports the number of valid, stale and invalid external metrics.
+func setMetricsTelemetry(valid, invalid, stale int) {
+	metricsTelemetry.WithLabelValues("valid").Set(float64(valid))
+	metricsTelemetry.WithLabelValues("stale").Set(float64(stale))
+	metricsTelemetry.WithLabelValues("invalid").Set(float64(invalid))
+}
+
+// lastRefreshAge returns the seconds since the end of the last refresh of the published Processor.
+func lastRefreshAge() float64 {
+	publishedMutex.RLock()
+	p := published
+	publishedMutex.RUnlock()
+	if p == nil {
+		return 0
+	}
+	p.stateMutex.RLock()
+	lastRefresh := p.state.lastRefresh
+	p.stateMutex.RUnlock()
+	if lastRefresh.IsZero() {
+		return 0
+	}
+	return p.now().Sub(lastRefresh).Seconds()
+}
+
+// stalenessLabels are the labels of the staleness of a metric.
+type stalenessLabels struct {
+	namespace, hpa, metric string
+}
+
+// recordStaleness reports the age of the Datadog point of the metrics at the end of a refresh of emList.
+func (p *Processor) recordStaleness(emList, updated []custommetrics.ExternalMetricValue) {
+	now := p.now().Unix() - int64(p.settings().queryOffset.Seconds())
+	refreshed := make(map[string]custommetrics.ExternalMetricValue, len(updated))
+	for _, em := range updated {
+		refreshed[refreshKey(em)] = em
+	}
+	staleness := make(map[stalenessLabels]float64)
+	for _, em := range emList {
+		if current, ok := refreshed[refreshKey(em)]; ok {
+			em = current
+		}
+		timestamp := em.Timestamp
+		if timestamp == 0 {
+			continue
+		}
+		age := float64(now - timestamp)
+		if age < 0 {
+			age = 0
+		}
+		labels := stalenessLabels{namespace: em.HPA.Namespace, hpa: em.HPA.Name, metric: em.MetricName}
+		if previous, ok := staleness[labels]; !ok || age > previous {
+			staleness[labels] = age
+		}
+	}
+
+	p.stateMutex.Lock()
+	previous := p.state.staleness
+	p.state.staleness = make(map[stalenessLabels]bool, len(staleness))
+	for labels := range staleness {
+		p.state.staleness[labels] = true
+	}
+	p.stateMutex.Unlock()
+	for labels := range previous {
+		if _, ok := staleness[labels]; !ok {
+			stalenessTelemetry.DeleteLabelValues(labels.namespace, labels.hpa, labels.metric)
+		}
+	}
+	for labels, age := range staleness {
+		stalenessTelemetry.WithLabelValues(labels.namespace, labels.hpa, labels.metric).Set(age)
+	}
+}
+
+// resetStaleness stops reporting the staleness of the metrics, e.g. once they are no longer refreshed.
+func (p *Processor) resetStaleness() {
+	p.stateMutex.Lock()
+	previous := p.state.staleness
+	p.state.staleness = nil
+	p.stateMutex.Unlock()
+	for labels := range previous {
+		stalenessTelemetry.DeleteLabelValues(labels.namespace, labels.hpa, labels.metric)
+	}
+}
@@ -0,0 +1,51 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"errors"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// queryTemplateAnnotation is the annotation of the HPAs querying their metrics with a query of their own.
+const (
+	queryTemplateAnnotation = "external-metrics.datadoghq.com/query"
+
+	metricPlaceholder = "{metric}"
+	scopePlaceholder  = "{scope}"
+)
+
+// errEmptyQueryTemplate is the error of the query templates rendering an empty query.
+var errEmptyQueryTemplate = errors.New("the query template renders an empty query")
+
+// parseQueryTemplate returns the query template set by the annotation of an HPA, empty if it is absent.
+func parseQueryTemplate(hpa metav1.ObjectMeta) string {
+	template, ok := hpa.Annotations[queryTemplateAnnotation]
+	if !ok {
+		return ""
+	}
+	if _, err := renderQueryTemplate(template, "metric", "*"); err != nil {
+		log.Warnf("Invalid %s annotation %q on the HPA %s/%s, its metrics are queried without it: %v", queryTemplateAnnotation, template, hpa.Namespace, hpa.Name, err)
+		return ""
+	}
+	return template
+}
+
+// renderQueryTemplate returns the query of a template for a metric and the scope of its query.
+func renderQueryTemplate(template, metricName, scope string) (string, error) {
+	query := strings.Replace(template, metricPlaceholder, metricName, -1)
+	query = strings.TrimSpace(strings.Replace(query, scopePlaceholder, scope, -1))
+	if query == "" {
+		return "", errEmptyQueryTemplate
+	}
+	return query, nil
+}
@@ -0,0 +1,49 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// Warmup queries the metrics of the store regardless of their age, bounded by the warmup timeout.
+func (p *Processor) Warmup(ctx context.Context, emList []custommetrics.ExternalMetricValue) ([]custommetrics.ExternalMetricValue, error) {
+	if len(emList) == 0 {
+		return nil, nil
+	}
+	if p.warmupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.warmupTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	externalMetrics := make([]custommetrics.ExternalMetricValue, len(emList))
+	copy(externalMetrics, emList)
+	externalMetrics, err := p.ValidateExternalMetrics(ctx, externalMetrics)
+	if err == nil {
+		log.Infof("Warmed up the external metrics: metrics=%d duration=%s", len(externalMetrics), time.Since(start))
+		return externalMetrics, nil
+	}
+
+	// The metrics that were not queried are invalid, their stored values are kept until they are refreshed.
+	warmed := externalMetrics[:0]
+	for _, em := range externalMetrics {
+		if em.Valid {
+			warmed = append(warmed, em)
+		}
+	}
+	log.Warnf("Partial warmup of the external metrics: metrics=%d warmed=%d error=%q", len(emList), len(warmed), err)
+	return warmed, errors.Wrap(err, "could not warm up all the external metrics")
+}
@@ -0,0 +1,105 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package hpa
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	autoscalingv2 "k8s.io/api/autoscaling/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// wpaMetricSpec is a metric of the spec of a WatermarkPodAutoscaler, its External source has the name and the
+// selector of the ones of the HPAs.
+type wpaMetricSpec struct {
+	Type     autoscalingv2.MetricSourceType      `json:"type"`
+	External *autoscalingv2.ExternalMetricSource `json:"external"`
+}
+
+// WPAObjectMeta returns the metadata of a WatermarkPodAutoscaler listed as an unstructured object.
+func WPAObjectMeta(wpa *unstructured.Unstructured) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:        wpa.GetName(),
+		Namespace:   wpa.GetNamespace(),
+		UID:         wpa.GetUID(),
+		Annotations: wpa.GetAnnotations(),
+	}
+}
+
+// ProcessWPAs processes a WatermarkPodAutoscaler into a list of ExternalMetricValues, referencing it as their HPA.
+func (p *Processor) ProcessWPAs(wpa *unstructured.Unstructured) []custommetrics.ExternalMetricValue {
+	externalMetrics, _ := p.ProcessWPAsWithContext(p.getContext(), wpa)
+	return externalMetrics
+}
+
+// ProcessWPAsWithContext is ProcessWPAs, interruptible by the given context.
+func (p *Processor) ProcessWPAsWithContext(ctx context.Context, wpa *unstructured.Unstructured) ([]custommetrics.ExternalMetricValue, error) {
+	externalMetrics := ExtractWPAExternalMetrics(wpa)
+	if len(externalMetrics) == 0 {
+		return nil, nil
+	}
+	externalMetrics, err := p.ValidateExternalMetrics(ctx, externalMetrics)
+	if err != nil {
+		return externalMetrics, errors.Wrapf(err, "could not validate the external metrics of the WPA %s/%s", wpa.GetNamespace(), wpa.GetName())
+	}
+	return externalMetrics, nil
+}
+
+// ExtractWPAExternalMetrics returns the ExternalMetricValues of the External metrics of a WatermarkPodAutoscaler,
+// without querying them.
+func ExtractWPAExternalMetrics(wpa *unstructured.Unstructured) []custommetrics.ExternalMetricValue {
+	meta := WPAObjectMeta(wpa)
+	metrics, err := wpaMetricSpecs(wpa)
+	if err != nil {
+		log.Errorf("Error processing the external metrics of the WPA %s/%s: %v", meta.Namespace, meta.Name, err)
+		return nil
+	}
+	if len(metrics) == 0 {
+		log.Errorf("Error processing the external metrics of the WPA %s/%s, empty list", meta.Namespace, meta.Name)
+		return nil
+	}
+
+	var externalMetrics []custommetrics.ExternalMetricValue
+	for _, metricSpec := range metrics {
+		if metricSpec.Type != autoscalingv2.ExternalMetricSourceType {
+			log.Debugf("Unsupported metric type %s of the WPA %s/%s", metricSpec.Type, meta.Namespace, meta.Name)
+			continue
+		}
+		if metricSpec.External == nil {
+			log.Warnf("The external metric of the WPA %s/%s has no source specified, it is skipped", meta.Namespace, meta.Name)
+			continue
+		}
+		externalMetrics = append(externalMetrics, newExternalMetricValue(meta, metricSpec.External.MetricName, metricSpec.External.MetricSelector))
+	}
+	setAnnotations(meta, externalMetrics)
+	return externalMetrics
+}
+
+// wpaMetricSpecs returns the metrics of the spec of a WatermarkPodAutoscaler.
+func wpaMetricSpecs(wpa *unstructured.Unstructured) ([]wpaMetricSpec, error) {
+	raw, found, err := unstructured.NestedSlice(wpa.Object, "spec", "metrics")
+	if err != nil || !found {
+		return nil, err
+	}
+	// The metrics are decoded as the JSON of the custom resource.
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var metrics []wpaMetricSpec
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}